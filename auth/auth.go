@@ -0,0 +1,67 @@
+// Package auth checks the credentials of requests and carries the principal
+// they identify in the request context.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+)
+
+var (
+	// ErrInvalidCredentials is returned for an unknown user name or a wrong
+	// password, without telling which.
+	ErrInvalidCredentials = errors.New("auth: invalid credentials")
+	// ErrLockedOut is returned by Lockout for a user name that failed too
+	// often, whatever the password.
+	ErrLockedOut = errors.New("auth: locked out")
+)
+
+// Principal is the identity that a request authenticated as.
+type Principal struct {
+	// Name is the user name the request authenticated with.
+	Name string
+}
+
+// Authenticator checks a user name and password, such as those of HTTP
+// basic auth.
+type Authenticator interface {
+	// Authenticate returns the principal that user and password identify,
+	// or ErrInvalidCredentials if they do not.
+	Authenticate(ctx context.Context, user, password string) (Principal, error)
+}
+
+type principalKey struct{}
+
+// NewContext returns a context for the requests of principal p.
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal of the request with context ctx, and
+// whether it has one.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Static authenticates a single user with a password given in plain text.
+type Static struct {
+	User     string
+	Password string
+}
+
+// Authenticate compares digests of the credentials, so that neither the
+// time taken nor an early mismatch of the user name reveals how much of
+// them is right.
+func (s Static) Authenticate(ctx context.Context, user, password string) (Principal, error) {
+	userSum, wantUserSum := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(s.User))
+	passSum, wantPassSum := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(s.Password))
+	ok := subtle.ConstantTimeCompare(userSum[:], wantUserSum[:]) &
+		subtle.ConstantTimeCompare(passSum[:], wantPassSum[:])
+	if ok != 1 {
+		return Principal{}, ErrInvalidCredentials
+	}
+	return Principal{Name: user}, nil
+}
@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestStatic(t *testing.T) {
+	ctx := context.Background()
+	s := Static{User: "alice", Password: "secret"}
+	if p, err := s.Authenticate(ctx, "alice", "secret"); err != nil || p.Name != "alice" {
+		t.Fatalf("Authenticate: got %+v, %v", p, err)
+	}
+	for _, c := range [][2]string{{"alice", "secre"}, {"alic", "secret"}, {"bob", "secret"}, {"", ""}} {
+		if _, err := s.Authenticate(ctx, c[0], c[1]); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("Authenticate(%q, %q): got %v, want %v", c[0], c[1], err, ErrInvalidCredentials)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	if _, ok := FromContext(ctx); ok {
+		t.Fatalf("FromContext of an empty context: got a principal")
+	}
+	if p, ok := FromContext(NewContext(ctx, Principal{Name: "alice"})); !ok || p.Name != "alice" {
+		t.Fatalf("FromContext: got %+v, %v", p, ok)
+	}
+}
+
+func bcryptLine(t *testing.T, user, password string) string {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+	// htpasswd -B writes $2y$, which is the same as $2a$.
+	return user + ":$2y$" + strings.TrimPrefix(string(h), "$2a$")
+}
+
+func argon2Line(user, password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+	return fmt.Sprintf("%s:$argon2id$v=%d$m=64,t=1,p=1$%s$%s", user, argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestHtpasswdFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	write := func(lines ...string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	check := func(f *HtpasswdFile, user, password string, want error) {
+		t.Helper()
+		p, err := f.Authenticate(ctx, user, password)
+		if !errors.Is(err, want) || err == nil && p.Name != user {
+			t.Fatalf("Authenticate(%q, %q): got %+v, %v, want %v", user, password, p, err, want)
+		}
+	}
+
+	write("# users", "", bcryptLine(t, "alice", "wonderland"), argon2Line("bob", "builder"))
+	f, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatalf("LoadHtpasswd: %v", err)
+	}
+	check(f, "alice", "wonderland", nil)
+	check(f, "alice", "builder", ErrInvalidCredentials)
+	check(f, "bob", "builder", nil)
+	check(f, "bob", "wonderland", ErrInvalidCredentials)
+	check(f, "carol", "", ErrInvalidCredentials)
+
+	// A change to the file takes effect without a restart.
+	write(bcryptLine(t, "alice", "looking-glass"), argon2Line("carol", "singer"))
+	modTime := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	check(f, "alice", "wonderland", ErrInvalidCredentials)
+	check(f, "alice", "looking-glass", nil)
+	check(f, "bob", "builder", ErrInvalidCredentials)
+	check(f, "carol", "singer", nil)
+
+	// A broken file leaves the users read before in effect.
+	write("carol:{SHA}plain")
+	check(f, "carol", "singer", nil)
+	if _, err := LoadHtpasswd(path); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("LoadHtpasswd of a broken file: got %v", err)
+	}
+}
+
+// rejectingHash matches no password.
+type rejectingHash struct{}
+
+func (rejectingHash) verify(password string) bool  { return false }
+func (rejectingHash) params() string               { return "reject" }
+func (rejectingHash) dummy() (passwordHash, error) { return rejectingHash{}, nil }
+
+func TestHtpasswdFileCache(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := bcryptLine(t, "alice", "wonderland") + "\n" + argon2Line("bob", "builder") + "\n" + argon2Line("carol", "singer") + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	f, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatalf("LoadHtpasswd: %v", err)
+	}
+
+	// Unknown users are checked against a hash like those of most users.
+	if got, want := f.dummy.params(), f.users["bob"].params(); got != want {
+		t.Fatalf("dummy hash: got %s, want %s", got, want)
+	}
+
+	// A successful check is remembered for the same password only.
+	if _, err := f.Authenticate(ctx, "bob", "builder"); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	f.users["bob"] = rejectingHash{}
+	if _, err := f.Authenticate(ctx, "bob", "builder"); err != nil {
+		t.Fatalf("Authenticate again: got %v, want the remembered check", err)
+	}
+	if _, err := f.Authenticate(ctx, "bob", "builde"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Authenticate with another password: got %v, want %v", err, ErrInvalidCredentials)
+	}
+	f.verified["bob"] = verifiedPassword{sum: f.verified["bob"].sum, expires: time.Now()}
+	if _, err := f.Authenticate(ctx, "bob", "builder"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Authenticate after the check expired: got %v, want %v", err, ErrInvalidCredentials)
+	}
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	for _, content := range []string{
+		"alice",
+		":$2y$10$abc",
+		"alice:plain",
+		"alice:$2y$10$short",
+		"alice:$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5",
+		"alice:$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5",
+		"alice:$argon2id$v=19$m=64,t=1,p=1$c2FsdA$",
+		argon2Line("alice", "a") + "\n" + argon2Line("alice", "b"),
+	} {
+		if _, err := parseHtpasswd(strings.NewReader(content)); err == nil {
+			t.Errorf("parseHtpasswd(%q): got no error", content)
+		}
+	}
+}
+
+// countingAuthenticator accepts the password "right" and counts the
+// attempts it checks.
+type countingAuthenticator struct{ checked int }
+
+func (a *countingAuthenticator) Authenticate(ctx context.Context, user, password string) (Principal, error) {
+	a.checked++
+	if password != "right" {
+		return Principal{}, ErrInvalidCredentials
+	}
+	return Principal{Name: user}, nil
+}
+
+func TestLockout(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingAuthenticator{}
+	l := &Lockout{Authenticator: inner, MaxFailures: 3, Duration: 50 * time.Millisecond}
+	try := func(user, password string, want error) {
+		t.Helper()
+		if _, err := l.Authenticate(ctx, user, password); !errors.Is(err, want) {
+			t.Fatalf("Authenticate(%q, %q): got %v, want %v", user, password, err, want)
+		}
+	}
+
+	// A success clears the failures.
+	try("alice", "wrong", ErrInvalidCredentials)
+	try("alice", "wrong", ErrInvalidCredentials)
+	try("alice", "right", nil)
+	try("alice", "wrong", ErrInvalidCredentials)
+	try("alice", "wrong", ErrInvalidCredentials)
+	try("alice", "wrong", ErrInvalidCredentials)
+
+	// Locked out, even with the right password, which is not checked.
+	checked := inner.checked
+	try("alice", "right", ErrLockedOut)
+	if inner.checked != checked {
+		t.Fatalf("the password of a locked out user was checked")
+	}
+	try("bob", "right", nil)
+
+	time.Sleep(60 * time.Millisecond)
+	try("alice", "right", nil)
+}
+
+// blockingAuthenticator rejects every attempt once release is closed, and
+// reports each attempt it starts to check on started.
+type blockingAuthenticator struct {
+	started chan struct{}
+	release chan struct{}
+	checked atomic.Int32
+}
+
+func (a *blockingAuthenticator) Authenticate(ctx context.Context, user, password string) (Principal, error) {
+	a.checked.Add(1)
+	a.started <- struct{}{}
+	<-a.release
+	return Principal{}, ErrInvalidCredentials
+}
+
+func TestLockoutConcurrent(t *testing.T) {
+	ctx := context.Background()
+	inner := &blockingAuthenticator{started: make(chan struct{}, 10), release: make(chan struct{})}
+	l := &Lockout{Authenticator: inner, MaxFailures: 3, Duration: time.Minute}
+
+	// Concurrent guesses get no more checks than MaxFailures between them.
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := l.Authenticate(ctx, "alice", "wrong")
+			errs <- err
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		<-inner.started
+	}
+	close(inner.release)
+	var invalid, locked int
+	for i := 0; i < 10; i++ {
+		switch err := <-errs; {
+		case errors.Is(err, ErrInvalidCredentials):
+			invalid++
+		case errors.Is(err, ErrLockedOut):
+			locked++
+		default:
+			t.Fatalf("Authenticate: got %v", err)
+		}
+	}
+	if checked := inner.checked.Load(); checked != 3 || invalid != 3 || locked != 7 {
+		t.Fatalf("got %d checked, %d invalid and %d locked out, want 3, 3 and 7", checked, invalid, locked)
+	}
+}
@@ -0,0 +1,338 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdFile authenticates the users listed in a file in the format of
+// Apache's htpasswd: one "user:hash" line per user, where the hash is a
+// bcrypt hash ($2a$, $2b$ or $2y$, as written by htpasswd -B) or an Argon2
+// hash in the PHC string format ($argon2id$ or $argon2i$). Blank lines and
+// lines starting with # are ignored.
+//
+// The file is read again when its modification time or size changes, so
+// that users can be added, removed or given new passwords without a
+// restart. If it cannot be read or parsed then, the users read before stay
+// in effect.
+//
+// Since every request carries the password, a successful check is
+// remembered for cacheTTL as a SHA-256 digest of the password, so that a
+// busy client does not cost a full bcrypt or Argon2 check per request.
+// Reading the file again forgets it. Unknown users are checked against a
+// hash with the parameters that most users' hashes have, so that they take
+// as long as known ones.
+type HtpasswdFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	users   map[string]passwordHash
+	// generation counts the times the users were read.
+	generation int
+	// dummy is the hash that the passwords of unknown users are checked
+	// against.
+	dummy passwordHash
+	// verified holds the last successful check of each user.
+	verified map[string]verifiedPassword
+}
+
+// cacheTTL is how long HtpasswdFile remembers a successful check.
+const cacheTTL = time.Minute
+
+// verifiedPassword is a password that was checked successfully.
+type verifiedPassword struct {
+	sum     [sha256.Size]byte
+	expires time.Time
+}
+
+// LoadHtpasswd reads the user file at path.
+func LoadHtpasswd(path string) (*HtpasswdFile, error) {
+	f := &HtpasswdFile{path: path}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *HtpasswdFile) Authenticate(ctx context.Context, user, password string) (Principal, error) {
+	f.reload()
+	sum := sha256.Sum256([]byte(password))
+	now := time.Now()
+	f.mu.Lock()
+	hash, ok := f.users[user]
+	generation, dummy := f.generation, f.dummy
+	v, cached := f.verified[user]
+	f.mu.Unlock()
+	if !ok {
+		// Take as long as for a known user, so that the time taken does not
+		// tell which users exist.
+		dummy.verify(password)
+		return Principal{}, ErrInvalidCredentials
+	}
+	if cached && now.Before(v.expires) && subtle.ConstantTimeCompare(sum[:], v.sum[:]) == 1 {
+		return Principal{Name: user}, nil
+	}
+	if !hash.verify(password) {
+		return Principal{}, ErrInvalidCredentials
+	}
+	f.mu.Lock()
+	// The file may have been read again meanwhile.
+	if f.generation == generation {
+		if f.verified == nil {
+			f.verified = make(map[string]verifiedPassword)
+		}
+		f.verified[user] = verifiedPassword{sum: sum, expires: now.Add(cacheTTL)}
+	}
+	f.mu.Unlock()
+	return Principal{Name: user}, nil
+}
+
+// reload reads the file again if it changed since it was last read.
+func (f *HtpasswdFile) reload() {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		log.Printf("Couldn't check user file %v. Here's why: %v\n", f.path, err)
+		return
+	}
+	f.mu.Lock()
+	changed := !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size
+	f.mu.Unlock()
+	if !changed {
+		return
+	}
+	if err := f.load(); err != nil {
+		log.Printf("Couldn't reload user file %v. Here's why: %v\n", f.path, err)
+	}
+}
+
+// load reads the file. The modification time and size are recorded even if
+// the file does not parse, so that a broken file is reported once.
+func (f *HtpasswdFile) load() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to open user file: %w", err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat user file: %w", err)
+	}
+	users, err := parseHtpasswd(file)
+	var dummy passwordHash
+	if err == nil {
+		f.mu.Lock()
+		dummy = f.dummy
+		f.mu.Unlock()
+		dummy, err = dummyFor(users, dummy)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	if err != nil {
+		return fmt.Errorf("failed to parse user file: %w", err)
+	}
+	f.users = users
+	f.generation++
+	f.dummy = dummy
+	f.verified = nil
+	return nil
+}
+
+// dummyFor returns a hash of an unknown password with the parameters that
+// most of the hashes of users have, reusing last if it has them already.
+func dummyFor(users map[string]passwordHash, last passwordHash) (passwordHash, error) {
+	counts := make(map[string]int)
+	var common passwordHash
+	for _, h := range users {
+		p := h.params()
+		counts[p]++
+		if common == nil || counts[p] > counts[common.params()] ||
+			counts[p] == counts[common.params()] && p < common.params() {
+			common = h
+		}
+	}
+	switch {
+	case common == nil:
+		return dummyHash(), nil
+	case last != nil && last.params() == common.params():
+		return last, nil
+	}
+	return common.dummy()
+}
+
+// parseHtpasswd reads the users and their password hashes from r.
+func parseHtpasswd(r io.Reader) (map[string]passwordHash, error) {
+	users := make(map[string]passwordHash)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: want user:hash", n)
+		}
+		if _, ok := users[user]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %q", n, user)
+		}
+		h, err := parsePasswordHash(hash)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		users[user] = h
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// passwordHash is the hash of a password, which verify checks a password
+// against.
+type passwordHash interface {
+	verify(password string) bool
+	// params describes the scheme and the parameters of the hash, which
+	// determine how long verify takes.
+	params() string
+	// dummy returns a hash of a random password with the same parameters.
+	dummy() (passwordHash, error)
+}
+
+var errUnsupportedHash = errors.New("unsupported password hash")
+
+// parsePasswordHash parses a bcrypt hash or an Argon2 hash in the PHC string
+// format.
+func parsePasswordHash(s string) (passwordHash, error) {
+	switch {
+	case strings.HasPrefix(s, "$2a$"), strings.HasPrefix(s, "$2b$"), strings.HasPrefix(s, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(s)); err != nil {
+			return nil, err
+		}
+		return bcryptHash(s), nil
+	case strings.HasPrefix(s, "$argon2id$"), strings.HasPrefix(s, "$argon2i$"):
+		return parseArgon2Hash(s)
+	}
+	return nil, errUnsupportedHash
+}
+
+type bcryptHash []byte
+
+func (h bcryptHash) verify(password string) bool {
+	return bcrypt.CompareHashAndPassword(h, []byte(password)) == nil
+}
+
+func (h bcryptHash) params() string {
+	cost, _ := bcrypt.Cost(h)
+	return fmt.Sprintf("bcrypt cost=%d", cost)
+}
+
+func (h bcryptHash) dummy() (passwordHash, error) {
+	cost, err := bcrypt.Cost(h)
+	if err != nil {
+		return nil, err
+	}
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return nil, err
+	}
+	b, err := bcrypt.GenerateFromPassword(password, cost)
+	if err != nil {
+		return nil, err
+	}
+	return bcryptHash(b), nil
+}
+
+// argon2Hash is an Argon2 hash, as encoded in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>, with the salt and the key in
+// unpadded base64.
+type argon2Hash struct {
+	id      bool
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(s string) (argon2Hash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 {
+		return argon2Hash{}, errUnsupportedHash
+	}
+	h := argon2Hash{id: parts[1] == "argon2id"}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return argon2Hash{}, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads)
+	if err != nil || h.time == 0 || h.threads == 0 {
+		return argon2Hash{}, fmt.Errorf("invalid argon2 parameters %q", parts[3])
+	}
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return argon2Hash{}, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return argon2Hash{}, fmt.Errorf("invalid argon2 key: %w", err)
+	}
+	if len(h.key) == 0 {
+		return argon2Hash{}, errors.New("empty argon2 key")
+	}
+	return h, nil
+}
+
+func (h argon2Hash) params() string {
+	return fmt.Sprintf("argon2 id=%t m=%d t=%d p=%d salt=%d key=%d", h.id, h.memory, h.time, h.threads, len(h.salt), len(h.key))
+}
+
+// dummy returns a hash with a random key, which takes as long to check as
+// the key of a random password.
+func (h argon2Hash) dummy() (passwordHash, error) {
+	d := h
+	d.salt, d.key = make([]byte, len(h.salt)), make([]byte, len(h.key))
+	if _, err := rand.Read(d.salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(d.key); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (h argon2Hash) verify(password string) bool {
+	derive := argon2.Key
+	if h.id {
+		derive = argon2.IDKey
+	}
+	key := derive([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// dummyHash returns the hash that the passwords of unknown users are checked
+// against when there are no users.
+var dummyHash = sync.OnceValue(func() passwordHash {
+	h, err := bcrypt.GenerateFromPassword(bytes.Repeat([]byte{0}, 16), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return bcryptHash(h)
+})
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// pruneThreshold is the number of tracked user names above which Lockout
+// forgets those whose failures have expired.
+const pruneThreshold = 1024
+
+// Lockout is an Authenticator that refuses a user name for Duration once
+// MaxFailures attempts for it have failed within Duration of each other,
+// which slows down the guessing of passwords. A successful attempt clears
+// the failures. Attempts while a user name is locked out fail with
+// ErrLockedOut without checking the password.
+//
+// Attempts that are being checked count against MaxFailures as if they had
+// failed, so that concurrent requests cannot guess more passwords than that.
+// An attempt beyond them waits until one of them is decided.
+//
+// The failures are counted per user name and in memory, so each instance
+// of the server counts its own.
+type Lockout struct {
+	Authenticator Authenticator
+	MaxFailures   int
+	Duration      time.Duration
+
+	mu sync.Mutex
+	// decided is signalled when an attempt is decided.
+	decided  *sync.Cond
+	failures map[string]*failures
+}
+
+// failures tracks the attempts for a user name.
+type failures struct {
+	count int
+	// pending is the number of attempts being checked.
+	pending int
+	last    time.Time
+	until   time.Time
+}
+
+func (l *Lockout) Authenticate(ctx context.Context, user, password string) (Principal, error) {
+	f, err := l.reserve(user)
+	if err != nil {
+		return Principal{}, err
+	}
+	p, err := l.Authenticator.Authenticate(ctx, user, password)
+	l.decide(user, f, err)
+	return p, err
+}
+
+// reserve counts an attempt for user as pending, once the failures and the
+// attempts pending already leave room for it to fail.
+func (l *Lockout) reserve(user string) (*failures, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failures == nil {
+		l.failures = make(map[string]*failures)
+		l.decided = sync.NewCond(&l.mu)
+	}
+	now := time.Now()
+	if len(l.failures) >= pruneThreshold {
+		for name, f := range l.failures {
+			if f.pending == 0 && l.expired(f, now) {
+				delete(l.failures, name)
+			}
+		}
+	}
+	for {
+		// A success may have dropped the failures while waiting.
+		f := l.failures[user]
+		if f == nil {
+			f = &failures{}
+			l.failures[user] = f
+		}
+		now = time.Now()
+		if now.Before(f.until) {
+			return nil, ErrLockedOut
+		}
+		if l.expired(f, now) {
+			f.count = 0
+		}
+		if f.count+f.pending < max(l.MaxFailures, 1) {
+			f.pending++
+			return f, nil
+		}
+		l.decided.Wait()
+	}
+}
+
+// decide records the outcome err of an attempt for user that reserve counted
+// in f.
+func (l *Lockout) decide(user string, f *failures, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.decided.Broadcast()
+	f.pending--
+	switch {
+	case err == nil:
+		f.count = 0
+		if f.pending == 0 && l.failures[user] == f {
+			delete(l.failures, user)
+		}
+	case errors.Is(err, ErrInvalidCredentials):
+		now := time.Now()
+		f.count++
+		f.last = now
+		if f.count >= l.MaxFailures {
+			f.count = 0
+			f.until = now.Add(l.Duration)
+		}
+	}
+}
+
+// expired reports whether f no longer counts at now.
+func (l *Lockout) expired(f *failures, now time.Time) bool {
+	return now.Sub(f.last) > l.Duration && !now.Before(f.until)
+}
@@ -0,0 +1,137 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrNoSuchBlob = errors.New("no such blob")
+
+// Blob is content shared by the files whose content has the same SHA-256
+// hash, when the Server deduplicates content. The Blob lives as long as any
+// entry refers to it.
+//
+// The stores record each reference on its own, rather than only counting
+// them, so that adding or removing a reference is idempotent, and a reap
+// that is interrupted and repeated does not release a reference twice.
+type Blob struct {
+	// Hash is the hex encoded SHA-256 hash of the content.
+	Hash string `dynamodbav:"id"`
+	// Object is the key of the content in the PhysicalStore.
+	Object string `dynamodbav:"object"`
+	// Refs is the number of entries that refer to the Blob.
+	Refs int64 `dynamodbav:"refcount"`
+}
+
+// blobKeyPrefix starts the object keys of Blobs, which are
+// blobKeyPrefix + hash + "/" + UUID. A Blob that is freed and then stored
+// again gets a new key, so deleting the object of the freed Blob never
+// removes the content of the new one.
+const blobKeyPrefix = "sha256/"
+
+func newBlobKey(hash string) string {
+	return blobKeyPrefix + hash + "/" + uuid.New().String()
+}
+
+// blobHashOf returns the hash of the Blob whose object key is key, or false
+// if key is not the key of a Blob.
+func blobHashOf(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, blobKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	hash, _, _ := strings.Cut(rest, "/")
+	return hash, true
+}
+
+// storeBlob makes entryID refer to the Blob with the given content hash,
+// whose content has been uploaded as uploadKey, and returns the object key of
+// the Blob. The uploaded object is copied to a key of its own only if no
+// entry stores the same content yet. The caller deletes uploadKey.
+func (s *Server) storeBlob(ctx context.Context, entryID, hash, uploadKey string, size int64) (string, error) {
+	key, err := s.MetadataStore.AcquireBlob(ctx, hash, entryID, "")
+	if !errors.Is(err, ErrNoSuchBlob) {
+		return key, err
+	}
+	blobKey := newBlobKey(hash)
+	if err := s.PhysicalStore.CopyObject(ctx, uploadKey, blobKey, size); err != nil {
+		return "", err
+	}
+	key, err = s.MetadataStore.AcquireBlob(ctx, hash, entryID, blobKey)
+	if err != nil || key != blobKey {
+		// Somebody stored the same content in the meantime.
+		s.deleteObject(blobKey)
+	}
+	return key, err
+}
+
+// releaseObjects drops the references of files to their content and the
+// content of their versions, and returns the keys of the objects that nothing
+// refers to anymore. The object of a file is its own unless it is a Blob.
+func (s *Server) releaseObjects(ctx context.Context, files []Entry) ([]string, error) {
+	var keys []string
+	for _, file := range files {
+		for _, key := range file.objectKeys() {
+			hash, ok := blobHashOf(key)
+			if !ok {
+				keys = append(keys, key)
+				continue
+			}
+			freed, err := s.MetadataStore.ReleaseBlob(ctx, hash, file.ID)
+			if err != nil {
+				return nil, err
+			}
+			if freed != "" {
+				keys = append(keys, freed)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// releaseObject is releaseObjects for a single object key of entry id, whose
+// failures are only logged: the object was replaced or never used, and the
+// gc command removes it if it is left behind.
+func (s *Server) releaseObject(id, key string) {
+	keys, err := s.releaseObjects(context.Background(), []Entry{{ID: id, Object: key}})
+	if err != nil {
+		log.Printf("Couldn't release object %v. Here's why: %v\n", key, err)
+		return
+	}
+	for _, key := range keys {
+		s.deleteObject(key)
+	}
+}
+
+// releaseReplacedObject is releaseObject for content that an overwrite
+// replaced. The object is deleted only after DeleteDelay, since GETs that
+// started before the overwrite may still be reading it range by range. The
+// references to it are dropped at once, so that a Blob acquired again in the
+// meantime keeps its reference. With SyncReap the object is deleted at once,
+// as a delayed deletion would not run while the process is frozen.
+func (s *Server) releaseReplacedObject(id, key string) {
+	if s.DeleteDelay <= 0 || s.SyncReap {
+		s.releaseObject(id, key)
+		return
+	}
+	keys, err := s.releaseObjects(context.Background(), []Entry{{ID: id, Object: key}})
+	if err != nil {
+		log.Printf("Couldn't release object %v. Here's why: %v\n", key, err)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	s.reaping.Add(1)
+	time.AfterFunc(s.DeleteDelay, func() {
+		defer s.reaping.Done()
+		for _, key := range keys {
+			s.deleteObject(key)
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package awsfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newDedupServer(t *testing.T) *Server {
+	t.Helper()
+	s := newMemServer(t)
+	s.Deduplicate = true
+	return s
+}
+
+func memCreate(t *testing.T, s *Server, name, data string) {
+	t.Helper()
+	_, err := s.Create(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Create %q: %v", name, err)
+	}
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// blobRefs returns the number of references to the Blob of data, or zero if
+// there is none.
+func blobRefs(t *testing.T, s *Server, data string) int {
+	t.Helper()
+	blob, err := s.MetadataStore.GetBlob(context.Background(), sha256Hex(data))
+	if errors.Is(err, ErrNoSuchBlob) {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("GetBlob: %v", err)
+	}
+	return int(blob.Refs)
+}
+
+func TestDedupCreate(t *testing.T) {
+	ctx := context.Background()
+	s := newDedupServer(t)
+	memCreate(t, s, "/a", "same")
+	memCreate(t, s, "/b", "same")
+	memCreate(t, s, "/c", "other")
+
+	if keys := memObjectKeys(t, s); len(keys) != 2 {
+		t.Fatalf("objects: got %q, want one per distinct content", keys)
+	}
+	for _, k := range memObjectKeys(t, s) {
+		if _, ok := blobHashOf(k); !ok {
+			t.Fatalf("object %q is not a blob", k)
+		}
+	}
+	if got := blobRefs(t, s, "same"); got != 2 {
+		t.Fatalf("references to the shared blob: got %d, want 2", got)
+	}
+
+	// Writing the same content again keeps the reference.
+	memCreate(t, s, "/a", "same")
+	if got := blobRefs(t, s, "same"); got != 2 {
+		t.Fatalf("references after rewriting the same content: got %d, want 2", got)
+	}
+
+	// Overwriting releases the old content.
+	memCreate(t, s, "/a", "other")
+	memCreate(t, s, "/b", "new")
+	if got := blobRefs(t, s, "same"); got != 0 {
+		t.Fatalf("references to overwritten content: got %d, want 0", got)
+	}
+	if keys := memObjectKeys(t, s); len(keys) != 2 {
+		t.Fatalf("objects after overwriting: got %q, want 2", keys)
+	}
+	for name, want := range map[string]string{"/a": "other", "/b": "new", "/c": "other"} {
+		if got := memReadFile(t, s, name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	if err := s.RemoveAll(ctx, "/a"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	s.Wait()
+	if got := memReadFile(t, s, "/c"); got != "other" {
+		t.Fatalf("file sharing the content of a removed one: got %q, want %q", got, "other")
+	}
+	if err := s.RemoveAll(ctx, "/c"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	s.Wait()
+	if got := blobRefs(t, s, "other"); got != 0 {
+		t.Fatalf("references after removing all files: got %d, want 0", got)
+	}
+	if keys := memObjectKeys(t, s); len(keys) != 1 {
+		t.Fatalf("objects after removing: got %q, want only that of /b", keys)
+	}
+}
+
+func TestDedupCopy(t *testing.T) {
+	ctx := context.Background()
+	s := newDedupServer(t)
+	memTree(t, s, "/a/", "/a/f", "/a/g")
+	before := memObjectKeys(t, s)
+
+	if err := s.Copy(ctx, "/a", "/b", true); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if got := memObjectKeys(t, s); fmt.Sprint(got) != fmt.Sprint(before) {
+		t.Fatalf("objects after Copy: got %q, want %q", got, before)
+	}
+	if got := blobRefs(t, s, "/a/f"); got != 2 {
+		t.Fatalf("references after Copy: got %d, want 2", got)
+	}
+
+	if err := s.RemoveAll(ctx, "/a"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	s.Wait()
+	for name, want := range map[string]string{"/b/f": "/a/f", "/b/g": "/a/g"} {
+		if got := memReadFile(t, s, name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDedupCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	s := newDedupServer(t)
+	memCreate(t, s, "/a", "data")
+	memCreate(t, s, "/b", "data")
+	live := memObjectKeys(t, s)
+
+	// Objects of a freed Blob and of a Blob that lost a race.
+	stale := []string{blobKeyPrefix + sha256Hex("gone") + "/1", blobKeyPrefix + sha256Hex("data") + "/2"}
+	for _, key := range stale {
+		if err := s.PhysicalStore.PutObject(ctx, key, strings.NewReader("x")); err != nil {
+			t.Fatalf("PutObject: %v", err)
+		}
+	}
+
+	var reported []string
+	err := s.CollectGarbage(ctx, -time.Hour, false, func(obj Object) {
+		reported = append(reported, obj.Key)
+	})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if len(reported) != len(stale) {
+		t.Fatalf("reported %q, want %q", reported, stale)
+	}
+	if got := memObjectKeys(t, s); fmt.Sprint(got) != fmt.Sprint(live) {
+		t.Fatalf("remaining objects: got %q, want %q", got, live)
+	}
+}
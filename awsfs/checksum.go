@@ -0,0 +1,36 @@
+package awsfs
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+)
+
+// Checksums are the hex encoded hashes of the content of a file. MD5 is kept
+// for clients that only know Content-MD5, as S3 clients do.
+type Checksums struct {
+	SHA256 string `dynamodbav:"sha256,omitempty"`
+	MD5    string `dynamodbav:"md5,omitempty"`
+}
+
+// checksumReader computes the Checksums of what is read through it.
+type checksumReader struct {
+	io.Reader
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	cr := &checksumReader{sha256: sha256.New(), md5: md5.New()}
+	cr.Reader = io.TeeReader(r, io.MultiWriter(cr.sha256, cr.md5))
+	return cr
+}
+
+func (r *checksumReader) Sum() Checksums {
+	return Checksums{
+		SHA256: hex.EncodeToString(r.sha256.Sum(nil)),
+		MD5:    hex.EncodeToString(r.md5.Sum(nil)),
+	}
+}
@@ -0,0 +1,68 @@
+package awsfs
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+	s := newMemServer(t)
+	do := newTestHandler(t, s)
+
+	const data = "hello, world"
+	sha256Sum := sha256.Sum256([]byte(data))
+	md5Sum := md5.Sum([]byte(data))
+	sha256B64 := base64.StdEncoding.EncodeToString(sha256Sum[:])
+	md5B64 := base64.StdEncoding.EncodeToString(md5Sum[:])
+	wrongB64 := base64.StdEncoding.EncodeToString(make([]byte, md5.Size))
+
+	rec := do("PUT", "/f", data, "Content-MD5", md5B64, "Digest", "SHA-256="+sha256B64)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("PUT: got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+	wantETag := `"` + hex.EncodeToString(sha256Sum[:]) + `"`
+	if got := rec.Header().Get("ETag"); got != wantETag {
+		t.Fatalf("PUT: got ETag %s, want %s", got, wantETag)
+	}
+
+	rec = do("GET", "/f", "")
+	if got := rec.Header().Get("ETag"); got != wantETag {
+		t.Errorf("GET: got ETag %s, want %s", got, wantETag)
+	}
+	if got, want := rec.Header().Get("Digest"), "SHA-256="+sha256B64+", MD5="+md5B64; got != want {
+		t.Errorf("GET: got Digest %q, want %q", got, want)
+	}
+	if got := rec.Header().Get("Content-MD5"); got != md5B64 {
+		t.Errorf("GET: got Content-MD5 %q, want %q", got, md5B64)
+	}
+	rec = do("GET", "/f", "", "Range", "bytes=0-4")
+	if got := rec.Header().Get("Content-MD5"); got != "" {
+		t.Errorf("GET of a range: got Content-MD5 %q, want none", got)
+	}
+
+	for _, headers := range [][]string{
+		{"Content-MD5", wrongB64},
+		{"Digest", "md5=" + wrongB64},
+		{"Digest", "SHA-256=" + sha256B64 + ",MD5=" + wrongB64},
+		{"Content-MD5", "not base64"},
+	} {
+		if rec := do("PUT", "/f", "other", headers...); rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT with %q: got status %d, want %d", headers, rec.Code, http.StatusBadRequest)
+		}
+	}
+	// The failed uploads left the file alone.
+	if got := memReadFile(t, s, "/f"); got != data {
+		t.Fatalf("content after failed uploads: got %q, want %q", got, data)
+	}
+	if keys := memObjectKeys(t, s); len(keys) != 1 {
+		t.Fatalf("objects after failed uploads: got %q, want 1", keys)
+	}
+	// Unknown digest algorithms are ignored.
+	if rec := do("PUT", "/g", data, "Digest", "UNIXsum=30637"); rec.Code != http.StatusCreated {
+		t.Fatalf("PUT with an unknown digest: got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+}
@@ -0,0 +1,158 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+var _ webdav.Copier = (*Server)(nil)
+
+// Copy copies src to dst without moving any content through the server: the
+// objects of files are copied within S3 and the entries below src are
+// duplicated with their dead properties. A file whose content is a Blob is
+// copied by adding a reference to the Blob. Copying out of a snapshot copies
+// the frozen entries, whose objects are still there.
+func (s *Server) Copy(ctx context.Context, src, dst string, recursive bool) error {
+	src, dst = slashClean(src), slashClean(dst)
+	if dst == "/" {
+		return os.ErrExist
+	}
+	if recursive && (src == "/" || strings.HasPrefix(dst, src+"/")) {
+		// The copy would contain itself.
+		return os.ErrInvalid
+	}
+	if s.inSnapshots(dst) || s.inSnapshots(src) && src == SnapshotsPath {
+		return os.ErrPermission
+	}
+	if err := checkTrash(ctx, src, false); err != nil {
+		return err
+	}
+	if err := checkTrash(ctx, dst, true); err != nil {
+		return err
+	}
+
+	var entry Entry
+	list := s.MetadataStore.ListEntriesByParentID
+	if s.inSnapshots(src) {
+		var t *snapshotTree
+		var err error
+		if entry, t, err = s.snapshotEntry(ctx, src); err != nil {
+			return err
+		}
+		list = t.list
+	} else {
+		id, err := s.resolve(ctx, src)
+		if err != nil {
+			return err
+		}
+		if entry, err = s.MetadataStore.GetEntry(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	parent, name, err := s.resolveParent(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if _, ok := parent.Entries[name]; ok {
+		return os.ErrExist
+	}
+
+	err = s.copyEntry(ctx, entry, parent.ID, dst, recursive, list)
+	if errors.Is(err, ErrEntryExists) {
+		return os.ErrExist
+	}
+	return err
+}
+
+// copyEntry adds a copy of entry to the directory parentID as the clean path
+// dst and, if recursive is true, copies the children of a directory, which
+// list returns, into the copy. A child that fails to copy does not keep the
+// others from being copied; the failures are returned as
+// webdav.MemberErrors.
+func (s *Server) copyEntry(ctx context.Context, entry Entry, parentID, dst string, recursive bool, list func(id string) EntryIterator) error {
+	newEntry := Entry{
+		ID:        uuid.New().String(),
+		ParentID:  parentID,
+		Name:      path.Base(dst),
+		Type:      entry.Type,
+		Size:      entry.Size,
+		Modify:    time.Now(),
+		Version:   1,
+		DeadProps: maps.Clone(entry.DeadProps),
+		Checksums: entry.Checksums,
+	}
+
+	if !entry.IsDir() {
+		added := Usage{Bytes: entry.Size, Files: 1}
+		if err := s.addUsage(ctx, added); err != nil {
+			return err
+		}
+		key, err := s.copyObject(ctx, entry, newEntry.ID)
+		if err != nil {
+			s.releaseUsage(added)
+			return err
+		}
+		if key != newEntry.ID {
+			newEntry.Object = key
+		}
+		err = s.MetadataStore.AddEntry(ctx, newEntry)
+		if err != nil {
+			// Nothing refers to the new object, so don't leave it behind.
+			s.releaseObject(newEntry.ID, key)
+			s.releaseUsage(added)
+		}
+		return err
+	}
+
+	err := s.MetadataStore.AddEntry(ctx, newEntry)
+	if err != nil || !recursive {
+		return err
+	}
+	var errs webdav.MemberErrors
+	children := list(entry.ID)
+	for children.Next(ctx) {
+		child := children.Entry()
+		childDst := path.Join(dst, child.Name)
+		err := s.copyEntry(ctx, child, newEntry.ID, childDst, recursive, list)
+		var childErrs webdav.MemberErrors
+		switch {
+		case errors.As(err, &childErrs):
+			errs = append(errs, childErrs...)
+		case errors.Is(err, ErrEntryExists):
+			errs = append(errs, webdav.MemberError{Name: childDst, Err: os.ErrExist})
+		case err != nil:
+			errs = append(errs, webdav.MemberError{Name: childDst, Err: err})
+		}
+	}
+	if err := children.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// copyObject makes a copy of the content of the file entry for the entry
+// newID and returns its key. The Blob of entry is shared rather than copied.
+func (s *Server) copyObject(ctx context.Context, entry Entry, newID string) (string, error) {
+	if hash, ok := blobHashOf(entry.ObjectKey()); ok {
+		key, err := s.MetadataStore.AcquireBlob(ctx, hash, newID, "")
+		if !errors.Is(err, ErrNoSuchBlob) {
+			return key, err
+		}
+		// The source was deleted and its Blob freed in the meantime. Its
+		// object may still be there.
+	}
+	err := s.PhysicalStore.CopyObject(ctx, entry.ObjectKey(), newID, entry.Size)
+	return newID, err
+}
@@ -0,0 +1,175 @@
+package awsfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	for _, dir := range []string{"/a", "/a/b"} {
+		if err := s.Mkdir(ctx, dir, 0777); err != nil {
+			t.Fatalf("Mkdir %q: %v", dir, err)
+		}
+	}
+	files := map[string]string{"/a/x": "x", "/a/b/y": "yy"}
+	for name, data := range files {
+		if _, err := s.Create(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader(data)); err != nil {
+			t.Fatalf("Create %q: %v", name, err)
+		}
+	}
+	f, err := s.OpenFile(ctx, "/a/x", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	prop := webdav.Property{XMLName: xml.Name{Space: "x:", Local: "color"}, InnerXML: []byte("blue")}
+	if _, err := f.(webdav.DeadPropsHolder).Patch([]webdav.Proppatch{{Props: []webdav.Property{prop}}}); err != nil {
+		t.Fatalf("Patch: %v", err)
+	}
+	f.Close()
+	s.s3.ranges = nil
+
+	if err := s.Copy(ctx, "/a", "/c", true); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if len(s.s3.ranges) != 0 {
+		t.Fatalf("Copy read objects through the server: %v", s.s3.ranges)
+	}
+	for name, want := range files {
+		name = "/c" + strings.TrimPrefix(name, "/a")
+		f, err := s.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile %q: %v", name, err)
+		}
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("ReadAll %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	f, err = s.OpenFile(ctx, "/c/x", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	props, err := f.(webdav.DeadPropsHolder).DeadProps()
+	f.Close()
+	if err != nil {
+		t.Fatalf("DeadProps: %v", err)
+	}
+	if got := props[prop.XMLName]; string(got.InnerXML) != "blue" {
+		t.Fatalf("dead property of the copy: got %v, want %v", got, prop)
+	}
+
+	// The source is untouched and the copy is independent of it.
+	if err := s.RemoveAll(ctx, "/a"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	s.Wait()
+	if _, err := s.Stat(ctx, "/c/b/y"); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if got := len(s.s3.keys()); got != 2 {
+		t.Fatalf("got %d objects, want 2", got)
+	}
+}
+
+func TestCopyShallow(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	if err := s.Mkdir(ctx, "/a", 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if _, err := s.Create(ctx, "/a/x", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader("x")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.Copy(ctx, "/a", "/b", false); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	fi, err := s.Stat(ctx, "/b")
+	if err != nil || !fi.IsDir() {
+		t.Fatalf("Stat: got %v, %v, want a directory", fi, err)
+	}
+	if _, err := s.Stat(ctx, "/b/x"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Stat /b/x: got %v, want os.ErrNotExist", err)
+	}
+	if err := s.Copy(ctx, "/a", "/a/b", true); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("Copy into itself: got %v, want os.ErrInvalid", err)
+	}
+	if err := s.Copy(ctx, "/a", "/b", true); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Copy onto an existing entry: got %v, want os.ErrExist", err)
+	}
+}
+
+func TestCopyObjectMultipart(t *testing.T) {
+	defer func(limit, size int64) { copyObjectLimit, copyPartSize = limit, size }(copyObjectLimit, copyPartSize)
+	copyObjectLimit, copyPartSize = 10, 4
+
+	ctx := context.Background()
+	s := newTestServer(t)
+	data := []byte("0123456789abcdefghij")
+	if _, err := s.Create(ctx, "/f", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.Copy(ctx, "/f", "/g", false); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	f, err := s.OpenFile(ctx, "/g", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %q, want %q", got, data)
+	}
+}
+
+func TestCopyPartial(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.QuotaFiles = 7
+	if err := s.Mkdir(ctx, "/src", 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := s.Create(ctx, "/src/"+name, 0, 0, strings.NewReader(name)); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	rec := newTestHandler(t, s)("COPY", "/src", "", "Destination", "/dst")
+
+	// The members over the quota fail on their own, and the others are
+	// copied.
+	body := rec.Body.String()
+	if rec.Code != webdav.StatusMulti || strings.Count(body, "507 Insufficient Storage") != 3 {
+		t.Fatalf("COPY over the quota: got %d %s, want 3 failed members", rec.Code, body)
+	}
+	var copied []string
+	err := s.ReadDir(ctx, "/dst", nil, func(fi os.FileInfo) error {
+		copied = append(copied, fi.Name())
+		return nil
+	})
+	if err != nil || len(copied) != 2 {
+		t.Fatalf("ReadDir of the copy: got %q, %v, want 2 members", copied, err)
+	}
+	for _, name := range copied {
+		if strings.Contains(body, "/dst/"+name+"<") {
+			t.Fatalf("COPY: copied member %s reported as failed in %s", name, body)
+		}
+	}
+}
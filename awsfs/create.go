@@ -2,12 +2,14 @@ package awsfs
 
 import (
 	"context"
+	"errors"
 	"io"
+	"log"
 	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/webdav-serverless/webdav-serverless/webdav"
 )
 
 func (s *Server) Create(ctx context.Context, path string, flag int, perm os.FileMode, r io.Reader) (os.FileInfo, error) {
@@ -15,78 +17,156 @@ func (s *Server) Create(ctx context.Context, path string, flag int, perm os.File
 	if path = slashClean(path); path == "" {
 		return nil, os.ErrInvalid
 	}
+	if s.inSnapshots(path) {
+		return nil, os.ErrPermission
+	}
+	if err := checkTrash(ctx, path, true); err != nil {
+		return nil, err
+	}
 
-	ref, err := s.MetadataStore.GetReference(ctx, referenceID)
+	ref, name, err := s.resolveParent(ctx, path)
 	if err != nil {
 		return nil, err
 	}
 
-	entryID, shouldUpdate := ref.Entries[path]
-	if !shouldUpdate {
-		entryID = uuid.New().String()
+	// The content always goes to a fresh object, so an upload that fails
+	// halfway never damages the content of an existing file.
+	entryID, shouldUpdate := ref.Entries[name]
+	objectKey := uuid.New().String()
+	if shouldUpdate {
+		objectKey = newObjectKey(entryID)
+	} else {
+		entryID = objectKey
+	}
+
+	// An overwrite only adds the difference in size to the usage.
+	var replaced Entry
+	if _, ok := s.quota(); ok && shouldUpdate {
+		if replaced, err = s.MetadataStore.GetEntry(ctx, entryID); err != nil {
+			return nil, err
+		}
 	}
 
-	sr := &sizingReader{Reader: r}
+	// The upload stops as soon as it goes over the byte quota, rather than
+	// at its end.
+	sr := &sizingReader{Reader: r, limit: -1}
+	if limit, ok := s.quota(); ok && limit.Bytes > 0 {
+		usage, err := s.MetadataStore.GetUsage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sr.limit = max(limit.Bytes-usage.Bytes+replaced.Size, 0)
+	}
+	cr := newChecksumReader(sr)
 
-	err = s.PhysicalStore.PutObjectLarge(ctx, entryID, sr)
+	err = s.PhysicalStore.PutObject(ctx, objectKey, cr)
+	if sr.exceeded {
+		return nil, webdav.ErrQuotaExceeded
+	}
 	if err != nil {
 		return nil, err
 	}
+	sum := cr.Sum()
 
-	if shouldUpdate {
-		entry, err := s.MetadataStore.GetEntry(ctx, entryID)
+	if s.Deduplicate {
+		uploadKey := objectKey
+		objectKey, err = s.storeBlob(ctx, entryID, sum.SHA256, uploadKey, sr.size)
+		s.deleteObject(uploadKey)
 		if err != nil {
 			return nil, err
 		}
-		entry.Size = sr.size
-		entry.Modify = time.Now()
-		err = s.MetadataStore.UpdateEntry(ctx, entry)
+	}
+
+	added := Usage{Bytes: sr.size, Files: 1}
+	if shouldUpdate {
+		added = Usage{Bytes: sr.size - replaced.Size}
+	}
+	if err := s.addUsage(ctx, added); err != nil {
+		s.releaseObject(entryID, objectKey)
+		return nil, err
+	}
+
+	if shouldUpdate {
+		modify := time.Now()
+		dropped, err := s.MetadataStore.UpdateEntryObject(ctx, entryID, objectKey, sr.size, sum, modify, s.KeepVersions)
 		if err != nil {
+			s.releaseObject(entryID, objectKey)
+			s.releaseUsage(added)
+			switch {
+			case errors.Is(err, ErrNoSuchEntry):
+				return nil, os.ErrNotExist
+			case errors.Is(err, ErrIsDir):
+				return nil, os.ErrInvalid
+			}
 			return nil, err
 		}
+		for _, key := range dropped {
+			s.releaseReplacedObject(entryID, key)
+		}
 		return &FileInfo{
-			name:    entry.Name,
-			size:    entry.Size,
-			modTime: entry.Modify,
-			isDir:   false,
-			sys:     nil,
+			id:        entryID,
+			name:      name,
+			size:      sr.size,
+			modTime:   modify,
+			isDir:     false,
+			checksums: sum,
+			sys:       nil,
 		}, nil
 	} else {
-		parentDirPath := filepath.Dir(path)
-		parentID, ok := ref.Entries[parentDirPath]
-		if !ok {
-			return nil, os.ErrNotExist
-		}
 		newEntry := Entry{
-			ID:       entryID,
-			ParentID: parentID,
-			Name:     filepath.Base(path),
-			Type:     EntryTypeFile,
-			Size:     sr.size,
-			Modify:   time.Now(),
-			Version:  1,
+			ID:        entryID,
+			ParentID:  ref.ID,
+			Name:      name,
+			Type:      EntryTypeFile,
+			Size:      sr.size,
+			Modify:    time.Now(),
+			Version:   1,
+			Checksums: sum,
+			CheckedIn: 1,
+		}
+		if objectKey != entryID {
+			newEntry.Object = objectKey
 		}
-		err = s.MetadataStore.AddEntry(ctx, newEntry, path)
+		err = s.MetadataStore.AddEntry(ctx, newEntry)
 		if err != nil {
+			// Nothing refers to the new object, so don't leave it behind.
+			s.releaseObject(entryID, objectKey)
+			s.releaseUsage(added)
+			if errors.Is(err, ErrEntryExists) {
+				return nil, os.ErrExist
+			}
 			return nil, err
 		}
-		return &FileInfo{
-			name:    newEntry.Name,
-			size:    newEntry.Size,
-			modTime: newEntry.Modify,
-			isDir:   false,
-			sys:     nil,
-		}, nil
+		info := newFileInfo(newEntry)
+		return &info, nil
 	}
 }
 
+// deleteObject deletes an object that no entry refers to, unless a snapshot
+// pins it. It does not use the request context, which is already canceled
+// when a client aborts an upload. Failures are only logged; the gc command
+// removes the object later.
+func (s *Server) deleteObject(key string) {
+	if err := s.deleteObjects(context.Background(), []string{key}); err != nil {
+		log.Printf("Couldn't clean up object %v. Here's why: %v\n", key, err)
+	}
+}
+
+// sizingReader counts the bytes read from Reader, and fails once they are
+// more than limit, unless limit is below zero.
 type sizingReader struct {
 	io.Reader
-	size int64
+	size     int64
+	limit    int64
+	exceeded bool
 }
 
 func (r *sizingReader) Read(p []byte) (n int, err error) {
 	n, err = r.Reader.Read(p)
 	r.size += int64(n)
+	if r.limit >= 0 && r.size > r.limit {
+		r.exceeded = true
+		return n, webdav.ErrQuotaExceeded
+	}
 	return
 }
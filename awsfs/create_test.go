@@ -0,0 +1,125 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, s testServer, name string) string {
+	t.Helper()
+	f, err := s.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile %q: %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll %q: %v", name, err)
+	}
+	return string(data)
+}
+
+func TestCreateOverwrite(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	for _, data := range []string{"first", "second version", "third"} {
+		fi, err := s.Create(ctx, "/f", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if fi.Size() != int64(len(data)) {
+			t.Fatalf("Size: got %d, want %d", fi.Size(), len(data))
+		}
+		if got := readFile(t, s, "/f"); got != data {
+			t.Fatalf("got %q, want %q", got, data)
+		}
+		// The replaced object is gone.
+		if keys := s.s3.keys(); len(keys) != 1 {
+			t.Fatalf("got objects %v, want one", keys)
+		}
+	}
+	id, err := s.resolve(ctx, "/f")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if key := s.s3.keys()[0]; entryIDOf(key) != id || key == id {
+		t.Fatalf("object key %q: want a fresh key of entry %q", key, id)
+	}
+}
+
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		err = r.err
+	}
+	return n, err
+}
+
+func TestCreateOverwriteFailedUpload(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	if _, err := s.Create(ctx, "/f", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader("original")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	aborted := errors.New("client went away")
+	_, err := s.Create(ctx, "/f", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, &failingReader{r: strings.NewReader("half"), err: aborted})
+	if !errors.Is(err, aborted) {
+		t.Fatalf("Create: got %v, want %v", err, aborted)
+	}
+	if got := readFile(t, s, "/f"); got != "original" {
+		t.Fatalf("got %q, want %q", got, "original")
+	}
+	fi, err := s.Stat(ctx, "/f")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Size() != int64(len("original")) {
+		t.Fatalf("Size: got %d, want %d", fi.Size(), len("original"))
+	}
+}
+
+func TestCreateOverwriteDir(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	if err := s.Mkdir(ctx, "/d", 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	_, err := s.Create(ctx, "/d", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader("x"))
+	if !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("Create: got %v, want os.ErrInvalid", err)
+	}
+	if keys := s.s3.keys(); len(keys) != 0 {
+		t.Fatalf("got objects %v, want none", keys)
+	}
+}
+
+func TestRemoveOverwrittenFile(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	if err := s.Mkdir(ctx, "/d", 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	for _, name := range []string{"/d/f", "/d/f", "/g", "/g"} {
+		if _, err := s.Create(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader(name)); err != nil {
+			t.Fatalf("Create %q: %v", name, err)
+		}
+	}
+	for _, name := range []string{"/d", "/g"} {
+		if err := s.RemoveAll(ctx, name); err != nil {
+			t.Fatalf("RemoveAll %q: %v", name, err)
+		}
+	}
+	s.Wait()
+	if keys := s.s3.keys(); len(keys) != 0 {
+		t.Fatalf("got objects %v, want none", keys)
+	}
+}
@@ -0,0 +1,648 @@
+package awsfs
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeDynamoDB is an in-memory stand-in for DynamoDB. Every table is keyed by
+// its string "id" attribute. It understands the subset of the condition and
+// update expression grammar that the expression builder produces for this
+// package, and evaluates the conditions of a transaction atomically.
+type fakeDynamoDB struct {
+	mu     sync.Mutex
+	tables map[string]map[string]map[string]types.AttributeValue
+	// beforeTransact, if non-nil, is called at the start of every
+	// TransactWriteItems call, before the fake's lock is taken.
+	beforeTransact func()
+	// indexes maps an index name to the attribute it is keyed by.
+	indexes map[string]string
+	// queryPageSize, if positive, caps the number of items a Query returns,
+	// standing in for the 1 MB limit of DynamoDB.
+	queryPageSize int
+	// reads counts the GetItem, BatchGetItem and Query calls.
+	reads int
+}
+
+var _ DynamoDBAPI = (*fakeDynamoDB)(nil)
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{
+		tables: make(map[string]map[string]map[string]types.AttributeValue),
+		indexes: map[string]string{
+			"entry-index-parent_id": "parent_id",
+		},
+	}
+}
+
+func newTestMetadataStore(db *fakeDynamoDB) DynamoDBMetadataStore {
+	return DynamoDBMetadataStore{
+		EntryTableName:     "entry",
+		ReferenceTableName: "reference",
+		BlobTableName:      "blob",
+		SnapshotTableName:  "snapshot",
+		DynamoDBClient:     db,
+	}
+}
+
+func (db *fakeDynamoDB) table(name string) map[string]map[string]types.AttributeValue {
+	t, ok := db.tables[name]
+	if !ok {
+		t = make(map[string]map[string]types.AttributeValue)
+		db.tables[name] = t
+	}
+	return t
+}
+
+func keyOf(key map[string]types.AttributeValue) string {
+	if s, ok := key["id"].(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
+
+func copyItem(item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	c := make(map[string]types.AttributeValue, len(item))
+	for k, v := range item {
+		c[k] = v
+	}
+	return c
+}
+
+func (db *fakeDynamoDB) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.reads++
+	return &dynamodb.GetItemOutput{
+		Item: copyItem(db.table(*params.TableName)[keyOf(params.Key)]),
+	}, nil
+}
+
+func (db *fakeDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t := db.table(*params.TableName)
+	id := keyOf(params.Item)
+	ok, err := evalCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, t[id])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("conditional check failed")}
+	}
+	t[id] = copyItem(params.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (db *fakeDynamoDB) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t := db.table(*params.TableName)
+	id := keyOf(params.Key)
+	ok, err := evalCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, t[id])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("conditional check failed")}
+	}
+	item, err := applyUpdate(params.UpdateExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, params.Key, t[id])
+	if err != nil {
+		return nil, err
+	}
+	t[id] = item
+	return &dynamodb.UpdateItemOutput{Attributes: copyItem(item)}, nil
+}
+
+func (db *fakeDynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t := db.table(*params.TableName)
+	id := keyOf(params.Key)
+	ok, err := evalCondition(params.ConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, t[id])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("conditional check failed")}
+	}
+	old := t[id]
+	delete(t, id)
+	return &dynamodb.DeleteItemOutput{Attributes: old}, nil
+}
+
+func (db *fakeDynamoDB) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.reads++
+	out := &dynamodb.BatchGetItemOutput{
+		Responses: make(map[string][]map[string]types.AttributeValue),
+	}
+	for name, ka := range params.RequestItems {
+		t := db.table(name)
+		for _, key := range ka.Keys {
+			if item, ok := t[keyOf(key)]; ok {
+				out.Responses[name] = append(out.Responses[name], copyItem(item))
+			}
+		}
+	}
+	return out, nil
+}
+
+func (db *fakeDynamoDB) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n := 0
+	for _, requests := range params.RequestItems {
+		n += len(requests)
+	}
+	if n > batchWriteLimit {
+		return nil, fmt.Errorf("fake dynamodb: too many requests in batch: %d", n)
+	}
+	for name, requests := range params.RequestItems {
+		t := db.table(name)
+		for _, r := range requests {
+			switch {
+			case r.PutRequest != nil:
+				t[keyOf(r.PutRequest.Item)] = copyItem(r.PutRequest.Item)
+			case r.DeleteRequest != nil:
+				delete(t, keyOf(r.DeleteRequest.Key))
+			}
+		}
+	}
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+// sortedItems returns the items of t matching the filter, ordered by ID.
+func sortedItems(t map[string]map[string]types.AttributeValue, match func(map[string]types.AttributeValue) (bool, error)) ([]map[string]types.AttributeValue, error) {
+	ids := make([]string, 0, len(t))
+	for id := range t {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var items []map[string]types.AttributeValue
+	for _, id := range ids {
+		ok, err := match(t[id])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			items = append(items, copyItem(t[id]))
+		}
+	}
+	return items, nil
+}
+
+// page applies ExclusiveStartKey and Limit to items, which are ordered by ID.
+func page(items []map[string]types.AttributeValue, start map[string]types.AttributeValue, limit *int32) (page []map[string]types.AttributeValue, last map[string]types.AttributeValue) {
+	if start != nil {
+		from := keyOf(start)
+		i := sort.Search(len(items), func(i int) bool { return keyOf(items[i]) > from })
+		items = items[i:]
+	}
+	if limit != nil && int(*limit) < len(items) {
+		items = items[:*limit]
+		return items, map[string]types.AttributeValue{"id": items[len(items)-1]["id"]}
+	}
+	return items, nil
+}
+
+func (db *fakeDynamoDB) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.reads++
+	t := db.table(*params.TableName)
+	items, err := sortedItems(t, func(item map[string]types.AttributeValue) (bool, error) {
+		if params.IndexName != nil {
+			if _, ok := item[db.indexes[*params.IndexName]]; !ok {
+				return false, nil
+			}
+		}
+		ok, err := evalCondition(params.KeyConditionExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, item)
+		if err != nil || !ok {
+			return false, err
+		}
+		return evalCondition(params.FilterExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	limit := params.Limit
+	if db.queryPageSize > 0 && (limit == nil || int(*limit) > db.queryPageSize) {
+		limit = aws.Int32(int32(db.queryPageSize))
+	}
+	items, last := page(items, params.ExclusiveStartKey, limit)
+	if last != nil && params.IndexName != nil {
+		attr := db.indexes[*params.IndexName]
+		last[attr] = items[len(items)-1][attr]
+	}
+	return &dynamodb.QueryOutput{Items: items, Count: int32(len(items)), LastEvaluatedKey: last}, nil
+}
+
+func (db *fakeDynamoDB) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t := db.table(*params.TableName)
+	items, err := sortedItems(t, func(item map[string]types.AttributeValue) (bool, error) {
+		return evalCondition(params.FilterExpression, params.ExpressionAttributeNames, params.ExpressionAttributeValues, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	items, last := page(items, params.ExclusiveStartKey, params.Limit)
+	return &dynamodb.ScanOutput{Items: items, Count: int32(len(items)), LastEvaluatedKey: last}, nil
+}
+
+func (db *fakeDynamoDB) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	if db.beforeTransact != nil {
+		db.beforeTransact()
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if len(params.TransactItems) > 100 {
+		return nil, fmt.Errorf("fake dynamodb: too many items in transaction: %d", len(params.TransactItems))
+	}
+
+	// Check every condition before applying anything.
+	reasons := make([]types.CancellationReason, len(params.TransactItems))
+	failed := false
+	for i, ti := range params.TransactItems {
+		var (
+			table, cond *string
+			key         map[string]types.AttributeValue
+			names       map[string]string
+			values      map[string]types.AttributeValue
+		)
+		switch {
+		case ti.Put != nil:
+			table, cond, key, names, values = ti.Put.TableName, ti.Put.ConditionExpression, ti.Put.Item, ti.Put.ExpressionAttributeNames, ti.Put.ExpressionAttributeValues
+		case ti.Update != nil:
+			table, cond, key, names, values = ti.Update.TableName, ti.Update.ConditionExpression, ti.Update.Key, ti.Update.ExpressionAttributeNames, ti.Update.ExpressionAttributeValues
+		case ti.Delete != nil:
+			table, cond, key, names, values = ti.Delete.TableName, ti.Delete.ConditionExpression, ti.Delete.Key, ti.Delete.ExpressionAttributeNames, ti.Delete.ExpressionAttributeValues
+		case ti.ConditionCheck != nil:
+			table, cond, key, names, values = ti.ConditionCheck.TableName, ti.ConditionCheck.ConditionExpression, ti.ConditionCheck.Key, ti.ConditionCheck.ExpressionAttributeNames, ti.ConditionCheck.ExpressionAttributeValues
+		}
+		ok, err := evalCondition(cond, names, values, db.table(*table)[keyOf(key)])
+		if err != nil {
+			return nil, err
+		}
+		reasons[i].Code = aws.String("None")
+		if !ok {
+			reasons[i].Code = aws.String("ConditionalCheckFailed")
+			failed = true
+		}
+	}
+	if failed {
+		return nil, &types.TransactionCanceledException{
+			Message:             aws.String("transaction cancelled"),
+			CancellationReasons: reasons,
+		}
+	}
+
+	for _, ti := range params.TransactItems {
+		switch {
+		case ti.Put != nil:
+			db.table(*ti.Put.TableName)[keyOf(ti.Put.Item)] = copyItem(ti.Put.Item)
+		case ti.Update != nil:
+			t := db.table(*ti.Update.TableName)
+			id := keyOf(ti.Update.Key)
+			item, err := applyUpdate(ti.Update.UpdateExpression, ti.Update.ExpressionAttributeNames, ti.Update.ExpressionAttributeValues, ti.Update.Key, t[id])
+			if err != nil {
+				return nil, err
+			}
+			t[id] = item
+		case ti.Delete != nil:
+			delete(db.table(*ti.Delete.TableName), keyOf(ti.Delete.Key))
+		}
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// exprTokens splits an expression into identifiers, placeholders,
+// parentheses, commas and comparison operators.
+func exprTokens(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\n' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == ',' || c == '=':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '<' || c == '>':
+			if i+1 < len(s) && (s[i+1] == '=' || s[i+1] == '>') {
+				tokens = append(tokens, s[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, string(c))
+				i++
+			}
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \n\t(),=<>", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+type exprParser struct {
+	tokens []string
+	names  map[string]string
+	values map[string]types.AttributeValue
+	item   map[string]types.AttributeValue
+}
+
+func (p *exprParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	if len(p.tokens) > 0 {
+		p.tokens = p.tokens[1:]
+	}
+	return t
+}
+
+func (p *exprParser) expect(t string) error {
+	if got := p.next(); got != t {
+		return fmt.Errorf("fake dynamodb: got %q, want %q", got, t)
+	}
+	return nil
+}
+
+// attrPath resolves a name placeholder such as "#0" or "#0.#1".
+func (p *exprParser) attrPath(t string) []string {
+	var path []string
+	for _, part := range strings.Split(t, ".") {
+		if name, ok := p.names[part]; ok {
+			part = name
+		}
+		path = append(path, part)
+	}
+	return path
+}
+
+func lookupPath(item map[string]types.AttributeValue, path []string) types.AttributeValue {
+	var v types.AttributeValue = &types.AttributeValueMemberM{Value: item}
+	for _, part := range path {
+		m, ok := v.(*types.AttributeValueMemberM)
+		if !ok {
+			return nil
+		}
+		if v, ok = m.Value[part]; !ok {
+			return nil
+		}
+	}
+	return v
+}
+
+func (p *exprParser) operand() types.AttributeValue {
+	t := p.next()
+	if strings.HasPrefix(t, ":") {
+		return p.values[t]
+	}
+	return lookupPath(p.item, p.attrPath(t))
+}
+
+func (p *exprParser) or() (bool, error) {
+	l, err := p.and()
+	if err != nil {
+		return false, err
+	}
+	for p.peek() == "OR" {
+		p.next()
+		r, err := p.and()
+		if err != nil {
+			return false, err
+		}
+		l = l || r
+	}
+	return l, nil
+}
+
+func (p *exprParser) and() (bool, error) {
+	l, err := p.term()
+	if err != nil {
+		return false, err
+	}
+	for p.peek() == "AND" {
+		p.next()
+		r, err := p.term()
+		if err != nil {
+			return false, err
+		}
+		l = l && r
+	}
+	return l, nil
+}
+
+func (p *exprParser) term() (bool, error) {
+	switch t := p.peek(); t {
+	case "(":
+		p.next()
+		v, err := p.or()
+		if err != nil {
+			return false, err
+		}
+		return v, p.expect(")")
+	case "NOT":
+		p.next()
+		v, err := p.term()
+		return !v, err
+	case "attribute_exists", "attribute_not_exists":
+		p.next()
+		if err := p.expect("("); err != nil {
+			return false, err
+		}
+		v := lookupPath(p.item, p.attrPath(p.next()))
+		if err := p.expect(")"); err != nil {
+			return false, err
+		}
+		return (v != nil) == (t == "attribute_exists"), nil
+	case "begins_with":
+		p.next()
+		if err := p.expect("("); err != nil {
+			return false, err
+		}
+		v := p.operand()
+		if err := p.expect(","); err != nil {
+			return false, err
+		}
+		prefix := p.operand()
+		if err := p.expect(")"); err != nil {
+			return false, err
+		}
+		s, ok1 := v.(*types.AttributeValueMemberS)
+		pre, ok2 := prefix.(*types.AttributeValueMemberS)
+		return ok1 && ok2 && strings.HasPrefix(s.Value, pre.Value), nil
+	}
+	l := p.operand()
+	op := p.next()
+	r := p.operand()
+	c, comparable := compareValues(l, r)
+	switch op {
+	case "=":
+		return comparable && c == 0, nil
+	case "<>":
+		return !comparable || c != 0, nil
+	case "<":
+		return comparable && c < 0, nil
+	case "<=":
+		return comparable && c <= 0, nil
+	case ">":
+		return comparable && c > 0, nil
+	case ">=":
+		return comparable && c >= 0, nil
+	}
+	return false, fmt.Errorf("fake dynamodb: unsupported operator %q", op)
+}
+
+// compareValues compares two attribute values of the same type.
+func compareValues(a, b types.AttributeValue) (int, bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+	switch a := a.(type) {
+	case *types.AttributeValueMemberN:
+		b, ok := b.(*types.AttributeValueMemberN)
+		if !ok {
+			return 0, false
+		}
+		x, _ := strconv.ParseFloat(a.Value, 64)
+		y, _ := strconv.ParseFloat(b.Value, 64)
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case *types.AttributeValueMemberS:
+		b, ok := b.(*types.AttributeValueMemberS)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a.Value, b.Value), true
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0, true
+	}
+	return 1, reflect.TypeOf(a) == reflect.TypeOf(b)
+}
+
+func evalCondition(expr *string, names map[string]string, values map[string]types.AttributeValue, item map[string]types.AttributeValue) (bool, error) {
+	if expr == nil || *expr == "" {
+		return true, nil
+	}
+	p := &exprParser{tokens: exprTokens(*expr), names: names, values: values, item: item}
+	ok, err := p.or()
+	if err != nil {
+		return false, err
+	}
+	if len(p.tokens) != 0 {
+		return false, fmt.Errorf("fake dynamodb: trailing tokens in %q", *expr)
+	}
+	return ok, nil
+}
+
+// applyUpdate applies the SET, ADD, DELETE and REMOVE clauses of an update expression
+// to a copy of item, creating the item from key if it does not exist.
+func applyUpdate(expr *string, names map[string]string, values map[string]types.AttributeValue, key, item map[string]types.AttributeValue) (map[string]types.AttributeValue, error) {
+	if item == nil {
+		item = copyItem(key)
+	} else {
+		item = copyItem(item)
+	}
+	p := &exprParser{tokens: exprTokens(*expr), names: names, values: values, item: item}
+	for len(p.tokens) > 0 {
+		clause := p.next()
+		for {
+			path := p.attrPath(p.next())
+			if len(path) != 1 {
+				return nil, fmt.Errorf("fake dynamodb: nested update paths are not supported: %q", *expr)
+			}
+			switch clause {
+			case "SET":
+				if err := p.expect("="); err != nil {
+					return nil, err
+				}
+				item[path[0]] = p.operand()
+			case "ADD":
+				switch v := p.operand().(type) {
+				case *types.AttributeValueMemberN:
+					x, _ := strconv.ParseFloat(v.Value, 64)
+					if old, ok := item[path[0]].(*types.AttributeValueMemberN); ok {
+						y, _ := strconv.ParseFloat(old.Value, 64)
+						x += y
+					}
+					item[path[0]] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(x, 'f', -1, 64)}
+				case *types.AttributeValueMemberSS:
+					var set []string
+					if old, ok := item[path[0]].(*types.AttributeValueMemberSS); ok {
+						set = append(set, old.Value...)
+					}
+					for _, e := range v.Value {
+						if !slices.Contains(set, e) {
+							set = append(set, e)
+						}
+					}
+					item[path[0]] = &types.AttributeValueMemberSS{Value: set}
+				default:
+					return nil, fmt.Errorf("fake dynamodb: ADD only supports numbers and string sets: %q", *expr)
+				}
+			case "DELETE":
+				v, ok := p.operand().(*types.AttributeValueMemberSS)
+				if !ok {
+					return nil, fmt.Errorf("fake dynamodb: DELETE only supports string sets: %q", *expr)
+				}
+				if old, ok := item[path[0]].(*types.AttributeValueMemberSS); ok {
+					var set []string
+					for _, e := range old.Value {
+						if !slices.Contains(v.Value, e) {
+							set = append(set, e)
+						}
+					}
+					// DynamoDB removes sets that become empty.
+					if len(set) == 0 {
+						delete(item, path[0])
+					} else {
+						item[path[0]] = &types.AttributeValueMemberSS{Value: set}
+					}
+				}
+			case "REMOVE":
+				delete(item, path[0])
+			default:
+				return nil, fmt.Errorf("fake dynamodb: unsupported clause %q", clause)
+			}
+			if p.peek() != "," {
+				break
+			}
+			p.next()
+		}
+	}
+	return item, nil
+}
@@ -1,14 +1,52 @@
 package awsfs
 
 import (
+	"context"
+	"errors"
+	"os"
 	"path"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 type Server struct {
 	MetadataStore MetadataStore
 	PhysicalStore PhysicalStore
-	TempDir       string
+	// Deduplicate stores files with the same content as a single Blob, and
+	// makes copying a file a metadata-only operation. Files written while it
+	// was unset keep objects of their own.
+	Deduplicate bool
+	// KeepVersions is the number of earlier versions of a file that are kept
+	// when its content is replaced. Older versions are deleted.
+	KeepVersions int
+	// DeleteDelay is how long the object of content that an overwrite
+	// dropped is kept before it is deleted, so that downloads of it can
+	// finish. Objects that the process does not live to delete are left to
+	// CollectGarbage.
+	DeleteDelay time.Duration
+	// Trash makes RemoveAll move entries to the trash of the user of the
+	// request, under TrashPath, instead of deleting them.
+	Trash bool
+	// Snapshots serves the snapshots read-only under SnapshotsPath.
+	Snapshots bool
+	// QuotaBytes and QuotaFiles limit the size of the content of the files
+	// and the number of files, trash included. Zero is no limit. While
+	// either is set, the usage is counted as files are written, and deleted
+	// files stop counting once they are reaped.
+	QuotaBytes int64
+	QuotaFiles int64
+	// SyncReap makes RemoveAll reap the deleted entries before it returns,
+	// and an overwrite delete the replaced content at once regardless of
+	// DeleteDelay, for environments such as AWS Lambda that freeze the
+	// process between requests, where work in the background would stall.
+	SyncReap bool
+
+	reaping sync.WaitGroup
+	// trees caches the trees of snapshots by the key of their manifest.
+	trees treeCache
 }
 
 // slashClean is equivalent to but slightly more efficient than
@@ -20,6 +58,53 @@ func slashClean(name string) string {
 	return path.Clean(name)
 }
 
+// resolve returns the ID of the entry named by the clean path p, reading one
+// Reference per directory on the way down from the root.
+func (s *Server) resolve(ctx context.Context, p string) (string, error) {
+	anchor, err := s.MetadataStore.GetReference(ctx, referenceID)
+	if err != nil {
+		return "", err
+	}
+	id, ok := anchor.Entries["/"]
+	if !ok {
+		return "", ErrNoSuchEntry
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		ref, err := s.MetadataStore.GetReference(ctx, id)
+		if errors.Is(err, ErrNoSuchReference) {
+			// id names a file, which has no children.
+			return "", os.ErrNotExist
+		}
+		if err != nil {
+			return "", err
+		}
+		if id, ok = ref.Entries[name]; !ok {
+			return "", os.ErrNotExist
+		}
+	}
+	return id, nil
+}
+
+// resolveParent returns the Reference of the directory containing the clean
+// path p, together with the last element of p.
+func (s *Server) resolveParent(ctx context.Context, p string) (Reference, string, error) {
+	parentID, err := s.resolve(ctx, path.Dir(p))
+	if err != nil {
+		return Reference{}, "", err
+	}
+	ref, err := s.MetadataStore.GetReference(ctx, parentID)
+	if errors.Is(err, ErrNoSuchReference) {
+		return Reference{}, "", os.ErrNotExist
+	}
+	if err != nil {
+		return Reference{}, "", err
+	}
+	return ref, path.Base(p), nil
+}
+
 type EntryType string
 
 const (
@@ -27,6 +112,10 @@ const (
 	EntryTypeDir  EntryType = "dir"
 )
 
+// Reference maps the names of the children of a directory to their entry
+// IDs. Every directory has exactly one Reference, whose ID is the ID of the
+// directory's entry. The Reference with the ID "root" is the entry point of
+// the tree; it maps "/" to the root directory.
 type Reference struct {
 	ID      string            `dynamodbav:"id"`
 	Entries map[string]string `dynamodbav:"entries"`
@@ -42,8 +131,48 @@ type Entry struct {
 	Modify    time.Time         `dynamodbav:"modify"`
 	DeadProps map[string]string `dynamodbav:"dead_props"`
 	Version   int               `dynamodbav:"version"`
+	// Checksums are the hashes of the content of a file. They are empty for
+	// files written before checksums were recorded.
+	Checksums
+	// Object is the key of the content of a file in the PhysicalStore. It is
+	// empty for a file that has not been overwritten since it was created,
+	// whose content is stored under the ID of the entry. The content of a
+	// file that shares it with others is a Blob, whose key starts with
+	// blobKeyPrefix.
+	Object string `dynamodbav:"object,omitempty"`
+	// CheckedIn is the number of the version that is the current content of
+	// a file, counting the writes of its content from 1. It is zero for a
+	// file written before versions were numbered, whose content is version 1.
+	CheckedIn int `dynamodbav:"checked_in,omitempty"`
+	// Versions are the earlier contents of a file that are kept, oldest
+	// first.
+	Versions []FileVersion `dynamodbav:"versions,omitempty"`
+	// Trash describes where an entry in the trash came from. It is nil for
+	// entries outside the trash.
+	Trash *TrashInfo `dynamodbav:"trash,omitempty"`
 }
 
 func (e Entry) IsDir() bool {
 	return e.Type == EntryTypeDir
 }
+
+// ObjectKey returns the key of the content of the file e.
+func (e Entry) ObjectKey() string {
+	if e.Object != "" {
+		return e.Object
+	}
+	return e.ID
+}
+
+// newObjectKey returns a key for new content of the file with the given
+// entry ID. Keys start with the entry ID, so the entry referring to an object
+// can be found from its key.
+func newObjectKey(id string) string {
+	return id + "/" + uuid.New().String()
+}
+
+// entryIDOf returns the ID of the entry that the object key belongs to.
+func entryIDOf(key string) string {
+	id, _, _ := strings.Cut(key, "/")
+	return id
+}
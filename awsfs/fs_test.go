@@ -0,0 +1,46 @@
+package awsfs
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+// testServer is a Server backed by fake DynamoDB and S3 services.
+type testServer struct {
+	*Server
+	db *fakeDynamoDB
+	s3 *fakeS3
+}
+
+func newTestServer(t *testing.T) testServer {
+	t.Helper()
+	db, s3 := newFakeDynamoDB(), newFakeS3()
+	s := &Server{
+		MetadataStore: newTestMetadataStore(db),
+		PhysicalStore: newTestPhysicalStore(s3),
+	}
+	if err := s.MetadataStore.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	return testServer{Server: s, db: db, s3: s3}
+}
+
+// newTestHandler returns a function that serves a request with the given
+// method, path, body and header name/value pairs from a Handler over fs.
+func newTestHandler(t *testing.T, fs webdav.FileSystem) func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+	h := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	return func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+}
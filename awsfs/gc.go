@@ -0,0 +1,111 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// CollectGarbage finds the objects of the physical store that no entry refers
+// to, calls report for each of them and, unless dryRun is set, deletes them.
+//
+// Objects younger than minAge are skipped: Create uploads an object before it
+// adds or updates the entry referring to it, so a recent object may still be
+// waiting for its entry. The objects of the kept versions of a file are
+// live, and the object of a Blob is live as long as the Blob exists. Objects
+// pinned by a snapshot and the manifests of snapshots are live as well.
+func (s *Server) CollectGarbage(ctx context.Context, minAge time.Duration, dryRun bool, report func(Object)) error {
+	cutoff := time.Now().Add(-minAge)
+	var batch []Object
+
+	snapshots, err := s.MetadataStore.GetSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+	manifests := make(map[string]bool, len(snapshots))
+	for _, snap := range snapshots {
+		manifests[snap.Manifest] = true
+	}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		keys := make([]string, 0, len(batch))
+		for _, obj := range batch {
+			keys = append(keys, obj.Key)
+		}
+		live, err := s.liveObjects(ctx, keys)
+		if err != nil {
+			return err
+		}
+		pinned, err := s.MetadataStore.GetPinnedObjects(ctx, keys)
+		if err != nil {
+			return err
+		}
+		for _, key := range pinned {
+			live[key] = true
+		}
+		var orphans []string
+		for _, obj := range batch {
+			if !live[obj.Key] && !manifests[obj.Key] {
+				report(obj)
+				orphans = append(orphans, obj.Key)
+			}
+		}
+		batch = batch[:0]
+		if dryRun || len(orphans) == 0 {
+			return nil
+		}
+		return s.PhysicalStore.DeleteObjects(ctx, orphans)
+	}
+
+	err = s.PhysicalStore.ListObjects(ctx, func(obj Object) error {
+		if obj.LastModified.After(cutoff) {
+			return nil
+		}
+		batch = append(batch, obj)
+		if len(batch) == batchGetLimit {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// liveObjects returns which of the objects with the given keys an entry or a
+// Blob refers to.
+func (s *Server) liveObjects(ctx context.Context, keys []string) (map[string]bool, error) {
+	seen := make(map[string]bool, len(keys))
+	ids := make([]string, 0, len(keys))
+	live := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if hash, ok := blobHashOf(key); ok {
+			blob, err := s.MetadataStore.GetBlob(ctx, hash)
+			if err != nil && !errors.Is(err, ErrNoSuchBlob) {
+				return nil, err
+			}
+			live[key] = err == nil && blob.Object == key
+			continue
+		}
+		if id := entryIDOf(key); !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	entries, err := s.MetadataStore.GetEntries(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			for _, key := range entry.objectKeys() {
+				live[key] = true
+			}
+		}
+	}
+	return live, nil
+}
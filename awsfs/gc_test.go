@@ -0,0 +1,92 @@
+package awsfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoveAllDeletesObjects(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	if err := s.Mkdir(ctx, "/a", 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	for _, name := range []string{"/a/x", "/a/y", "/z"} {
+		if _, err := s.Create(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader(name)); err != nil {
+			t.Fatalf("Create %q: %v", name, err)
+		}
+	}
+	if got := len(s.s3.keys()); got != 3 {
+		t.Fatalf("got %d objects, want 3", got)
+	}
+
+	if err := s.RemoveAll(ctx, "/a"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	s.Wait()
+	keys := s.s3.keys()
+	if len(keys) != 1 {
+		t.Fatalf("got objects %v, want only the object of /z", keys)
+	}
+	fi, err := s.Stat(ctx, "/z")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Size() != 2 {
+		t.Fatalf("Size: got %d, want 2", fi.Size())
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("/file%d", i)
+		if _, err := s.Create(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader(name)); err != nil {
+			t.Fatalf("Create %q: %v", name, err)
+		}
+	}
+	// An overwritten file refers to an object with a fresh key.
+	if _, err := s.Create(ctx, "/file0", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader("new")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	id, err := s.resolve(ctx, "/file0")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	live := s.s3.keys()
+	old := time.Now().Add(-2 * time.Hour)
+	for _, key := range live {
+		s.s3.put(key, s.s3.objects[key].data, old)
+	}
+	for i := 0; i < 2; i++ {
+		s.s3.put(fmt.Sprintf("orphan%d", i), []byte("orphan"), old)
+	}
+	// A former object of /file0 that was not cleaned up.
+	s.s3.put(id+"/orphan2", []byte("orphan"), old)
+	s.s3.put("recent", []byte("recent"), time.Now())
+
+	for _, dryRun := range []bool{true, false} {
+		var reported []string
+		err := s.CollectGarbage(ctx, time.Hour, dryRun, func(obj Object) {
+			reported = append(reported, obj.Key)
+		})
+		if err != nil {
+			t.Fatalf("dryRun=%t: CollectGarbage: %v", dryRun, err)
+		}
+		if got, want := strings.Join(reported, ","), id+"/orphan2,orphan0,orphan1"; got != want {
+			t.Fatalf("dryRun=%t: reported %q, want %q", dryRun, got, want)
+		}
+	}
+
+	want := append(live, "recent")
+	sort.Strings(want)
+	if got := s.s3.keys(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("remaining objects: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,193 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LocalPhysicalStore is a PhysicalStore that keeps objects as files below a
+// local directory, for development and for installations without S3.
+//
+// Object keys contain slashes, and a key may be a prefix of another one, so
+// every object is a single file whose name is its escaped key. The files are
+// spread over subdirectories named after the first two characters of the
+// key. Objects are written to a temporary file that is renamed into place,
+// so a reader never sees a partially written object.
+type LocalPhysicalStore struct {
+	// Dir is the directory holding the objects. It is created when the
+	// first object is stored.
+	Dir string
+}
+
+// localTempPrefix starts the names of files being written. Escaped keys never
+// start with a dot, so these files are not mistaken for objects.
+const localTempPrefix = ".upload-"
+
+// path returns the name of the file holding the object key.
+func (s LocalPhysicalStore) path(key string) string {
+	name := url.PathEscape(key)
+	shard := name
+	if len(shard) > 2 {
+		shard = shard[:2]
+	}
+	return filepath.Join(s.Dir, shard, name)
+}
+
+// GetObjectRange returns a reader for length bytes of the object starting at
+// offset.
+func (s LocalPhysicalStore) GetObjectRange(ctx context.Context, objectKey string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(objectKey))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoSuchObject
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+// PutObject stores the content of r as objectKey, replacing the object
+// atomically if it exists.
+func (s LocalPhysicalStore) PutObject(ctx context.Context, objectKey string, r io.Reader) error {
+	return s.writeFile(s.path(objectKey), func(f *os.File) error {
+		_, err := io.Copy(f, r)
+		return err
+	})
+}
+
+// writeFile creates a temporary file next to name, fills it with write and
+// renames it to name.
+func (s LocalPhysicalStore) writeFile(name string, write func(f *os.File) error) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, localTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// CopyObject copies the object srcKey to dstKey. Objects are never modified
+// once written, so the copy is a hard link where the file system allows it.
+// A link shares the source's modification time, so it is reset to now: the
+// copy must look as new as a freshly written object, or gc could delete it
+// before its entry is added. This makes the source look new too, which only
+// keeps it longer.
+func (s LocalPhysicalStore) CopyObject(ctx context.Context, srcKey, dstKey string, size int64) error {
+	src, dst := s.path(srcKey), s.path(dstKey)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		now := time.Now()
+		return os.Chtimes(dst, now, now)
+	}
+	in, err := os.Open(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNoSuchObject
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return s.writeFile(dst, func(f *os.File) error {
+		_, err := io.Copy(f, in)
+		return err
+	})
+}
+
+// DeleteObjects deletes the objects with the given keys. Keys that do not
+// name an object are ignored.
+func (s LocalPhysicalStore) DeleteObjects(ctx context.Context, objectKeys []string) error {
+	var errs []error
+	for _, key := range objectKeys {
+		if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ListObjects calls fn for every object, in key order. Files being written
+// are skipped.
+func (s LocalPhysicalStore) ListObjects(ctx context.Context, fn func(Object) error) error {
+	shards, err := os.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	var objects []Object
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(s.Dir, shard.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %w", err)
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			key, err := url.PathUnescape(file.Name())
+			if err != nil {
+				continue
+			}
+			info, err := file.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				// Deleted since the directory was read.
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to list objects: %w", err)
+			}
+			objects = append(objects, Object{
+				Key:          key,
+				Size:         info.Size(),
+				LastModified: info.ModTime(),
+			})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	for _, obj := range objects {
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
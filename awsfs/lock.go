@@ -0,0 +1,800 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+// LockSystem is a webdav.LockSystem that keeps the locks in a DynamoDB table,
+// so that every instance of the server sees the same locks.
+//
+// The table has an item per locked resource and per ancestor of a locked
+// resource, keyed by its path. The item of a locked resource carries the
+// lock, and every item records the tokens and deadlines of the locks below
+// it, so the locks that conflict with a new one are found in the items from
+// its root up to "/". Another item, keyed by the token, maps a lock to its
+// root. Items are written with a version check, like the Reference items of
+// the MetadataStore, and expired items are removed by the ttl attribute.
+//
+// The item of a resource carries either its exclusive lock or its shared
+// locks, which are kept in a map by token.
+//
+// Unlike the in-memory LockSystem, a lock expires at its deadline even while
+// a request holds it.
+type LockSystem struct {
+	TableName      string
+	DynamoDBClient DynamoDBAPI
+	// MaxRetries is how many times a write that lost a race against a
+	// concurrent writer is retried before a *ConflictError is returned. If
+	// zero, defaultMaxRetries is used.
+	MaxRetries int
+}
+
+var (
+	_ webdav.LockSystem = LockSystem{}
+	_ webdav.LockLister = LockSystem{}
+)
+
+// lockHoldTimeout bounds how long Confirm holds a lock, so that the lock does
+// not stay held forever if the process holding it dies.
+const lockHoldTimeout = time.Hour
+
+// neverExpires is the deadline of a lock with an infinite timeout.
+const neverExpires = math.MaxInt64
+
+var errLockTooDeep = errors.New("lock root too deep")
+
+// lockNode is the item of a path in the lock table. Times are Unix times in
+// nanoseconds.
+type lockNode struct {
+	ID        string        `dynamodbav:"id"`
+	Token     string        `dynamodbav:"token,omitempty"`
+	ZeroDepth bool          `dynamodbav:"zero_depth,omitempty"`
+	OwnerXML  string        `dynamodbav:"owner,omitempty"`
+	Duration  time.Duration `dynamodbav:"duration,omitempty"`
+	Expiry    int64         `dynamodbav:"expiry,omitempty"`
+	HeldUntil int64         `dynamodbav:"held_until,omitempty"`
+	// Shared maps the tokens of the shared locks on the path to them.
+	Shared map[string]sharedLock `dynamodbav:"shared,omitempty"`
+	// Descendants maps the tokens of the exclusive locks below the path to
+	// their deadlines, and SharedDescendants those of the shared locks.
+	Descendants       map[string]int64 `dynamodbav:"descendants,omitempty"`
+	SharedDescendants map[string]int64 `dynamodbav:"shared_descendants,omitempty"`
+	TTL               int64            `dynamodbav:"ttl,omitempty"`
+	Version           int              `dynamodbav:"version"`
+}
+
+// sharedLock is a shared lock in the item of its root.
+type sharedLock struct {
+	ZeroDepth bool          `dynamodbav:"zero_depth,omitempty"`
+	OwnerXML  string        `dynamodbav:"owner,omitempty"`
+	Duration  time.Duration `dynamodbav:"duration,omitempty"`
+	Expiry    int64         `dynamodbav:"expiry,omitempty"`
+	HeldUntil int64         `dynamodbav:"held_until,omitempty"`
+}
+
+// lockRef is a lock found in the item of its root, n.
+type lockRef struct {
+	n     *lockNode
+	token string
+}
+
+func (r lockRef) shared() bool {
+	return r.token != r.n.Token
+}
+
+func (r lockRef) zeroDepth() bool {
+	if r.shared() {
+		return r.n.Shared[r.token].ZeroDepth
+	}
+	return r.n.ZeroDepth
+}
+
+func (r lockRef) held(now int64) bool {
+	if r.shared() {
+		return now < r.n.Shared[r.token].HeldUntil
+	}
+	return r.n.held(now)
+}
+
+// lockToken is the item of a token in the lock table.
+type lockToken struct {
+	ID   string `dynamodbav:"id"`
+	Root string `dynamodbav:"root"`
+	TTL  int64  `dynamodbav:"ttl,omitempty"`
+}
+
+// prune drops the locks of n and the locks below it that have expired at now.
+func (n *lockNode) prune(now int64) {
+	if n.Token != "" && now >= n.Expiry {
+		n.Token, n.ZeroDepth, n.OwnerXML, n.Duration, n.Expiry, n.HeldUntil = "", false, "", 0, 0, 0
+	}
+	for token, s := range n.Shared {
+		if now >= s.Expiry {
+			delete(n.Shared, token)
+		}
+	}
+	for token, expiry := range n.Descendants {
+		if now >= expiry {
+			delete(n.Descendants, token)
+		}
+	}
+	for token, expiry := range n.SharedDescendants {
+		if now >= expiry {
+			delete(n.SharedDescendants, token)
+		}
+	}
+}
+
+// lock returns the lock of n with the given token, if n carries it.
+func (n *lockNode) lock(token string) (lockRef, bool) {
+	if token == "" {
+		return lockRef{}, false
+	}
+	if _, ok := n.Shared[token]; ok || n.Token == token {
+		return lockRef{n: n, token: token}, true
+	}
+	return lockRef{}, false
+}
+
+func (n *lockNode) held(now int64) bool {
+	return now < n.HeldUntil
+}
+
+// sharedInfinite reports whether n has a shared lock with infinite depth.
+func (n *lockNode) sharedInfinite() bool {
+	for _, s := range n.Shared {
+		if !s.ZeroDepth {
+			return true
+		}
+	}
+	return false
+}
+
+// setDescendant records the deadline of a lock below n.
+func (n *lockNode) setDescendant(token string, shared bool, expiry int64) {
+	m := &n.Descendants
+	if shared {
+		m = &n.SharedDescendants
+	}
+	if *m == nil {
+		*m = make(map[string]int64)
+	}
+	(*m)[token] = expiry
+}
+
+// empty reports whether n no longer records any lock.
+func (n *lockNode) empty() bool {
+	return n.Token == "" && len(n.Shared) == 0 && len(n.Descendants) == 0 && len(n.SharedDescendants) == 0
+}
+
+func (r lockRef) details() webdav.LockDetails {
+	if r.shared() {
+		s := r.n.Shared[r.token]
+		return webdav.LockDetails{
+			Root:      r.n.ID,
+			Duration:  s.Duration,
+			OwnerXML:  s.OwnerXML,
+			ZeroDepth: s.ZeroDepth,
+			Shared:    true,
+		}
+	}
+	return webdav.LockDetails{
+		Root:      r.n.ID,
+		Duration:  r.n.Duration,
+		OwnerXML:  r.n.OwnerXML,
+		ZeroDepth: r.n.ZeroDepth,
+	}
+}
+
+func (r lockRef) expiry() int64 {
+	if r.shared() {
+		return r.n.Shared[r.token].Expiry
+	}
+	return r.n.Expiry
+}
+
+// ttl returns the value of the ttl attribute for the given deadlines: the
+// Unix time in seconds after the last of them, or zero if one never comes.
+func ttl(deadlines ...int64) int64 {
+	var last int64
+	for _, d := range deadlines {
+		if d == neverExpires {
+			return 0
+		}
+		last = max(last, d)
+	}
+	return time.Unix(0, last).Unix() + 1
+}
+
+func lockExpiry(now time.Time, duration time.Duration) int64 {
+	if duration < 0 {
+		return neverExpires
+	}
+	return now.Add(duration).UnixNano()
+}
+
+// lockPaths returns name and its ancestors, up to "/".
+func lockPaths(name string) []string {
+	names := []string{name}
+	for name != "/" {
+		name = path.Dir(name)
+		names = append(names, name)
+	}
+	return names
+}
+
+func (l LockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	ctx := context.Background()
+	t := now.UnixNano()
+	heldUntil := now.Add(lockHoldTimeout).UnixNano()
+
+	var held []lockRef
+	err := retry(ctx, l.MaxRetries, func(int) error {
+		held = held[:0]
+		for _, name := range []string{name0, name1} {
+			if name == "" {
+				continue
+			}
+			r, ok, err := l.lookup(ctx, t, slashClean(name), conditions...)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return webdav.ErrConfirmationFailed
+			}
+			// Don't hold the same lock twice.
+			if len(held) == 0 || held[0].token != r.token {
+				held = append(held, r)
+			}
+		}
+		if len(held) == 0 {
+			return nil
+		}
+		var items []types.TransactWriteItem
+		for i, r := range held {
+			if i == 1 && r.n.ID == held[0].n.ID {
+				// Both are shared locks on the same resource, which the
+				// update of its item already holds.
+				break
+			}
+			tokens := []string{r.token}
+			if i == 0 && len(held) == 2 && held[1].n.ID == r.n.ID {
+				tokens = append(tokens, held[1].token)
+			}
+			item, err := l.holdUpdate(r.n, tokens, heldUntil)
+			if err != nil {
+				return err
+			}
+			items = append(items, item)
+		}
+		_, err := l.DynamoDBClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: items,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to hold locks: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		for _, r := range held {
+			if err := l.release(ctx, r, heldUntil); err != nil {
+				log.Printf("Couldn't release lock %v. Here's why: %v\n", r.n.ID, err)
+			}
+		}
+	}, nil
+}
+
+// lookup returns the lock that covers the named resource, provided that it
+// matches one of the given conditions and isn't held. Otherwise, it reports
+// false.
+func (l LockSystem) lookup(ctx context.Context, now int64, name string, conditions ...webdav.Condition) (lockRef, bool, error) {
+	for _, c := range conditions {
+		if c.Token == "" {
+			continue
+		}
+		tok, err := l.getToken(ctx, c.Token)
+		if errors.Is(err, webdav.ErrNoSuchLock) {
+			continue
+		}
+		if err != nil {
+			return lockRef{}, false, err
+		}
+		n, err := l.getNode(ctx, tok.Root)
+		if err != nil {
+			return lockRef{}, false, err
+		}
+		n.prune(now)
+		r, ok := n.lock(c.Token)
+		if !ok || r.held(now) {
+			continue
+		}
+		if name == n.ID {
+			return r, true, nil
+		}
+		if r.zeroDepth() {
+			continue
+		}
+		if n.ID == "/" || strings.HasPrefix(name, n.ID+"/") {
+			return r, true, nil
+		}
+	}
+	return lockRef{}, false, nil
+}
+
+// holdUpdate returns a transactional write that marks the locks of n with the
+// given tokens as held until heldUntil, provided that n has not changed since
+// it was read.
+func (l LockSystem) holdUpdate(n *lockNode, tokens []string, heldUntil int64) (types.TransactWriteItem, error) {
+	condition := expression.Name("version").Equal(expression.Value(n.Version))
+	update := expression.Add(expression.Name("version"), expression.Value(1))
+	shared := make(map[string]sharedLock, len(n.Shared))
+	for token, s := range n.Shared {
+		shared[token] = s
+	}
+	holdsShared := false
+	for _, token := range tokens {
+		if token == n.Token {
+			update = update.Set(expression.Name("held_until"), expression.Value(heldUntil))
+			continue
+		}
+		s := shared[token]
+		s.HeldUntil = heldUntil
+		shared[token] = s
+		holdsShared = true
+	}
+	if holdsShared {
+		update = update.Set(expression.Name("shared"), expression.Value(shared))
+	}
+	expr, err := expression.NewBuilder().
+		WithCondition(condition).
+		WithUpdate(update).
+		Build()
+	if err != nil {
+		return types.TransactWriteItem{}, fmt.Errorf("failed to build expression, %w", err)
+	}
+	return types.TransactWriteItem{
+		Update: &types.Update{
+			Key:                       lockKey(n.ID),
+			TableName:                 aws.String(l.TableName),
+			UpdateExpression:          expr.Update(),
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		},
+	}, nil
+}
+
+// release undoes holdUpdate, unless the lock has been held again since.
+func (l LockSystem) release(ctx context.Context, r lockRef, heldUntil int64) error {
+	if r.shared() {
+		return l.releaseShared(ctx, r, heldUntil)
+	}
+	condition := expression.Name("token").Equal(expression.Value(r.token)).
+		And(expression.Name("held_until").Equal(expression.Value(heldUntil)))
+	update := expression.Remove(expression.Name("held_until")).
+		Add(expression.Name("version"), expression.Value(1))
+	expr, err := expression.NewBuilder().
+		WithCondition(condition).
+		WithUpdate(update).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression, %w", err)
+	}
+	_, err = l.DynamoDBClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		Key:                       lockKey(r.n.ID),
+		TableName:                 aws.String(l.TableName),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		// The lock expired or was taken over after the hold timed out.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update item: %w", err)
+	}
+	return nil
+}
+
+// releaseShared releases a shared lock. The shared locks of an item are
+// written together, so the item is read again and written back with a version
+// check.
+func (l LockSystem) releaseShared(ctx context.Context, r lockRef, heldUntil int64) error {
+	return retry(ctx, l.MaxRetries, func(int) error {
+		n, err := l.getNode(ctx, r.n.ID)
+		if err != nil {
+			return err
+		}
+		s, ok := n.Shared[r.token]
+		if !ok || s.HeldUntil != heldUntil {
+			// The lock was removed or held again.
+			return nil
+		}
+		s.HeldUntil = 0
+		n.Shared[r.token] = s
+		condition := expression.Name("version").Equal(expression.Value(n.Version))
+		update := expression.Set(expression.Name("shared"), expression.Value(n.Shared)).
+			Add(expression.Name("version"), expression.Value(1))
+		expr, err := expression.NewBuilder().
+			WithCondition(condition).
+			WithUpdate(update).
+			Build()
+		if err != nil {
+			return fmt.Errorf("failed to build expression, %w", err)
+		}
+		_, err = l.DynamoDBClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			Key:                       lockKey(n.ID),
+			TableName:                 aws.String(l.TableName),
+			UpdateExpression:          expr.Update(),
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update item: %w", err)
+		}
+		return nil
+	})
+}
+
+func (l LockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	ctx := context.Background()
+	details.Root = slashClean(details.Root)
+	names := lockPaths(details.Root)
+	if len(names)+1 > transactWriteLimit {
+		return "", errLockTooDeep
+	}
+	t := now.UnixNano()
+	expiry := lockExpiry(now, details.Duration)
+	token := "urn:uuid:" + uuid.New().String()
+
+	err := retry(ctx, l.MaxRetries, func(int) error {
+		nodes, err := l.getNodes(ctx, names)
+		if err != nil {
+			return err
+		}
+		for i, n := range nodes {
+			n.prune(t)
+			switch {
+			case i == 0 && n.Token != "":
+				// The target is already locked exclusively.
+				return webdav.ErrLocked
+			case i == 0 && !details.Shared && len(n.Shared) > 0:
+				// The target has shared locks, and the requested lock is
+				// exclusive.
+				return webdav.ErrLocked
+			case i == 0 && !details.ZeroDepth && len(n.Descendants) > 0:
+				// The requested lock depth is infinite, and a descendant of
+				// the target is locked exclusively.
+				return webdav.ErrLocked
+			case i == 0 && !details.ZeroDepth && !details.Shared && len(n.SharedDescendants) > 0:
+				// The requested lock is exclusive with infinite depth, and a
+				// descendant of the target has a shared lock.
+				return webdav.ErrLocked
+			case i > 0 && n.Token != "" && !n.ZeroDepth:
+				// An ancestor of the target is locked exclusively with
+				// infinite depth.
+				return webdav.ErrLocked
+			case i > 0 && !details.Shared && n.sharedInfinite():
+				// An ancestor of the target has a shared lock with infinite
+				// depth, and the requested lock is exclusive.
+				return webdav.ErrLocked
+			}
+		}
+
+		target := nodes[0]
+		if details.Shared {
+			if target.Shared == nil {
+				target.Shared = make(map[string]sharedLock)
+			}
+			target.Shared[token] = sharedLock{
+				ZeroDepth: details.ZeroDepth,
+				OwnerXML:  details.OwnerXML,
+				Duration:  details.Duration,
+				Expiry:    expiry,
+			}
+		} else {
+			target.Token = token
+			target.ZeroDepth = details.ZeroDepth
+			target.OwnerXML = details.OwnerXML
+			target.Duration = details.Duration
+			target.Expiry = expiry
+			target.HeldUntil = 0
+		}
+		for _, n := range nodes[1:] {
+			n.setDescendant(token, details.Shared, expiry)
+		}
+		tok := lockToken{ID: token, Root: details.Root, TTL: ttl(expiry)}
+		return l.write(ctx, nodes, &tok, nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Locks reads the items from name up to "/", which carry the locks on name
+// and those of its ancestors.
+func (l LockSystem) Locks(now time.Time, name string) ([]webdav.ActiveLock, error) {
+	nodes, err := l.getNodes(context.Background(), lockPaths(slashClean(name)))
+	if err != nil {
+		return nil, err
+	}
+	t := now.UnixNano()
+	var locks []webdav.ActiveLock
+	for i, n := range nodes {
+		n.prune(t)
+		tokens := make([]string, 0, len(n.Shared)+1)
+		if n.Token != "" {
+			tokens = append(tokens, n.Token)
+		}
+		for token := range n.Shared {
+			tokens = append(tokens, token)
+		}
+		sort.Strings(tokens)
+		for _, token := range tokens {
+			r := lockRef{n: n, token: token}
+			if i > 0 && r.zeroDepth() {
+				continue
+			}
+			lock := webdav.ActiveLock{Token: token, LockDetails: r.details()}
+			if expiry := r.expiry(); expiry != neverExpires {
+				lock.Duration = time.Duration(expiry - t)
+			}
+			locks = append(locks, lock)
+		}
+	}
+	return locks, nil
+}
+
+func (l LockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	ctx := context.Background()
+	t := now.UnixNano()
+	expiry := lockExpiry(now, duration)
+
+	var details webdav.LockDetails
+	err := retry(ctx, l.MaxRetries, func(int) error {
+		tok, nodes, err := l.getLock(ctx, t, token)
+		if err != nil {
+			return err
+		}
+		r := lockRef{n: nodes[0], token: token}
+		if r.shared() {
+			s := r.n.Shared[token]
+			s.Duration = duration
+			s.Expiry = expiry
+			r.n.Shared[token] = s
+		} else {
+			r.n.Duration = duration
+			r.n.Expiry = expiry
+		}
+		for _, n := range nodes[1:] {
+			n.setDescendant(token, r.shared(), expiry)
+		}
+		tok.TTL = ttl(expiry)
+		details = r.details()
+		return l.write(ctx, nodes, &tok, nil)
+	})
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+	return details, nil
+}
+
+func (l LockSystem) Unlock(now time.Time, token string) error {
+	ctx := context.Background()
+	t := now.UnixNano()
+
+	return retry(ctx, l.MaxRetries, func(int) error {
+		tok, nodes, err := l.getLock(ctx, t, token)
+		if err != nil {
+			return err
+		}
+		target := nodes[0]
+		if target.Token == token {
+			target.Token, target.ZeroDepth, target.OwnerXML, target.Duration, target.Expiry = "", false, "", 0, 0
+		}
+		delete(target.Shared, token)
+		for _, n := range nodes[1:] {
+			delete(n.Descendants, token)
+			delete(n.SharedDescendants, token)
+		}
+		return l.write(ctx, nodes, nil, &tok)
+	})
+}
+
+// getLock returns the token item of the given lock and the nodes from its
+// root up to "/", with expired locks pruned. It fails with ErrNoSuchLock if
+// the lock does not exist or has expired, and with ErrLocked if it is held.
+func (l LockSystem) getLock(ctx context.Context, now int64, token string) (lockToken, []*lockNode, error) {
+	tok, err := l.getToken(ctx, token)
+	if err != nil {
+		return lockToken{}, nil, err
+	}
+	nodes, err := l.getNodes(ctx, lockPaths(tok.Root))
+	if err != nil {
+		return lockToken{}, nil, err
+	}
+	for _, n := range nodes {
+		n.prune(now)
+	}
+	r, ok := nodes[0].lock(token)
+	if !ok {
+		return lockToken{}, nil, webdav.ErrNoSuchLock
+	}
+	if r.held(now) {
+		return lockToken{}, nil, webdav.ErrLocked
+	}
+	return tok, nodes, nil
+}
+
+// write stores the nodes, deleting those that no longer record any lock, and
+// puts or deletes a token item, in a single transaction. Each node is written
+// only if it has not changed since it was read.
+func (l LockSystem) write(ctx context.Context, nodes []*lockNode, put, del *lockToken) error {
+	var items []types.TransactWriteItem
+	for _, n := range nodes {
+		var condition expression.ConditionBuilder
+		if n.Version == 0 {
+			condition = expression.AttributeNotExists(expression.Name("id"))
+		} else {
+			condition = expression.Name("version").Equal(expression.Value(n.Version))
+		}
+		expr, err := expression.NewBuilder().WithCondition(condition).Build()
+		if err != nil {
+			return fmt.Errorf("failed to build expression, %w", err)
+		}
+
+		if n.empty() {
+			if n.Version == 0 {
+				continue
+			}
+			items = append(items, types.TransactWriteItem{
+				Delete: &types.Delete{
+					Key:                       lockKey(n.ID),
+					TableName:                 aws.String(l.TableName),
+					ConditionExpression:       expr.Condition(),
+					ExpressionAttributeNames:  expr.Names(),
+					ExpressionAttributeValues: expr.Values(),
+				},
+			})
+			continue
+		}
+
+		deadlines := []int64{n.HeldUntil}
+		if n.Token != "" {
+			deadlines = append(deadlines, n.Expiry)
+		}
+		for _, s := range n.Shared {
+			deadlines = append(deadlines, s.Expiry, s.HeldUntil)
+		}
+		for _, expiry := range n.Descendants {
+			deadlines = append(deadlines, expiry)
+		}
+		for _, expiry := range n.SharedDescendants {
+			deadlines = append(deadlines, expiry)
+		}
+		node := *n
+		node.TTL = ttl(deadlines...)
+		node.Version++
+		item, err := attributevalue.MarshalMap(node)
+		if err != nil {
+			return fmt.Errorf("failed to marshal map: %w", err)
+		}
+		items = append(items, types.TransactWriteItem{
+			Put: &types.Put{
+				Item:                      item,
+				TableName:                 aws.String(l.TableName),
+				ConditionExpression:       expr.Condition(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+			},
+		})
+	}
+	if put != nil {
+		item, err := attributevalue.MarshalMap(put)
+		if err != nil {
+			return fmt.Errorf("failed to marshal map: %w", err)
+		}
+		items = append(items, types.TransactWriteItem{
+			Put: &types.Put{
+				Item:      item,
+				TableName: aws.String(l.TableName),
+			},
+		})
+	}
+	if del != nil {
+		items = append(items, types.TransactWriteItem{
+			Delete: &types.Delete{
+				Key:       lockKey(del.ID),
+				TableName: aws.String(l.TableName),
+			},
+		})
+	}
+	_, err := l.DynamoDBClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write locks: %w", err)
+	}
+	return nil
+}
+
+func (l LockSystem) getToken(ctx context.Context, token string) (lockToken, error) {
+	out, err := l.DynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+		Key:            lockKey(token),
+		TableName:      aws.String(l.TableName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return lockToken{}, fmt.Errorf("failed to get item: %w", err)
+	}
+	if out.Item == nil {
+		return lockToken{}, webdav.ErrNoSuchLock
+	}
+	var tok lockToken
+	if err := attributevalue.UnmarshalMap(out.Item, &tok); err != nil {
+		return lockToken{}, fmt.Errorf("failed to unmarshal map: %w", err)
+	}
+	return tok, nil
+}
+
+func (l LockSystem) getNode(ctx context.Context, name string) (*lockNode, error) {
+	nodes, err := l.getNodes(ctx, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	return nodes[0], nil
+}
+
+// getNodes returns the nodes of the given paths, in the same order. A path
+// without an item gets an empty node.
+func (l LockSystem) getNodes(ctx context.Context, names []string) ([]*lockNode, error) {
+	items, err := batchGet(ctx, l.DynamoDBClient, l.TableName, names)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*lockNode, len(items))
+	for _, item := range items {
+		n := &lockNode{}
+		if err := attributevalue.UnmarshalMap(item, n); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal map: %w", err)
+		}
+		byID[n.ID] = n
+	}
+	nodes := make([]*lockNode, len(names))
+	for i, name := range names {
+		if nodes[i] = byID[name]; nodes[i] == nil {
+			nodes[i] = &lockNode{ID: name}
+		}
+	}
+	return nodes, nil
+}
+
+func lockKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: id},
+	}
+}
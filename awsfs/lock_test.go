@@ -0,0 +1,680 @@
+package awsfs
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+// The tests in this file follow those of the in-memory LockSystem in the
+// webdav package.
+
+const infiniteTimeout = -1
+
+var lockTestDurations = []time.Duration{
+	infiniteTimeout, // infiniteTimeout means to never expire.
+	0,               // A zero duration means to expire immediately.
+	100 * time.Hour, // A very large duration will not expire in these tests.
+}
+
+// lockTestNames are the names of a set of mutually compatible locks. For each
+// name fragment:
+//   - _ means no explicit lock.
+//   - i means an infinite-depth lock,
+//   - z means a zero-depth lock,
+var lockTestNames = []string{
+	"/_/_/_/_/z",
+	"/_/_/i",
+	"/_/z",
+	"/_/z/i",
+	"/_/z/z",
+	"/_/z/_/i",
+	"/_/z/_/z",
+	"/i",
+	"/z",
+	"/z/_/i",
+	"/z/_/z",
+}
+
+func lockTestZeroDepth(name string) bool {
+	switch name[len(name)-1] {
+	case 'i':
+		return false
+	case 'z':
+		return true
+	}
+	panic(fmt.Sprintf("lock name %q did not end with 'i' or 'z'", name))
+}
+
+func newTestLockSystem(db *fakeDynamoDB) LockSystem {
+	return LockSystem{
+		TableName:      "lock",
+		DynamoDBClient: db,
+	}
+}
+
+// lockNodes returns the nodes stored in the lock table.
+func lockNodes(t *testing.T, db *fakeDynamoDB) map[string]*lockNode {
+	t.Helper()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	nodes := make(map[string]*lockNode)
+	for id, item := range db.table("lock") {
+		if !strings.HasPrefix(id, "/") {
+			continue
+		}
+		n := &lockNode{}
+		if err := attributevalue.UnmarshalMap(item, n); err != nil {
+			t.Fatalf("UnmarshalMap: %v", err)
+		}
+		nodes[id] = n
+	}
+	return nodes
+}
+
+// lockConsistent checks that, at now, every node records exactly the live
+// locks below it and that every live lock has a token item.
+func lockConsistent(t *testing.T, db *fakeDynamoDB, now time.Time) error {
+	t.Helper()
+	nodes := lockNodes(t, db)
+	for _, n := range nodes {
+		n.prune(now.UnixNano())
+	}
+	for name, n := range nodes {
+		want, wantShared := map[string]int64{}, map[string]int64{}
+		for name0, n0 := range nodes {
+			if name0 == name || (name != "/" && !strings.HasPrefix(name0, name+"/")) {
+				continue
+			}
+			if n0.Token != "" {
+				want[n0.Token] = n0.Expiry
+			}
+			for token, s := range n0.Shared {
+				wantShared[token] = s.Expiry
+			}
+		}
+		got, gotShared := n.Descendants, n.SharedDescendants
+		if got == nil {
+			got = map[string]int64{}
+		}
+		if gotShared == nil {
+			gotShared = map[string]int64{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("node %q records descendants %v, want %v", name, got, want)
+		}
+		if !reflect.DeepEqual(gotShared, wantShared) {
+			return fmt.Errorf("node %q records shared descendants %v, want %v", name, gotShared, wantShared)
+		}
+		if n.Token != "" && len(n.Shared) > 0 {
+			return fmt.Errorf("node %q has both an exclusive and shared locks", name)
+		}
+		tokens := make([]string, 0, len(n.Shared)+1)
+		if n.Token != "" {
+			tokens = append(tokens, n.Token)
+		}
+		for token := range n.Shared {
+			tokens = append(tokens, token)
+		}
+		for _, token := range tokens {
+			db.mu.Lock()
+			_, ok := db.table("lock")[token]
+			db.mu.Unlock()
+			if !ok {
+				return fmt.Errorf("node %q is locked with %q, which has no token item", name, token)
+			}
+		}
+	}
+	return nil
+}
+
+func TestLockSystemCanCreate(t *testing.T) {
+	now := time.Unix(0, 0)
+	db := newFakeDynamoDB()
+	m := newTestLockSystem(db)
+
+	for _, name := range lockTestNames {
+		_, err := m.Create(now, webdav.LockDetails{
+			Root:      name,
+			Duration:  infiniteTimeout,
+			ZeroDepth: lockTestZeroDepth(name),
+		})
+		if err != nil {
+			t.Fatalf("creating lock for %q: %v", name, err)
+		}
+	}
+
+	wantCanCreate := func(name string, zeroDepth bool) bool {
+		for _, n := range lockTestNames {
+			switch {
+			case n == name:
+				// An existing lock has the same name as the proposed lock.
+				return false
+			case strings.HasPrefix(n, name):
+				// An existing lock would be a child of the proposed lock,
+				// which conflicts if the proposed lock has infinite depth.
+				if !zeroDepth {
+					return false
+				}
+			case strings.HasPrefix(name, n):
+				// An existing lock would be an ancestor of the proposed lock,
+				// which conflicts if the ancestor has infinite depth.
+				if n[len(n)-1] == 'i' {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	var check func(int, string)
+	check = func(recursion int, name string) {
+		for _, zeroDepth := range []bool{false, true} {
+			token, err := m.Create(now, webdav.LockDetails{
+				Root:      name,
+				Duration:  infiniteTimeout,
+				ZeroDepth: zeroDepth,
+			})
+			got := err == nil
+			if err != nil && err != webdav.ErrLocked {
+				t.Fatalf("Create name=%q zeroDepth=%t: %v", name, zeroDepth, err)
+			}
+			if want := wantCanCreate(name, zeroDepth); got != want {
+				t.Errorf("Create name=%q zeroDepth=%t: got %t, want %t", name, zeroDepth, got, want)
+			}
+			if got {
+				if err := m.Unlock(now, token); err != nil {
+					t.Fatalf("Unlock name=%q: %v", name, err)
+				}
+			}
+		}
+		if recursion == 4 {
+			return
+		}
+		if name != "/" {
+			name += "/"
+		}
+		for _, c := range "_iz" {
+			check(recursion+1, name+string(c))
+		}
+	}
+	check(0, "/")
+	if err := lockConsistent(t, db, now); err != nil {
+		t.Fatalf("inconsistent state: %v", err)
+	}
+}
+
+func TestLockSystemConfirm(t *testing.T) {
+	now := time.Unix(0, 0)
+	db := newFakeDynamoDB()
+	m := newTestLockSystem(db)
+	alice, err := m.Create(now, webdav.LockDetails{
+		Root:      "/alice",
+		Duration:  infiniteTimeout,
+		ZeroDepth: false,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	tweedle, err := m.Create(now, webdav.LockDetails{
+		Root:      "/tweedle",
+		Duration:  infiniteTimeout,
+		ZeroDepth: false,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// Test a mismatch between name and condition.
+	_, err = m.Confirm(now, "/tweedle/dee", "", webdav.Condition{Token: alice})
+	if err != webdav.ErrConfirmationFailed {
+		t.Fatalf("Confirm (mismatch): got %v, want ErrConfirmationFailed", err)
+	}
+
+	// Test two names (that fall under the same lock) in the one Confirm call.
+	release, err := m.Confirm(now, "/tweedle/dee", "/tweedle/dum", webdav.Condition{Token: tweedle})
+	if err != nil {
+		t.Fatalf("Confirm (twins): %v", err)
+	}
+	release()
+
+	// Test the same two names in overlapping Confirm / release calls.
+	releaseDee, err := m.Confirm(now, "/tweedle/dee", "", webdav.Condition{Token: tweedle})
+	if err != nil {
+		t.Fatalf("Confirm (sequence #0): %v", err)
+	}
+
+	_, err = m.Confirm(now, "/tweedle/dum", "", webdav.Condition{Token: tweedle})
+	if err != webdav.ErrConfirmationFailed {
+		t.Fatalf("Confirm (sequence #1): got %v, want ErrConfirmationFailed", err)
+	}
+
+	releaseDee()
+
+	releaseDum, err := m.Confirm(now, "/tweedle/dum", "", webdav.Condition{Token: tweedle})
+	if err != nil {
+		t.Fatalf("Confirm (sequence #3): %v", err)
+	}
+
+	// Test that you can't unlock a held lock.
+	err = m.Unlock(now, tweedle)
+	if err != webdav.ErrLocked {
+		t.Fatalf("Unlock (sequence #4): got %v, want ErrLocked", err)
+	}
+
+	releaseDum()
+
+	err = m.Unlock(now, tweedle)
+	if err != nil {
+		t.Fatalf("Unlock (sequence #6): %v", err)
+	}
+	if err := lockConsistent(t, db, now); err != nil {
+		t.Fatalf("Unlock (sequence #6): inconsistent state: %v", err)
+	}
+}
+
+func TestLockSystemNonCanonicalRoot(t *testing.T) {
+	now := time.Unix(0, 0)
+	db := newFakeDynamoDB()
+	m := newTestLockSystem(db)
+	token, err := m.Create(now, webdav.LockDetails{
+		Root:     "/foo/./bar//",
+		Duration: 1 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, ok := lockNodes(t, db)["/foo/bar"]; !ok {
+		t.Fatalf("Create: no node for /foo/bar")
+	}
+	if err := m.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if nodes := lockNodes(t, db); len(nodes) != 0 {
+		t.Fatalf("Unlock: got nodes %v, want none", nodes)
+	}
+}
+
+func TestLockSystemExpiry(t *testing.T) {
+	db := newFakeDynamoDB()
+	m := newTestLockSystem(db)
+	testCases := []string{
+		"setNow 0",
+		"create /a.5",
+		"want /a.5",
+		"create /c.6",
+		"want /a.5 /c.6",
+		"create /a/b.7",
+		"want /a.5 /a/b.7 /c.6",
+		"setNow 4",
+		"want /a.5 /a/b.7 /c.6",
+		"setNow 5",
+		"want /a/b.7 /c.6",
+		"setNow 6",
+		"want /a/b.7",
+		"setNow 7",
+		"want ",
+		"setNow 8",
+		"want ",
+		"create /a.12",
+		"create /b.13",
+		"create /c.15",
+		"create /a/d.16",
+		"want /a.12 /a/d.16 /b.13 /c.15",
+		"refresh /a.14",
+		"want /a.14 /a/d.16 /b.13 /c.15",
+		"setNow 12",
+		"want /a.14 /a/d.16 /b.13 /c.15",
+		"setNow 13",
+		"want /a.14 /a/d.16 /c.15",
+		"setNow 14",
+		"want /a/d.16 /c.15",
+		"refresh /a/d.20",
+		"refresh /c.20",
+		"want /a/d.20 /c.20",
+		"setNow 20",
+		"want ",
+	}
+
+	tokens := map[string]string{}
+	zTime := time.Unix(0, 0)
+	now := zTime
+	for i, tc := range testCases {
+		j := strings.IndexByte(tc, ' ')
+		if j < 0 {
+			t.Fatalf("test case #%d %q: invalid command", i, tc)
+		}
+		op, arg := tc[:j], tc[j+1:]
+		switch op {
+		default:
+			t.Fatalf("test case #%d %q: invalid operation %q", i, tc, op)
+
+		case "create", "refresh":
+			parts := strings.Split(arg, ".")
+			if len(parts) != 2 {
+				t.Fatalf("test case #%d %q: invalid create", i, tc)
+			}
+			root := parts[0]
+			d, err := strconv.Atoi(parts[1])
+			if err != nil {
+				t.Fatalf("test case #%d %q: invalid duration", i, tc)
+			}
+			dur := time.Unix(0, 0).Add(time.Duration(d) * time.Second).Sub(now)
+
+			switch op {
+			case "create":
+				token, err := m.Create(now, webdav.LockDetails{
+					Root:      root,
+					Duration:  dur,
+					ZeroDepth: true,
+				})
+				if err != nil {
+					t.Fatalf("test case #%d %q: Create: %v", i, tc, err)
+				}
+				tokens[root] = token
+
+			case "refresh":
+				token := tokens[root]
+				if token == "" {
+					t.Fatalf("test case #%d %q: no token for %q", i, tc, root)
+				}
+				got, err := m.Refresh(now, token, dur)
+				if err != nil {
+					t.Fatalf("test case #%d %q: Refresh: %v", i, tc, err)
+				}
+				want := webdav.LockDetails{
+					Root:      root,
+					Duration:  dur,
+					ZeroDepth: true,
+				}
+				if got != want {
+					t.Fatalf("test case #%d %q:\ngot  %v\nwant %v", i, tc, got, want)
+				}
+			}
+
+		case "setNow":
+			d, err := strconv.Atoi(arg)
+			if err != nil {
+				t.Fatalf("test case #%d %q: invalid duration", i, tc)
+			}
+			now = time.Unix(0, 0).Add(time.Duration(d) * time.Second)
+
+		case "want":
+			got := []string{}
+			for _, n := range lockNodes(t, db) {
+				n.prune(now.UnixNano())
+				if n.Token != "" {
+					got = append(got, fmt.Sprintf("%s.%d", n.ID, time.Unix(0, n.Expiry).Sub(zTime)/time.Second))
+				}
+			}
+			sort.Strings(got)
+			want := []string{}
+			if arg != "" {
+				want = strings.Split(arg, " ")
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("test case #%d %q:\ngot  %q\nwant %q", i, tc, got, want)
+			}
+		}
+
+		if err := lockConsistent(t, db, now); err != nil {
+			t.Fatalf("test case #%d %q: inconsistent state: %v", i, tc, err)
+		}
+	}
+}
+
+func TestLockSystemShared(t *testing.T) {
+	now := time.Unix(0, 0)
+	db := newFakeDynamoDB()
+	m := newTestLockSystem(db)
+	create := func(root string, zeroDepth, shared bool) (string, error) {
+		t.Helper()
+		token, err := m.Create(now, webdav.LockDetails{
+			Root:      root,
+			Duration:  infiniteTimeout,
+			ZeroDepth: zeroDepth,
+			Shared:    shared,
+		})
+		if err := lockConsistent(t, db, now); err != nil {
+			t.Fatalf("Create %s: inconsistent state: %v", root, err)
+		}
+		return token, err
+	}
+
+	alice, err := create("/a", false, true)
+	if err != nil {
+		t.Fatalf("Create shared /a: %v", err)
+	}
+	bob, err := create("/a", true, true)
+	if err != nil {
+		t.Fatalf("Create second shared /a: %v", err)
+	}
+	testCases := []struct {
+		root      string
+		zeroDepth bool
+		shared    bool
+		want      error
+	}{
+		{"/a", true, false, webdav.ErrLocked},
+		{"/", false, false, webdav.ErrLocked},
+		{"/a/b", true, false, webdav.ErrLocked},
+		{"/a/b", true, true, nil},
+		{"/c", false, false, nil},
+		{"/c/d", true, true, webdav.ErrLocked},
+		{"/", false, true, webdav.ErrLocked},
+		{"/a/b/e", false, true, nil},
+	}
+	for _, tc := range testCases {
+		if _, err := create(tc.root, tc.zeroDepth, tc.shared); err != tc.want {
+			t.Errorf("Create %s zeroDepth=%t shared=%t: got %v, want %v", tc.root, tc.zeroDepth, tc.shared, err, tc.want)
+		}
+	}
+
+	// Every holder of a shared lock can confirm it, even while another holder
+	// has confirmed theirs.
+	releaseAlice, err := m.Confirm(now, "/a", "", webdav.Condition{Token: alice})
+	if err != nil {
+		t.Fatalf("Confirm alice: %v", err)
+	}
+	if _, err := m.Confirm(now, "/a/x", "", webdav.Condition{Token: alice}); err != webdav.ErrConfirmationFailed {
+		t.Fatalf("Confirm of a held shared lock: got %v, want %v", err, webdav.ErrConfirmationFailed)
+	}
+	releaseBob, err := m.Confirm(now, "/a", "", webdav.Condition{Token: bob})
+	if err != nil {
+		t.Fatalf("Confirm bob: %v", err)
+	}
+	releaseAlice()
+	releaseBob()
+	if _, err := m.Confirm(now, "/a/b", "", webdav.Condition{Token: bob}); err != webdav.ErrConfirmationFailed {
+		t.Fatalf("Confirm of a zero-depth shared lock below its root: got %v, want %v", err, webdav.ErrConfirmationFailed)
+	}
+
+	locks, err := m.Locks(now, "/a")
+	if err != nil {
+		t.Fatalf("Locks /a: %v", err)
+	}
+	if len(locks) != 2 || !locks[0].Shared || !locks[1].Shared {
+		t.Fatalf("Locks /a: got %v, want 2 shared locks", locks)
+	}
+	if _, err := m.Refresh(now, bob, time.Second); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if err := m.Unlock(now, alice); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := lockConsistent(t, db, now); err != nil {
+		t.Fatalf("Unlock: inconsistent state: %v", err)
+	}
+	if _, err := create("/a", true, false); err != webdav.ErrLocked {
+		t.Fatalf("Create exclusive /a with a shared lock left: got %v, want %v", err, webdav.ErrLocked)
+	}
+	now = now.Add(time.Second)
+	if _, err := create("/a", true, false); err != nil {
+		t.Fatalf("Create exclusive /a after the shared lock expired: %v", err)
+	}
+}
+
+func TestLockSystemLocks(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := newTestLockSystem(newFakeDynamoDB())
+	create := func(root string, zeroDepth bool, duration time.Duration) string {
+		t.Helper()
+		token, err := m.Create(now, webdav.LockDetails{
+			Root:      root,
+			Duration:  duration,
+			OwnerXML:  "<D:href>" + root + "</D:href>",
+			ZeroDepth: zeroDepth,
+		})
+		if err != nil {
+			t.Fatalf("Create %s: %v", root, err)
+		}
+		return token
+	}
+	tokens := map[string]string{
+		"/a":   create("/a", false, 10*time.Second),
+		"/b":   create("/b", true, infiniteTimeout),
+		"/c":   create("/c", true, infiniteTimeout),
+		"/c/d": create("/c/d", true, 20*time.Second),
+	}
+	now = now.Add(4 * time.Second)
+
+	testCases := []struct {
+		name string
+		want []string
+	}{
+		{"/", nil},
+		{"/a", []string{"/a"}},
+		{"/a/b/c", []string{"/a"}},
+		{"/b", []string{"/b"}},
+		{"/b/c", nil},
+		{"/c", []string{"/c"}},
+		{"/c/d", []string{"/c/d"}},
+	}
+	for _, tc := range testCases {
+		locks, err := m.Locks(now, tc.name)
+		if err != nil {
+			t.Fatalf("Locks %s: %v", tc.name, err)
+		}
+		var got []string
+		for _, l := range locks {
+			got = append(got, l.Root)
+			if l.Token != tokens[l.Root] {
+				t.Errorf("Locks %s: lock on %s: got token %q, want %q", tc.name, l.Root, l.Token, tokens[l.Root])
+			}
+			if want := "<D:href>" + l.Root + "</D:href>"; l.OwnerXML != want {
+				t.Errorf("Locks %s: lock on %s: got owner %q, want %q", tc.name, l.Root, l.OwnerXML, want)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Locks %s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	for name, want := range map[string]time.Duration{"/a": 6 * time.Second, "/b": infiniteTimeout, "/c/d": 16 * time.Second} {
+		if locks, _ := m.Locks(now, name); len(locks) != 1 || locks[0].Duration != want {
+			t.Errorf("Locks %s: got %v, want one lock with %v left", name, locks, want)
+		}
+	}
+	now = now.Add(6 * time.Second)
+	if locks, _ := m.Locks(now, "/a/b/c"); len(locks) != 0 {
+		t.Errorf("Locks after /a expired: got %v, want none", locks)
+	}
+}
+
+func TestLockSystem(t *testing.T) {
+	now := time.Unix(0, 0)
+	db := newFakeDynamoDB()
+	// Two instances sharing the same table.
+	systems := []LockSystem{newTestLockSystem(db), newTestLockSystem(db)}
+	rng := rand.New(rand.NewSource(0))
+	tokens := map[string]string{}
+	nConfirm, nCreate, nRefresh, nUnlock := 0, 0, 0, 0
+	const N = 500
+
+	for i := 0; i < N; i++ {
+		m := systems[i%len(systems)]
+		name := lockTestNames[rng.Intn(len(lockTestNames))]
+		duration := lockTestDurations[rng.Intn(len(lockTestDurations))]
+		confirmed, unlocked := false, false
+
+		// If the name was already locked, we randomly confirm/release, refresh
+		// or unlock it. Otherwise, we create a lock.
+		token := tokens[name]
+		if token != "" {
+			switch rng.Intn(3) {
+			case 0:
+				confirmed = true
+				nConfirm++
+				release, err := m.Confirm(now, name, "", webdav.Condition{Token: token})
+				if err != nil {
+					t.Fatalf("iteration #%d: Confirm %q: %v", i, name, err)
+				}
+				if err := lockConsistent(t, db, now); err != nil {
+					t.Fatalf("iteration #%d: inconsistent state: %v", i, err)
+				}
+				release()
+
+			case 1:
+				nRefresh++
+				if _, err := m.Refresh(now, token, duration); err != nil {
+					t.Fatalf("iteration #%d: Refresh %q: %v", i, name, err)
+				}
+
+			case 2:
+				unlocked = true
+				nUnlock++
+				if err := m.Unlock(now, token); err != nil {
+					t.Fatalf("iteration #%d: Unlock %q: %v", i, name, err)
+				}
+			}
+
+		} else {
+			nCreate++
+			var err error
+			token, err = m.Create(now, webdav.LockDetails{
+				Root:      name,
+				Duration:  duration,
+				ZeroDepth: lockTestZeroDepth(name),
+			})
+			if err != nil {
+				t.Fatalf("iteration #%d: Create %q: %v", i, name, err)
+			}
+		}
+
+		if !confirmed {
+			if duration == 0 || unlocked {
+				// A zero-duration lock should expire immediately and is
+				// effectively equivalent to being unlocked.
+				tokens[name] = ""
+			} else {
+				tokens[name] = token
+			}
+		}
+
+		if err := lockConsistent(t, db, now); err != nil {
+			t.Fatalf("iteration #%d: inconsistent state: %v", i, err)
+		}
+	}
+
+	if nConfirm < N/10 {
+		t.Fatalf("too few Confirm calls: got %d, want >= %d", nConfirm, N/10)
+	}
+	if nCreate < N/10 {
+		t.Fatalf("too few Create calls: got %d, want >= %d", nCreate, N/10)
+	}
+	if nRefresh < N/10 {
+		t.Fatalf("too few Refresh calls: got %d, want >= %d", nRefresh, N/10)
+	}
+	if nUnlock < N/10 {
+		t.Fatalf("too few Unlock calls: got %d, want >= %d", nUnlock, N/10)
+	}
+}
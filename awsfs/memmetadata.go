@@ -0,0 +1,488 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+// errVersionMismatch is the cause of the *ConflictError returned by the
+// in-memory MetadataStore when an entry was written since it was read.
+var errVersionMismatch = errors.New("version mismatch")
+
+// NewMemMetadataStore returns a new MetadataStore that keeps entries and
+// References in memory. It is meant for tests and for trying the server out.
+func NewMemMetadataStore() MetadataStore {
+	return &memMetadataStore{
+		entries:   map[string]Entry{},
+		refs:      map[string]Reference{},
+		blobs:     map[string]Blob{},
+		blobRefs:  map[string][]string{},
+		snapshots: map[string]Snapshot{},
+		pins:      map[string][]string{},
+	}
+}
+
+// memMetadataStore is a MetadataStore whose writes are serialized by a
+// mutex. Entries and References are copied on the way in and out, so that
+// callers never share maps with the store.
+type memMetadataStore struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+	refs    map[string]Reference
+	blobs   map[string]Blob
+	// blobRefs are the IDs of the entries referring to a Blob by its hash.
+	blobRefs map[string][]string
+	// snapshots are the snapshots by name, and pins the names of the
+	// snapshots pinning an object by its key.
+	snapshots map[string]Snapshot
+	pins      map[string][]string
+	usage     Usage
+}
+
+func cloneEntry(e Entry) Entry {
+	e.DeadProps = maps.Clone(e.DeadProps)
+	if e.DeadProps == nil {
+		e.DeadProps = make(map[string]string)
+	}
+	return e
+}
+
+func cloneReference(ref Reference) Reference {
+	ref.Entries = maps.Clone(ref.Entries)
+	if ref.Entries == nil {
+		ref.Entries = make(map[string]string)
+	}
+	return ref
+}
+
+func (m *memMetadataStore) Init(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.refs[referenceID]; ok {
+		return nil
+	}
+	entryID := uuid.New().String()
+	m.entries[entryID] = Entry{
+		ID:        entryID,
+		ParentID:  referenceID,
+		Name:      "/",
+		Type:      EntryTypeDir,
+		Modify:    time.Now(),
+		DeadProps: map[string]string{},
+		Version:   1,
+	}
+	m.refs[referenceID] = Reference{
+		ID:      referenceID,
+		Entries: map[string]string{"/": entryID},
+		Version: 1,
+	}
+	m.refs[entryID] = Reference{
+		ID:      entryID,
+		Entries: map[string]string{},
+		Version: 1,
+	}
+	return nil
+}
+
+func (m *memMetadataStore) GetReference(ctx context.Context, id string) (Reference, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ref, ok := m.refs[id]
+	if !ok {
+		return Reference{}, ErrNoSuchReference
+	}
+	return cloneReference(ref), nil
+}
+
+func (m *memMetadataStore) GetEntry(ctx context.Context, id string) (Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[id]
+	if !ok {
+		return Entry{}, ErrNoSuchEntry
+	}
+	return cloneEntry(entry), nil
+}
+
+func (m *memMetadataStore) GetEntries(ctx context.Context, ids []string) ([]Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []Entry
+	for _, id := range ids {
+		if entry, ok := m.entries[id]; ok {
+			entries = append(entries, cloneEntry(entry))
+		}
+	}
+	return entries, nil
+}
+
+// GetEntriesByParentID returns the entries whose parent is id, sorted by
+// name.
+func (m *memMetadataStore) GetEntriesByParentID(ctx context.Context, id string) ([]Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []Entry
+	for _, entry := range m.entries {
+		if entry.ParentID == id {
+			entries = append(entries, cloneEntry(entry))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// ListEntriesByParentID returns an iterator over the entries whose parent is
+// id. The entries are read when Next is first called.
+func (m *memMetadataStore) ListEntriesByParentID(id string) EntryIterator {
+	return &memEntryIterator{m: m, parentID: id}
+}
+
+type memEntryIterator struct {
+	m        *memMetadataStore
+	parentID string
+	entries  []Entry
+	started  bool
+	entry    Entry
+	err      error
+}
+
+func (it *memEntryIterator) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		it.entries, it.err = it.m.GetEntriesByParentID(ctx, it.parentID)
+		if it.err != nil {
+			return false
+		}
+	}
+	if len(it.entries) == 0 {
+		return false
+	}
+	it.entry, it.entries = it.entries[0], it.entries[1:]
+	return true
+}
+
+func (it *memEntryIterator) Entry() Entry {
+	return it.entry
+}
+
+func (it *memEntryIterator) Err() error {
+	return it.err
+}
+
+func (m *memMetadataStore) AddEntry(ctx context.Context, entry Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ref, ok := m.refs[entry.ParentID]
+	if !ok {
+		return ErrNoSuchReference
+	}
+	if _, ok := ref.Entries[entry.Name]; ok {
+		return ErrEntryExists
+	}
+	ref = cloneReference(ref)
+	ref.Entries[entry.Name] = entry.ID
+	ref.Version++
+	m.refs[ref.ID] = ref
+	m.entries[entry.ID] = cloneEntry(entry)
+	if entry.IsDir() {
+		m.refs[entry.ID] = Reference{
+			ID:      entry.ID,
+			Entries: map[string]string{},
+			Version: 1,
+		}
+	}
+	return nil
+}
+
+func (m *memMetadataStore) UpdateEntry(ctx context.Context, entry Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.entries[entry.ID]
+	if !ok {
+		return ErrNoSuchEntry
+	}
+	if stored.Version != entry.Version {
+		return &ConflictError{Attempts: 1, Err: errVersionMismatch}
+	}
+	stored.Size = entry.Size
+	stored.Modify = entry.Modify
+	stored.DeadProps = maps.Clone(entry.DeadProps)
+	stored.Version++
+	m.entries[entry.ID] = stored
+	return nil
+}
+
+func (m *memMetadataStore) UpdateEntryObject(ctx context.Context, id, key string, size int64, sum Checksums, modify time.Time, keep int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[id]
+	if !ok {
+		return nil, ErrNoSuchEntry
+	}
+	if entry.IsDir() {
+		return nil, ErrIsDir
+	}
+	dropped := entry.replaceObject(key, size, sum, modify, keep)
+	entry.Version++
+	m.entries[id] = entry
+	return dropped, nil
+}
+
+// UpdateEntryName moves the entry with the ID of entry to the given name in
+// directory parentID and sets its trash info. Like DynamoDBMetadataStore, it
+// works from the stored entry, so that a stale entry is not an error.
+func (m *memMetadataStore) UpdateEntryName(ctx context.Context, entry Entry, parentID, name string, trash *TrashInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.entries[entry.ID]
+	if !ok {
+		return ErrNoSuchEntry
+	}
+	oldRef, ok := m.refs[stored.ParentID]
+	if !ok {
+		return ErrNoSuchReference
+	}
+	newRef, ok := m.refs[parentID]
+	if !ok {
+		return ErrNoSuchReference
+	}
+	if _, ok := newRef.Entries[name]; ok {
+		return ErrEntryExists
+	}
+	oldRef = cloneReference(oldRef)
+	delete(oldRef.Entries, stored.Name)
+	oldRef.Version++
+	m.refs[oldRef.ID] = oldRef
+	newRef = cloneReference(m.refs[parentID])
+	newRef.Entries[name] = stored.ID
+	if newRef.ID != oldRef.ID {
+		newRef.Version++
+	}
+	m.refs[newRef.ID] = newRef
+
+	stored.ParentID = parentID
+	stored.Name = name
+	stored.Trash = trash
+	stored.Version++
+	m.entries[stored.ID] = stored
+	return nil
+}
+
+func (m *memMetadataStore) DeleteEntries(ctx context.Context, entry Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.entries[entry.ID]
+	if !ok {
+		return ErrNoSuchEntry
+	}
+	parent, ok := m.refs[stored.ParentID]
+	if !ok {
+		return ErrNoSuchReference
+	}
+	parent = cloneReference(parent)
+	delete(parent.Entries, stored.Name)
+	parent.Version++
+	m.refs[parent.ID] = parent
+
+	stored.ParentID = deletedParentID
+	stored.Version++
+	m.entries[stored.ID] = stored
+	return nil
+}
+
+func (m *memMetadataStore) GetDeletedEntries(ctx context.Context) ([]Entry, error) {
+	return m.GetEntriesByParentID(ctx, deletedParentID)
+}
+
+// ReapEntries removes entry and everything below it. The store is not locked
+// while deleteFiles runs.
+func (m *memMetadataStore) ReapEntries(ctx context.Context, entry Entry, deleteFiles func(files []Entry) error) error {
+	m.mu.Lock()
+	var ids []string
+	var files []Entry
+	var walk func(id string)
+	walk = func(id string) {
+		ids = append(ids, id)
+		if ref, ok := m.refs[id]; ok {
+			for _, child := range ref.Entries {
+				walk(child)
+			}
+			return
+		}
+		if e, ok := m.entries[id]; ok && !e.IsDir() {
+			files = append(files, cloneEntry(e))
+		}
+	}
+	walk(entry.ID)
+	m.mu.Unlock()
+
+	if len(files) > 0 {
+		if err := deleteFiles(files); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		delete(m.entries, id)
+		delete(m.refs, id)
+	}
+	return nil
+}
+
+func (m *memMetadataStore) GetBlob(ctx context.Context, hash string) (Blob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	blob, ok := m.blobs[hash]
+	if !ok {
+		return Blob{}, ErrNoSuchBlob
+	}
+	blob.Refs = int64(len(m.blobRefs[hash]))
+	return blob, nil
+}
+
+func (m *memMetadataStore) AcquireBlob(ctx context.Context, hash, entryID, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	blob, ok := m.blobs[hash]
+	if !ok {
+		if key == "" {
+			return "", ErrNoSuchBlob
+		}
+		blob = Blob{Hash: hash, Object: key}
+	}
+	if !slices.Contains(m.blobRefs[hash], entryID) {
+		m.blobRefs[hash] = append(m.blobRefs[hash], entryID)
+	}
+	m.blobs[hash] = blob
+	return blob.Object, nil
+}
+
+func (m *memMetadataStore) ReleaseBlob(ctx context.Context, hash, entryID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	blob, ok := m.blobs[hash]
+	if !ok {
+		return "", nil
+	}
+	m.blobRefs[hash] = slices.DeleteFunc(m.blobRefs[hash], func(id string) bool {
+		return id == entryID
+	})
+	if len(m.blobRefs[hash]) > 0 {
+		return "", nil
+	}
+	delete(m.blobs, hash)
+	delete(m.blobRefs, hash)
+	return blob.Object, nil
+}
+
+func (m *memMetadataStore) AddSnapshot(ctx context.Context, snap Snapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.snapshots[snap.Name]; ok {
+		return ErrSnapshotExists
+	}
+	snap.Pending = true
+	m.snapshots[snap.Name] = snap
+	return nil
+}
+
+func (m *memMetadataStore) CompleteSnapshot(ctx context.Context, snap Snapshot, keys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.snapshots[snap.Name]; !ok {
+		return ErrNoSuchSnapshot
+	}
+	for _, key := range keys {
+		if !slices.Contains(m.pins[key], snap.Name) {
+			m.pins[key] = append(slices.Clone(m.pins[key]), snap.Name)
+		}
+	}
+	snap.Pending = false
+	m.snapshots[snap.Name] = snap
+	return nil
+}
+
+func (m *memMetadataStore) GetSnapshots(ctx context.Context) ([]Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshots := make([]Snapshot, 0, len(m.snapshots))
+	for _, snap := range m.snapshots {
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, nil
+}
+
+func (m *memMetadataStore) DeleteSnapshot(ctx context.Context, name string, keys []string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var unpinned []string
+	for _, key := range keys {
+		pins := slices.DeleteFunc(slices.Clone(m.pins[key]), func(n string) bool {
+			return n == name
+		})
+		if len(pins) > 0 {
+			m.pins[key] = pins
+			continue
+		}
+		delete(m.pins, key)
+		unpinned = append(unpinned, key)
+	}
+	delete(m.snapshots, name)
+	return unpinned, nil
+}
+
+func (m *memMetadataStore) GetPinnedObjects(ctx context.Context, keys []string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, snap := range m.snapshots {
+		if snap.Pending {
+			return slices.Clone(keys), nil
+		}
+	}
+	var pinned []string
+	for _, key := range keys {
+		if len(m.pins[key]) > 0 {
+			pinned = append(pinned, key)
+		}
+	}
+	return pinned, nil
+}
+
+func (m *memMetadataStore) GetUsage(ctx context.Context) (Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage, nil
+}
+
+func (m *memMetadataStore) AddUsage(ctx context.Context, delta, limit Usage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.usage.exceeds(delta, limit) {
+		return webdav.ErrQuotaExceeded
+	}
+	m.usage.Bytes += delta.Bytes
+	m.usage.Files += delta.Files
+	return nil
+}
+
+func (m *memMetadataStore) SetUsage(ctx context.Context, usage Usage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.usage = usage
+	return nil
+}
@@ -0,0 +1,346 @@
+package awsfs
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+// newMemServer returns a Server backed by the in-memory stores.
+func newMemServer(t *testing.T) *Server {
+	t.Helper()
+	s := &Server{
+		MetadataStore: NewMemMetadataStore(),
+		PhysicalStore: NewMemPhysicalStore(),
+	}
+	if err := s.MetadataStore.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	return s
+}
+
+// memTree creates the directories and files, in order, with their names as
+// the content of the files. Names ending in a slash are directories.
+func memTree(t *testing.T, s *Server, names ...string) {
+	t.Helper()
+	ctx := context.Background()
+	for _, name := range names {
+		if dir, ok := strings.CutSuffix(name, "/"); ok {
+			if err := s.Mkdir(ctx, dir, 0777); err != nil {
+				t.Fatalf("Mkdir %q: %v", dir, err)
+			}
+			continue
+		}
+		if _, err := s.Create(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader(name)); err != nil {
+			t.Fatalf("Create %q: %v", name, err)
+		}
+	}
+}
+
+func memReadFile(t *testing.T, s *Server, name string) string {
+	t.Helper()
+	f, err := s.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile %q: %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll %q: %v", name, err)
+	}
+	return string(data)
+}
+
+func memObjectKeys(t *testing.T, s *Server) []string {
+	t.Helper()
+	var keys []string
+	err := s.PhysicalStore.ListObjects(context.Background(), func(obj Object) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListObjects: %v", err)
+	}
+	return keys
+}
+
+func TestMemMkdir(t *testing.T) {
+	ctx := context.Background()
+	s := newMemServer(t)
+	memTree(t, s, "/a/", "/a/b/", "/f")
+
+	testCases := []struct {
+		name string
+		want error
+	}{
+		{"/", os.ErrExist},
+		{"/a", os.ErrExist},
+		{"/a/b/", os.ErrExist},
+		{"/x/y", os.ErrNotExist},
+		{"/f/y", os.ErrNotExist},
+		{"/a/b/c", nil},
+	}
+	for _, tc := range testCases {
+		if err := s.Mkdir(ctx, tc.name, 0777); !errors.Is(err, tc.want) {
+			t.Errorf("Mkdir %q: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	fi, err := s.Stat(ctx, "/a/b/c")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !fi.IsDir() || fi.Name() != "c" {
+		t.Fatalf("Stat: got %q (dir %t), want directory c", fi.Name(), fi.IsDir())
+	}
+}
+
+func TestMemCreate(t *testing.T) {
+	ctx := context.Background()
+	s := newMemServer(t)
+	memTree(t, s, "/d/")
+
+	fi, err := s.Create(ctx, "/d/f", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if fi.Size() != 5 || fi.IsDir() {
+		t.Fatalf("Create: got size %d (dir %t), want a file of 5 bytes", fi.Size(), fi.IsDir())
+	}
+	if _, err := s.Create(ctx, "/d/f", os.O_RDWR|os.O_TRUNC, 0666, strings.NewReader("hello, world")); err != nil {
+		t.Fatalf("Create overwrite: %v", err)
+	}
+	if got := memReadFile(t, s, "/d/f"); got != "hello, world" {
+		t.Fatalf("content: got %q, want %q", got, "hello, world")
+	}
+	if keys := memObjectKeys(t, s); len(keys) != 1 {
+		t.Fatalf("objects after overwrite: got %q, want one", keys)
+	}
+
+	if _, err := s.Create(ctx, "/d", os.O_RDWR|os.O_TRUNC, 0666, strings.NewReader("x")); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("Create over a directory: got %v, want %v", err, os.ErrInvalid)
+	}
+	if _, err := s.Create(ctx, "/x/f", os.O_RDWR|os.O_CREATE, 0666, strings.NewReader("x")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Create in a missing directory: got %v, want %v", err, os.ErrNotExist)
+	}
+	if keys := memObjectKeys(t, s); len(keys) != 1 {
+		t.Fatalf("objects after failed creates: got %q, want one", keys)
+	}
+}
+
+func TestMemOpenFile(t *testing.T) {
+	ctx := context.Background()
+	s := newMemServer(t)
+	memTree(t, s, "/d/", "/d/b", "/d/a", "/d/c/", "/d/c/z")
+
+	f, err := s.OpenFile(ctx, "/d/a", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.Seek(2, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(data) != "/a" {
+		t.Fatalf("read after seek: got %q, want %q", data, "/a")
+	}
+
+	d, err := s.OpenFile(ctx, "/d", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer d.Close()
+	if _, err := d.Read(make([]byte, 1)); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("Read of a directory: got %v, want %v", err, ErrNotSupported)
+	}
+	infos, err := d.Readdir(0)
+	if err != nil {
+		t.Fatalf("Readdir: %v", err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if got, want := strings.Join(names, " "), "a b c"; got != want {
+		t.Fatalf("Readdir: got %q, want %q", got, want)
+	}
+
+	if _, err := s.OpenFile(ctx, "/d/x", os.O_RDONLY, 0); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("OpenFile of a missing file: got %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestMemPatch(t *testing.T) {
+	ctx := context.Background()
+	s := newMemServer(t)
+	memTree(t, s, "/f")
+
+	prop := webdav.Property{XMLName: xml.Name{Space: "x:", Local: "color"}, InnerXML: []byte("blue")}
+	f, err := s.OpenFile(ctx, "/f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := f.(webdav.DeadPropsHolder).Patch([]webdav.Proppatch{{Props: []webdav.Property{prop}}}); err != nil {
+		t.Fatalf("Patch: %v", err)
+	}
+	f.Close()
+
+	f, err = s.OpenFile(ctx, "/f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	props, err := f.(webdav.DeadPropsHolder).DeadProps()
+	f.Close()
+	if err != nil {
+		t.Fatalf("DeadProps: %v", err)
+	}
+	if got := props[prop.XMLName]; string(got.InnerXML) != "blue" {
+		t.Fatalf("DeadProps: got %v, want %v", got, prop)
+	}
+}
+
+func TestMemStat(t *testing.T) {
+	ctx := context.Background()
+	s := newMemServer(t)
+	memTree(t, s, "/d/", "/d/f")
+
+	testCases := []struct {
+		name  string
+		base  string
+		size  int64
+		isDir bool
+		err   error
+	}{
+		{"/", "/", 0, true, nil},
+		{"/d", "d", 0, true, nil},
+		{"/d/f", "f", 4, false, nil},
+		{"/d/f/", "f", 4, false, nil},
+		{"/d/g", "", 0, false, os.ErrNotExist},
+		{"/d/f/g", "", 0, false, os.ErrNotExist},
+	}
+	for _, tc := range testCases {
+		fi, err := s.Stat(ctx, tc.name)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("Stat %q: got %v, want %v", tc.name, err, tc.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if fi.Name() != tc.base || fi.Size() != tc.size || fi.IsDir() != tc.isDir {
+			t.Errorf("Stat %q: got %q size %d dir %t, want %q size %d dir %t",
+				tc.name, fi.Name(), fi.Size(), fi.IsDir(), tc.base, tc.size, tc.isDir)
+		}
+	}
+}
+
+func TestMemRename(t *testing.T) {
+	ctx := context.Background()
+	s := newMemServer(t)
+	memTree(t, s, "/a/", "/a/b/", "/a/b/f", "/c/", "/g")
+
+	testCases := []struct {
+		oldPath, newPath string
+		want             error
+	}{
+		{"/", "/x", os.ErrInvalid},
+		{"/a", "/a/b/x", os.ErrInvalid},
+		{"/a", "/c", os.ErrExist},
+		{"/x", "/y", os.ErrNotExist},
+		{"/g", "/x/g", os.ErrNotExist},
+		{"/g", "/h", nil},
+		{"/a", "/c/a", nil},
+	}
+	for _, tc := range testCases {
+		if err := s.Rename(ctx, tc.oldPath, tc.newPath); !errors.Is(err, tc.want) {
+			t.Errorf("Rename %q to %q: got %v, want %v", tc.oldPath, tc.newPath, err, tc.want)
+		}
+	}
+	for _, name := range []string{"/g", "/a", "/a/b/f"} {
+		if _, err := s.Stat(ctx, name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Stat %q after Rename: got %v, want %v", name, err, os.ErrNotExist)
+		}
+	}
+	if got := memReadFile(t, s, "/h"); got != "/g" {
+		t.Errorf("renamed file: got %q, want %q", got, "/g")
+	}
+	if got := memReadFile(t, s, "/c/a/b/f"); got != "/a/b/f" {
+		t.Errorf("file in renamed directory: got %q, want %q", got, "/a/b/f")
+	}
+}
+
+func TestMemRemoveAll(t *testing.T) {
+	ctx := context.Background()
+	s := newMemServer(t)
+	memTree(t, s, "/a/", "/a/b/", "/a/b/f", "/a/g", "/h")
+
+	if err := s.RemoveAll(ctx, "/"); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("RemoveAll of the root: got %v, want %v", err, os.ErrInvalid)
+	}
+	if err := s.RemoveAll(ctx, "/x"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("RemoveAll of a missing file: got %v, want %v", err, os.ErrNotExist)
+	}
+	if err := s.RemoveAll(ctx, "/a"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if _, err := s.Stat(ctx, "/a/b/f"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Stat after RemoveAll: got %v, want %v", err, os.ErrNotExist)
+	}
+	s.Wait()
+
+	deleted, err := s.MetadataStore.GetDeletedEntries(ctx)
+	if err != nil {
+		t.Fatalf("GetDeletedEntries: %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Fatalf("deleted entries after reaping: got %v, want none", deleted)
+	}
+	if keys := memObjectKeys(t, s); len(keys) != 1 {
+		t.Fatalf("objects after RemoveAll: got %q, want only that of /h", keys)
+	}
+	if got := memReadFile(t, s, "/h"); got != "/h" {
+		t.Fatalf("untouched file: got %q, want %q", got, "/h")
+	}
+}
+
+func TestMemCopy(t *testing.T) {
+	ctx := context.Background()
+	s := newMemServer(t)
+	memTree(t, s, "/a/", "/a/b/", "/a/b/f", "/a/g")
+
+	if err := s.Copy(ctx, "/a", "/a/b/c", true); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("Copy into itself: got %v, want %v", err, os.ErrInvalid)
+	}
+	if err := s.Copy(ctx, "/a/g", "/a/b", false); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Copy onto an existing file: got %v, want %v", err, os.ErrExist)
+	}
+	if err := s.Copy(ctx, "/a", "/c", false); err != nil {
+		t.Fatalf("shallow Copy: %v", err)
+	}
+	if _, err := s.Stat(ctx, "/c/g"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Stat in a shallow copy: got %v, want %v", err, os.ErrNotExist)
+	}
+	if err := s.Copy(ctx, "/a", "/d", true); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if err := s.RemoveAll(ctx, "/a"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	s.Wait()
+	for name, want := range map[string]string{"/d/b/f": "/a/b/f", "/d/g": "/a/g"} {
+		if got := memReadFile(t, s, name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"sync"
+	"path"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -13,26 +13,72 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
+	"github.com/webdav-serverless/webdav-serverless/webdav"
 )
 
-type MetadataStore struct {
+// DynamoDBAPI is the part of the DynamoDB client used by DynamoDBMetadataStore.
+type DynamoDBAPI interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+	BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+// DynamoDBMetadataStore is a MetadataStore that keeps entries and References
+// in two DynamoDB tables, and Blobs in a third one.
+type DynamoDBMetadataStore struct {
 	EntryTableName     string
 	ReferenceTableName string
-	DynamoDBClient     *dynamodb.Client
+	// BlobTableName is the table of Blobs. It is only used by a Server that
+	// deduplicates content.
+	BlobTableName string
+	// SnapshotTableName is the table of Snapshots and of the pins of their
+	// objects. Snapshots are not supported if it is empty.
+	SnapshotTableName string
+	DynamoDBClient    DynamoDBAPI
+	// MaxRetries is how many times a write that lost a race against a
+	// concurrent writer is retried before a *ConflictError is returned. If
+	// zero, defaultMaxRetries is used.
+	MaxRetries int
 }
 
 var (
 	ErrNoSuchReference = errors.New("no such reference")
 	ErrNoSuchEntry     = errors.New("no such entry")
+	ErrEntryExists     = errors.New("entry already exists")
+	ErrIsDir           = errors.New("entry is a directory")
+)
+
+const (
+	// batchGetLimit is the maximum number of keys in a single BatchGetItem
+	// call.
+	batchGetLimit = 100
+	// batchWriteLimit is the maximum number of requests in a single
+	// BatchWriteItem call.
+	batchWriteLimit = 25
+	// transactWriteLimit is the maximum number of items in a single
+	// TransactWriteItems call.
+	transactWriteLimit = 100
 )
 
-func (m MetadataStore) Init(ctx context.Context) error {
-	_, err := m.GetReference(ctx, referenceID)
+// deletedParentID is the parent ID of entries that have been deleted but not
+// reaped yet.
+const deletedParentID = "deleted"
+
+// Init creates the root directory if the store is empty, and migrates a
+// store that still uses the single-Reference layout, in which the "root"
+// Reference mapped every path in the tree to its entry ID.
+func (m DynamoDBMetadataStore) Init(ctx context.Context) error {
+	anchor, err := m.GetReference(ctx, referenceID)
 	if errors.Is(err, ErrNoSuchReference) {
 		entryID := uuid.New().String()
 		entry := Entry{
 			ID:       entryID,
-			ParentID: "root",
+			ParentID: referenceID,
 			Name:     "/",
 			Type:     EntryTypeDir,
 			Size:     0,
@@ -46,6 +92,11 @@ func (m MetadataStore) Init(ctx context.Context) error {
 			},
 			Version: 1,
 		}
+		rootRef := Reference{
+			ID:      entryID,
+			Entries: map[string]string{},
+			Version: 1,
+		}
 
 		entryItem, err := attributevalue.MarshalMap(entry)
 		if err != nil {
@@ -55,6 +106,10 @@ func (m MetadataStore) Init(ctx context.Context) error {
 		if err != nil {
 			return fmt.Errorf("failed to marshal refarence: %w", err)
 		}
+		rootRefItem, err := attributevalue.MarshalMap(rootRef)
+		if err != nil {
+			return fmt.Errorf("failed to marshal refarence: %w", err)
+		}
 
 		_, putErr := m.DynamoDBClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
 			TransactItems: []types.TransactWriteItem{
@@ -70,6 +125,12 @@ func (m MetadataStore) Init(ctx context.Context) error {
 						Item:      refItem,
 					},
 				},
+				{
+					Put: &types.Put{
+						TableName: aws.String(m.ReferenceTableName),
+						Item:      rootRefItem,
+					},
+				},
 			},
 		})
 
@@ -81,10 +142,80 @@ func (m MetadataStore) Init(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to get reference: %w", err)
 	}
+	if len(anchor.Entries) > 1 {
+		return m.migrate(ctx, anchor)
+	}
+	if _, err := m.GetReference(ctx, anchor.Entries["/"]); errors.Is(err, ErrNoSuchReference) {
+		return m.migrate(ctx, anchor)
+	} else if err != nil {
+		return fmt.Errorf("failed to get reference: %w", err)
+	}
+	return nil
+}
+
+// migrate splits a legacy Reference, keyed by absolute path, into one
+// Reference per directory and then shrinks the root Reference so that it only
+// points at the root directory. Every step can safely be repeated, so an
+// interrupted migration is finished by the next Init.
+func (m DynamoDBMetadataStore) migrate(ctx context.Context, legacy Reference) error {
+	rootID, ok := legacy.Entries["/"]
+	if !ok {
+		return fmt.Errorf("failed to migrate: %w", ErrNoSuchEntry)
+	}
+	ids := make([]string, 0, len(legacy.Entries))
+	for _, id := range legacy.Entries {
+		ids = append(ids, id)
+	}
+	entries, err := m.GetEntries(ctx, ids)
+	if err != nil {
+		return fmt.Errorf("failed to migrate: %w", err)
+	}
+
+	refs := make(map[string]Reference)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			refs[entry.ID] = Reference{
+				ID:      entry.ID,
+				Entries: make(map[string]string),
+				Version: 1,
+			}
+		}
+	}
+	for p, id := range legacy.Entries {
+		if p == "/" {
+			continue
+		}
+		ref, ok := refs[legacy.Entries[path.Dir(p)]]
+		if !ok {
+			// The parent is gone or is not a directory, so p was unreachable.
+			continue
+		}
+		ref.Entries[path.Base(p)] = id
+	}
+	if _, ok := refs[rootID]; !ok {
+		refs[rootID] = Reference{ID: rootID, Entries: make(map[string]string), Version: 1}
+	}
+	for _, ref := range refs {
+		if err := m.AddReference(ctx, ref); err != nil {
+			return fmt.Errorf("failed to migrate reference %s: %w", ref.ID, err)
+		}
+	}
+
+	legacy.Entries = map[string]string{"/": rootID}
+	update, err := m.referenceUpdate(legacy)
+	if err != nil {
+		return err
+	}
+	_, err = m.DynamoDBClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{update},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate root reference: %w", err)
+	}
 	return nil
 }
 
-func (m MetadataStore) AddReference(ctx context.Context, ref Reference) error {
+func (m DynamoDBMetadataStore) AddReference(ctx context.Context, ref Reference) error {
 	refItem, err := attributevalue.MarshalMap(ref)
 	if err != nil {
 		return fmt.Errorf("failed to marshal reference: %w", err)
@@ -99,7 +230,7 @@ func (m MetadataStore) AddReference(ctx context.Context, ref Reference) error {
 	return nil
 }
 
-func (m MetadataStore) GetReference(ctx context.Context, id string) (Reference, error) {
+func (m DynamoDBMetadataStore) GetReference(ctx context.Context, id string) (Reference, error) {
 	resp, err := m.DynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
 		Key: map[string]types.AttributeValue{
 			"id": &types.AttributeValueMemberS{Value: id},
@@ -118,10 +249,13 @@ func (m MetadataStore) GetReference(ctx context.Context, id string) (Reference,
 	if err != nil {
 		return Reference{}, err
 	}
+	if item.Entries == nil {
+		item.Entries = make(map[string]string)
+	}
 	return item, nil
 }
 
-func (m MetadataStore) GetEntry(ctx context.Context, id string) (Entry, error) {
+func (m DynamoDBMetadataStore) GetEntry(ctx context.Context, id string) (Entry, error) {
 	out, err := m.DynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
 		Key: map[string]types.AttributeValue{
 			"id": &types.AttributeValueMemberS{Value: id},
@@ -146,92 +280,255 @@ func (m MetadataStore) GetEntry(ctx context.Context, id string) (Entry, error) {
 	return entry, nil
 }
 
-func (m MetadataStore) GetEntriesByParentID(ctx context.Context, id string) ([]Entry, error) {
-
-	builder := expression.NewBuilder().
-		WithKeyCondition(expression.KeyEqual(expression.Key("parent_id"), expression.Value(id)))
-	expr, err := builder.Build()
+// GetEntries returns the entries with the given IDs, in no particular order.
+// IDs that do not name an entry are skipped.
+func (m DynamoDBMetadataStore) GetEntries(ctx context.Context, ids []string) ([]Entry, error) {
+	items, err := batchGet(ctx, m.DynamoDBClient, m.EntryTableName, ids)
 	if err != nil {
 		return nil, err
 	}
+	var entries []Entry
+	err = attributevalue.UnmarshalListOfMaps(items, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal map: %w", err)
+	}
+	for i := range entries {
+		if entries[i].DeadProps == nil {
+			entries[i].DeadProps = make(map[string]string)
+		}
+	}
+	return entries, nil
+}
 
-	out, err := m.DynamoDBClient.Query(ctx, &dynamodb.QueryInput{
-		IndexName:                 aws.String("entry-index-parent_id"),
-		TableName:                 aws.String(m.EntryTableName),
-		ExpressionAttributeNames:  expr.Names(),
-		KeyConditionExpression:    expr.KeyCondition(),
-		ScanIndexForward:          aws.Bool(true),
-		ExpressionAttributeValues: expr.Values(),
-	})
+// getReferences returns the References with the given IDs, keyed by ID. IDs
+// that do not name a Reference are skipped.
+func (m DynamoDBMetadataStore) getReferences(ctx context.Context, ids []string) (map[string]Reference, error) {
+	items, err := batchGet(ctx, m.DynamoDBClient, m.ReferenceTableName, ids)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query entry: %w", err)
+		return nil, err
 	}
-	var entries []Entry
-	err = attributevalue.UnmarshalListOfMaps(out.Items, &entries)
+	var list []Reference
+	err = attributevalue.UnmarshalListOfMaps(items, &list)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal map: %w", err)
 	}
-	for _, entry := range entries {
-		if entry.DeadProps == nil {
-			entry.DeadProps = make(map[string]string)
+	refs := make(map[string]Reference, len(list))
+	for _, ref := range list {
+		if ref.Entries == nil {
+			ref.Entries = make(map[string]string)
+		}
+		refs[ref.ID] = ref
+	}
+	return refs, nil
+}
+
+// batchGet reads the items with the given IDs from table, batchGetLimit keys
+// at a time.
+func batchGet(ctx context.Context, client DynamoDBAPI, table string, ids []string) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	for len(ids) > 0 {
+		n := min(len(ids), batchGetLimit)
+		keys := make([]map[string]types.AttributeValue, 0, n)
+		for _, id := range ids[:n] {
+			keys = append(keys, map[string]types.AttributeValue{
+				"id": &types.AttributeValueMemberS{Value: id},
+			})
+		}
+		ids = ids[n:]
+
+		requests := map[string]types.KeysAndAttributes{
+			table: {Keys: keys, ConsistentRead: aws.Bool(true)},
+		}
+		for len(requests) > 0 {
+			out, err := client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: requests,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to batch get items: %w", err)
+			}
+			items = append(items, out.Responses[table]...)
+			requests = out.UnprocessedKeys
 		}
 	}
+	return items, nil
+}
+
+// batchDelete deletes the items with the given IDs from table,
+// batchWriteLimit keys at a time.
+func (m DynamoDBMetadataStore) batchDelete(ctx context.Context, table string, ids []string) error {
+	for len(ids) > 0 {
+		n := min(len(ids), batchWriteLimit)
+		requests := make([]types.WriteRequest, 0, n)
+		for _, id := range ids[:n] {
+			requests = append(requests, types.WriteRequest{
+				DeleteRequest: &types.DeleteRequest{
+					Key: map[string]types.AttributeValue{
+						"id": &types.AttributeValueMemberS{Value: id},
+					},
+				},
+			})
+		}
+		ids = ids[n:]
+
+		items := map[string][]types.WriteRequest{table: requests}
+		for len(items) > 0 {
+			out, err := m.DynamoDBClient.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: items,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to batch delete items: %w", err)
+			}
+			items = out.UnprocessedItems
+		}
+	}
+	return nil
+}
+
+func (m DynamoDBMetadataStore) GetEntriesByParentID(ctx context.Context, id string) ([]Entry, error) {
+	var entries []Entry
+	it := m.ListEntriesByParentID(id)
+	for it.Next(ctx) {
+		entries = append(entries, it.Entry())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
 	return entries, nil
 }
 
-var mux = &sync.Mutex{}
+// ListEntriesByParentID returns an iterator over the entries whose parent is
+// id. Entries are fetched one Query page at a time as the iterator advances.
+func (m DynamoDBMetadataStore) ListEntriesByParentID(id string) EntryIterator {
+	return &dynamoDBEntryIterator{m: m, parentID: id}
+}
+
+// dynamoDBEntryIterator iterates over the result of a paginated Query.
+type dynamoDBEntryIterator struct {
+	m         DynamoDBMetadataStore
+	parentID  string
+	paginator *dynamodb.QueryPaginator
+	page      []Entry
+	entry     Entry
+	err       error
+}
+
+// Next advances the iterator to the next entry, querying the next page when
+// the current one is used up. It returns false at the end of the listing or
+// on error.
+func (it *dynamoDBEntryIterator) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+	if it.paginator == nil {
+		it.paginator, it.err = it.m.queryByParentID(it.parentID)
+		if it.err != nil {
+			return false
+		}
+	}
+	for len(it.page) == 0 {
+		if !it.paginator.HasMorePages() {
+			return false
+		}
+		out, err := it.paginator.NextPage(ctx)
+		if err != nil {
+			it.err = fmt.Errorf("failed to query entry: %w", err)
+			return false
+		}
+		err = attributevalue.UnmarshalListOfMaps(out.Items, &it.page)
+		if err != nil {
+			it.err = fmt.Errorf("failed to unmarshal map: %w", err)
+			return false
+		}
+	}
+	it.entry, it.page = it.page[0], it.page[1:]
+	if it.entry.DeadProps == nil {
+		it.entry.DeadProps = make(map[string]string)
+	}
+	return true
+}
+
+// Entry returns the entry the iterator is positioned at.
+func (it *dynamoDBEntryIterator) Entry() Entry {
+	return it.entry
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *dynamoDBEntryIterator) Err() error {
+	return it.err
+}
 
-func (m MetadataStore) AddEntry(ctx context.Context, entry Entry, path string) error {
-	mux.Lock()
-	defer mux.Unlock()
+func (m DynamoDBMetadataStore) queryByParentID(id string) (*dynamodb.QueryPaginator, error) {
+	builder := expression.NewBuilder().
+		WithKeyCondition(expression.KeyEqual(expression.Key("parent_id"), expression.Value(id)))
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+	return dynamodb.NewQueryPaginator(m.DynamoDBClient, &dynamodb.QueryInput{
+		IndexName:                 aws.String("entry-index-parent_id"),
+		TableName:                 aws.String(m.EntryTableName),
+		ExpressionAttributeNames:  expr.Names(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ScanIndexForward:          aws.Bool(true),
+		ExpressionAttributeValues: expr.Values(),
+	}), nil
+}
+
+// AddEntry stores entry and links it into the Reference of its parent
+// directory. A directory entry also gets an empty Reference of its own.
+func (m DynamoDBMetadataStore) AddEntry(ctx context.Context, entry Entry) error {
+	return m.retry(ctx, func(int) error {
+		return m.addEntry(ctx, entry)
+	})
+}
 
-	ref, err := m.GetReference(ctx, referenceID)
+func (m DynamoDBMetadataStore) addEntry(ctx context.Context, entry Entry) error {
+	ref, err := m.GetReference(ctx, entry.ParentID)
 	if err != nil {
 		return err
 	}
-	ref.Entries[path] = entry.ID
+	if _, ok := ref.Entries[entry.Name]; ok {
+		return ErrEntryExists
+	}
+	ref.Entries[entry.Name] = entry.ID
 
 	entryItem, err := attributevalue.MarshalMap(entry)
 	if err != nil {
 		return fmt.Errorf("failed to marshal entry: %w", err)
 	}
-
-	condition := expression.Name("version").Equal(expression.Value(ref.Version))
-	update := expression.Set(expression.Name("entries"), expression.Value(ref.Entries)).
-		Add(expression.Name("version"), expression.Value(1))
-	expr, err := expression.NewBuilder().
-		WithCondition(condition).
-		WithUpdate(update).
-		Build()
-
+	refUpdate, err := m.referenceUpdate(ref)
 	if err != nil {
-		return fmt.Errorf("failed to build expression, %w", err)
+		return err
 	}
 
-	_, err = m.DynamoDBClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
-		TransactItems: []types.TransactWriteItem{
-			{
-				Put: &types.Put{
-					TableName: aws.String(m.EntryTableName),
-					Item:      entryItem,
-				},
-			},
-			{
-				Update: &types.Update{
-					Key: map[string]types.AttributeValue{
-						"id": &types.AttributeValueMemberS{
-							Value: ref.ID,
-						},
-					},
-					TableName:                           aws.String(m.ReferenceTableName),
-					UpdateExpression:                    expr.Update(),
-					ConditionExpression:                 expr.Condition(),
-					ExpressionAttributeNames:            expr.Names(),
-					ExpressionAttributeValues:           expr.Values(),
-					ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureNone,
-				},
+	transactItems := []types.TransactWriteItem{
+		{
+			Put: &types.Put{
+				TableName: aws.String(m.EntryTableName),
+				Item:      entryItem,
 			},
 		},
+		refUpdate,
+	}
+	if entry.IsDir() {
+		dirRefItem, err := attributevalue.MarshalMap(Reference{
+			ID:      entry.ID,
+			Entries: map[string]string{},
+			Version: 1,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal reference: %w", err)
+		}
+		transactItems = append(transactItems, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName: aws.String(m.ReferenceTableName),
+				Item:      dirRefItem,
+			},
+		})
+	}
+
+	_, err = m.DynamoDBClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: transactItems,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to transact write items: %w", err)
@@ -239,7 +536,10 @@ func (m MetadataStore) AddEntry(ctx context.Context, entry Entry, path string) e
 	return nil
 }
 
-func (m MetadataStore) UpdateEntry(ctx context.Context, entry Entry) error {
+// UpdateEntry stores the size, modification time and dead properties of
+// entry, provided that its version is still entry.Version. It is not retried,
+// since the caller decided on the new values based on the version it read.
+func (m DynamoDBMetadataStore) UpdateEntry(ctx context.Context, entry Entry) error {
 	condition := expression.Name("version").Equal(expression.Value(entry.Version))
 	update := expression.
 		Set(expression.Name("size"), expression.Value(entry.Size)).
@@ -268,17 +568,115 @@ func (m MetadataStore) UpdateEntry(ctx context.Context, entry Entry) error {
 		ExpressionAttributeValues:           expr.Values(),
 		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureNone,
 	})
+	if isConflict(err) {
+		return &ConflictError{Attempts: 1, Err: err}
+	}
 	if err != nil {
 		return fmt.Errorf("failed to update items: %w", err)
 	}
 	return nil
 }
 
-func (m MetadataStore) UpdateEntryName(ctx context.Context, entry Entry, ref Reference) error {
+// UpdateEntryObject points the file entry id at the object key holding new
+// content of the given size and checksums, keeping the replaced content as
+// the newest of at most keep earlier versions. It returns the keys of the
+// objects that the entry no longer refers to.
+func (m DynamoDBMetadataStore) UpdateEntryObject(ctx context.Context, id, key string, size int64, sum Checksums, modify time.Time, keep int) ([]string, error) {
+	var dropped []string
+	err := m.retry(ctx, func(int) error {
+		entry, err := m.GetEntry(ctx, id)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return ErrIsDir
+		}
+		condition := expression.Name("version").Equal(expression.Value(entry.Version))
+		keys := entry.replaceObject(key, size, sum, modify, keep)
+		update := expression.
+			Set(expression.Name("object"), expression.Value(key)).
+			Set(expression.Name("size"), expression.Value(size)).
+			Set(expression.Name("sha256"), expression.Value(sum.SHA256)).
+			Set(expression.Name("md5"), expression.Value(sum.MD5)).
+			Set(expression.Name("modify"), expression.Value(modify)).
+			Set(expression.Name("checked_in"), expression.Value(entry.CheckedIn)).
+			Add(expression.Name("version"), expression.Value(1))
+		if len(entry.Versions) > 0 {
+			update = update.Set(expression.Name("versions"), expression.Value(entry.Versions))
+		} else {
+			update = update.Remove(expression.Name("versions"))
+		}
+		expr, err := expression.NewBuilder().
+			WithCondition(condition).
+			WithUpdate(update).
+			Build()
+		if err != nil {
+			return fmt.Errorf("failed to build expression, %w", err)
+		}
+		_, err = m.DynamoDBClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			Key: map[string]types.AttributeValue{
+				"id": &types.AttributeValueMemberS{
+					Value: id,
+				},
+			},
+			TableName:                 aws.String(m.EntryTableName),
+			UpdateExpression:          expr.Update(),
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update items: %w", err)
+		}
+		dropped = keys
+		return nil
+	})
+	return dropped, err
+}
+
+// UpdateEntryName moves entry to the given name in directory parentID,
+// unlinking it from its current parent, and sets its trash info. The
+// References below a moved directory are keyed by entry ID, so they are left
+// untouched.
+func (m DynamoDBMetadataStore) UpdateEntryName(ctx context.Context, entry Entry, parentID, name string, trash *TrashInfo) error {
+	return m.retry(ctx, func(attempt int) error {
+		if attempt > 0 {
+			var err error
+			if entry, err = m.GetEntry(ctx, entry.ID); err != nil {
+				return err
+			}
+		}
+		return m.updateEntryName(ctx, entry, parentID, name, trash)
+	})
+}
+
+func (m DynamoDBMetadataStore) updateEntryName(ctx context.Context, entry Entry, parentID, name string, trash *TrashInfo) error {
+	oldRef, err := m.GetReference(ctx, entry.ParentID)
+	if err != nil {
+		return err
+	}
+	newRef := oldRef
+	if parentID != entry.ParentID {
+		newRef, err = m.GetReference(ctx, parentID)
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := newRef.Entries[name]; ok {
+		return ErrEntryExists
+	}
+	delete(oldRef.Entries, entry.Name)
+	newRef.Entries[name] = entry.ID
+
 	entryCondition := expression.Name("version").Equal(expression.Value(entry.Version))
-	entryUpdate := expression.Set(expression.Name("name"), expression.Value(entry.Name)).
-		Set(expression.Name("parent_id"), expression.Value(entry.ParentID)).
+	entryUpdate := expression.Set(expression.Name("name"), expression.Value(name)).
+		Set(expression.Name("parent_id"), expression.Value(parentID)).
 		Add(expression.Name("version"), expression.Value(1))
+	if trash != nil {
+		entryUpdate = entryUpdate.Set(expression.Name("trash"), expression.Value(trash))
+	} else {
+		entryUpdate = entryUpdate.Remove(expression.Name("trash"))
+	}
 	entryExpr, err := expression.NewBuilder().
 		WithCondition(entryCondition).
 		WithUpdate(entryUpdate).
@@ -287,12 +685,76 @@ func (m MetadataStore) UpdateEntryName(ctx context.Context, entry Entry, ref Ref
 		return fmt.Errorf("failed to build expression, %w", err)
 	}
 
-	refCondition := expression.Name("version").Equal(expression.Value(ref.Version))
-	refUpdate := expression.Set(expression.Name("entries"), expression.Value(ref.Entries)).
+	transactItems := []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				Key: map[string]types.AttributeValue{
+					"id": &types.AttributeValueMemberS{
+						Value: entry.ID,
+					},
+				},
+				TableName:                           aws.String(m.EntryTableName),
+				UpdateExpression:                    entryExpr.Update(),
+				ConditionExpression:                 entryExpr.Condition(),
+				ExpressionAttributeNames:            entryExpr.Names(),
+				ExpressionAttributeValues:           entryExpr.Values(),
+				ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureNone,
+			},
+		},
+	}
+	for _, ref := range []Reference{oldRef, newRef} {
+		refUpdate, err := m.referenceUpdate(ref)
+		if err != nil {
+			return err
+		}
+		transactItems = append(transactItems, refUpdate)
+		if parentID == entry.ParentID {
+			break
+		}
+	}
+
+	_, err = m.DynamoDBClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: transactItems,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to transact write items: %w", err)
+	}
+	return nil
+}
+
+// DeleteEntries detaches entry from its parent directory and marks it, and
+// with it everything below it, as deleted. This is a single transaction no
+// matter how large the subtree is; the entries are removed afterwards by
+// ReapEntries.
+func (m DynamoDBMetadataStore) DeleteEntries(ctx context.Context, entry Entry) error {
+	return m.retry(ctx, func(attempt int) error {
+		if attempt > 0 {
+			var err error
+			if entry, err = m.GetEntry(ctx, entry.ID); err != nil {
+				return err
+			}
+		}
+		return m.deleteEntries(ctx, entry)
+	})
+}
+
+func (m DynamoDBMetadataStore) deleteEntries(ctx context.Context, entry Entry) error {
+	parent, err := m.GetReference(ctx, entry.ParentID)
+	if err != nil {
+		return err
+	}
+	delete(parent.Entries, entry.Name)
+	refUpdate, err := m.referenceUpdate(parent)
+	if err != nil {
+		return err
+	}
+
+	entryCondition := expression.Name("version").Equal(expression.Value(entry.Version))
+	entryUpdate := expression.Set(expression.Name("parent_id"), expression.Value(deletedParentID)).
 		Add(expression.Name("version"), expression.Value(1))
-	refExpr, err := expression.NewBuilder().
-		WithCondition(refCondition).
-		WithUpdate(refUpdate).
+	entryExpr, err := expression.NewBuilder().
+		WithCondition(entryCondition).
+		WithUpdate(entryUpdate).
 		Build()
 	if err != nil {
 		return fmt.Errorf("failed to build expression, %w", err)
@@ -315,55 +777,98 @@ func (m MetadataStore) UpdateEntryName(ctx context.Context, entry Entry, ref Ref
 					ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureNone,
 				},
 			},
-			{
-				Update: &types.Update{
-					Key: map[string]types.AttributeValue{
-						"id": &types.AttributeValueMemberS{
-							Value: ref.ID,
-						},
-					},
-					TableName:                           aws.String(m.ReferenceTableName),
-					UpdateExpression:                    refExpr.Update(),
-					ConditionExpression:                 refExpr.Condition(),
-					ExpressionAttributeNames:            refExpr.Names(),
-					ExpressionAttributeValues:           refExpr.Values(),
-					ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureNone,
-				},
-			},
+			refUpdate,
 		},
 	})
 	if err != nil {
-		return fmt.Errorf("failed to transact write items: %w", err)
+		return fmt.Errorf("failed to delete items, %w", err)
 	}
 	return nil
 }
 
-func (m MetadataStore) DeleteEntries(ctx context.Context, ids []string, ref Reference) error {
-	refCondition := expression.Name("version").Equal(expression.Value(ref.Version))
-	refUpdate := expression.Set(expression.Name("entries"), expression.Value(ref.Entries)).
-		Add(expression.Name("version"), expression.Value(1))
-	refExpr, err := expression.NewBuilder().
-		WithCondition(refCondition).
-		WithUpdate(refUpdate).
-		Build()
+// GetDeletedEntries returns the entries that DeleteEntries has marked as
+// deleted and that have not been reaped yet.
+func (m DynamoDBMetadataStore) GetDeletedEntries(ctx context.Context) ([]Entry, error) {
+	return m.GetEntriesByParentID(ctx, deletedParentID)
+}
+
+// ReapEntries removes entry, which DeleteEntries has marked as deleted, and
+// everything below it. deleteFiles is called with the entries of files before
+// they are removed.
+//
+// Directories are reaped bottom up and no Reference is modified on the way,
+// so an interrupted call is finished by calling ReapEntries again.
+func (m DynamoDBMetadataStore) ReapEntries(ctx context.Context, entry Entry, deleteFiles func(files []Entry) error) error {
+	ref, err := m.GetReference(ctx, entry.ID)
+	switch {
+	case err == nil:
+		if err := m.reapDir(ctx, ref, deleteFiles); err != nil {
+			return err
+		}
+	case errors.Is(err, ErrNoSuchReference):
+		if !entry.IsDir() {
+			if err := deleteFiles([]Entry{entry}); err != nil {
+				return err
+			}
+		}
+	default:
+		return err
+	}
+	return m.batchDelete(ctx, m.EntryTableName, []string{entry.ID})
+}
+
+// reapDir removes everything below the directory of ref, and ref itself.
+func (m DynamoDBMetadataStore) reapDir(ctx context.Context, ref Reference, deleteFiles func(files []Entry) error) error {
+	childIDs := make([]string, 0, len(ref.Entries))
+	for _, id := range ref.Entries {
+		childIDs = append(childIDs, id)
+	}
+	childRefs, err := m.getReferences(ctx, childIDs)
 	if err != nil {
-		return fmt.Errorf("failed to build expression, %w", err)
+		return err
+	}
+	var fileIDs []string
+	for _, id := range childIDs {
+		childRef, ok := childRefs[id]
+		if !ok {
+			// Only directories have a Reference.
+			fileIDs = append(fileIDs, id)
+			continue
+		}
+		if err := m.reapDir(ctx, childRef, deleteFiles); err != nil {
+			return err
+		}
+	}
+	if len(fileIDs) > 0 {
+		files, err := m.GetEntries(ctx, fileIDs)
+		if err != nil {
+			return err
+		}
+		if err := deleteFiles(files); err != nil {
+			return err
+		}
+	}
+	if err := m.batchDelete(ctx, m.EntryTableName, childIDs); err != nil {
+		return err
 	}
+	return m.batchDelete(ctx, m.ReferenceTableName, []string{ref.ID})
+}
 
-	var transactItems []types.TransactWriteItem
-	for _, id := range ids {
-		transactItems = append(transactItems, types.TransactWriteItem{
-			Delete: &types.Delete{
-				TableName: aws.String(m.EntryTableName),
-				Key: map[string]types.AttributeValue{
-					"id": &types.AttributeValueMemberS{
-						Value: id,
-					},
-				},
-			},
-		})
+// referenceUpdate returns a transactional write that replaces the entries of
+// ref and bumps its version, provided that nobody has written ref since it
+// was read.
+func (m DynamoDBMetadataStore) referenceUpdate(ref Reference) (types.TransactWriteItem, error) {
+	condition := expression.Name("version").Equal(expression.Value(ref.Version))
+	update := expression.Set(expression.Name("entries"), expression.Value(ref.Entries)).
+		Add(expression.Name("version"), expression.Value(1))
+	expr, err := expression.NewBuilder().
+		WithCondition(condition).
+		WithUpdate(update).
+		Build()
+	if err != nil {
+		return types.TransactWriteItem{}, fmt.Errorf("failed to build expression, %w", err)
 	}
-	transactItems = append(transactItems, types.TransactWriteItem{
+	return types.TransactWriteItem{
 		Update: &types.Update{
 			Key: map[string]types.AttributeValue{
 				"id": &types.AttributeValueMemberS{
@@ -371,19 +876,584 @@ func (m MetadataStore) DeleteEntries(ctx context.Context, ids []string, ref Refe
 				},
 			},
 			TableName:                           aws.String(m.ReferenceTableName),
-			UpdateExpression:                    refExpr.Update(),
-			ConditionExpression:                 refExpr.Condition(),
-			ExpressionAttributeNames:            refExpr.Names(),
-			ExpressionAttributeValues:           refExpr.Values(),
+			UpdateExpression:                    expr.Update(),
+			ConditionExpression:                 expr.Condition(),
+			ExpressionAttributeNames:            expr.Names(),
+			ExpressionAttributeValues:           expr.Values(),
 			ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureNone,
 		},
+	}, nil
+}
+
+func (m DynamoDBMetadataStore) GetBlob(ctx context.Context, hash string) (Blob, error) {
+	out, err := m.DynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: hash},
+		},
+		TableName:      aws.String(m.BlobTableName),
+		ConsistentRead: aws.Bool(true),
 	})
-	_, err = m.DynamoDBClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
-		TransactItems: transactItems,
+	if err != nil {
+		return Blob{}, fmt.Errorf("failed to get item: %w", err)
+	}
+	if out.Item == nil {
+		return Blob{}, ErrNoSuchBlob
+	}
+	blob := Blob{}
+	if err := attributevalue.UnmarshalMap(out.Item, &blob); err != nil {
+		return Blob{}, fmt.Errorf("failed to unmarshal map: %w", err)
+	}
+	return blob, nil
+}
+
+// blobRefID is the ID of the item of the blob table that records that the
+// entry entryID refers to the Blob hash. With an item per reference, the Blob
+// item stays small however many entries share its content, and adding or
+// removing a reference is idempotent.
+func blobRefID(hash, entryID string) string {
+	return hash + "/" + entryID
+}
+
+// AcquireBlob adds the reference item of entryID and counts it in the Blob
+// hash, in one transaction. The Blob is created with the object key if it
+// does not exist, which loses to a concurrent AcquireBlob that creates it
+// first.
+func (m DynamoDBMetadataStore) AcquireBlob(ctx context.Context, hash, entryID, key string) (string, error) {
+	refKey := map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: blobRefID(hash, entryID)},
+	}
+	var object string
+	err := m.retry(ctx, func(int) error {
+		blob, err := m.GetBlob(ctx, hash)
+		exists := err == nil
+		switch {
+		case errors.Is(err, ErrNoSuchBlob):
+			if key == "" {
+				return ErrNoSuchBlob
+			}
+			blob = Blob{Hash: hash, Object: key, Refs: 1}
+		case err != nil:
+			return err
+		}
+		out, err := m.DynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+			Key:            refKey,
+			TableName:      aws.String(m.BlobTableName),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get item: %w", err)
+		}
+		if out.Item != nil && exists {
+			// Acquired already.
+			object = blob.Object
+			return nil
+		}
+
+		var blobItem types.TransactWriteItem
+		if exists {
+			expr, err := expression.NewBuilder().
+				WithCondition(expression.AttributeExists(expression.Name("id"))).
+				WithUpdate(expression.Add(expression.Name("refcount"), expression.Value(1))).
+				Build()
+			if err != nil {
+				return fmt.Errorf("failed to build expression, %w", err)
+			}
+			blobItem.Update = &types.Update{
+				Key: map[string]types.AttributeValue{
+					"id": &types.AttributeValueMemberS{Value: hash},
+				},
+				TableName:                 aws.String(m.BlobTableName),
+				UpdateExpression:          expr.Update(),
+				ConditionExpression:       expr.Condition(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+			}
+		} else {
+			item, err := attributevalue.MarshalMap(blob)
+			if err != nil {
+				return fmt.Errorf("failed to marshal blob: %w", err)
+			}
+			put, err := putIfNotExists(m.BlobTableName, item)
+			if err != nil {
+				return err
+			}
+			blobItem.Put = put
+		}
+		refPut, err := putIfNotExists(m.BlobTableName, refKey)
+		if err != nil {
+			return err
+		}
+		_, err = m.DynamoDBClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{blobItem, {Put: refPut}},
+		})
+		if err != nil {
+			// A conflict is retried, and then adds to the Blob that won.
+			return fmt.Errorf("failed to transact write items: %w", err)
+		}
+		object = blob.Object
+		return nil
 	})
+	return object, err
+}
+
+// putIfNotExists returns a transaction item that puts item into table on
+// condition that no item with its ID exists.
+func putIfNotExists(table string, item map[string]types.AttributeValue) (*types.Put, error) {
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.AttributeNotExists(expression.Name("id"))).
+		Build()
 	if err != nil {
-		return fmt.Errorf("failed to delete items, %w", err)
+		return nil, fmt.Errorf("failed to build expression, %w", err)
+	}
+	return &types.Put{
+		Item:                     item,
+		TableName:                aws.String(table),
+		ConditionExpression:      expr.Condition(),
+		ExpressionAttributeNames: expr.Names(),
+	}, nil
+}
+
+// ReleaseBlob deletes the reference item of entryID and uncounts it in the
+// Blob hash, in one transaction. A Blob whose count has dropped to zero is
+// deleted afterwards, on condition that nobody acquired it in between; a
+// release that is repeated after being interrupted in between deletes it
+// then.
+func (m DynamoDBMetadataStore) ReleaseBlob(ctx context.Context, hash, entryID string) (string, error) {
+	key := map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: hash},
+	}
+	refExpr, err := expression.NewBuilder().
+		WithCondition(expression.AttributeExists(expression.Name("id"))).
+		Build()
+	if err != nil {
+		return "", fmt.Errorf("failed to build expression, %w", err)
+	}
+	blobExpr, err := expression.NewBuilder().
+		WithCondition(expression.AttributeExists(expression.Name("id"))).
+		WithUpdate(expression.Add(expression.Name("refcount"), expression.Value(-1))).
+		Build()
+	if err != nil {
+		return "", fmt.Errorf("failed to build expression, %w", err)
+	}
+	refKey := map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: blobRefID(hash, entryID)},
+	}
+	err = m.retry(ctx, func(int) error {
+		_, err := m.DynamoDBClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{
+				{Delete: &types.Delete{
+					Key:                      refKey,
+					TableName:                aws.String(m.BlobTableName),
+					ConditionExpression:      refExpr.Condition(),
+					ExpressionAttributeNames: refExpr.Names(),
+				}},
+				{Update: &types.Update{
+					Key:                       key,
+					TableName:                 aws.String(m.BlobTableName),
+					UpdateExpression:          blobExpr.Update(),
+					ConditionExpression:       blobExpr.Condition(),
+					ExpressionAttributeNames:  blobExpr.Names(),
+					ExpressionAttributeValues: blobExpr.Values(),
+				}},
+			},
+		})
+		if !isConflict(err) {
+			if err != nil {
+				return fmt.Errorf("failed to transact write items: %w", err)
+			}
+			return nil
+		}
+		// A conflict either means that the reference is gone already, or that
+		// a concurrent write got in the way, which is retried.
+		out, gerr := m.DynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+			Key:            refKey,
+			TableName:      aws.String(m.BlobTableName),
+			ConsistentRead: aws.Bool(true),
+		})
+		if gerr != nil {
+			return fmt.Errorf("failed to get item: %w", gerr)
+		}
+		if out.Item == nil {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	blob, err := m.GetBlob(ctx, hash)
+	if errors.Is(err, ErrNoSuchBlob) {
+		return "", nil
+	}
+	if err != nil || blob.Refs > 0 {
+		return "", err
+	}
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("refcount").LessThanEqual(expression.Value(0))).
+		Build()
+	if err != nil {
+		return "", fmt.Errorf("failed to build expression, %w", err)
+	}
+	_, err = m.DynamoDBClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		Key:                       key,
+		TableName:                 aws.String(m.BlobTableName),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if isConflict(err) {
+		// Acquired again, or deleted by a concurrent ReleaseBlob.
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to delete item: %w", err)
+	}
+	return blob.Object, nil
+}
+
+// snapshotCatalogID is the ID of the item of the snapshot table that holds
+// the Snapshots by name. The other items pin objects; their ID is the object
+// key and their refs are the names of the snapshots pinning the object.
+const snapshotCatalogID = "snapshots"
+
+type snapshotCatalog struct {
+	ID        string              `dynamodbav:"id"`
+	Snapshots map[string]Snapshot `dynamodbav:"snapshots"`
+	Version   int                 `dynamodbav:"version"`
+}
+
+type snapshotPin struct {
+	Object string   `dynamodbav:"id"`
+	Refs   []string `dynamodbav:"refs,stringset,omitempty"`
+}
+
+func (m DynamoDBMetadataStore) getSnapshotCatalog(ctx context.Context) (snapshotCatalog, error) {
+	catalog := snapshotCatalog{ID: snapshotCatalogID}
+	out, err := m.DynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: snapshotCatalogID},
+		},
+		TableName:      aws.String(m.SnapshotTableName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return catalog, fmt.Errorf("failed to get item: %w", err)
+	}
+	if out.Item != nil {
+		if err := attributevalue.UnmarshalMap(out.Item, &catalog); err != nil {
+			return catalog, fmt.Errorf("failed to unmarshal map: %w", err)
+		}
+	}
+	if catalog.Snapshots == nil {
+		catalog.Snapshots = make(map[string]Snapshot)
+	}
+	return catalog, nil
+}
+
+// updateSnapshotCatalog applies fn to the Snapshots by name and writes them
+// back, provided that nobody wrote them in the meantime.
+func (m DynamoDBMetadataStore) updateSnapshotCatalog(ctx context.Context, fn func(snapshots map[string]Snapshot) error) error {
+	if m.SnapshotTableName == "" {
+		return ErrNotSupported
+	}
+	return m.retry(ctx, func(int) error {
+		catalog, err := m.getSnapshotCatalog(ctx)
+		if err != nil {
+			return err
+		}
+		if err := fn(catalog.Snapshots); err != nil {
+			return err
+		}
+		condition := expression.AttributeNotExists(expression.Name("id"))
+		if catalog.Version > 0 {
+			condition = expression.Name("version").Equal(expression.Value(catalog.Version))
+		}
+		expr, err := expression.NewBuilder().WithCondition(condition).Build()
+		if err != nil {
+			return fmt.Errorf("failed to build expression, %w", err)
+		}
+		catalog.Version++
+		item, err := attributevalue.MarshalMap(catalog)
+		if err != nil {
+			return fmt.Errorf("failed to marshal snapshots: %w", err)
+		}
+		_, err = m.DynamoDBClient.PutItem(ctx, &dynamodb.PutItemInput{
+			Item:                      item,
+			TableName:                 aws.String(m.SnapshotTableName),
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to put item: %w", err)
+		}
+		return nil
+	})
+}
+
+func (m DynamoDBMetadataStore) AddSnapshot(ctx context.Context, snap Snapshot) error {
+	return m.updateSnapshotCatalog(ctx, func(snapshots map[string]Snapshot) error {
+		if _, ok := snapshots[snap.Name]; ok {
+			return ErrSnapshotExists
+		}
+		snap.Pending = true
+		snapshots[snap.Name] = snap
+		return nil
+	})
+}
+
+// CompleteSnapshot adds name to the pins of the objects one item at a time,
+// and then marks the snapshot complete. The snapshot is pending until then,
+// so nothing is deleted while the pins are being written.
+func (m DynamoDBMetadataStore) CompleteSnapshot(ctx context.Context, snap Snapshot, keys []string) error {
+	if m.SnapshotTableName == "" {
+		return ErrNotSupported
+	}
+	update := expression.Add(expression.Name("refs"), expression.Value(&types.AttributeValueMemberSS{Value: []string{snap.Name}}))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression, %w", err)
+	}
+	for _, key := range keys {
+		_, err := m.DynamoDBClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			Key: map[string]types.AttributeValue{
+				"id": &types.AttributeValueMemberS{Value: key},
+			},
+			TableName:                 aws.String(m.SnapshotTableName),
+			UpdateExpression:          expr.Update(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update item: %w", err)
+		}
+	}
+	return m.updateSnapshotCatalog(ctx, func(snapshots map[string]Snapshot) error {
+		if _, ok := snapshots[snap.Name]; !ok {
+			return ErrNoSuchSnapshot
+		}
+		snap.Pending = false
+		snapshots[snap.Name] = snap
+		return nil
+	})
+}
+
+func (m DynamoDBMetadataStore) GetSnapshots(ctx context.Context) ([]Snapshot, error) {
+	if m.SnapshotTableName == "" {
+		return nil, nil
+	}
+	catalog, err := m.getSnapshotCatalog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]Snapshot, 0, len(catalog.Snapshots))
+	for _, snap := range catalog.Snapshots {
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, nil
+}
+
+// DeleteSnapshot removes name from the pins of the objects one item at a
+// time, like ReleaseBlob, and then removes the snapshot.
+func (m DynamoDBMetadataStore) DeleteSnapshot(ctx context.Context, name string, keys []string) ([]string, error) {
+	if m.SnapshotTableName == "" {
+		return nil, ErrNotSupported
+	}
+	var unpinned []string
+	for _, key := range keys {
+		ok, err := m.unpin(ctx, key, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			unpinned = append(unpinned, key)
+		}
+	}
+	err := m.updateSnapshotCatalog(ctx, func(snapshots map[string]Snapshot) error {
+		delete(snapshots, name)
+		return nil
+	})
+	return unpinned, err
+}
+
+// unpin removes the snapshot name from the pins of the object key, and
+// reports whether no snapshot pins the object anymore.
+func (m DynamoDBMetadataStore) unpin(ctx context.Context, key, name string) (bool, error) {
+	id := map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: key},
+	}
+	condition := expression.AttributeExists(expression.Name("id"))
+	update := expression.Delete(expression.Name("refs"), expression.Value(&types.AttributeValueMemberSS{Value: []string{name}}))
+	expr, err := expression.NewBuilder().
+		WithCondition(condition).
+		WithUpdate(update).
+		Build()
+	if err != nil {
+		return false, fmt.Errorf("failed to build expression, %w", err)
+	}
+	out, err := m.DynamoDBClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		Key:                       id,
+		TableName:                 aws.String(m.SnapshotTableName),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if isConflict(err) {
+		// Nothing pins the object.
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update item: %w", err)
+	}
+	pin := snapshotPin{}
+	if err := attributevalue.UnmarshalMap(out.Attributes, &pin); err != nil {
+		return false, fmt.Errorf("failed to unmarshal map: %w", err)
+	}
+	if len(pin.Refs) > 0 {
+		return false, nil
 	}
 
+	expr, err = expression.NewBuilder().
+		WithCondition(expression.AttributeNotExists(expression.Name("refs"))).
+		Build()
+	if err != nil {
+		return false, fmt.Errorf("failed to build expression, %w", err)
+	}
+	_, err = m.DynamoDBClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		Key:                      id,
+		TableName:                aws.String(m.SnapshotTableName),
+		ConditionExpression:      expr.Condition(),
+		ExpressionAttributeNames: expr.Names(),
+	})
+	if isConflict(err) {
+		// Pinned again by a concurrent snapshot.
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to delete item: %w", err)
+	}
+	return true, nil
+}
+
+func (m DynamoDBMetadataStore) GetPinnedObjects(ctx context.Context, keys []string) ([]string, error) {
+	if m.SnapshotTableName == "" || len(keys) == 0 {
+		return nil, nil
+	}
+	catalog, err := m.getSnapshotCatalog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range catalog.Snapshots {
+		if snap.Pending {
+			return keys, nil
+		}
+	}
+	items, err := batchGet(ctx, m.DynamoDBClient, m.SnapshotTableName, keys)
+	if err != nil {
+		return nil, err
+	}
+	var pinned []string
+	for _, item := range items {
+		pin := snapshotPin{}
+		if err := attributevalue.UnmarshalMap(item, &pin); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal map: %w", err)
+		}
+		if len(pin.Refs) > 0 && pin.Object != snapshotCatalogID {
+			pinned = append(pinned, pin.Object)
+		}
+	}
+	return pinned, nil
+}
+
+// usageID is the ID of the item of the reference table that holds the usage.
+const usageID = "usage"
+
+func (m DynamoDBMetadataStore) GetUsage(ctx context.Context) (Usage, error) {
+	out, err := m.DynamoDBClient.GetItem(ctx, &dynamodb.GetItemInput{
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: usageID},
+		},
+		TableName:      aws.String(m.ReferenceTableName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Usage{}, fmt.Errorf("failed to get item: %w", err)
+	}
+	usage := Usage{}
+	if err := attributevalue.UnmarshalMap(out.Item, &usage); err != nil {
+		return Usage{}, fmt.Errorf("failed to unmarshal map: %w", err)
+	}
+	return usage, nil
+}
+
+// AddUsage adds delta to the usage in a single update, on condition that the
+// fields that grow stay within limit.
+func (m DynamoDBMetadataStore) AddUsage(ctx context.Context, delta, limit Usage) error {
+	update := expression.Add(expression.Name("bytes"), expression.Value(delta.Bytes)).
+		Add(expression.Name("files"), expression.Value(delta.Files))
+	builder := expression.NewBuilder().WithUpdate(update)
+	var conditions []expression.ConditionBuilder
+	for _, f := range []struct {
+		name         string
+		delta, limit int64
+	}{
+		{"bytes", delta.Bytes, limit.Bytes},
+		{"files", delta.Files, limit.Files},
+	} {
+		if f.delta <= 0 || f.limit <= 0 {
+			continue
+		}
+		if f.delta > f.limit {
+			return webdav.ErrQuotaExceeded
+		}
+		name := expression.Name(f.name)
+		conditions = append(conditions, expression.AttributeNotExists(name).
+			Or(name.LessThanEqual(expression.Value(f.limit-f.delta))))
+	}
+	switch len(conditions) {
+	case 1:
+		builder = builder.WithCondition(conditions[0])
+	case 2:
+		builder = builder.WithCondition(conditions[0].And(conditions[1]))
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression, %w", err)
+	}
+	_, err = m.DynamoDBClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: usageID},
+		},
+		TableName:                 aws.String(m.ReferenceTableName),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if isConflict(err) {
+		return webdav.ErrQuotaExceeded
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update item: %w", err)
+	}
+	return nil
+}
+
+func (m DynamoDBMetadataStore) SetUsage(ctx context.Context, usage Usage) error {
+	item, err := attributevalue.MarshalMap(usage)
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage: %w", err)
+	}
+	item["id"] = &types.AttributeValueMemberS{Value: usageID}
+	_, err = m.DynamoDBClient.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(m.ReferenceTableName),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put item: %w", err)
+	}
 	return nil
 }
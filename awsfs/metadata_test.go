@@ -0,0 +1,257 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestMetadataStoreInit(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMetadataStore(newFakeDynamoDB())
+	for i := 0; i < 2; i++ {
+		if err := m.Init(ctx); err != nil {
+			t.Fatalf("Init #%d: %v", i, err)
+		}
+	}
+	anchor, err := m.GetReference(ctx, referenceID)
+	if err != nil {
+		t.Fatalf("GetReference: %v", err)
+	}
+	if len(anchor.Entries) != 1 {
+		t.Fatalf("root reference: got %v, want a single entry", anchor.Entries)
+	}
+	root, err := m.GetReference(ctx, anchor.Entries["/"])
+	if err != nil {
+		t.Fatalf("GetReference(root directory): %v", err)
+	}
+	if len(root.Entries) != 0 {
+		t.Fatalf("root directory: got %v, want no entries", root.Entries)
+	}
+}
+
+func TestMetadataStoreMigrate(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDynamoDB()
+	m := newTestMetadataStore(db)
+
+	// Write a tree in the legacy layout, where the "root" Reference maps
+	// every path to an entry ID.
+	legacy := []struct {
+		path, id, parentID string
+		typ                EntryType
+	}{
+		{"/", "r", referenceID, EntryTypeDir},
+		{"/a", "a", "r", EntryTypeDir},
+		{"/a/b", "b", "a", EntryTypeDir},
+		{"/a/b/c.txt", "c", "b", EntryTypeFile},
+		{"/d.txt", "d", "r", EntryTypeFile},
+		{"/e", "e", "r", EntryTypeDir},
+	}
+	ref := Reference{ID: referenceID, Entries: map[string]string{}, Version: 7}
+	for _, l := range legacy {
+		ref.Entries[l.path] = l.id
+		item, err := attributevalue.MarshalMap(Entry{ID: l.id, ParentID: l.parentID, Name: l.path, Type: l.typ, Version: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.table(m.EntryTableName)[l.id] = item
+	}
+	if err := m.AddReference(ctx, ref); err != nil {
+		t.Fatalf("AddReference: %v", err)
+	}
+
+	if err := m.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	want := map[string]map[string]string{
+		referenceID: {"/": "r"},
+		"r":         {"a": "a", "d.txt": "d", "e": "e"},
+		"a":         {"b": "b"},
+		"b":         {"c.txt": "c"},
+		"e":         {},
+	}
+	for id, entries := range want {
+		got, err := m.GetReference(ctx, id)
+		if err != nil {
+			t.Fatalf("GetReference(%q): %v", id, err)
+		}
+		if fmt.Sprint(got.Entries) != fmt.Sprint(entries) {
+			t.Errorf("Reference %q: got %v, want %v", id, got.Entries, entries)
+		}
+	}
+	for _, id := range []string{"c", "d"} {
+		if _, err := m.GetReference(ctx, id); !errors.Is(err, ErrNoSuchReference) {
+			t.Errorf("GetReference(%q) of a file: got %v, want ErrNoSuchReference", id, err)
+		}
+	}
+}
+
+func TestConcurrentMkdir(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMetadataStore(newFakeDynamoDB())
+	m.MaxRetries = 1000
+	if err := m.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	// Two servers sharing the same tables, as in two processes.
+	servers := []*Server{{MetadataStore: m}, {MetadataStore: m}}
+
+	const n = 32
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- servers[i%len(servers)].Mkdir(ctx, fmt.Sprintf("/dir%02d", i), 0777)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+	}
+
+	f, err := servers[0].OpenFile(ctx, "/", 0, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		t.Fatalf("Readdir: %v", err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	if len(names) != n {
+		t.Fatalf("got %d directories, want %d: %v", len(names), n, names)
+	}
+	for i, name := range names {
+		if want := fmt.Sprintf("dir%02d", i); name != want {
+			t.Fatalf("directory #%d: got %q, want %q", i, name, want)
+		}
+	}
+}
+
+func TestConcurrentMkdirSameName(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMetadataStore(newFakeDynamoDB())
+	m.MaxRetries = 1000
+	if err := m.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	s := &Server{MetadataStore: m}
+
+	const n = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.Mkdir(ctx, "/dir", 0777)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case errors.Is(err, os.ErrExist):
+		default:
+			t.Fatalf("Mkdir: %v", err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("got %d successful Mkdir calls, want 1", created)
+	}
+}
+
+func TestAddEntryRetriesExhausted(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDynamoDB()
+	m := newTestMetadataStore(db)
+	m.MaxRetries = 2
+	if err := m.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	anchor, err := m.GetReference(ctx, referenceID)
+	if err != nil {
+		t.Fatalf("GetReference: %v", err)
+	}
+	rootID := anchor.Entries["/"]
+
+	// Another writer changes the root directory right before every write.
+	db.beforeTransact = func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		item := db.table(m.ReferenceTableName)[rootID]
+		var ref Reference
+		if err := attributevalue.UnmarshalMap(item, &ref); err != nil {
+			t.Error(err)
+			return
+		}
+		ref.Version++
+		item["version"], _ = attributevalue.Marshal(ref.Version)
+	}
+
+	err = m.AddEntry(ctx, Entry{ID: "x", ParentID: rootID, Name: "x", Type: EntryTypeFile, Modify: time.Now(), Version: 1})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("AddEntry: got %v, want a *ConflictError", err)
+	}
+	if conflict.Attempts != 3 {
+		t.Fatalf("Attempts: got %d, want 3", conflict.Attempts)
+	}
+	var tce *types.TransactionCanceledException
+	if !errors.As(err, &tce) {
+		t.Fatalf("AddEntry: got %v, want it to wrap the last TransactionCanceledException", err)
+	}
+	if _, err := m.GetEntry(ctx, "x"); !errors.Is(err, ErrNoSuchEntry) {
+		t.Fatalf("GetEntry: got %v, want ErrNoSuchEntry", err)
+	}
+}
+
+func TestGetEntriesByParentIDPaginates(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.db.queryPageSize = 3
+	const n = 10
+	for i := 0; i < n; i++ {
+		if err := s.Mkdir(ctx, fmt.Sprintf("/dir%02d", i), 0777); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+	}
+	rootID, err := s.resolve(ctx, "/")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	entries, err := s.MetadataStore.GetEntriesByParentID(ctx, rootID)
+	if err != nil {
+		t.Fatalf("GetEntriesByParentID: %v", err)
+	}
+	if len(entries) != n {
+		t.Fatalf("got %d entries, want %d", len(entries), n)
+	}
+	for _, entry := range entries {
+		if entry.DeadProps == nil {
+			t.Fatalf("entry %q: DeadProps is nil", entry.Name)
+		}
+	}
+}
@@ -2,8 +2,8 @@ package awsfs
 
 import (
 	"context"
+	"errors"
 	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,34 +14,40 @@ func (s *Server) Mkdir(ctx context.Context, path string, perm os.FileMode) error
 	if path = slashClean(path); path == "/" {
 		return os.ErrExist
 	}
+	if s.inSnapshots(path) {
+		return os.ErrPermission
+	}
+	if err := checkTrash(ctx, path, true); err != nil {
+		return err
+	}
+	return s.mkdir(ctx, path)
+}
 
-	ref, err := s.MetadataStore.GetReference(ctx, referenceID)
+// mkdir creates the directory named by the clean path p.
+func (s *Server) mkdir(ctx context.Context, path string) error {
+	ref, name, err := s.resolveParent(ctx, path)
 	if err != nil {
 		return err
 	}
 
-	_, ok := ref.Entries[path]
+	_, ok := ref.Entries[name]
 	if ok {
 		return os.ErrExist
 	}
 
-	parentDirPath := filepath.Dir(path)
-
-	parentID, ok := ref.Entries[parentDirPath]
-	if !ok {
-		return os.ErrNotExist
-	}
-
 	newEntry := Entry{
 		ID:       uuid.New().String(),
-		ParentID: parentID,
-		Name:     filepath.Base(path),
+		ParentID: ref.ID,
+		Name:     name,
 		Type:     EntryTypeDir,
 		Size:     0,
 		Modify:   time.Now(),
 		Version:  1,
 	}
-	err = s.MetadataStore.AddEntry(ctx, newEntry, path)
+	err = s.MetadataStore.AddEntry(ctx, newEntry)
+	if errors.Is(err, ErrEntryExists) {
+		return os.ErrExist
+	}
 	if err != nil {
 		return err
 	}
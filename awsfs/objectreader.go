@@ -0,0 +1,119 @@
+package awsfs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+)
+
+const (
+	// readAheadMin and readAheadMax bound the size of a single ranged
+	// GetObject. The window starts small, so that short range requests stay
+	// cheap, and doubles while the object is read sequentially.
+	readAheadMin = 1 << 20
+	readAheadMax = 64 << 20
+
+	// readBufferSize is the size of the buffer in front of the response body.
+	readBufferSize = 256 << 10
+)
+
+// objectReader is an io.ReadSeekCloser over a stored object that fetches the
+// content on demand with ranged GetObject calls, so seeking to an offset and
+// reading a few bytes transfers only those bytes.
+type objectReader struct {
+	ctx   context.Context
+	store PhysicalStore
+	key   string
+	size  int64
+
+	pos int64 // offset of the next Read
+
+	body   io.ReadCloser // open ranged response, or nil
+	buf    *bufio.Reader // buffers body
+	end    int64         // offset just past the range of body
+	window int64         // size of the next range to fetch
+}
+
+func newObjectReader(ctx context.Context, store PhysicalStore, key string, size int64) *objectReader {
+	return &objectReader{
+		ctx:    ctx,
+		store:  store,
+		key:    key,
+		size:   size,
+		window: readAheadMin,
+	}
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body != nil && r.pos >= r.end {
+		// The range is used up and reading goes on; fetch a bigger one.
+		r.closeBody()
+		r.window = min(2*r.window, readAheadMax)
+	}
+	if r.body == nil {
+		length := min(r.window, r.size-r.pos)
+		body, err := r.store.GetObjectRange(r.ctx, r.key, r.pos, length)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+		r.end = r.pos + length
+		if r.buf == nil {
+			r.buf = bufio.NewReaderSize(body, readBufferSize)
+		} else {
+			r.buf.Reset(body)
+		}
+	}
+	if rest := r.end - r.pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := r.buf.Read(p)
+	r.pos += int64(n)
+	if err == io.EOF {
+		if r.pos < r.end {
+			// The object is shorter than its entry says.
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func (r *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != r.pos {
+		// A seek starts a new access pattern; drop the open range and the
+		// read-ahead that was built up.
+		r.closeBody()
+		r.window = readAheadMin
+		r.pos = offset
+	}
+	return r.pos, nil
+}
+
+func (r *objectReader) Close() error {
+	r.closeBody()
+	return nil
+}
+
+func (r *objectReader) closeBody() {
+	if r.body != nil {
+		_ = r.body.Close()
+		r.body = nil
+	}
+}
@@ -0,0 +1,154 @@
+package awsfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestObjectReader(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	data := make([]byte, 3*readAheadMin+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if _, err := s.Create(ctx, "/big", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	f, err := s.OpenFile(ctx, "/big", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+
+	// A short read at an offset fetches a single bounded range.
+	if _, err := f.Seek(1000, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	p := make([]byte, 24)
+	if _, err := io.ReadFull(f, p); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if !bytes.Equal(p, data[1000:1024]) {
+		t.Fatalf("got %v, want %v", p, data[1000:1024])
+	}
+	if want := []string{"bytes=1000-1049575"}; len(s.s3.ranges) != 1 || s.s3.ranges[0] != want[0] {
+		t.Fatalf("ranges: got %v, want %v", s.s3.ranges, want)
+	}
+
+	// A sequential read of the whole object uses growing ranges.
+	s.s3.ranges = nil
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("ReadAll: got %d bytes that differ from the %d bytes written", len(got), len(data))
+	}
+	if want := []string{"bytes=0-1048575", "bytes=1048576-3145727", "bytes=3145728-3145850"}; fmt.Sprint(s.s3.ranges) != fmt.Sprint(want) {
+		t.Fatalf("ranges: got %v, want %v", s.s3.ranges, want)
+	}
+
+	if n, err := f.Seek(0, io.SeekEnd); err != nil || n != int64(len(data)) {
+		t.Fatalf("Seek(0, io.SeekEnd): got %d, %v, want %d", n, err, len(data))
+	}
+	if _, err := f.Read(p); err != io.EOF {
+		t.Fatalf("Read at the end: got %v, want io.EOF", err)
+	}
+}
+
+func TestObjectReaderServeContent(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	if _, err := s.Create(ctx, "/f", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	f, err := s.OpenFile(ctx, "/f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/f", nil)
+	req.Header.Set("Range", "bytes=10-15")
+	rec := httptest.NewRecorder()
+	http.ServeContent(rec, req, "f.txt", time.Time{}, f)
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status: got %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	if got := rec.Body.String(); got != "abcdef" {
+		t.Fatalf("body: got %q, want %q", got, "abcdef")
+	}
+	// The read-ahead window is capped by the size of the object.
+	if len(s.s3.ranges) != 1 || s.s3.ranges[0] != "bytes=10-35" {
+		t.Fatalf("ranges: got %v, want [bytes=10-35]", s.s3.ranges)
+	}
+}
+
+func TestObjectReaderEmpty(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	if _, err := s.Create(ctx, "/empty", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, bytes.NewReader(nil)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	f, err := s.OpenFile(ctx, "/empty", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil || len(got) != 0 {
+		t.Fatalf("ReadAll: got %q, %v, want no data", got, err)
+	}
+	if len(s.s3.ranges) != 0 {
+		t.Fatalf("ranges: got %v, want no GetObject calls", s.s3.ranges)
+	}
+}
+
+func TestObjectReaderOverwritten(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.DeleteDelay = 50 * time.Millisecond
+	data := bytes.Repeat([]byte("old"), readAheadMin)
+	if _, err := s.Create(ctx, "/f", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	f, err := s.OpenFile(ctx, "/f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+	p := make([]byte, 10)
+	if _, err := io.ReadFull(f, p); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+
+	// A download that started before an overwrite reads the old content to
+	// the end, since its object outlives the overwrite for a while.
+	if _, err := s.Create(ctx, "/f", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, bytes.NewReader([]byte("new"))); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll after the overwrite: %v", err)
+	}
+	if got := append(p, rest...); !bytes.Equal(got, data) {
+		t.Fatalf("ReadAll after the overwrite: got %d bytes that differ from the old content", len(got))
+	}
+	s.Wait()
+	if keys := s.s3.keys(); len(keys) != 1 {
+		t.Fatalf("got objects %v after the delay, want only the new content", keys)
+	}
+}
@@ -2,12 +2,16 @@ package awsfs
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"io"
 	"io/fs"
+	"maps"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"time"
 
 	"github.com/webdav-serverless/webdav-serverless/webdav"
@@ -18,12 +22,48 @@ const referenceID = "root"
 var ErrNotSupported = errors.New("not supported")
 
 type FileInfo struct {
+	// id is the ID of the entry, by which ReadDir finds a directory.
+	id        string
 	name      string
 	size      int64
 	modTime   time.Time
 	isDir     bool
+	checksums Checksums
+	// checkedIn is the number of the version of a file.
+	checkedIn int
 	sys       any
-	deadProps map[xml.Name]webdav.Property
+	// deadProps are the dead properties of the entry as stored, or nil if
+	// they are not known.
+	deadProps map[string]string
+	// trash describes an entry in the trash; it is nil for other entries.
+	trash *TrashInfo
+}
+
+var (
+	_ webdav.ETager            = FileInfo{}
+	_ webdav.Digester          = FileInfo{}
+	_ webdav.ContentTyper      = FileInfo{}
+	_ webdav.DeadPropsReader   = FileInfo{}
+	_ webdav.VersionedFileInfo = FileInfo{}
+)
+
+func newFileInfo(entry Entry) FileInfo {
+	deadProps := entry.DeadProps
+	if deadProps == nil {
+		deadProps = map[string]string{}
+	}
+	return FileInfo{
+		id:        entry.ID,
+		name:      entry.Name,
+		size:      entry.Size,
+		modTime:   entry.Modify,
+		isDir:     entry.IsDir(),
+		checksums: entry.Checksums,
+		checkedIn: entry.checkedIn(),
+		sys:       nil,
+		deadProps: deadProps,
+		trash:     entry.Trash,
+	}
 }
 
 func (f FileInfo) Name() string {
@@ -53,18 +93,91 @@ func (f FileInfo) Sys() any {
 	return f.sys
 }
 
+// ETag returns the SHA-256 hash of the content as a strong ETag. Files
+// written before checksums were recorded fall back to the default ETag.
+func (f FileInfo) ETag(ctx context.Context) (string, error) {
+	if f.checksums.SHA256 == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + f.checksums.SHA256 + `"`, nil
+}
+
+// Digests returns the checksums of the content.
+func (f FileInfo) Digests(ctx context.Context) (sha256, md5 []byte, err error) {
+	if f.checksums.SHA256 == "" && f.checksums.MD5 == "" {
+		return nil, nil, webdav.ErrNotImplemented
+	}
+	if sha256, err = hex.DecodeString(f.checksums.SHA256); err != nil {
+		return nil, nil, err
+	}
+	if md5, err = hex.DecodeString(f.checksums.MD5); err != nil {
+		return nil, nil, err
+	}
+	if len(sha256) == 0 {
+		sha256 = nil
+	}
+	if len(md5) == 0 {
+		md5 = nil
+	}
+	return sha256, md5, nil
+}
+
+// ContentType returns the content type for the extension of the name, or
+// application/octet-stream for an unknown extension, so that PROPFIND never
+// reads the content to sniff its type.
+func (f FileInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(f.name)); ctype != "" {
+		return ctype, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// CheckedIn returns the number of the version of a file.
+func (f FileInfo) CheckedIn() int {
+	return f.checkedIn
+}
+
+// DeadProps returns the dead properties read with the entry.
+func (f FileInfo) DeadProps() (map[xml.Name]webdav.Property, error) {
+	if f.deadProps == nil {
+		return nil, webdav.ErrNotImplemented
+	}
+	return parseDeadProps(f.deadProps, f.trash)
+}
+
+// parseDeadProps unmarshals the dead properties of an entry, which are kept
+// as XML keyed by the namespace and the local name of the property. The
+// properties of an entry in the trash describe where it came from.
+func parseDeadProps(deadProps map[string]string, trash *TrashInfo) (map[xml.Name]webdav.Property, error) {
+	props := make(map[xml.Name]webdav.Property, len(deadProps))
+	for _, v := range deadProps {
+		var prop webdav.Property
+		err := xml.Unmarshal([]byte(v), &prop)
+		if err != nil {
+			return nil, err
+		}
+		props[prop.XMLName] = prop
+	}
+	if trash != nil {
+		maps.Copy(props, trashProps(trash))
+	}
+	return props, nil
+}
+
 func (s *Server) OpenFile(ctx context.Context, path string, flag int, perm os.FileMode) (webdav.File, error) {
 
 	if path = slashClean(path); path == "" {
 		return nil, os.ErrInvalid
 	}
-	ref, err := s.MetadataStore.GetReference(ctx, referenceID)
-	if err != nil {
+	if s.inSnapshots(path) {
+		return s.openSnapshot(ctx, path, flag)
+	}
+	if err := checkTrash(ctx, path, flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0); err != nil {
 		return nil, err
 	}
-	entryID, ok := ref.Entries[path]
-	if !ok {
-		return nil, os.ErrNotExist
+	entryID, err := s.resolve(ctx, path)
+	if err != nil {
+		return nil, err
 	}
 
 	entry, err := s.MetadataStore.GetEntry(ctx, entryID)
@@ -73,30 +186,15 @@ func (s *Server) OpenFile(ctx context.Context, path string, flag int, perm os.Fi
 	}
 	if entry.IsDir() {
 		return &FileReader{
-			tempFile:      nil,
 			entry:         entry,
 			metadataStore: s.MetadataStore,
 			ctx:           ctx,
+			children:      s.listChildren(ctx, path, entry.ID),
 		}, nil
 	}
 
-	r, err := s.PhysicalStore.GetObject(ctx, entryID)
-	if err != nil {
-		return nil, err
-	}
-
-	temp, err := os.CreateTemp(s.TempDir, "webdav-temp-")
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = io.Copy(temp, r)
-	if err != nil {
-		return nil, err
-	}
-
 	return &FileReader{
-		tempFile:      temp,
+		object:        newObjectReader(ctx, s.PhysicalStore, entry.ObjectKey(), entry.Size),
 		entry:         entry,
 		metadataStore: s.MetadataStore,
 		ctx:           ctx,
@@ -104,58 +202,58 @@ func (s *Server) OpenFile(ctx context.Context, path string, flag int, perm os.Fi
 }
 
 type FileReader struct {
-	tempFile      *os.File
+	// object reads the content of a file; it is nil for a directory.
+	object        *objectReader
 	entry         Entry
 	metadataStore MetadataStore
 	ctx           context.Context
+	// children lists the entries of a directory; Readdir advances it.
+	children EntryIterator
 }
 
 func (f FileReader) Close() error {
-	if f.tempFile == nil {
+	if f.object == nil {
 		return nil
 	}
-	err := f.tempFile.Close()
-	_ = os.Remove(f.tempFile.Name())
-	return err
+	return f.object.Close()
 }
 
 func (f FileReader) Read(p []byte) (n int, err error) {
-	return f.tempFile.Read(p)
+	if f.object == nil {
+		return 0, ErrNotSupported
+	}
+	return f.object.Read(p)
 }
 
 func (f FileReader) Seek(offset int64, whence int) (int64, error) {
-	return f.tempFile.Seek(offset, whence)
+	if f.object == nil {
+		return 0, ErrNotSupported
+	}
+	return f.object.Seek(offset, whence)
 }
 
+// Readdir follows the os.File semantics: with count > 0 it returns at most
+// count entries and io.EOF at the end of the directory, otherwise it returns
+// all remaining entries.
 func (f FileReader) Readdir(count int) ([]fs.FileInfo, error) {
-	if f.entry.Type == EntryTypeDir {
-		entries, err := f.metadataStore.GetEntriesByParentID(f.ctx, f.entry.ID)
-		if err != nil {
-			return nil, err
-		}
-		var files []fs.FileInfo
-		for _, entry := range entries {
-			files = append(files, FileInfo{
-				name:    entry.Name,
-				size:    entry.Size,
-				modTime: entry.Modify,
-				isDir:   entry.IsDir(),
-				sys:     nil,
-			})
-		}
-		return files, nil
+	if f.entry.Type != EntryTypeDir {
+		return nil, nil
 	}
-	return nil, nil
+	var files []fs.FileInfo
+	for (count <= 0 || len(files) < count) && f.children.Next(f.ctx) {
+		files = append(files, newFileInfo(f.children.Entry()))
+	}
+	if err := f.children.Err(); err != nil {
+		return files, err
+	}
+	if count > 0 && len(files) == 0 {
+		return nil, io.EOF
+	}
+	return files, nil
 }
 
 func (f FileReader) Stat() (fs.FileInfo, error) {
-	return FileInfo{
-		name:    f.entry.Name,
-		size:    f.entry.Size,
-		modTime: f.entry.Modify,
-		isDir:   f.entry.IsDir(),
-		sys:     nil,
-	}, nil
+	return newFileInfo(f.entry), nil
 }
 
 func (f FileReader) Write(p []byte) (n int, err error) {
@@ -163,16 +261,7 @@ func (f FileReader) Write(p []byte) (n int, err error) {
 }
 
 func (f FileReader) DeadProps() (map[xml.Name]webdav.Property, error) {
-	props := make(map[xml.Name]webdav.Property, len(f.entry.DeadProps))
-	for _, v := range f.entry.DeadProps {
-		var prop webdav.Property
-		err := xml.Unmarshal([]byte(v), &prop)
-		if err != nil {
-			return nil, err
-		}
-		props[prop.XMLName] = prop
-	}
-	return props, nil
+	return parseDeadProps(f.entry.DeadProps, f.entry.Trash)
 }
 
 func (f FileReader) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
@@ -0,0 +1,131 @@
+package awsfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+func TestReaddirCount(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.db.queryPageSize = 4
+	const n = 11
+	for i := 0; i < n; i++ {
+		if err := s.Mkdir(ctx, fmt.Sprintf("/dir%02d", i), 0777); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+	}
+
+	f, err := s.OpenFile(ctx, "/", 0, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+	var names []string
+	for {
+		infos, err := f.Readdir(3)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Readdir: %v", err)
+		}
+		if len(infos) == 0 || len(infos) > 3 {
+			t.Fatalf("Readdir(3): got %d entries", len(infos))
+		}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	if len(names) != n {
+		t.Fatalf("got %d entries, want %d: %v", len(names), n, names)
+	}
+	for i, name := range names {
+		if want := fmt.Sprintf("dir%02d", i); name != want {
+			t.Fatalf("entry #%d: got %q, want %q", i, name, want)
+		}
+	}
+	infos, err := f.Readdir(-1)
+	if err != nil || len(infos) != 0 {
+		t.Fatalf("Readdir(-1) at the end: got %d entries and %v, want none and nil", len(infos), err)
+	}
+}
+
+func TestReaddirAll(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.db.queryPageSize = 2
+	for i := 0; i < 5; i++ {
+		if err := s.Mkdir(ctx, fmt.Sprintf("/dir%d", i), 0777); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+	}
+	f, err := s.OpenFile(ctx, "/", 0, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+	first, err := f.Readdir(2)
+	if err != nil {
+		t.Fatalf("Readdir(2): %v", err)
+	}
+	rest, err := f.Readdir(0)
+	if err != nil {
+		t.Fatalf("Readdir(0): %v", err)
+	}
+	if len(first)+len(rest) != 5 {
+		t.Fatalf("got %d+%d entries, want 5", len(first), len(rest))
+	}
+}
+
+func TestPropfindReads(t *testing.T) {
+	s := newTestServer(t)
+	do := newTestHandler(t, s)
+	for _, dir := range []string{"/a", "/a/b", "/a/b/c"} {
+		if rec := do("MKCOL", dir, ""); rec.Code != http.StatusCreated {
+			t.Fatalf("MKCOL %s: got %d", dir, rec.Code)
+		}
+		for i := 0; i < 10; i++ {
+			if rec := do("PUT", fmt.Sprintf("%s/f%d", dir, i), "content"); rec.Code != http.StatusCreated {
+				t.Fatalf("PUT: got %d", rec.Code)
+			}
+		}
+	}
+	rec := do("PROPPATCH", "/a/b/f3", `<?xml version="1.0" encoding="utf-8" ?>
+		<D:propertyupdate xmlns:D="DAV:" xmlns:x="x:">
+			<D:set><D:prop><x:color>blue</x:color></D:prop></D:set>
+		</D:propertyupdate>`)
+	if rec.Code != webdav.StatusMulti {
+		t.Fatalf("PROPPATCH: got %d", rec.Code)
+	}
+
+	s.db.reads = 0
+	s.s3.ranges = nil
+	rec = do("PROPFIND", "/a", "", "Depth", "infinity")
+	if rec.Code != webdav.StatusMulti {
+		t.Fatalf("PROPFIND: got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if n := strings.Count(body, "<D:response>"); n != 33 {
+		t.Errorf("PROPFIND: got %d responses, want 33", n)
+	}
+	if !strings.Contains(body, "blue") {
+		t.Errorf("PROPFIND: the dead property of /a/b/f3 is missing")
+	}
+	// Resolving /a takes two reads, its entry one, and listing each of the
+	// three directories one Query.
+	if s.db.reads != 6 {
+		t.Errorf("PROPFIND: got %d DynamoDB reads, want 6", s.db.reads)
+	}
+	if len(s.s3.ranges) != 0 {
+		t.Errorf("PROPFIND: read objects %q", s.s3.ranges)
+	}
+}
@@ -2,20 +2,55 @@ package awsfs
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net/url"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-type PhysicalStore struct {
+// S3API is the part of the S3 client used by S3PhysicalStore.
+type S3API interface {
+	manager.UploadAPIClient
+	s3.ListObjectsV2APIClient
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+}
+
+// S3PhysicalStore is a PhysicalStore that keeps objects in an S3 bucket.
+type S3PhysicalStore struct {
 	BucketName string
-	S3Client   *s3.Client
+	S3Client   S3API
+}
+
+// Object describes a stored object.
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
 }
 
-func (s PhysicalStore) GetObject(ctx context.Context, objectKey string) (io.ReadCloser, error) {
+// deleteObjectsLimit is the maximum number of keys in a single DeleteObjects
+// call.
+const deleteObjectsLimit = 1000
+
+var (
+	// copyObjectLimit is the size of the largest object that CopyObject
+	// copies in a single call; S3 refuses larger ones.
+	copyObjectLimit int64 = 5 << 30
+	// copyPartSize is the part size of a multipart copy.
+	copyPartSize int64 = 512 << 20
+)
+
+func (s S3PhysicalStore) GetObject(ctx context.Context, objectKey string) (io.ReadCloser, error) {
 	result, err := s.S3Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.BucketName),
 		Key:    aws.String(objectKey),
@@ -27,20 +62,23 @@ func (s PhysicalStore) GetObject(ctx context.Context, objectKey string) (io.Read
 	return result.Body, nil
 }
 
-func (s PhysicalStore) PutObject(ctx context.Context, objectKey string, r io.Reader) error {
-	_, err := s.S3Client.PutObject(ctx, &s3.PutObjectInput{
+// GetObjectRange returns a reader for length bytes of the object starting at
+// offset.
+func (s S3PhysicalStore) GetObjectRange(ctx context.Context, objectKey string, offset, length int64) (io.ReadCloser, error) {
+	result, err := s.S3Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.BucketName),
 		Key:    aws.String(objectKey),
-		Body:   r,
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
 	})
 	if err != nil {
-		log.Printf("Couldn't upload to %v:%v. Here's why: %v\n",
-			s.BucketName, objectKey, err)
+		log.Printf("Couldn't get object %v:%v (bytes %d+%d). Here's why: %v\n", s.BucketName, objectKey, offset, length, err)
+		return nil, err
 	}
-	return err
+	return result.Body, nil
 }
 
-func (s PhysicalStore) PutObjectLarge(ctx context.Context, objectKey string, r io.Reader) error {
+// PutObject uploads the content of r to objectKey, in parts if it is large.
+func (s S3PhysicalStore) PutObject(ctx context.Context, objectKey string, r io.Reader) error {
 	var partMiBs int64 = 10
 	uploader := manager.NewUploader(s.S3Client, func(u *manager.Uploader) {
 		u.PartSize = partMiBs * 1024 * 1024
@@ -57,3 +95,128 @@ func (s PhysicalStore) PutObjectLarge(ctx context.Context, objectKey string, r i
 	}
 	return nil
 }
+
+// CopyObject copies the object srcKey of the given size to dstKey within the
+// bucket. Objects larger than a single CopyObject call allows are copied part
+// by part with UploadPartCopy.
+func (s S3PhysicalStore) CopyObject(ctx context.Context, srcKey, dstKey string, size int64) error {
+	source := url.PathEscape(s.BucketName) + "/" + url.PathEscape(srcKey)
+	if size <= copyObjectLimit {
+		_, err := s.S3Client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(s.BucketName),
+			Key:        aws.String(dstKey),
+			CopySource: aws.String(source),
+		})
+		if err != nil {
+			log.Printf("Couldn't copy object %v to %v. Here's why: %v\n", srcKey, dstKey, err)
+		}
+		return err
+	}
+
+	upload, err := s.S3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.BucketName),
+		Key:    aws.String(dstKey),
+	})
+	if err != nil {
+		log.Printf("Couldn't start copying object %v to %v. Here's why: %v\n", srcKey, dstKey, err)
+		return err
+	}
+	var parts []types.CompletedPart
+	for offset, n := int64(0), int32(1); offset < size; offset, n = offset+copyPartSize, n+1 {
+		end := min(offset+copyPartSize, size) - 1
+		out, err := s.S3Client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.BucketName),
+			Key:             aws.String(dstKey),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int32(n),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+		})
+		if err != nil {
+			log.Printf("Couldn't copy part %d of object %v to %v. Here's why: %v\n", n, srcKey, dstKey, err)
+			s.abortUpload(ctx, dstKey, upload.UploadId)
+			return err
+		}
+		parts = append(parts, types.CompletedPart{
+			ETag:       out.CopyPartResult.ETag,
+			PartNumber: aws.Int32(n),
+		})
+	}
+	_, err = s.S3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.BucketName),
+		Key:             aws.String(dstKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		log.Printf("Couldn't complete copying object %v to %v. Here's why: %v\n", srcKey, dstKey, err)
+		s.abortUpload(ctx, dstKey, upload.UploadId)
+		return err
+	}
+	return nil
+}
+
+func (s S3PhysicalStore) abortUpload(ctx context.Context, key string, uploadID *string) {
+	_, err := s.S3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.BucketName),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Printf("Couldn't abort upload of %v. Here's why: %v\n", key, err)
+	}
+}
+
+// DeleteObjects deletes the objects with the given keys. Keys that do not
+// name an object are ignored.
+func (s S3PhysicalStore) DeleteObjects(ctx context.Context, objectKeys []string) error {
+	var errs []error
+	for len(objectKeys) > 0 {
+		n := min(len(objectKeys), deleteObjectsLimit)
+		ids := make([]types.ObjectIdentifier, 0, n)
+		for _, key := range objectKeys[:n] {
+			ids = append(ids, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+		objectKeys = objectKeys[n:]
+
+		out, err := s.S3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.BucketName),
+			Delete: &types.Delete{
+				Objects: ids,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			log.Printf("Couldn't delete objects from %v. Here's why: %v\n", s.BucketName, err)
+			return err
+		}
+		for _, e := range out.Errors {
+			errs = append(errs, fmt.Errorf("failed to delete object %s: %s", aws.ToString(e.Key), aws.ToString(e.Message)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ListObjects calls fn for every object in the bucket, in key order.
+func (s S3PhysicalStore) ListObjects(ctx context.Context, fn func(Object) error) error {
+	p := s3.NewListObjectsV2Paginator(s.S3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.BucketName),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %w", err)
+		}
+		for _, obj := range page.Contents {
+			err := fn(Object{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
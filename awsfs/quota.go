@@ -0,0 +1,96 @@
+package awsfs
+
+import (
+	"context"
+	"log"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+// Usage is the storage used by the files of the tree, including those in the
+// trash: the size of their content, without kept versions, and their number.
+type Usage struct {
+	Bytes int64 `dynamodbav:"bytes"`
+	Files int64 `dynamodbav:"files"`
+}
+
+// exceeds reports whether adding delta to u takes a field above the same
+// field of limit, where zero is no limit. Shrinking never exceeds the limit,
+// so files can be deleted when the usage is above a lowered quota.
+func (u Usage) exceeds(delta, limit Usage) bool {
+	return delta.Bytes > 0 && limit.Bytes > 0 && u.Bytes+delta.Bytes > limit.Bytes ||
+		delta.Files > 0 && limit.Files > 0 && u.Files+delta.Files > limit.Files
+}
+
+// usageOf returns the usage of files.
+func usageOf(files []Entry) Usage {
+	var u Usage
+	for _, file := range files {
+		u.Bytes += file.Size
+		u.Files++
+	}
+	return u
+}
+
+// quota returns the limits of the usage, and whether there are any. The
+// usage is only counted if there are.
+func (s *Server) quota() (Usage, bool) {
+	limit := Usage{Bytes: s.QuotaBytes, Files: s.QuotaFiles}
+	return limit, limit != Usage{}
+}
+
+// addUsage adds delta to the usage, or fails with webdav.ErrQuotaExceeded if
+// that goes over the quota.
+func (s *Server) addUsage(ctx context.Context, delta Usage) error {
+	limit, ok := s.quota()
+	if !ok || delta == (Usage{}) {
+		return nil
+	}
+	return s.MetadataStore.AddUsage(ctx, delta, limit)
+}
+
+// releaseUsage takes delta, which an operation that failed added, off the
+// usage again. Failures are only logged; recounting the usage corrects them.
+func (s *Server) releaseUsage(delta Usage) {
+	err := s.addUsage(context.Background(), Usage{Bytes: -delta.Bytes, Files: -delta.Files})
+	if err != nil {
+		log.Printf("Couldn't release usage %+v. Here's why: %v\n", delta, err)
+	}
+}
+
+var _ webdav.Quotaer = (*Server)(nil)
+
+// Quota returns the bytes left in the quota and the bytes used by the whole
+// tree, which every resource shares.
+func (s *Server) Quota(ctx context.Context, name string) (available, used int64, err error) {
+	if _, ok := s.quota(); !ok {
+		return 0, 0, webdav.ErrNotImplemented
+	}
+	usage, err := s.MetadataStore.GetUsage(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	available = -1
+	if s.QuotaBytes > 0 {
+		available = max(s.QuotaBytes-usage.Bytes, 0)
+	}
+	return available, usage.Bytes, nil
+}
+
+// RecountUsage counts the usage of the tree anew and stores it. The usage is
+// only counted while a quota is set, so it has to be recounted when a quota
+// is set for an existing tree.
+func (s *Server) RecountUsage(ctx context.Context) (Usage, error) {
+	entries, err := s.walk(ctx)
+	if err != nil {
+		return Usage{}, err
+	}
+	var usage Usage
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			usage.Bytes += entry.Size
+			usage.Files++
+		}
+	}
+	return usage, s.MetadataStore.SetUsage(ctx, usage)
+}
@@ -0,0 +1,173 @@
+package awsfs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.QuotaBytes = 10
+	s.QuotaFiles = 3
+	s.KeepVersions = 1
+	do := newTestHandler(t, s)
+	usage := func() Usage {
+		t.Helper()
+		u, err := s.MetadataStore.GetUsage(ctx)
+		if err != nil {
+			t.Fatalf("GetUsage: %v", err)
+		}
+		return u
+	}
+
+	if code := do("PUT", "/f", "12345").Code; code != http.StatusCreated {
+		t.Fatalf("PUT: got %d, want %d", code, http.StatusCreated)
+	}
+	if code := do("PUT", "/g", "123456").Code; code != http.StatusInsufficientStorage {
+		t.Fatalf("PUT over the quota: got %d, want %d", code, http.StatusInsufficientStorage)
+	}
+	// An overwrite counts the difference, and kept versions do not count.
+	if code := do("PUT", "/f", "1234").Code; code != http.StatusCreated {
+		t.Fatalf("PUT over a file: got %d, want %d", code, http.StatusCreated)
+	}
+	if code := do("COPY", "/f", "", "Destination", "/g").Code; code != http.StatusCreated {
+		t.Fatalf("COPY: got %d, want %d", code, http.StatusCreated)
+	}
+	if code := do("COPY", "/f", "", "Destination", "/h").Code; code != http.StatusInsufficientStorage {
+		t.Fatalf("COPY over the quota: got %d, want %d", code, http.StatusInsufficientStorage)
+	}
+	if u := usage(); u != (Usage{Bytes: 8, Files: 2}) {
+		t.Fatalf("usage: got %+v, want 8 bytes in 2 files", u)
+	}
+	if len(s.s3.keys()) != 3 {
+		t.Fatalf("objects: got %q, want no leftovers of the refused writes", s.s3.keys())
+	}
+
+	rec := do("PROPFIND", "/", `<?xml version="1.0" encoding="utf-8" ?>
+		<D:propfind xmlns:D="DAV:">
+			<D:prop><D:quota-available-bytes/><D:quota-used-bytes/></D:prop>
+		</D:propfind>`, "Depth", "0")
+	body := rec.Body.String()
+	if rec.Code != webdav.StatusMulti ||
+		!strings.Contains(body, "<D:quota-available-bytes>2</D:quota-available-bytes>") ||
+		!strings.Contains(body, "<D:quota-used-bytes>8</D:quota-used-bytes>") {
+		t.Fatalf("PROPFIND of the quota: got %d %s", rec.Code, body)
+	}
+	if rec := do("PROPFIND", "/", "", "Depth", "0"); strings.Contains(rec.Body.String(), "quota") {
+		t.Fatalf("allprop PROPFIND: got %s, want no quota properties", rec.Body)
+	}
+
+	// Deleting frees the usage once the files are reaped.
+	if code := do("DELETE", "/g", "").Code; code != http.StatusNoContent {
+		t.Fatalf("DELETE: got %d, want %d", code, http.StatusNoContent)
+	}
+	s.Wait()
+	if u := usage(); u != (Usage{Bytes: 4, Files: 1}) {
+		t.Fatalf("usage after DELETE: got %+v, want 4 bytes in 1 file", u)
+	}
+	for _, name := range []string{"/a", "/b"} {
+		if code := do("PUT", name, "1").Code; code != http.StatusCreated {
+			t.Fatalf("PUT: got %d, want %d", code, http.StatusCreated)
+		}
+	}
+	if code := do("PUT", "/c", "1").Code; code != http.StatusInsufficientStorage {
+		t.Fatalf("PUT over the file quota: got %d, want %d", code, http.StatusInsufficientStorage)
+	}
+
+	// Recounting corrects a usage that went astray.
+	if err := s.MetadataStore.SetUsage(ctx, Usage{}); err != nil {
+		t.Fatalf("SetUsage: %v", err)
+	}
+	if u, err := s.RecountUsage(ctx); err != nil || u != (Usage{Bytes: 6, Files: 3}) {
+		t.Fatalf("RecountUsage: got %+v, %v, want 6 bytes in 3 files", u, err)
+	}
+	if u := usage(); u != (Usage{Bytes: 6, Files: 3}) {
+		t.Fatalf("usage after RecountUsage: got %+v", u)
+	}
+}
+
+func TestQuotaUnset(t *testing.T) {
+	s := newTestServer(t)
+	rec := newTestHandler(t, s)("PROPFIND", "/", `<?xml version="1.0" encoding="utf-8" ?>
+		<D:propfind xmlns:D="DAV:">
+			<D:prop><D:quota-used-bytes/></D:prop>
+		</D:propfind>`)
+	body := rec.Body.String()
+	if rec.Code != webdav.StatusMulti || !strings.Contains(body, "404 Not Found") {
+		t.Fatalf("PROPFIND of the quota without one: got %d %s", rec.Code, body)
+	}
+	u, err := s.MetadataStore.GetUsage(context.Background())
+	if err != nil || u != (Usage{}) {
+		t.Fatalf("GetUsage: got %+v, %v, want nothing counted", u, err)
+	}
+}
+
+// countingReader counts the bytes read from Reader.
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestQuotaBeforeUpload(t *testing.T) {
+	s := newTestServer(t)
+	s.QuotaBytes = 10
+	h := &webdav.Handler{FileSystem: s, LockSystem: webdav.NewMemLS()}
+	put := func(body *countingReader, contentLength int64) int {
+		t.Helper()
+		req := httptest.NewRequest("PUT", "/f", body)
+		req.ContentLength = contentLength
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// A Content-Length over the quota is refused without reading the body.
+	body := &countingReader{Reader: strings.NewReader(strings.Repeat("x", 11))}
+	if code := put(body, 11); code != http.StatusInsufficientStorage {
+		t.Fatalf("PUT over the quota: got %d, want %d", code, http.StatusInsufficientStorage)
+	}
+	if body.n != 0 {
+		t.Fatalf("PUT over the quota: read %d bytes of the body, want none", body.n)
+	}
+
+	// Without a Content-Length, the upload stops once it goes over.
+	body = &countingReader{Reader: io.LimitReader(zeroReader{}, 1<<30)}
+	if code := put(body, -1); code != http.StatusInsufficientStorage {
+		t.Fatalf("PUT of unknown length over the quota: got %d, want %d", code, http.StatusInsufficientStorage)
+	}
+	if body.n >= 1<<30 {
+		t.Fatalf("PUT of unknown length over the quota: read the whole body")
+	}
+	if keys := s.s3.keys(); len(keys) != 0 {
+		t.Fatalf("objects: got %q, want no leftovers of the refused upload", keys)
+	}
+
+	// An overwrite only needs room for the difference.
+	if code := put(&countingReader{Reader: strings.NewReader("123456")}, 6); code != http.StatusCreated {
+		t.Fatalf("PUT: got %d, want %d", code, http.StatusCreated)
+	}
+	if code := put(&countingReader{Reader: strings.NewReader("1234567890")}, 10); code != http.StatusCreated {
+		t.Fatalf("PUT over a file within the quota: got %d, want %d", code, http.StatusCreated)
+	}
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
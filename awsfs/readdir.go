@@ -0,0 +1,53 @@
+package awsfs
+
+import (
+	"context"
+	"os"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+var _ webdav.DirLister = (*Server)(nil)
+
+// ReadDir lists the directory name with a query of the parent index, which
+// returns the entries of its members with all their metadata, so that a
+// PROPFIND needs neither a Stat nor an OpenFile per member. If fi was returned
+// by the Server, the directory is found by the entry ID it carries instead of
+// resolving name. The entries of snapshots share their IDs with the tree, so
+// directories under SnapshotsPath are always found by name.
+func (s *Server) ReadDir(ctx context.Context, name string, fi os.FileInfo, fn func(os.FileInfo) error) error {
+	if name = slashClean(name); s.inSnapshots(name) {
+		entry, t, err := s.snapshotEntry(ctx, name)
+		if err != nil {
+			return err
+		}
+		it, err := s.listSnapshotEntry(ctx, entry, t)
+		if err != nil {
+			return err
+		}
+		return readDir(ctx, it, fn)
+	}
+	if err := checkTrash(ctx, name, false); err != nil {
+		return err
+	}
+	var id string
+	if info, ok := fi.(FileInfo); ok {
+		id = info.id
+	}
+	if id == "" {
+		var err error
+		if id, err = s.resolve(ctx, name); err != nil {
+			return err
+		}
+	}
+	return readDir(ctx, s.listChildren(ctx, name, id), fn)
+}
+
+func readDir(ctx context.Context, it EntryIterator, fn func(os.FileInfo) error) error {
+	for it.Next(ctx) {
+		if err := fn(newFileInfo(it.Entry())); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
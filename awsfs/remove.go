@@ -2,37 +2,96 @@ package awsfs
 
 import (
 	"context"
+	"log"
 	"os"
-	"strings"
 )
 
+// RemoveAll detaches path from the tree and returns; the entries and objects
+// below it are reaped in the background, or before it returns if SyncReap is
+// set. Entries whose reaping does not finish, for example because the
+// process exits, are picked up by ReapDeleted.
 func (s *Server) RemoveAll(ctx context.Context, path string) error {
 	if path = slashClean(path); path == "/" {
 		return os.ErrInvalid
 	}
+	if s.inSnapshots(path) {
+		return os.ErrPermission
+	}
+	if err := checkTrash(ctx, path, true); err != nil {
+		return err
+	}
 
-	ref, err := s.MetadataStore.GetReference(ctx, referenceID)
+	id, err := s.resolve(ctx, path)
 	if err != nil {
 		return err
 	}
 
-	_, ok := ref.Entries[path]
-	if !ok {
-		return os.ErrNotExist
+	entry, err := s.MetadataStore.GetEntry(ctx, id)
+	if err != nil {
+		return err
 	}
-	var ids []string
-	for k, v := range ref.Entries {
 
-		if k == path || strings.HasPrefix(k, path+"/") {
-			delete(ref.Entries, k)
-			ids = append(ids, v)
-		}
+	if s.Trash && !inTrash(path) {
+		return s.trash(ctx, path, entry)
 	}
 
-	err = s.MetadataStore.DeleteEntries(ctx, ids, ref)
+	err = s.MetadataStore.DeleteEntries(ctx, entry)
 	if err != nil {
 		return err
 	}
 
+	if s.SyncReap {
+		if err := s.reap(context.WithoutCancel(ctx), entry); err != nil {
+			// The entry is detached already, so the deletion has succeeded.
+			log.Printf("Couldn't reap %v. Here's why: %v\n", path, err)
+		}
+		return nil
+	}
+
+	s.reaping.Add(1)
+	go func() {
+		defer s.reaping.Done()
+		if err := s.reap(context.WithoutCancel(ctx), entry); err != nil {
+			log.Printf("Couldn't reap %v. Here's why: %v\n", path, err)
+		}
+	}()
+
 	return nil
 }
+
+// ReapDeleted reaps every entry that has been deleted but not reaped yet.
+func (s *Server) ReapDeleted(ctx context.Context) error {
+	entries, err := s.MetadataStore.GetDeletedEntries(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := s.reap(ctx, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait waits for the background work started by earlier calls, such as
+// reaping after RemoveAll and the delayed deletion of replaced content, to
+// finish.
+func (s *Server) Wait() {
+	s.reaping.Wait()
+}
+
+func (s *Server) reap(ctx context.Context, entry Entry) error {
+	return s.MetadataStore.ReapEntries(ctx, entry, func(files []Entry) error {
+		keys, err := s.releaseObjects(ctx, files)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := s.deleteObjects(ctx, keys); err != nil {
+				return err
+			}
+		}
+		freed := usageOf(files)
+		return s.addUsage(ctx, Usage{Bytes: -freed.Bytes, Files: -freed.Files})
+	})
+}
@@ -0,0 +1,136 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoveAllLargeTree(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	for _, dir := range []string{"/a", "/a/b", "/keep"} {
+		if err := s.Mkdir(ctx, dir, 0777); err != nil {
+			t.Fatalf("Mkdir %q: %v", dir, err)
+		}
+	}
+	// Far more descendants than fit in a single transaction.
+	for i := 0; i < 250; i++ {
+		name := fmt.Sprintf("/a/f%03d", i)
+		if i%2 == 1 {
+			name = fmt.Sprintf("/a/b/f%03d", i)
+		}
+		if _, err := s.Create(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader(name)); err != nil {
+			t.Fatalf("Create %q: %v", name, err)
+		}
+	}
+	if _, err := s.Create(ctx, "/keep/x", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader("x")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if err := s.RemoveAll(ctx, "/a"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if _, err := s.Stat(ctx, "/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Stat after RemoveAll: got %v, want os.ErrNotExist", err)
+	}
+	s.Wait()
+
+	if got := len(s.s3.keys()); got != 1 {
+		t.Fatalf("got %d objects, want 1", got)
+	}
+	// The root directory, /keep and /keep/x.
+	if got := len(s.db.table("entry")); got != 3 {
+		t.Fatalf("got %d entries, want 3", got)
+	}
+	// The anchor, the root directory and /keep.
+	if got := len(s.db.table("reference")); got != 3 {
+		t.Fatalf("got %d references, want 3", got)
+	}
+}
+
+func TestReapDeleted(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	if err := s.Mkdir(ctx, "/a", 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if _, err := s.Create(ctx, "/a/x", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader("x")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	id, err := s.resolve(ctx, "/a")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	entry, err := s.MetadataStore.GetEntry(ctx, id)
+	if err != nil {
+		t.Fatalf("GetEntry: %v", err)
+	}
+	// Detach without reaping, as if the process died right after.
+	if err := s.MetadataStore.DeleteEntries(ctx, entry); err != nil {
+		t.Fatalf("DeleteEntries: %v", err)
+	}
+	deleted, err := s.MetadataStore.GetDeletedEntries(ctx)
+	if err != nil {
+		t.Fatalf("GetDeletedEntries: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0].ID != id {
+		t.Fatalf("GetDeletedEntries: got %v, want only %q", deleted, id)
+	}
+
+	if err := s.ReapDeleted(ctx); err != nil {
+		t.Fatalf("ReapDeleted: %v", err)
+	}
+	if keys := s.s3.keys(); len(keys) != 0 {
+		t.Fatalf("got objects %v, want none", keys)
+	}
+	deleted, err = s.MetadataStore.GetDeletedEntries(ctx)
+	if err != nil {
+		t.Fatalf("GetDeletedEntries: %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Fatalf("GetDeletedEntries after ReapDeleted: got %v, want none", deleted)
+	}
+}
+
+func TestRemoveAllSyncReap(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.SyncReap = true
+	if err := s.Mkdir(ctx, "/a", 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if _, err := s.Create(ctx, "/a/f", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader("f")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.RemoveAll(ctx, "/a"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	// Without waiting for the background work, which there is none of.
+	if keys := s.s3.keys(); len(keys) != 0 {
+		t.Fatalf("got objects %v after RemoveAll, want none", keys)
+	}
+	if got := len(s.db.table("entry")); got != 1 {
+		t.Fatalf("got %d entries after RemoveAll, want the root directory", got)
+	}
+}
+
+func TestOverwriteSyncReap(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.SyncReap = true
+	s.DeleteDelay = time.Hour
+	for _, content := range []string{"old", "new"} {
+		if _, err := s.Create(ctx, "/f", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader(content)); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	// Without waiting for the delay, which would not run in a frozen process.
+	if keys := s.s3.keys(); len(keys) != 1 {
+		t.Fatalf("got objects %v after the overwrite, want only the new content", keys)
+	}
+}
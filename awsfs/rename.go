@@ -2,8 +2,8 @@ package awsfs
 
 import (
 	"context"
+	"errors"
 	"os"
-	"path/filepath"
 	"strings"
 )
 
@@ -14,43 +14,47 @@ func (s *Server) Rename(ctx context.Context, oldPath, newPath string) error {
 	if newPath = slashClean(newPath); newPath == "/" {
 		return os.ErrInvalid
 	}
+	if s.inSnapshots(oldPath) || s.inSnapshots(newPath) {
+		return os.ErrPermission
+	}
+	if err := checkTrash(ctx, oldPath, true); err != nil {
+		return err
+	}
+	if err := checkTrash(ctx, newPath, true); err != nil {
+		return err
+	}
+	if strings.HasPrefix(newPath, oldPath+"/") {
+		// We can't rename oldPath to be a sub-directory of itself.
+		return os.ErrInvalid
+	}
 
-	ref, err := s.MetadataStore.GetReference(ctx, referenceID)
+	id, err := s.resolve(ctx, oldPath)
 	if err != nil {
 		return err
 	}
-
-	id, ok := ref.Entries[oldPath]
-	if !ok {
-		return os.ErrNotExist
+	parent, name, err := s.resolveParent(ctx, newPath)
+	if err != nil {
+		return err
 	}
-	parentDirPath := filepath.Dir(newPath)
-	parentID, ok := ref.Entries[parentDirPath]
-	if !ok {
-		return os.ErrNotExist
+	if _, ok := parent.Entries[name]; ok {
+		return os.ErrExist
 	}
 
 	entry, err := s.MetadataStore.GetEntry(ctx, id)
 	if err != nil {
 		return err
 	}
-	entry.Name = filepath.Base(newPath)
-	entry.ParentID = parentID
 
-	ref.Entries[newPath] = id
-	delete(ref.Entries, oldPath)
-
-	if entry.Type == EntryTypeDir {
-		for k, v := range ref.Entries {
-			if strings.HasPrefix(k, oldPath+"/") {
-				delete(ref.Entries, k)
-				newPath := strings.Replace(k, oldPath, newPath, 1)
-				ref.Entries[newPath] = v
-			}
-		}
+	// Moving an entry out of the trash restores it.
+	var trash *TrashInfo
+	if inTrash(newPath) {
+		trash = entry.Trash
+	}
+	err = s.MetadataStore.UpdateEntryName(ctx, entry, parent.ID, name, trash)
+	if errors.Is(err, ErrEntryExists) {
+		// The name was taken after the check above.
+		return os.ErrExist
 	}
-
-	err = s.MetadataStore.UpdateEntryName(ctx, entry, ref)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,30 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRenameConcurrentCreate(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	if err := s.Mkdir(ctx, "/a", 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	// Another writer takes the new name after Rename checked it is free.
+	s.db.beforeTransact = func() {
+		s.db.beforeTransact = nil
+		if err := s.Mkdir(ctx, "/b", 0777); err != nil {
+			t.Errorf("Mkdir: %v", err)
+		}
+	}
+	if err := s.Rename(ctx, "/a", "/b"); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Rename onto a name taken meanwhile: got %v, want %v", err, os.ErrExist)
+	}
+	if _, err := s.Stat(ctx, "/a"); err != nil {
+		t.Fatalf("Stat of the source: %v", err)
+	}
+}
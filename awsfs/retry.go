@@ -0,0 +1,108 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// defaultMaxRetries is used when MaxRetries is zero.
+	defaultMaxRetries = 10
+	retryBaseDelay    = 5 * time.Millisecond
+	retryMaxDelay     = 500 * time.Millisecond
+)
+
+// ConflictError is returned when a write keeps failing its version check
+// because other writers, possibly in other processes, change the same items
+// in between.
+type ConflictError struct {
+	// Attempts is the number of times the write was tried.
+	Attempts int
+	// Err is the error of the last attempt.
+	Err error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflicting concurrent writes after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// retry calls fn until it succeeds, fails with an error other than a lost
+// version check, or runs out of attempts. Every call of fn must re-read what
+// it writes, since the previous attempt lost to a concurrent writer. The
+// attempt argument starts at zero.
+func (m DynamoDBMetadataStore) retry(ctx context.Context, fn func(attempt int) error) error {
+	return retry(ctx, m.MaxRetries, fn)
+}
+
+// retry implements DynamoDBMetadataStore.retry and LockSystem.retry.
+func retry(ctx context.Context, maxRetries int, fn func(attempt int) error) error {
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	}
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, backoff(attempt)); err != nil {
+				return err
+			}
+		}
+		if err = fn(attempt); !isConflict(err) {
+			return err
+		}
+	}
+	return &ConflictError{Attempts: maxRetries + 1, Err: err}
+}
+
+// backoff returns a random delay that grows exponentially with attempt.
+func backoff(attempt int) time.Duration {
+	d := retryMaxDelay
+	if attempt < 16 {
+		d = min(retryBaseDelay<<attempt, retryMaxDelay)
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// isConflict reports whether err is caused by a condition check failing, or
+// by a transaction colliding with another one.
+func isConflict(err error) bool {
+	if err == nil {
+		return false
+	}
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return true
+	}
+	var tc *types.TransactionConflictException
+	if errors.As(err, &tc) {
+		return true
+	}
+	var tce *types.TransactionCanceledException
+	if errors.As(err, &tce) {
+		for _, reason := range tce.CancellationReasons {
+			if code := reason.Code; code != nil && (*code == "ConditionalCheckFailed" || *code == "TransactionConflict") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,248 @@
+package awsfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type fakeObject struct {
+	data     []byte
+	modified time.Time
+}
+
+// fakeS3 is an in-memory stand-in for a single S3 bucket.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	uploads map[string]map[int32][]byte
+	nextID  int
+	// ranges records the Range of every GetObject call.
+	ranges []string
+}
+
+var _ S3API = (*fakeS3)(nil)
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string]fakeObject),
+		uploads: make(map[string]map[int32][]byte),
+	}
+}
+
+func newTestPhysicalStore(s3 *fakeS3) S3PhysicalStore {
+	return S3PhysicalStore{
+		BucketName: "bucket",
+		S3Client:   s3,
+	}
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) put(key string, data []byte, modified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = fakeObject{data: data, modified: modified}
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	var data []byte
+	if params.Body != nil {
+		var err error
+		if data, err = io.ReadAll(params.Body); err != nil {
+			return nil, err
+		}
+	}
+	f.put(aws.ToString(params.Key), data, time.Now())
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("no such key")}
+	}
+	data := obj.data
+	f.ranges = append(f.ranges, aws.ToString(params.Range))
+	if r := aws.ToString(params.Range); r != "" {
+		var start, end int64
+		if _, err := fmt.Sscanf(r, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, fmt.Errorf("fake s3: unsupported range %q", r)
+		}
+		end = min(end+1, int64(len(data)))
+		if start >= end {
+			return nil, fmt.Errorf("fake s3: invalid range %q", r)
+		}
+		data = data[start:end]
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+		LastModified:  aws.Time(obj.modified),
+	}, nil
+}
+
+// copySource returns the data of the object named by a CopySource, limited
+// to rng if it is not empty.
+func (f *fakeS3) copySource(source, rng string) ([]byte, error) {
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		return nil, err
+	}
+	_, key, _ := strings.Cut(source, "/")
+	obj, ok := f.objects[key]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("no such key")}
+	}
+	data := obj.data
+	if rng != "" {
+		var start, end int64
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || start > end || end >= int64(len(data)) {
+			return nil, fmt.Errorf("fake s3: invalid copy range %q", rng)
+		}
+		data = data[start : end+1]
+	}
+	return data, nil
+}
+
+func (f *fakeS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, err := f.copySource(aws.ToString(params.CopySource), "")
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > copyObjectLimit {
+		return nil, fmt.Errorf("fake s3: object too large to copy: %d", len(data))
+	}
+	f.objects[aws.ToString(params.Key)] = fakeObject{data: data, modified: time.Now()}
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeS3) UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts, ok := f.uploads[aws.ToString(params.UploadId)]
+	if !ok {
+		return nil, &types.NoSuchUpload{Message: aws.String("no such upload")}
+	}
+	data, err := f.copySource(aws.ToString(params.CopySource), aws.ToString(params.CopySourceRange))
+	if err != nil {
+		return nil, err
+	}
+	n := aws.ToInt32(params.PartNumber)
+	parts[n] = data
+	return &s3.UploadPartCopyOutput{
+		CopyPartResult: &types.CopyPartResult{ETag: aws.String(strconv.Itoa(int(n)))},
+	}, nil
+}
+
+func (f *fakeS3) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(params.Delete.Objects) > deleteObjectsLimit {
+		return nil, fmt.Errorf("fake s3: too many keys: %d", len(params.Delete.Objects))
+	}
+	for _, id := range params.Delete.Objects {
+		delete(f.objects, aws.ToString(id.Key))
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, aws.ToString(params.Prefix)) && k > aws.ToString(params.ContinuationToken) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	const pageSize = 2
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, k := range keys {
+		obj := f.objects[k]
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(k),
+			Size:         aws.Int64(int64(len(obj.data))),
+			LastModified: aws.Time(obj.modified),
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	id := strconv.Itoa(f.nextID)
+	f.uploads[id] = make(map[int32][]byte)
+	return &s3.CreateMultipartUploadOutput{Bucket: params.Bucket, Key: params.Key, UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts, ok := f.uploads[aws.ToString(params.UploadId)]
+	if !ok {
+		return nil, &types.NoSuchUpload{Message: aws.String("no such upload")}
+	}
+	parts[aws.ToInt32(params.PartNumber)] = data
+	return &s3.UploadPartOutput{ETag: aws.String(strconv.Itoa(int(aws.ToInt32(params.PartNumber))))}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := aws.ToString(params.UploadId)
+	parts, ok := f.uploads[id]
+	if !ok {
+		return nil, &types.NoSuchUpload{Message: aws.String("no such upload")}
+	}
+	var data []byte
+	for _, p := range params.MultipartUpload.Parts {
+		data = append(data, parts[aws.ToInt32(p.PartNumber)]...)
+	}
+	delete(f.uploads, id)
+	f.objects[aws.ToString(params.Key)] = fakeObject{data: data, modified: time.Now()}
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.uploads, aws.ToString(params.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
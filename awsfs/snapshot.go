@@ -0,0 +1,589 @@
+package awsfs
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+// SnapshotsPath is the read-only collection that serves the snapshots, each
+// as a collection named after the snapshot that holds the tree as it was
+// when the snapshot was created.
+const SnapshotsPath = "/.snapshots"
+
+// snapshotKeyPrefix starts the object keys of snapshot manifests, which are
+// snapshotKeyPrefix + name + "/" + UUID.
+const snapshotKeyPrefix = "snapshots/"
+
+var (
+	ErrNoSuchSnapshot = errors.New("no such snapshot")
+	ErrSnapshotExists = errors.New("snapshot already exists")
+)
+
+// Snapshot is a point-in-time copy of the namespace. The entries of the tree
+// are frozen in a manifest object, and the objects holding the content of
+// the files are pinned, so that they outlive the files until the snapshot is
+// deleted. Copying the tree costs one entry per file, not its content.
+type Snapshot struct {
+	Name    string    `dynamodbav:"name"`
+	Created time.Time `dynamodbav:"created"`
+	// Manifest is the key of the manifest in the PhysicalStore, and Size its
+	// size.
+	Manifest string `dynamodbav:"manifest"`
+	Size     int64  `dynamodbav:"size"`
+	// Pending is set while the snapshot is being created. Every object
+	// counts as pinned while a snapshot is pending, so a snapshot whose
+	// creation failed has to be deleted.
+	Pending bool `dynamodbav:"pending,omitempty"`
+}
+
+// snapshotManifest is the content of the manifest of a snapshot: the entries
+// of the tree below Root, without the versions of files.
+type snapshotManifest struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Root    string    `json:"root"`
+	Entries []Entry   `json:"entries"`
+}
+
+// validSnapshotName reports whether name can name a snapshot, which is a
+// collection under SnapshotsPath.
+func validSnapshotName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// CreateSnapshot freezes the tree as the snapshot name. The snapshot is
+// pending while the tree is read, so that no object it refers to is deleted
+// before it is pinned. The tree is read as it was at a single point in time,
+// see walk, so that a concurrent MOVE does not drop or duplicate entries.
+func (s *Server) CreateSnapshot(ctx context.Context, name string) (snap Snapshot, err error) {
+	if !validSnapshotName(name) {
+		return Snapshot{}, fmt.Errorf("%w: snapshot name %q", os.ErrInvalid, name)
+	}
+	snap = Snapshot{
+		Name:     name,
+		Created:  time.Now(),
+		Manifest: snapshotKeyPrefix + name + "/" + uuid.New().String(),
+	}
+	if err := s.MetadataStore.AddSnapshot(ctx, snap); err != nil {
+		return Snapshot{}, err
+	}
+	var keys []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		// Don't leave a pending snapshot behind, which would pin every
+		// object.
+		if _, err := s.MetadataStore.DeleteSnapshot(context.WithoutCancel(ctx), name, keys); err != nil {
+			log.Printf("Couldn't delete snapshot %v. Here's why: %v\n", name, err)
+		}
+		s.deleteObject(snap.Manifest)
+	}()
+
+	entries, err := s.walk(ctx)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	manifest := snapshotManifest{Name: name, Created: snap.Created, Root: entries[0].ID}
+	seen := make(map[string]bool)
+	for _, entry := range withoutTrash(entries, manifest.Root) {
+		entry.Versions = nil
+		manifest.Entries = append(manifest.Entries, entry)
+		if key := entry.ObjectKey(); !entry.IsDir() && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err := s.PhysicalStore.PutObject(ctx, snap.Manifest, bytes.NewReader(b)); err != nil {
+		return Snapshot{}, err
+	}
+	snap.Size = int64(len(b))
+	if err := s.MetadataStore.CompleteSnapshot(ctx, snap, keys); err != nil {
+		return Snapshot{}, err
+	}
+	return snap, nil
+}
+
+// withoutTrash returns entries, which list every directory before its
+// members, without the trash below the root directory rootID. Snapshots leave
+// the trash out, since the trash of each user is only for that user.
+func withoutTrash(entries []Entry, rootID string) []Entry {
+	trashed := make(map[string]bool)
+	kept := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.ParentID == rootID && entry.Name == path.Base(TrashPath) || trashed[entry.ParentID] {
+			trashed[entry.ID] = true
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return kept
+}
+
+// errTreeChanged is the error of a walk that kept seeing the tree change.
+var errTreeChanged = errors.New("tree changed while walking it")
+
+// walk returns the root directory and every entry below it, directory by
+// directory, as the directories were at a single point in time. It reads the
+// members of each directory from its Reference, and walks again if any of the
+// References changed by the end of the walk, so that an entry moved or
+// deleted meanwhile is neither missed nor returned twice. The entries of
+// files whose content was replaced meanwhile may have either content.
+func (s *Server) walk(ctx context.Context) ([]Entry, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, backoff(attempt)); err != nil {
+				return nil, err
+			}
+		}
+		entries, versions, err := s.readTree(ctx)
+		if err == nil {
+			err = s.checkVersions(ctx, versions)
+		}
+		if !errors.Is(err, errTreeChanged) {
+			return entries, err
+		}
+		if attempt == defaultMaxRetries {
+			return nil, &ConflictError{Attempts: attempt + 1, Err: err}
+		}
+	}
+}
+
+// readTree reads the entries of the tree, and the versions of the References
+// it read them from by ID. It fails with errTreeChanged if the References and
+// the entries disagree, because of a change in between.
+func (s *Server) readTree(ctx context.Context) ([]Entry, map[string]int, error) {
+	anchor, err := s.MetadataStore.GetReference(ctx, referenceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	versions := map[string]int{anchor.ID: anchor.Version}
+	rootID, ok := anchor.Entries["/"]
+	if !ok {
+		return nil, nil, ErrNoSuchEntry
+	}
+	root, err := s.MetadataStore.GetEntry(ctx, rootID)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := []Entry{root}
+	for dirs := []string{root.ID}; len(dirs) > 0; dirs = dirs[1:] {
+		ref, err := s.MetadataStore.GetReference(ctx, dirs[0])
+		if errors.Is(err, ErrNoSuchReference) {
+			return nil, nil, errTreeChanged
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		versions[ref.ID] = ref.Version
+		names := make([]string, 0, len(ref.Entries))
+		for name := range ref.Entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		ids := make([]string, len(names))
+		for i, name := range names {
+			ids[i] = ref.Entries[name]
+		}
+		children, err := s.MetadataStore.GetEntries(ctx, ids)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(children) != len(ids) {
+			return nil, nil, errTreeChanged
+		}
+		for _, child := range children {
+			if child.ParentID != ref.ID {
+				return nil, nil, errTreeChanged
+			}
+			entries = append(entries, child)
+			if child.IsDir() {
+				dirs = append(dirs, child.ID)
+			}
+		}
+	}
+	return entries, versions, nil
+}
+
+// checkVersions returns errTreeChanged if any of the References with the
+// given IDs no longer has the given version.
+func (s *Server) checkVersions(ctx context.Context, versions map[string]int) error {
+	for id, version := range versions {
+		ref, err := s.MetadataStore.GetReference(ctx, id)
+		if errors.Is(err, ErrNoSuchReference) {
+			return errTreeChanged
+		}
+		if err != nil {
+			return err
+		}
+		if ref.Version != version {
+			return errTreeChanged
+		}
+	}
+	return nil
+}
+
+// ListSnapshots returns the snapshots, oldest first.
+func (s *Server) ListSnapshots(ctx context.Context) ([]Snapshot, error) {
+	snapshots, err := s.MetadataStore.GetSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if !snapshots[i].Created.Equal(snapshots[j].Created) {
+			return snapshots[i].Created.Before(snapshots[j].Created)
+		}
+		return snapshots[i].Name < snapshots[j].Name
+	})
+	return snapshots, nil
+}
+
+// snapshot returns the snapshot name, or ErrNoSuchSnapshot.
+func (s *Server) snapshot(ctx context.Context, name string) (Snapshot, error) {
+	snapshots, err := s.MetadataStore.GetSnapshots(ctx)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, snap := range snapshots {
+		if snap.Name == name {
+			return snap, nil
+		}
+	}
+	return Snapshot{}, ErrNoSuchSnapshot
+}
+
+// DeleteSnapshot deletes the snapshot name, and with it the objects that only
+// the snapshot kept.
+func (s *Server) DeleteSnapshot(ctx context.Context, name string) error {
+	snap, err := s.snapshot(ctx, name)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	if !snap.Pending {
+		manifest, err := s.readManifest(ctx, snap)
+		if err != nil {
+			return err
+		}
+		for _, entry := range manifest.Entries {
+			if !entry.IsDir() {
+				keys = append(keys, entry.ObjectKey())
+			}
+		}
+	}
+	unpinned, err := s.MetadataStore.DeleteSnapshot(ctx, name, keys)
+	if err != nil {
+		return err
+	}
+	live, err := s.liveObjects(ctx, unpinned)
+	if err != nil {
+		return err
+	}
+	dead := []string{snap.Manifest}
+	for _, key := range unpinned {
+		if !live[key] {
+			dead = append(dead, key)
+		}
+	}
+	s.trees.remove(snap.Manifest)
+	return s.deleteObjects(ctx, dead)
+}
+
+func (s *Server) readManifest(ctx context.Context, snap Snapshot) (snapshotManifest, error) {
+	r, err := s.PhysicalStore.GetObjectRange(ctx, snap.Manifest, 0, snap.Size)
+	if err != nil {
+		return snapshotManifest{}, err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return snapshotManifest{}, err
+	}
+	var manifest snapshotManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return snapshotManifest{}, fmt.Errorf("failed to read manifest of snapshot %v: %w", snap.Name, err)
+	}
+	return manifest, nil
+}
+
+// deleteObjects deletes the objects with the given keys that no entry refers
+// to anymore, except those that a snapshot pins.
+func (s *Server) deleteObjects(ctx context.Context, keys []string) error {
+	pinned, err := s.MetadataStore.GetPinnedObjects(ctx, keys)
+	if err != nil || len(pinned) == len(keys) {
+		return err
+	}
+	if len(pinned) > 0 {
+		keys = without(keys, pinned)
+	}
+	return s.PhysicalStore.DeleteObjects(ctx, keys)
+}
+
+// without returns the elements of keys that are not in drop.
+func without(keys, drop []string) []string {
+	skip := make(map[string]bool, len(drop))
+	for _, key := range drop {
+		skip[key] = true
+	}
+	var rest []string
+	for _, key := range keys {
+		if !skip[key] {
+			rest = append(rest, key)
+		}
+	}
+	return rest
+}
+
+// snapshotTree is the frozen tree of a snapshot, read from its manifest.
+// Entries keep their IDs, so they are only looked up within the tree.
+type snapshotTree struct {
+	root Entry
+	// children are the entries of the directories by ID, sorted by name.
+	children map[string][]Entry
+}
+
+func newSnapshotTree(snap Snapshot, manifest snapshotManifest) *snapshotTree {
+	t := &snapshotTree{children: make(map[string][]Entry)}
+	// Manifests written before the trash was left out still have it.
+	for _, entry := range withoutTrash(manifest.Entries, manifest.Root) {
+		if entry.ID == manifest.Root {
+			t.root = entry
+			continue
+		}
+		t.children[entry.ParentID] = append(t.children[entry.ParentID], entry)
+	}
+	for _, children := range t.children {
+		sort.Slice(children, func(i, j int) bool { return children[i].Name < children[j].Name })
+	}
+	t.root.Name = snap.Name
+	t.root.Modify = snap.Created
+	return t
+}
+
+// lookup returns the entry of the clean path p within the tree.
+func (t *snapshotTree) lookup(p string) (Entry, bool) {
+	entry := t.root
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		children := t.children[entry.ID]
+		i := sort.Search(len(children), func(i int) bool { return children[i].Name >= name })
+		if !entry.IsDir() || i == len(children) || children[i].Name != name {
+			return Entry{}, false
+		}
+		entry = children[i]
+	}
+	return entry, true
+}
+
+// list returns an iterator over the children of the directory id.
+func (t *snapshotTree) list(id string) EntryIterator {
+	return &sliceEntryIterator{entries: t.children[id]}
+}
+
+// sliceEntryIterator iterates over entries that are already read.
+type sliceEntryIterator struct {
+	entries []Entry
+	entry   Entry
+}
+
+func (it *sliceEntryIterator) Next(ctx context.Context) bool {
+	if len(it.entries) == 0 {
+		return false
+	}
+	it.entry, it.entries = it.entries[0], it.entries[1:]
+	return true
+}
+
+func (it *sliceEntryIterator) Entry() Entry {
+	return it.entry
+}
+
+func (it *sliceEntryIterator) Err() error {
+	return nil
+}
+
+// inSnapshots reports whether the clean path p is served from the snapshots
+// rather than the tree.
+func (s *Server) inSnapshots(p string) bool {
+	return s.Snapshots && (p == SnapshotsPath || strings.HasPrefix(p, SnapshotsPath+"/"))
+}
+
+// treeCacheSize is the number of snapshot trees that a Server keeps in
+// memory.
+const treeCacheSize = 8
+
+// treeCache holds the most recently used snapshot trees by the key of their
+// manifest, which is never written twice. The zero value is an empty cache.
+type treeCache struct {
+	mu sync.Mutex
+	// order holds the keys, most recently used first.
+	order *list.List
+	trees map[string]*list.Element
+}
+
+// treeCacheItem is an element of treeCache.order.
+type treeCacheItem struct {
+	key  string
+	tree *snapshotTree
+}
+
+func (c *treeCache) get(key string) (*snapshotTree, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.trees[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*treeCacheItem).tree, true
+}
+
+// add caches t, dropping the least recently used tree if the cache is full.
+func (c *treeCache) add(key string, t *snapshotTree) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.trees == nil {
+		c.order = list.New()
+		c.trees = make(map[string]*list.Element)
+	}
+	if e, ok := c.trees[key]; ok {
+		e.Value.(*treeCacheItem).tree = t
+		c.order.MoveToFront(e)
+		return
+	}
+	c.trees[key] = c.order.PushFront(&treeCacheItem{key: key, tree: t})
+	if c.order.Len() > treeCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.trees, oldest.Value.(*treeCacheItem).key)
+	}
+}
+
+func (c *treeCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.trees[key]; ok {
+		c.order.Remove(e)
+		delete(c.trees, key)
+	}
+}
+
+// loadSnapshotTree returns the tree of the complete snapshot name, from the
+// cache if it was used recently.
+func (s *Server) loadSnapshotTree(ctx context.Context, name string) (*snapshotTree, error) {
+	snap, err := s.snapshot(ctx, name)
+	if errors.Is(err, ErrNoSuchSnapshot) || err == nil && snap.Pending {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := s.trees.get(snap.Manifest); ok {
+		return t, nil
+	}
+	manifest, err := s.readManifest(ctx, snap)
+	if err != nil {
+		return nil, err
+	}
+	t := newSnapshotTree(snap, manifest)
+	s.trees.add(snap.Manifest, t)
+	return t, nil
+}
+
+// snapshotEntry returns the entry of the clean path p under SnapshotsPath,
+// and the tree of the snapshot it belongs to. SnapshotsPath itself is a
+// directory of no snapshot, whose children are the roots of the snapshots.
+func (s *Server) snapshotEntry(ctx context.Context, p string) (Entry, *snapshotTree, error) {
+	rest := strings.TrimPrefix(p, SnapshotsPath)
+	if rest == "" {
+		entry := Entry{Name: path.Base(SnapshotsPath), Type: EntryTypeDir}
+		snapshots, err := s.MetadataStore.GetSnapshots(ctx)
+		if err != nil {
+			return Entry{}, nil, err
+		}
+		for _, snap := range snapshots {
+			if snap.Created.After(entry.Modify) {
+				entry.Modify = snap.Created
+			}
+		}
+		return entry, nil, nil
+	}
+	name, rest, _ := strings.Cut(rest[1:], "/")
+	t, err := s.loadSnapshotTree(ctx, name)
+	if err != nil {
+		return Entry{}, nil, err
+	}
+	entry, ok := t.lookup(rest)
+	if !ok {
+		return Entry{}, nil, os.ErrNotExist
+	}
+	return entry, t, nil
+}
+
+// listSnapshotEntry returns an iterator over the children of the directory
+// entry of the tree t, or over the roots of the complete snapshots if t is
+// nil.
+func (s *Server) listSnapshotEntry(ctx context.Context, entry Entry, t *snapshotTree) (EntryIterator, error) {
+	if t != nil {
+		return t.list(entry.ID), nil
+	}
+	snapshots, err := s.ListSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var roots []Entry
+	for _, snap := range snapshots {
+		if !snap.Pending {
+			roots = append(roots, Entry{Name: snap.Name, Type: EntryTypeDir, Modify: snap.Created})
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Name < roots[j].Name })
+	return &sliceEntryIterator{entries: roots}, nil
+}
+
+// openSnapshot is OpenFile for the clean path p under SnapshotsPath, which
+// can only be opened for reading.
+func (s *Server) openSnapshot(ctx context.Context, p string, flag int) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, os.ErrPermission
+	}
+	entry, t, err := s.snapshotEntry(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	f := &FileReader{
+		entry:         entry,
+		metadataStore: s.MetadataStore,
+		ctx:           ctx,
+	}
+	if !entry.IsDir() {
+		f.object = newObjectReader(ctx, s.PhysicalStore, entry.ObjectKey(), entry.Size)
+		return f, nil
+	}
+	if f.children, err = s.listSnapshotEntry(ctx, entry, t); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,270 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.Snapshots = true
+	do := newTestHandler(t, s)
+	get := func(path string) (int, string) {
+		t.Helper()
+		rec := do("GET", path, "")
+		return rec.Code, rec.Body.String()
+	}
+
+	if err := s.Mkdir(ctx, "/d", 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	for name, content := range map[string]string{"/d/f": "one", "/g": "gee"} {
+		if _, err := s.Create(ctx, name, 0, 0, strings.NewReader(content)); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	if _, err := s.CreateSnapshot(ctx, "s1"); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	if _, err := s.CreateSnapshot(ctx, "s1"); !errors.Is(err, ErrSnapshotExists) {
+		t.Fatalf("CreateSnapshot of an existing name: got %v, want %v", err, ErrSnapshotExists)
+	}
+	if _, err := s.CreateSnapshot(ctx, "a/b"); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("CreateSnapshot with a slash: got %v, want %v", err, os.ErrInvalid)
+	}
+
+	// Changes to the tree leave the snapshot alone.
+	if _, err := s.Create(ctx, "/d/f", 0, 0, strings.NewReader("two")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.RemoveAll(ctx, "/g"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	s.Wait()
+	if code, body := get("/.snapshots/s1/d/f"); code != http.StatusOK || body != "one" {
+		t.Fatalf("GET in the snapshot: got %d %q", code, body)
+	}
+	if code, body := get("/.snapshots/s1/g"); code != http.StatusOK || body != "gee" {
+		t.Fatalf("GET of a deleted file in the snapshot: got %d %q", code, body)
+	}
+	if code, body := get("/d/f"); code != http.StatusOK || body != "two" {
+		t.Fatalf("GET in the tree: got %d %q", code, body)
+	}
+	rec := do("PROPFIND", "/.snapshots/", "", "Depth", "1")
+	if rec.Code != webdav.StatusMulti || !strings.Contains(rec.Body.String(), "<D:href>/.snapshots/s1/</D:href>") {
+		t.Fatalf("PROPFIND of the snapshots: got %d %s", rec.Code, rec.Body)
+	}
+	rec = do("PROPFIND", "/.snapshots/s1/d/", "", "Depth", "1")
+	if rec.Code != webdav.StatusMulti || !strings.Contains(rec.Body.String(), "<D:getcontentlength>3</D:getcontentlength>") {
+		t.Fatalf("PROPFIND in the snapshot: got %d %s", rec.Code, rec.Body)
+	}
+
+	// The snapshot is read-only, but files can be copied out of it.
+	if code := do("PUT", "/.snapshots/s1/d/f", "three").Code; code != http.StatusForbidden {
+		t.Fatalf("PUT in the snapshot: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := do("DELETE", "/.snapshots/s1/d/f", "").Code; code < 400 {
+		t.Fatalf("DELETE in the snapshot: got %d", code)
+	}
+	if code := do("MKCOL", "/.snapshots/s1/e", "").Code; code < 400 {
+		t.Fatalf("MKCOL in the snapshot: got %d", code)
+	}
+	update := `<?xml version="1.0" encoding="utf-8" ?>
+		<D:update xmlns:D="DAV:"><D:version><D:href>/.snapshots/s1/d/f?version=1</D:href></D:version></D:update>`
+	if code := do("UPDATE", "/.snapshots/s1/d/f", update).Code; code != http.StatusForbidden {
+		t.Fatalf("UPDATE in the snapshot: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := do("MOVE", "/.snapshots/s1/g", "", "Destination", "/g").Code; code < 400 {
+		t.Fatalf("MOVE out of the snapshot: got %d", code)
+	}
+	if code := do("COPY", "/.snapshots/s1/g", "", "Destination", "/g").Code; code != http.StatusCreated {
+		t.Fatalf("COPY out of the snapshot: got %d, want %d", code, http.StatusCreated)
+	}
+	if code, body := get("/g"); code != http.StatusOK || body != "gee" {
+		t.Fatalf("GET of a restored file: got %d %q", code, body)
+	}
+
+	// The old content of f and g, the copy of g, the new content of f and the
+	// manifest.
+	if got := len(s.s3.keys()); got != 5 {
+		t.Fatalf("got %d objects, want 5: %q", got, s.s3.keys())
+	}
+	var orphans []string
+	err := s.CollectGarbage(ctx, 0, false, func(obj Object) { orphans = append(orphans, obj.Key) })
+	if err != nil || len(orphans) != 0 {
+		t.Fatalf("CollectGarbage: got %q, %v, want no orphans", orphans, err)
+	}
+
+	// Deleting the snapshot frees what only it kept.
+	if err := s.DeleteSnapshot(ctx, "s1"); err != nil {
+		t.Fatalf("DeleteSnapshot: %v", err)
+	}
+	if got := len(s.s3.keys()); got != 2 {
+		t.Fatalf("got %d objects after DeleteSnapshot, want 2: %q", got, s.s3.keys())
+	}
+	if code, _ := get("/.snapshots/s1/d/f"); code != http.StatusNotFound {
+		t.Fatalf("GET in a deleted snapshot: got %d, want %d", code, http.StatusNotFound)
+	}
+	if err := s.DeleteSnapshot(ctx, "s1"); !errors.Is(err, ErrNoSuchSnapshot) {
+		t.Fatalf("DeleteSnapshot of a deleted snapshot: got %v, want %v", err, ErrNoSuchSnapshot)
+	}
+}
+
+func TestSnapshotPending(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	if _, err := s.Create(ctx, "/f", 0, 0, strings.NewReader("one")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// A snapshot whose creation is under way keeps every object.
+	err := s.MetadataStore.AddSnapshot(ctx, Snapshot{Name: "s", Created: time.Now(), Manifest: "snapshots/s/m"})
+	if err != nil {
+		t.Fatalf("AddSnapshot: %v", err)
+	}
+	if err := s.RemoveAll(ctx, "/f"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	s.Wait()
+	if got := len(s.s3.keys()); got != 1 {
+		t.Fatalf("got %d objects, want 1", got)
+	}
+	if err := s.DeleteSnapshot(ctx, "s"); err != nil {
+		t.Fatalf("DeleteSnapshot: %v", err)
+	}
+	if err := s.CollectGarbage(ctx, 0, false, func(Object) {}); err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if keys := s.s3.keys(); len(keys) != 0 {
+		t.Fatalf("objects after CollectGarbage: %q", keys)
+	}
+}
+
+// hookedMetadataStore calls onGetReference before reading a Reference.
+type hookedMetadataStore struct {
+	MetadataStore
+	onGetReference func(id string)
+}
+
+func (m *hookedMetadataStore) GetReference(ctx context.Context, id string) (Reference, error) {
+	if m.onGetReference != nil {
+		m.onGetReference(id)
+	}
+	return m.MetadataStore.GetReference(ctx, id)
+}
+
+func TestSnapshotConcurrentMove(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.Snapshots = true
+	for _, dir := range []string{"/a", "/b"} {
+		if err := s.Mkdir(ctx, dir, 0777); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+	}
+	if _, err := s.Create(ctx, "/b/f", 0, 0, strings.NewReader("f")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	bID, err := s.resolve(ctx, "/b")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+
+	// Move /b/f into /a, which the walk has read already, just before the
+	// walk reads /b.
+	store := &hookedMetadataStore{MetadataStore: s.MetadataStore}
+	store.onGetReference = func(id string) {
+		if id != bID {
+			return
+		}
+		store.onGetReference = nil
+		if err := s.Rename(ctx, "/b/f", "/a/f"); err != nil {
+			t.Errorf("Rename: %v", err)
+		}
+	}
+	s.MetadataStore = store
+	if _, err := s.CreateSnapshot(ctx, "s"); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	if store.onGetReference != nil {
+		t.Fatalf("the walk did not read /b")
+	}
+	for name, want := range map[string]bool{"/a/f": true, "/b/f": false} {
+		_, err := s.Stat(ctx, SnapshotsPath+"/s"+name)
+		if got := err == nil; got != want {
+			t.Errorf("Stat of %s in the snapshot: got %v, want it to exist: %v", name, err, want)
+		}
+	}
+}
+
+func TestTreeCache(t *testing.T) {
+	var c treeCache
+	trees := make([]*snapshotTree, treeCacheSize+1)
+	for i := range trees {
+		trees[i] = &snapshotTree{}
+		c.add(fmt.Sprint(i), trees[i])
+		if i == 0 {
+			continue
+		}
+		// Using the first tree keeps it from being dropped.
+		if got, ok := c.get("0"); !ok || got != trees[0] {
+			t.Fatalf("get of the first tree after %d adds: got %v, %v", i+1, got, ok)
+		}
+	}
+	if _, ok := c.get("1"); ok {
+		t.Fatalf("get of the least recently used tree: got it, want it dropped")
+	}
+	if got, ok := c.get(fmt.Sprint(treeCacheSize)); !ok || got != trees[treeCacheSize] {
+		t.Fatalf("get of the last tree: got %v, %v", got, ok)
+	}
+	c.remove("0")
+	if _, ok := c.get("0"); ok {
+		t.Fatalf("get of a removed tree: got it")
+	}
+}
+
+func TestSnapshotTrash(t *testing.T) {
+	s := newTestServer(t)
+	s.Snapshots = true
+	s.Trash = true
+	alice := WithUser(context.Background(), "alice")
+	bob := WithUser(context.Background(), "bob")
+	if _, err := s.Create(alice, "/secret", 0, 0, strings.NewReader("alice-secret")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.RemoveAll(alice, "/secret"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if _, err := s.CreateSnapshot(alice, "s1"); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+
+	// The snapshot leaves the trash out, so it cannot be read through it.
+	var names []string
+	err := s.ReadDir(bob, SnapshotsPath+"/s1", nil, func(fi os.FileInfo) error {
+		names = append(names, fi.Name())
+		return nil
+	})
+	if err != nil || len(names) != 0 {
+		t.Fatalf("ReadDir of the snapshot: got %q, %v, want nothing", names, err)
+	}
+	for _, ctx := range []context.Context{alice, bob} {
+		if _, err := s.Stat(ctx, SnapshotsPath+"/s1"+TrashPath+"/alice"); !os.IsNotExist(err) {
+			t.Fatalf("Stat of the trash in the snapshot as %s: got %v, want not exist", userOf(ctx), err)
+		}
+	}
+	if err := s.Copy(bob, SnapshotsPath+"/s1", "/stolen", true); err != nil {
+		t.Fatalf("Copy of the snapshot: %v", err)
+	}
+	if _, err := s.Stat(bob, "/stolen"+TrashPath); !os.IsNotExist(err) {
+		t.Fatalf("Stat of the trash in a copy of the snapshot: got %v, want not exist", err)
+	}
+}
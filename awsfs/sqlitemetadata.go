@@ -0,0 +1,943 @@
+package awsfs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+	_ "modernc.org/sqlite"
+)
+
+// OpenSQLite opens the SQLite database file at path for a
+// SQLiteMetadataStore. Transactions take the write lock when they begin, so
+// that concurrent ones wait for each other instead of failing when they
+// upgrade from reading to writing.
+func OpenSQLite(path string) (*sql.DB, error) {
+	q := url.Values{}
+	q.Add("_pragma", "busy_timeout(10000)")
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Set("_txlock", "immediate")
+	return sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+}
+
+// SQLiteMetadataStore is a MetadataStore that keeps entries and References
+// in an SQLite database, for deployments that cannot use DynamoDB. Open the
+// database with OpenSQLite.
+//
+// The entry table holds one row per entry, indexed by parent_id. A Reference
+// is a row of the reference table, which carries its version, and one row
+// of the reference_entry table per child. Likewise, a Blob is a row of the
+// blob table and one row of the blob_ref table per reference, and a Snapshot
+// is a row of the snapshot table and one row of the pin table per pinned
+// object. The usage is the single row of the usage table. Every write is a
+// transaction.
+type SQLiteMetadataStore struct {
+	DB *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS entry (
+	id         TEXT PRIMARY KEY,
+	parent_id  TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	type       TEXT NOT NULL,
+	size       INTEGER NOT NULL,
+	modify     TEXT NOT NULL,
+	dead_props TEXT NOT NULL,
+	version    INTEGER NOT NULL,
+	object     TEXT NOT NULL DEFAULT '',
+	sha256     TEXT NOT NULL DEFAULT '',
+	md5        TEXT NOT NULL DEFAULT '',
+	checked_in INTEGER NOT NULL DEFAULT 0,
+	versions   TEXT NOT NULL DEFAULT '[]',
+	trash      TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS entry_parent_id ON entry (parent_id);
+CREATE TABLE IF NOT EXISTS reference (
+	id      TEXT PRIMARY KEY,
+	version INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS reference_entry (
+	reference_id TEXT NOT NULL,
+	name         TEXT NOT NULL,
+	entry_id     TEXT NOT NULL,
+	PRIMARY KEY (reference_id, name)
+);
+CREATE TABLE IF NOT EXISTS blob (
+	hash   TEXT PRIMARY KEY,
+	object TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS blob_ref (
+	hash     TEXT NOT NULL,
+	entry_id TEXT NOT NULL,
+	PRIMARY KEY (hash, entry_id)
+);
+CREATE TABLE IF NOT EXISTS snapshot (
+	name     TEXT PRIMARY KEY,
+	created  TEXT NOT NULL,
+	manifest TEXT NOT NULL,
+	size     INTEGER NOT NULL,
+	pending  INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS pin (
+	object   TEXT NOT NULL,
+	snapshot TEXT NOT NULL,
+	PRIMARY KEY (object, snapshot)
+);
+CREATE TABLE IF NOT EXISTS usage (
+	id    INTEGER PRIMARY KEY CHECK (id = 0),
+	bytes INTEGER NOT NULL,
+	files INTEGER NOT NULL
+);
+`
+
+const entryColumns = "id, parent_id, name, type, size, modify, dead_props, version, object, sha256, md5, checked_in, versions, trash"
+
+// sqliteAddedColumns are the columns of the entry table that databases
+// created by earlier versions lack. Init adds them.
+var sqliteAddedColumns = []struct{ name, decl string }{
+	{"sha256", "TEXT NOT NULL DEFAULT ''"},
+	{"md5", "TEXT NOT NULL DEFAULT ''"},
+	{"checked_in", "INTEGER NOT NULL DEFAULT 0"},
+	{"versions", "TEXT NOT NULL DEFAULT '[]'"},
+	{"trash", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// sqlQueryer is implemented by *sql.DB and *sql.Tx.
+type sqlQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Init creates the tables and the root directory if the database is empty.
+func (m SQLiteMetadataStore) Init(ctx context.Context) error {
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, sqliteSchema); err != nil {
+			return fmt.Errorf("failed to create tables: %w", err)
+		}
+		if err := m.addColumns(ctx, tx); err != nil {
+			return err
+		}
+		_, err := m.getReference(ctx, tx, referenceID)
+		if !errors.Is(err, ErrNoSuchReference) {
+			return err
+		}
+		entryID := uuid.New().String()
+		err = m.insertEntry(ctx, tx, Entry{
+			ID:       entryID,
+			ParentID: referenceID,
+			Name:     "/",
+			Type:     EntryTypeDir,
+			Size:     0,
+			Modify:   time.Now(),
+			Version:  1,
+		})
+		if err != nil {
+			return err
+		}
+		if err := m.insertReference(ctx, tx, referenceID); err != nil {
+			return err
+		}
+		if err := m.link(ctx, tx, referenceID, "/", entryID); err != nil {
+			return err
+		}
+		return m.insertReference(ctx, tx, entryID)
+	})
+}
+
+// addColumns adds the sqliteAddedColumns that the entry table lacks.
+func (m SQLiteMetadataStore) addColumns(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, "SELECT name FROM pragma_table_info('entry')")
+	if err != nil {
+		return fmt.Errorf("failed to get columns: %w", err)
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf("failed to scan column: %w", err)
+		}
+		columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get columns: %w", err)
+	}
+	for _, c := range sqliteAddedColumns {
+		if columns[c.name] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "ALTER TABLE entry ADD COLUMN "+c.name+" "+c.decl); err != nil {
+			return fmt.Errorf("failed to add column %s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+// transact runs fn in a transaction, which is committed if fn succeeds and
+// rolled back otherwise.
+func (m SQLiteMetadataStore) transact(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (m SQLiteMetadataStore) GetReference(ctx context.Context, id string) (Reference, error) {
+	return m.getReference(ctx, m.DB, id)
+}
+
+func (m SQLiteMetadataStore) getReference(ctx context.Context, q sqlQueryer, id string) (Reference, error) {
+	ref := Reference{ID: id, Entries: make(map[string]string)}
+	err := q.QueryRowContext(ctx, "SELECT version FROM reference WHERE id = ?", id).Scan(&ref.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Reference{}, ErrNoSuchReference
+	}
+	if err != nil {
+		return Reference{}, fmt.Errorf("failed to get reference: %w", err)
+	}
+	rows, err := q.QueryContext(ctx, "SELECT name, entry_id FROM reference_entry WHERE reference_id = ?", id)
+	if err != nil {
+		return Reference{}, fmt.Errorf("failed to get reference: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, entryID string
+		if err := rows.Scan(&name, &entryID); err != nil {
+			return Reference{}, fmt.Errorf("failed to scan reference: %w", err)
+		}
+		ref.Entries[name] = entryID
+	}
+	if err := rows.Err(); err != nil {
+		return Reference{}, fmt.Errorf("failed to get reference: %w", err)
+	}
+	return ref, nil
+}
+
+func (m SQLiteMetadataStore) insertReference(ctx context.Context, tx *sql.Tx, id string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO reference (id, version) VALUES (?, 1)", id)
+	if err != nil {
+		return fmt.Errorf("failed to insert reference: %w", err)
+	}
+	return nil
+}
+
+// bumpReference increments the version of the Reference id, since its
+// entries are about to change.
+func (m SQLiteMetadataStore) bumpReference(ctx context.Context, tx *sql.Tx, id string) error {
+	res, err := tx.ExecContext(ctx, "UPDATE reference SET version = version + 1 WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to update reference: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to update reference: %w", err)
+	} else if n == 0 {
+		return ErrNoSuchReference
+	}
+	return nil
+}
+
+// link adds name to the Reference refID, failing with ErrEntryExists if the
+// name is taken.
+func (m SQLiteMetadataStore) link(ctx context.Context, tx *sql.Tx, refID, name, entryID string) error {
+	var taken int
+	err := tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM reference_entry WHERE reference_id = ? AND name = ?", refID, name).Scan(&taken)
+	if err != nil {
+		return fmt.Errorf("failed to get reference: %w", err)
+	}
+	if taken > 0 {
+		return ErrEntryExists
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO reference_entry (reference_id, name, entry_id) VALUES (?, ?, ?)", refID, name, entryID)
+	if err != nil {
+		return fmt.Errorf("failed to insert reference entry: %w", err)
+	}
+	return nil
+}
+
+func (m SQLiteMetadataStore) unlink(ctx context.Context, tx *sql.Tx, refID, name string) error {
+	_, err := tx.ExecContext(ctx,
+		"DELETE FROM reference_entry WHERE reference_id = ? AND name = ?", refID, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete reference entry: %w", err)
+	}
+	return nil
+}
+
+// scanEntry reads an entry from a row holding entryColumns.
+func scanEntry(row interface{ Scan(dest ...any) error }) (Entry, error) {
+	var entry Entry
+	var modify, deadProps, versions, trash string
+	err := row.Scan(&entry.ID, &entry.ParentID, &entry.Name, &entry.Type, &entry.Size,
+		&modify, &deadProps, &entry.Version, &entry.Object, &entry.SHA256, &entry.MD5,
+		&entry.CheckedIn, &versions, &trash)
+	if err != nil {
+		return Entry{}, err
+	}
+	if entry.Modify, err = time.Parse(time.RFC3339Nano, modify); err != nil {
+		return Entry{}, fmt.Errorf("failed to parse modify time: %w", err)
+	}
+	if err := json.Unmarshal([]byte(deadProps), &entry.DeadProps); err != nil {
+		return Entry{}, fmt.Errorf("failed to unmarshal dead props: %w", err)
+	}
+	if entry.DeadProps == nil {
+		entry.DeadProps = make(map[string]string)
+	}
+	if err := json.Unmarshal([]byte(versions), &entry.Versions); err != nil {
+		return Entry{}, fmt.Errorf("failed to unmarshal versions: %w", err)
+	}
+	if len(entry.Versions) == 0 {
+		entry.Versions = nil
+	}
+	if trash != "" {
+		if err := json.Unmarshal([]byte(trash), &entry.Trash); err != nil {
+			return Entry{}, fmt.Errorf("failed to unmarshal trash info: %w", err)
+		}
+	}
+	return entry, nil
+}
+
+func marshalVersions(versions []FileVersion) (string, error) {
+	if versions == nil {
+		versions = []FileVersion{}
+	}
+	b, err := json.Marshal(versions)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal versions: %w", err)
+	}
+	return string(b), nil
+}
+
+func marshalDeadProps(props map[string]string) (string, error) {
+	if props == nil {
+		props = map[string]string{}
+	}
+	b, err := json.Marshal(props)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal dead props: %w", err)
+	}
+	return string(b), nil
+}
+
+// marshalTrash returns the trash info as stored, which is empty for an entry
+// that is not in the trash.
+func marshalTrash(trash *TrashInfo) (string, error) {
+	if trash == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(trash)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal trash info: %w", err)
+	}
+	return string(b), nil
+}
+
+func (m SQLiteMetadataStore) insertEntry(ctx context.Context, tx *sql.Tx, entry Entry) error {
+	deadProps, err := marshalDeadProps(entry.DeadProps)
+	if err != nil {
+		return err
+	}
+	versions, err := marshalVersions(entry.Versions)
+	if err != nil {
+		return err
+	}
+	trash, err := marshalTrash(entry.Trash)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO entry ("+entryColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		entry.ID, entry.ParentID, entry.Name, string(entry.Type), entry.Size,
+		entry.Modify.UTC().Format(time.RFC3339Nano), deadProps, entry.Version, entry.Object,
+		entry.SHA256, entry.MD5, entry.CheckedIn, versions, trash)
+	if err != nil {
+		return fmt.Errorf("failed to insert entry: %w", err)
+	}
+	return nil
+}
+
+func (m SQLiteMetadataStore) GetEntry(ctx context.Context, id string) (Entry, error) {
+	return m.getEntry(ctx, m.DB, id)
+}
+
+func (m SQLiteMetadataStore) getEntry(ctx context.Context, q sqlQueryer, id string) (Entry, error) {
+	entry, err := scanEntry(q.QueryRowContext(ctx, "SELECT "+entryColumns+" FROM entry WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Entry{}, ErrNoSuchEntry
+	}
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to get entry: %w", err)
+	}
+	return entry, nil
+}
+
+// GetEntries returns the entries with the given IDs, in no particular order.
+// IDs that do not name an entry are skipped.
+func (m SQLiteMetadataStore) GetEntries(ctx context.Context, ids []string) ([]Entry, error) {
+	var entries []Entry
+	for len(ids) > 0 {
+		n := min(len(ids), batchGetLimit)
+		args := make([]any, n)
+		for i, id := range ids[:n] {
+			args[i] = id
+		}
+		ids = ids[n:]
+		placeholders := strings.Repeat(", ?", n)[2:]
+		batch, err := m.queryEntries(ctx, "SELECT "+entryColumns+" FROM entry WHERE id IN ("+placeholders+")", args...)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, batch...)
+	}
+	return entries, nil
+}
+
+func (m SQLiteMetadataStore) queryEntries(ctx context.Context, query string, args ...any) ([]Entry, error) {
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query entry: %w", err)
+	}
+	defer rows.Close()
+	var entries []Entry
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query entry: %w", err)
+	}
+	return entries, nil
+}
+
+// GetEntriesByParentID returns the entries whose parent is id, sorted by
+// name.
+func (m SQLiteMetadataStore) GetEntriesByParentID(ctx context.Context, id string) ([]Entry, error) {
+	return m.queryEntries(ctx, "SELECT "+entryColumns+" FROM entry WHERE parent_id = ? ORDER BY name", id)
+}
+
+// ListEntriesByParentID returns an iterator over the entries whose parent is
+// id. Entries are read batchGetLimit at a time as the iterator advances.
+func (m SQLiteMetadataStore) ListEntriesByParentID(id string) EntryIterator {
+	return &sqliteEntryIterator{m: m, parentID: id}
+}
+
+// sqliteEntryIterator pages through the children of a directory by name,
+// so no statement stays open between calls of Next.
+type sqliteEntryIterator struct {
+	m        SQLiteMetadataStore
+	parentID string
+	after    string
+	page     []Entry
+	done     bool
+	entry    Entry
+	err      error
+}
+
+func (it *sqliteEntryIterator) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+	if len(it.page) == 0 {
+		if it.done {
+			return false
+		}
+		it.page, it.err = it.m.queryEntries(ctx,
+			"SELECT "+entryColumns+" FROM entry WHERE parent_id = ? AND name > ? ORDER BY name LIMIT ?",
+			it.parentID, it.after, batchGetLimit)
+		if it.err != nil {
+			return false
+		}
+		it.done = len(it.page) < batchGetLimit
+		if len(it.page) == 0 {
+			return false
+		}
+	}
+	it.entry, it.page = it.page[0], it.page[1:]
+	it.after = it.entry.Name
+	return true
+}
+
+func (it *sqliteEntryIterator) Entry() Entry {
+	return it.entry
+}
+
+func (it *sqliteEntryIterator) Err() error {
+	return it.err
+}
+
+// AddEntry stores entry and links it into the Reference of its parent
+// directory. A directory entry also gets an empty Reference of its own.
+func (m SQLiteMetadataStore) AddEntry(ctx context.Context, entry Entry) error {
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		if err := m.bumpReference(ctx, tx, entry.ParentID); err != nil {
+			return err
+		}
+		if err := m.link(ctx, tx, entry.ParentID, entry.Name, entry.ID); err != nil {
+			return err
+		}
+		if err := m.insertEntry(ctx, tx, entry); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return m.insertReference(ctx, tx, entry.ID)
+		}
+		return nil
+	})
+}
+
+// UpdateEntry stores the size, modification time and dead properties of
+// entry, provided that its version is still entry.Version.
+func (m SQLiteMetadataStore) UpdateEntry(ctx context.Context, entry Entry) error {
+	deadProps, err := marshalDeadProps(entry.DeadProps)
+	if err != nil {
+		return err
+	}
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx,
+			"UPDATE entry SET size = ?, modify = ?, dead_props = ?, version = version + 1 WHERE id = ? AND version = ?",
+			entry.Size, entry.Modify.UTC().Format(time.RFC3339Nano), deadProps, entry.ID, entry.Version)
+		if err != nil {
+			return fmt.Errorf("failed to update entry: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to update entry: %w", err)
+		} else if n == 0 {
+			if _, err := m.getEntry(ctx, tx, entry.ID); err != nil {
+				return err
+			}
+			return &ConflictError{Attempts: 1, Err: errVersionMismatch}
+		}
+		return nil
+	})
+}
+
+// UpdateEntryObject points the file entry id at the object key holding new
+// content of the given size and checksums, keeping the replaced content as
+// the newest of at most keep earlier versions. It returns the keys of the
+// objects that the entry no longer refers to.
+func (m SQLiteMetadataStore) UpdateEntryObject(ctx context.Context, id, key string, size int64, sum Checksums, modify time.Time, keep int) ([]string, error) {
+	var dropped []string
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		entry, err := m.getEntry(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return ErrIsDir
+		}
+		keys := entry.replaceObject(key, size, sum, modify, keep)
+		versions, err := marshalVersions(entry.Versions)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			"UPDATE entry SET object = ?, size = ?, sha256 = ?, md5 = ?, modify = ?, checked_in = ?, versions = ?, version = version + 1 WHERE id = ?",
+			key, size, sum.SHA256, sum.MD5, modify.UTC().Format(time.RFC3339Nano), entry.CheckedIn, versions, id)
+		if err != nil {
+			return fmt.Errorf("failed to update entry: %w", err)
+		}
+		dropped = keys
+		return nil
+	})
+	return dropped, err
+}
+
+// UpdateEntryName moves the entry with the ID of entry to the given name in
+// directory parentID and sets its trash info. The stored entry is read in the
+// same transaction, so a stale entry is not an error.
+func (m SQLiteMetadataStore) UpdateEntryName(ctx context.Context, entry Entry, parentID, name string, trash *TrashInfo) error {
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		stored, err := m.getEntry(ctx, tx, entry.ID)
+		if err != nil {
+			return err
+		}
+		if err := m.bumpReference(ctx, tx, parentID); err != nil {
+			return err
+		}
+		if parentID != stored.ParentID {
+			if err := m.bumpReference(ctx, tx, stored.ParentID); err != nil {
+				return err
+			}
+		}
+		if err := m.link(ctx, tx, parentID, name, stored.ID); err != nil {
+			return err
+		}
+		if err := m.unlink(ctx, tx, stored.ParentID, stored.Name); err != nil {
+			return err
+		}
+		trashInfo, err := marshalTrash(trash)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			"UPDATE entry SET parent_id = ?, name = ?, trash = ?, version = version + 1 WHERE id = ?",
+			parentID, name, trashInfo, stored.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update entry: %w", err)
+		}
+		return nil
+	})
+}
+
+// DeleteEntries detaches entry from its parent directory and marks it, and
+// with it everything below it, as deleted.
+func (m SQLiteMetadataStore) DeleteEntries(ctx context.Context, entry Entry) error {
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		stored, err := m.getEntry(ctx, tx, entry.ID)
+		if err != nil {
+			return err
+		}
+		if err := m.bumpReference(ctx, tx, stored.ParentID); err != nil {
+			return err
+		}
+		if err := m.unlink(ctx, tx, stored.ParentID, stored.Name); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			"UPDATE entry SET parent_id = ?, version = version + 1 WHERE id = ?", deletedParentID, stored.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update entry: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetDeletedEntries returns the entries that DeleteEntries has marked as
+// deleted and that have not been reaped yet.
+func (m SQLiteMetadataStore) GetDeletedEntries(ctx context.Context) ([]Entry, error) {
+	return m.GetEntriesByParentID(ctx, deletedParentID)
+}
+
+// ReapEntries removes entry, which DeleteEntries has marked as deleted, and
+// everything below it. deleteFiles is called with the entries of files before
+// they are removed.
+//
+// Like DynamoDBMetadataStore, it works bottom up, one directory at a time, so
+// an interrupted call is finished by calling ReapEntries again.
+func (m SQLiteMetadataStore) ReapEntries(ctx context.Context, entry Entry, deleteFiles func(files []Entry) error) error {
+	_, err := m.GetReference(ctx, entry.ID)
+	switch {
+	case err == nil:
+		if err := m.reapDir(ctx, entry.ID, deleteFiles); err != nil {
+			return err
+		}
+	case errors.Is(err, ErrNoSuchReference):
+		if !entry.IsDir() {
+			if err := deleteFiles([]Entry{entry}); err != nil {
+				return err
+			}
+		}
+	default:
+		return err
+	}
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM entry WHERE id = ?", entry.ID)
+		if err != nil {
+			return fmt.Errorf("failed to delete entry: %w", err)
+		}
+		return nil
+	})
+}
+
+// reapDir removes everything below the directory id, and its Reference. A
+// directory without a Reference has been reaped by an interrupted call.
+func (m SQLiteMetadataStore) reapDir(ctx context.Context, id string, deleteFiles func(files []Entry) error) error {
+	ref, err := m.GetReference(ctx, id)
+	if errors.Is(err, ErrNoSuchReference) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	childIDs := make([]string, 0, len(ref.Entries))
+	for _, childID := range ref.Entries {
+		childIDs = append(childIDs, childID)
+	}
+	children, err := m.GetEntries(ctx, childIDs)
+	if err != nil {
+		return err
+	}
+	var files []Entry
+	for _, child := range children {
+		if child.IsDir() {
+			if err := m.reapDir(ctx, child.ID, deleteFiles); err != nil {
+				return err
+			}
+			continue
+		}
+		files = append(files, child)
+	}
+	if len(files) > 0 {
+		if err := deleteFiles(files); err != nil {
+			return err
+		}
+	}
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		for _, childID := range childIDs {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM entry WHERE id = ?", childID); err != nil {
+				return fmt.Errorf("failed to delete entry: %w", err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM reference_entry WHERE reference_id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete reference entry: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM reference WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete reference: %w", err)
+		}
+		return nil
+	})
+}
+
+func (m SQLiteMetadataStore) GetBlob(ctx context.Context, hash string) (Blob, error) {
+	return m.getBlob(ctx, m.DB, hash)
+}
+
+func (m SQLiteMetadataStore) getBlob(ctx context.Context, q sqlQueryer, hash string) (Blob, error) {
+	blob := Blob{Hash: hash}
+	err := q.QueryRowContext(ctx, "SELECT object FROM blob WHERE hash = ?", hash).Scan(&blob.Object)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Blob{}, ErrNoSuchBlob
+	}
+	if err != nil {
+		return Blob{}, fmt.Errorf("failed to get blob: %w", err)
+	}
+	err = q.QueryRowContext(ctx, "SELECT COUNT(*) FROM blob_ref WHERE hash = ?", hash).Scan(&blob.Refs)
+	if err != nil {
+		return Blob{}, fmt.Errorf("failed to count blob references: %w", err)
+	}
+	return blob, nil
+}
+
+func (m SQLiteMetadataStore) AcquireBlob(ctx context.Context, hash, entryID, key string) (string, error) {
+	var object string
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, "SELECT object FROM blob WHERE hash = ?", hash).Scan(&object)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			if key == "" {
+				return ErrNoSuchBlob
+			}
+			object = key
+			if _, err := tx.ExecContext(ctx, "INSERT INTO blob (hash, object) VALUES (?, ?)", hash, key); err != nil {
+				return fmt.Errorf("failed to insert blob: %w", err)
+			}
+		case err != nil:
+			return fmt.Errorf("failed to get blob: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO blob_ref (hash, entry_id) VALUES (?, ?)", hash, entryID)
+		if err != nil {
+			return fmt.Errorf("failed to insert blob reference: %w", err)
+		}
+		return nil
+	})
+	return object, err
+}
+
+func (m SQLiteMetadataStore) ReleaseBlob(ctx context.Context, hash, entryID string) (string, error) {
+	var freed string
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM blob_ref WHERE hash = ? AND entry_id = ?", hash, entryID)
+		if err != nil {
+			return fmt.Errorf("failed to delete blob reference: %w", err)
+		}
+		blob, err := m.getBlob(ctx, tx, hash)
+		if errors.Is(err, ErrNoSuchBlob) {
+			return nil
+		}
+		if err != nil || blob.Refs > 0 {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM blob WHERE hash = ?", hash); err != nil {
+			return fmt.Errorf("failed to delete blob: %w", err)
+		}
+		freed = blob.Object
+		return nil
+	})
+	return freed, err
+}
+
+func (m SQLiteMetadataStore) AddSnapshot(ctx context.Context, snap Snapshot) error {
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM snapshot WHERE name = ?)", snap.Name).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to get snapshot: %w", err)
+		}
+		if exists {
+			return ErrSnapshotExists
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO snapshot (name, created, manifest, size, pending) VALUES (?, ?, ?, ?, 1)",
+			snap.Name, snap.Created.UTC().Format(time.RFC3339Nano), snap.Manifest, snap.Size)
+		if err != nil {
+			return fmt.Errorf("failed to insert snapshot: %w", err)
+		}
+		return nil
+	})
+}
+
+func (m SQLiteMetadataStore) CompleteSnapshot(ctx context.Context, snap Snapshot, keys []string) error {
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "UPDATE snapshot SET created = ?, manifest = ?, size = ?, pending = 0 WHERE name = ?",
+			snap.Created.UTC().Format(time.RFC3339Nano), snap.Manifest, snap.Size, snap.Name)
+		if err != nil {
+			return fmt.Errorf("failed to update snapshot: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return ErrNoSuchSnapshot
+		}
+		for _, key := range keys {
+			_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO pin (object, snapshot) VALUES (?, ?)", key, snap.Name)
+			if err != nil {
+				return fmt.Errorf("failed to insert pin: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (m SQLiteMetadataStore) GetSnapshots(ctx context.Context) ([]Snapshot, error) {
+	rows, err := m.DB.QueryContext(ctx, "SELECT name, created, manifest, size, pending FROM snapshot")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshots: %w", err)
+	}
+	defer rows.Close()
+	var snapshots []Snapshot
+	for rows.Next() {
+		var snap Snapshot
+		var created string
+		if err := rows.Scan(&snap.Name, &created, &snap.Manifest, &snap.Size, &snap.Pending); err != nil {
+			return nil, fmt.Errorf("failed to scan snapshot: %w", err)
+		}
+		if snap.Created, err = time.Parse(time.RFC3339Nano, created); err != nil {
+			return nil, fmt.Errorf("failed to scan snapshot: %w", err)
+		}
+		snapshots = append(snapshots, snap)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get snapshots: %w", err)
+	}
+	return snapshots, nil
+}
+
+func (m SQLiteMetadataStore) DeleteSnapshot(ctx context.Context, name string, keys []string) ([]string, error) {
+	var unpinned []string
+	err := m.transact(ctx, func(tx *sql.Tx) error {
+		unpinned = nil
+		for _, key := range keys {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM pin WHERE object = ? AND snapshot = ?", key, name); err != nil {
+				return fmt.Errorf("failed to delete pin: %w", err)
+			}
+			var pinned bool
+			err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pin WHERE object = ?)", key).Scan(&pinned)
+			if err != nil {
+				return fmt.Errorf("failed to get pin: %w", err)
+			}
+			if !pinned {
+				unpinned = append(unpinned, key)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM snapshot WHERE name = ?", name); err != nil {
+			return fmt.Errorf("failed to delete snapshot: %w", err)
+		}
+		return nil
+	})
+	return unpinned, err
+}
+
+func (m SQLiteMetadataStore) GetPinnedObjects(ctx context.Context, keys []string) ([]string, error) {
+	var pending bool
+	err := m.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM snapshot WHERE pending)").Scan(&pending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshots: %w", err)
+	}
+	if pending {
+		return keys, nil
+	}
+	var pinned []string
+	for len(keys) > 0 {
+		n := min(len(keys), batchGetLimit)
+		args := make([]any, n)
+		for i, key := range keys[:n] {
+			args[i] = key
+		}
+		keys = keys[n:]
+		placeholders := strings.Repeat(", ?", n)[2:]
+		rows, err := m.DB.QueryContext(ctx, "SELECT DISTINCT object FROM pin WHERE object IN ("+placeholders+")", args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get pins: %w", err)
+		}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan pin: %w", err)
+			}
+			pinned = append(pinned, key)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get pins: %w", err)
+		}
+	}
+	return pinned, nil
+}
+
+func (m SQLiteMetadataStore) GetUsage(ctx context.Context) (Usage, error) {
+	return m.getUsage(ctx, m.DB)
+}
+
+func (m SQLiteMetadataStore) getUsage(ctx context.Context, q sqlQueryer) (Usage, error) {
+	var usage Usage
+	err := q.QueryRowContext(ctx, "SELECT bytes, files FROM usage WHERE id = 0").Scan(&usage.Bytes, &usage.Files)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Usage{}, fmt.Errorf("failed to get usage: %w", err)
+	}
+	return usage, nil
+}
+
+func (m SQLiteMetadataStore) AddUsage(ctx context.Context, delta, limit Usage) error {
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		usage, err := m.getUsage(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if usage.exceeds(delta, limit) {
+			return webdav.ErrQuotaExceeded
+		}
+		return m.setUsage(ctx, tx, Usage{Bytes: usage.Bytes + delta.Bytes, Files: usage.Files + delta.Files})
+	})
+}
+
+func (m SQLiteMetadataStore) SetUsage(ctx context.Context, usage Usage) error {
+	return m.transact(ctx, func(tx *sql.Tx) error {
+		return m.setUsage(ctx, tx, usage)
+	})
+}
+
+func (m SQLiteMetadataStore) setUsage(ctx context.Context, tx *sql.Tx, usage Usage) error {
+	_, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO usage (id, bytes, files) VALUES (0, ?, ?)", usage.Bytes, usage.Files)
+	if err != nil {
+		return fmt.Errorf("failed to set usage: %w", err)
+	}
+	return nil
+}
@@ -8,15 +8,20 @@ import (
 func (s *Server) Stat(ctx context.Context, path string) (os.FileInfo, error) {
 
 	path = slashClean(path)
-
-	ref, err := s.MetadataStore.GetReference(ctx, referenceID)
-	if err != nil {
+	if s.inSnapshots(path) {
+		entry, _, err := s.snapshotEntry(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		return newFileInfo(entry), nil
+	}
+	if err := checkTrash(ctx, path, false); err != nil {
 		return nil, err
 	}
 
-	id, ok := ref.Entries[path]
-	if !ok {
-		return nil, os.ErrNotExist
+	id, err := s.resolve(ctx, path)
+	if err != nil {
+		return nil, err
 	}
 
 	entry, err := s.MetadataStore.GetEntry(ctx, id)
@@ -24,12 +29,5 @@ func (s *Server) Stat(ctx context.Context, path string) (os.FileInfo, error) {
 		return nil, err
 	}
 
-	info := FileInfo{
-		name:    entry.Name,
-		size:    entry.Size,
-		modTime: entry.Modify,
-		isDir:   entry.IsDir(),
-	}
-
-	return info, nil
+	return newFileInfo(entry), nil
 }
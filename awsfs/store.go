@@ -0,0 +1,134 @@
+package awsfs
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// MetadataStore keeps the entries of the file system and the References that
+// link them into a tree. DynamoDBMetadataStore is the implementation used in
+// production and SQLiteMetadataStore the one for single-node deployments;
+// NewMemMetadataStore returns one that keeps everything in memory.
+//
+// Writes that lose a version check against a concurrent writer fail with an
+// error for which errors.As finds a *ConflictError, unless the store retries
+// them itself.
+type MetadataStore interface {
+	// Init creates the root directory if the store is empty.
+	Init(ctx context.Context) error
+	// GetReference returns the Reference with the given ID, or
+	// ErrNoSuchReference.
+	GetReference(ctx context.Context, id string) (Reference, error)
+	// GetEntry returns the entry with the given ID, or ErrNoSuchEntry.
+	GetEntry(ctx context.Context, id string) (Entry, error)
+	// GetEntries returns the entries with the given IDs, in no particular
+	// order. IDs that name no entry are skipped.
+	GetEntries(ctx context.Context, ids []string) ([]Entry, error)
+	// GetEntriesByParentID returns the entries whose parent is id.
+	GetEntriesByParentID(ctx context.Context, id string) ([]Entry, error)
+	// ListEntriesByParentID returns an iterator over the entries whose
+	// parent is id.
+	ListEntriesByParentID(id string) EntryIterator
+	// AddEntry stores entry and links it into the Reference of its parent
+	// directory. A directory entry also gets an empty Reference of its own.
+	AddEntry(ctx context.Context, entry Entry) error
+	// UpdateEntry stores the size, modification time and dead properties of
+	// entry, provided that its version is still entry.Version.
+	UpdateEntry(ctx context.Context, entry Entry) error
+	// UpdateEntryObject points the file entry id at the object key holding
+	// new content of the given size and checksums, keeping the replaced
+	// content as the newest of at most keep earlier versions. It returns the
+	// keys of the objects that the entry no longer refers to.
+	UpdateEntryObject(ctx context.Context, id, key string, size int64, sum Checksums, modify time.Time, keep int) ([]string, error)
+	// UpdateEntryName moves entry to the given name in directory parentID
+	// and sets its trash info, which is nil for an entry moved out of the
+	// trash or within the tree.
+	UpdateEntryName(ctx context.Context, entry Entry, parentID, name string, trash *TrashInfo) error
+	// DeleteEntries detaches entry from its parent directory and marks it,
+	// and with it everything below it, as deleted.
+	DeleteEntries(ctx context.Context, entry Entry) error
+	// GetDeletedEntries returns the entries that DeleteEntries has marked as
+	// deleted and that have not been reaped yet.
+	GetDeletedEntries(ctx context.Context) ([]Entry, error)
+	// ReapEntries removes entry, which DeleteEntries has marked as deleted,
+	// and everything below it. deleteFiles is called with the entries of
+	// files before they are removed, and may be called again with the same
+	// entries if an interrupted call is repeated.
+	ReapEntries(ctx context.Context, entry Entry, deleteFiles func(files []Entry) error) error
+
+	// GetBlob returns the Blob with the given content hash, or
+	// ErrNoSuchBlob.
+	GetBlob(ctx context.Context, hash string) (Blob, error)
+	// AcquireBlob adds entryID to the references of the Blob with the given
+	// content hash, and returns the object key of the Blob. If there is no
+	// such Blob, it is created with the object key, unless key is empty, in
+	// which case ErrNoSuchBlob is returned.
+	AcquireBlob(ctx context.Context, hash, entryID, key string) (string, error)
+	// ReleaseBlob removes entryID from the references of the Blob with the
+	// given content hash. If no reference is left, the Blob is removed and
+	// the key of its object, which the caller deletes, is returned.
+	ReleaseBlob(ctx context.Context, hash, entryID string) (string, error)
+
+	// AddSnapshot records snap as pending, or returns ErrSnapshotExists if
+	// there is a snapshot with the same name. While any snapshot is pending,
+	// every object counts as pinned.
+	AddSnapshot(ctx context.Context, snap Snapshot) error
+	// CompleteSnapshot pins the objects with the given keys to the pending
+	// snapshot with the name of snap, and stores snap as complete. It
+	// returns ErrNoSuchSnapshot if there is no such snapshot.
+	CompleteSnapshot(ctx context.Context, snap Snapshot, keys []string) error
+	// GetSnapshots returns the snapshots, in no particular order.
+	GetSnapshots(ctx context.Context) ([]Snapshot, error)
+	// DeleteSnapshot unpins the objects with the given keys from the
+	// snapshot name and removes the snapshot. It returns the keys of the
+	// objects that no snapshot pins anymore.
+	DeleteSnapshot(ctx context.Context, name string, keys []string) ([]string, error)
+	// GetPinnedObjects returns those of the given object keys that a
+	// snapshot pins.
+	GetPinnedObjects(ctx context.Context, keys []string) ([]string, error)
+
+	// GetUsage returns the usage of the tree, which is zero until it is
+	// first added to or set.
+	GetUsage(ctx context.Context) (Usage, error)
+	// AddUsage adds delta to the usage, unless that takes it above limit,
+	// in which case webdav.ErrQuotaExceeded is returned.
+	AddUsage(ctx context.Context, delta, limit Usage) error
+	// SetUsage replaces the usage.
+	SetUsage(ctx context.Context, usage Usage) error
+}
+
+// EntryIterator iterates over a listing of entries. Call Next to advance it
+// and Entry to read the current entry. After Next returns false, Err reports
+// the error that stopped the iteration, if any.
+type EntryIterator interface {
+	Next(ctx context.Context) bool
+	Entry() Entry
+	Err() error
+}
+
+// PhysicalStore keeps the content of files as objects. S3PhysicalStore is
+// the implementation used in production and LocalPhysicalStore the one for
+// installations without S3; NewMemPhysicalStore returns one that keeps
+// everything in memory.
+type PhysicalStore interface {
+	// GetObjectRange returns a reader for length bytes of the object
+	// starting at offset.
+	GetObjectRange(ctx context.Context, objectKey string, offset, length int64) (io.ReadCloser, error)
+	// PutObject stores the content of r as objectKey.
+	PutObject(ctx context.Context, objectKey string, r io.Reader) error
+	// CopyObject copies the object srcKey of the given size to dstKey.
+	CopyObject(ctx context.Context, srcKey, dstKey string, size int64) error
+	// DeleteObjects deletes the objects with the given keys. Keys that do
+	// not name an object are ignored.
+	DeleteObjects(ctx context.Context, objectKeys []string) error
+	// ListObjects calls fn for every object, in key order.
+	ListObjects(ctx context.Context, fn func(Object) error) error
+}
+
+var (
+	_ MetadataStore = DynamoDBMetadataStore{}
+	_ MetadataStore = SQLiteMetadataStore{}
+	_ PhysicalStore = S3PhysicalStore{}
+	_ PhysicalStore = LocalPhysicalStore{}
+)
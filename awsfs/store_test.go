@@ -0,0 +1,768 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+// testMetadataStore runs the conformance tests that every MetadataStore
+// implementation must pass. newStore returns an empty store.
+func testMetadataStore(t *testing.T, newStore func(t *testing.T) MetadataStore) {
+	ctx := context.Background()
+
+	// initStore returns an initialized store and the ID of its root
+	// directory.
+	initStore := func(t *testing.T) (MetadataStore, string) {
+		t.Helper()
+		m := newStore(t)
+		if err := m.Init(ctx); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+		anchor, err := m.GetReference(ctx, referenceID)
+		if err != nil {
+			t.Fatalf("GetReference: %v", err)
+		}
+		return m, anchor.Entries["/"]
+	}
+	add := func(t *testing.T, m MetadataStore, parentID, name string, typ EntryType) Entry {
+		t.Helper()
+		entry := Entry{
+			ID:        name + "-id",
+			ParentID:  parentID,
+			Name:      name,
+			Type:      typ,
+			Modify:    time.Unix(1700000000, 123).UTC(),
+			DeadProps: map[string]string{},
+			Version:   1,
+		}
+		if err := m.AddEntry(ctx, entry); err != nil {
+			t.Fatalf("AddEntry %q: %v", name, err)
+		}
+		return entry
+	}
+	refEntries := func(t *testing.T, m MetadataStore, id string) string {
+		t.Helper()
+		ref, err := m.GetReference(ctx, id)
+		if err != nil {
+			t.Fatalf("GetReference(%q): %v", id, err)
+		}
+		return fmt.Sprint(ref.Entries)
+	}
+	names := func(entries []Entry) string {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		sort.Strings(names)
+		return fmt.Sprint(names)
+	}
+
+	t.Run("Init", func(t *testing.T) {
+		m, rootID := initStore(t)
+		if err := m.Init(ctx); err != nil {
+			t.Fatalf("second Init: %v", err)
+		}
+		anchor, err := m.GetReference(ctx, referenceID)
+		if err != nil {
+			t.Fatalf("GetReference: %v", err)
+		}
+		if len(anchor.Entries) != 1 || anchor.Entries["/"] != rootID {
+			t.Fatalf("anchor after second Init: got %v, want only / -> %s", anchor.Entries, rootID)
+		}
+		root, err := m.GetEntry(ctx, rootID)
+		if err != nil {
+			t.Fatalf("GetEntry(root): %v", err)
+		}
+		if !root.IsDir() || root.ParentID != referenceID {
+			t.Fatalf("root entry: got %+v", root)
+		}
+		if got := refEntries(t, m, rootID); got != "map[]" {
+			t.Fatalf("root directory: got %v, want no entries", got)
+		}
+	})
+
+	t.Run("AddEntry", func(t *testing.T) {
+		m, rootID := initStore(t)
+		dir := add(t, m, rootID, "d", EntryTypeDir)
+		add(t, m, dir.ID, "f", EntryTypeFile)
+
+		if got, want := refEntries(t, m, rootID), "map[d:d-id]"; got != want {
+			t.Errorf("root directory: got %v, want %v", got, want)
+		}
+		if got, want := refEntries(t, m, dir.ID), "map[f:f-id]"; got != want {
+			t.Errorf("directory d: got %v, want %v", got, want)
+		}
+		if _, err := m.GetReference(ctx, "f-id"); !errors.Is(err, ErrNoSuchReference) {
+			t.Errorf("GetReference of a file: got %v, want %v", err, ErrNoSuchReference)
+		}
+		err := m.AddEntry(ctx, Entry{ID: "other", ParentID: dir.ID, Name: "f", Type: EntryTypeFile, Version: 1})
+		if !errors.Is(err, ErrEntryExists) {
+			t.Errorf("AddEntry of a taken name: got %v, want %v", err, ErrEntryExists)
+		}
+		err = m.AddEntry(ctx, Entry{ID: "other", ParentID: "missing", Name: "f", Type: EntryTypeFile, Version: 1})
+		if !errors.Is(err, ErrNoSuchReference) {
+			t.Errorf("AddEntry to a missing directory: got %v, want %v", err, ErrNoSuchReference)
+		}
+	})
+
+	t.Run("GetEntry", func(t *testing.T) {
+		m, rootID := initStore(t)
+		want := add(t, m, rootID, "f", EntryTypeFile)
+		got, err := m.GetEntry(ctx, want.ID)
+		if err != nil {
+			t.Fatalf("GetEntry: %v", err)
+		}
+		if got.ID != want.ID || got.ParentID != want.ParentID || got.Name != want.Name ||
+			got.Type != want.Type || !got.Modify.Equal(want.Modify) || got.Version != 1 || got.DeadProps == nil {
+			t.Fatalf("GetEntry: got %+v, want %+v", got, want)
+		}
+		want = Entry{ID: "g-id", ParentID: rootID, Name: "g", Type: EntryTypeFile, Version: 1,
+			Checksums: Checksums{SHA256: "5a", MD5: "6b"}}
+		if err := m.AddEntry(ctx, want); err != nil {
+			t.Fatalf("AddEntry: %v", err)
+		}
+		if got, err = m.GetEntry(ctx, want.ID); err != nil || got.Checksums != want.Checksums {
+			t.Fatalf("GetEntry: got checksums %+v, %v, want %+v", got.Checksums, err, want.Checksums)
+		}
+		if _, err := m.GetEntry(ctx, "missing"); !errors.Is(err, ErrNoSuchEntry) {
+			t.Fatalf("GetEntry of a missing entry: got %v, want %v", err, ErrNoSuchEntry)
+		}
+		if _, err := m.GetReference(ctx, "missing"); !errors.Is(err, ErrNoSuchReference) {
+			t.Fatalf("GetReference of a missing reference: got %v, want %v", err, ErrNoSuchReference)
+		}
+		entries, err := m.GetEntries(ctx, []string{"f-id", "missing", rootID})
+		if err != nil {
+			t.Fatalf("GetEntries: %v", err)
+		}
+		if got, want := names(entries), "[/ f]"; got != want {
+			t.Fatalf("GetEntries: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("ListEntriesByParentID", func(t *testing.T) {
+		m, rootID := initStore(t)
+		var want []string
+		for i := 0; i < batchGetLimit+5; i++ {
+			name := fmt.Sprintf("f%03d", i)
+			add(t, m, rootID, name, EntryTypeFile)
+			want = append(want, name)
+		}
+		var got []Entry
+		it := m.ListEntriesByParentID(rootID)
+		for it.Next(ctx) {
+			got = append(got, it.Entry())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("ListEntriesByParentID: %v", err)
+		}
+		if names(got) != fmt.Sprint(want) {
+			t.Fatalf("ListEntriesByParentID: got %v, want %v", names(got), want)
+		}
+		entries, err := m.GetEntriesByParentID(ctx, rootID)
+		if err != nil {
+			t.Fatalf("GetEntriesByParentID: %v", err)
+		}
+		if names(entries) != fmt.Sprint(want) {
+			t.Fatalf("GetEntriesByParentID: got %v, want %v", names(entries), want)
+		}
+	})
+
+	t.Run("UpdateEntry", func(t *testing.T) {
+		m, rootID := initStore(t)
+		entry := add(t, m, rootID, "f", EntryTypeFile)
+		entry.Size = 42
+		entry.Modify = entry.Modify.Add(time.Hour)
+		entry.DeadProps = map[string]string{"x:color": "<color>blue</color>"}
+		if err := m.UpdateEntry(ctx, entry); err != nil {
+			t.Fatalf("UpdateEntry: %v", err)
+		}
+		got, err := m.GetEntry(ctx, entry.ID)
+		if err != nil {
+			t.Fatalf("GetEntry: %v", err)
+		}
+		if got.Size != 42 || !got.Modify.Equal(entry.Modify) || got.DeadProps["x:color"] != entry.DeadProps["x:color"] {
+			t.Fatalf("after UpdateEntry: got %+v, want %+v", got, entry)
+		}
+		if got.Version <= entry.Version {
+			t.Fatalf("version after UpdateEntry: got %d, want more than %d", got.Version, entry.Version)
+		}
+		var conflict *ConflictError
+		if err := m.UpdateEntry(ctx, entry); !errors.As(err, &conflict) {
+			t.Fatalf("UpdateEntry of a stale entry: got %v, want a *ConflictError", err)
+		}
+	})
+
+	t.Run("UpdateEntryObject", func(t *testing.T) {
+		m, rootID := initStore(t)
+		entry := add(t, m, rootID, "f", EntryTypeFile)
+		dir := add(t, m, rootID, "d", EntryTypeDir)
+		modify := entry.Modify.Add(time.Hour)
+		sum := Checksums{SHA256: "5a", MD5: "6b"}
+		dropped, err := m.UpdateEntryObject(ctx, entry.ID, "f-id/1", 7, Checksums{}, modify, 0)
+		if err != nil {
+			t.Fatalf("UpdateEntryObject: %v", err)
+		}
+		if fmt.Sprint(dropped) != "[f-id]" {
+			t.Fatalf("first dropped keys: got %q, want [f-id]", dropped)
+		}
+		if dropped, err = m.UpdateEntryObject(ctx, entry.ID, "f-id/2", 8, sum, modify, 1); err != nil {
+			t.Fatalf("UpdateEntryObject: %v", err)
+		}
+		if len(dropped) != 0 {
+			t.Fatalf("second dropped keys: got %q, want none", dropped)
+		}
+		got, err := m.GetEntry(ctx, entry.ID)
+		if err != nil {
+			t.Fatalf("GetEntry: %v", err)
+		}
+		if got.ObjectKey() != "f-id/2" || got.Size != 8 || got.Checksums != sum || !got.Modify.Equal(modify) || got.CheckedIn != 3 {
+			t.Fatalf("after UpdateEntryObject: got %+v", got)
+		}
+		if len(got.Versions) != 1 || got.Versions[0].Number != 2 || got.Versions[0].Object != "f-id/1" ||
+			got.Versions[0].Size != 7 || !got.Versions[0].Modify.Equal(modify) {
+			t.Fatalf("versions after UpdateEntryObject: got %+v", got.Versions)
+		}
+		// Making a kept version current again keeps its object.
+		if dropped, err = m.UpdateEntryObject(ctx, entry.ID, "f-id/1", 7, Checksums{}, modify, 1); err != nil {
+			t.Fatalf("UpdateEntryObject: %v", err)
+		}
+		if len(dropped) != 0 {
+			t.Fatalf("dropped keys after restoring: got %q, want none", dropped)
+		}
+		if dropped, err = m.UpdateEntryObject(ctx, entry.ID, "f-id/3", 9, sum, modify, 0); err != nil {
+			t.Fatalf("UpdateEntryObject: %v", err)
+		}
+		if fmt.Sprint(dropped) != "[f-id/1 f-id/2]" {
+			t.Fatalf("dropped keys without versions: got %q, want [f-id/1 f-id/2]", dropped)
+		}
+		if got, err = m.GetEntry(ctx, entry.ID); err != nil {
+			t.Fatalf("GetEntry: %v", err)
+		}
+		if got.CheckedIn != 5 || got.Versions != nil {
+			t.Fatalf("after UpdateEntryObject without versions: got %+v", got)
+		}
+		if _, err := m.UpdateEntryObject(ctx, dir.ID, "d-id/1", 1, sum, modify, 0); !errors.Is(err, ErrIsDir) {
+			t.Fatalf("UpdateEntryObject of a directory: got %v, want %v", err, ErrIsDir)
+		}
+		if _, err := m.UpdateEntryObject(ctx, "missing", "missing/1", 1, sum, modify, 0); !errors.Is(err, ErrNoSuchEntry) {
+			t.Fatalf("UpdateEntryObject of a missing entry: got %v, want %v", err, ErrNoSuchEntry)
+		}
+	})
+
+	t.Run("UpdateEntryName", func(t *testing.T) {
+		m, rootID := initStore(t)
+		a := add(t, m, rootID, "a", EntryTypeDir)
+		f := add(t, m, a.ID, "f", EntryTypeFile)
+		add(t, m, rootID, "g", EntryTypeFile)
+
+		trash := &TrashInfo{Path: "/a/f", Deleted: time.Unix(1700000000, 0), Deleter: "alice"}
+		if err := m.UpdateEntryName(ctx, f, a.ID, "h", trash); err != nil {
+			t.Fatalf("UpdateEntryName in the same directory: %v", err)
+		}
+		moved, err := m.GetEntry(ctx, f.ID)
+		if err != nil {
+			t.Fatalf("GetEntry: %v", err)
+		}
+		if moved.Trash == nil || moved.Trash.Path != trash.Path || !moved.Trash.Deleted.Equal(trash.Deleted) || moved.Trash.Deleter != trash.Deleter {
+			t.Fatalf("trash info: got %+v, want %+v", moved.Trash, trash)
+		}
+		// f is stale now, which the store must cope with.
+		if err := m.UpdateEntryName(ctx, f, rootID, "f", nil); err != nil {
+			t.Fatalf("UpdateEntryName to another directory: %v", err)
+		}
+		if got, want := refEntries(t, m, a.ID), "map[]"; got != want {
+			t.Errorf("directory a: got %v, want %v", got, want)
+		}
+		if got, want := refEntries(t, m, rootID), "map[a:a-id f:f-id g:g-id]"; got != want {
+			t.Errorf("root directory: got %v, want %v", got, want)
+		}
+		got, err := m.GetEntry(ctx, f.ID)
+		if err != nil {
+			t.Fatalf("GetEntry: %v", err)
+		}
+		if got.ParentID != rootID || got.Name != "f" || got.Trash != nil {
+			t.Errorf("moved entry: got parent %q name %q trash %+v, want %q, f and no trash", got.ParentID, got.Name, got.Trash, rootID)
+		}
+		if err := m.UpdateEntryName(ctx, got, rootID, "g", nil); !errors.Is(err, ErrEntryExists) {
+			t.Errorf("UpdateEntryName to a taken name: got %v, want %v", err, ErrEntryExists)
+		}
+	})
+
+	t.Run("DeleteAndReapEntries", func(t *testing.T) {
+		m, rootID := initStore(t)
+		a := add(t, m, rootID, "a", EntryTypeDir)
+		b := add(t, m, a.ID, "b", EntryTypeDir)
+		add(t, m, a.ID, "f", EntryTypeFile)
+		add(t, m, b.ID, "g", EntryTypeFile)
+		if _, err := m.UpdateEntryObject(ctx, "g-id", "g-id/1", 1, Checksums{}, time.Now(), 0); err != nil {
+			t.Fatalf("UpdateEntryObject: %v", err)
+		}
+		h := add(t, m, rootID, "h", EntryTypeFile)
+
+		for _, e := range []Entry{a, h} {
+			if err := m.DeleteEntries(ctx, e); err != nil {
+				t.Fatalf("DeleteEntries %q: %v", e.Name, err)
+			}
+		}
+		if got := refEntries(t, m, rootID); got != "map[]" {
+			t.Fatalf("root directory after DeleteEntries: got %v, want no entries", got)
+		}
+		deleted, err := m.GetDeletedEntries(ctx)
+		if err != nil {
+			t.Fatalf("GetDeletedEntries: %v", err)
+		}
+		if got, want := names(deleted), "[a h]"; got != want {
+			t.Fatalf("GetDeletedEntries: got %v, want %v", got, want)
+		}
+
+		var keys []string
+		for _, e := range deleted {
+			err := m.ReapEntries(ctx, e, func(files []Entry) error {
+				for _, f := range files {
+					keys = append(keys, f.ObjectKey())
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("ReapEntries %q: %v", e.Name, err)
+			}
+		}
+		sort.Strings(keys)
+		if got, want := fmt.Sprint(keys), "[f-id g-id/1 h-id]"; got != want {
+			t.Fatalf("deleted objects: got %v, want %v", got, want)
+		}
+		for _, id := range []string{"a-id", "b-id", "f-id", "g-id", "h-id"} {
+			if _, err := m.GetEntry(ctx, id); !errors.Is(err, ErrNoSuchEntry) {
+				t.Errorf("GetEntry(%q) after ReapEntries: got %v, want %v", id, err, ErrNoSuchEntry)
+			}
+		}
+		for _, id := range []string{"a-id", "b-id"} {
+			if _, err := m.GetReference(ctx, id); !errors.Is(err, ErrNoSuchReference) {
+				t.Errorf("GetReference(%q) after ReapEntries: got %v, want %v", id, err, ErrNoSuchReference)
+			}
+		}
+		if deleted, err = m.GetDeletedEntries(ctx); err != nil || len(deleted) != 0 {
+			t.Fatalf("GetDeletedEntries after ReapEntries: got %v, %v, want none", names(deleted), err)
+		}
+	})
+
+	t.Run("ReapEntriesDeleteObjectsFails", func(t *testing.T) {
+		m, rootID := initStore(t)
+		a := add(t, m, rootID, "a", EntryTypeDir)
+		add(t, m, a.ID, "f", EntryTypeFile)
+		if err := m.DeleteEntries(ctx, a); err != nil {
+			t.Fatalf("DeleteEntries: %v", err)
+		}
+		errFail := errors.New("fail")
+		err := m.ReapEntries(ctx, a, func([]Entry) error { return errFail })
+		if !errors.Is(err, errFail) {
+			t.Fatalf("ReapEntries: got %v, want %v", err, errFail)
+		}
+		if _, err := m.GetEntry(ctx, "f-id"); err != nil {
+			t.Fatalf("GetEntry of a file whose object was not deleted: %v", err)
+		}
+		// A later call finishes the job.
+		if err := m.ReapEntries(ctx, a, func([]Entry) error { return nil }); err != nil {
+			t.Fatalf("ReapEntries: %v", err)
+		}
+		if _, err := m.GetEntry(ctx, "f-id"); !errors.Is(err, ErrNoSuchEntry) {
+			t.Fatalf("GetEntry after ReapEntries: got %v, want %v", err, ErrNoSuchEntry)
+		}
+	})
+
+	t.Run("ConcurrentAddEntry", func(t *testing.T) {
+		m, rootID := initStore(t)
+		const n = 16
+		var wg sync.WaitGroup
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- m.AddEntry(ctx, Entry{
+					ID:       fmt.Sprintf("d%d", i),
+					ParentID: rootID,
+					Name:     "d",
+					Type:     EntryTypeDir,
+					Version:  1,
+				})
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		added := 0
+		for err := range errs {
+			switch {
+			case err == nil:
+				added++
+			case errors.Is(err, ErrEntryExists):
+			default:
+				t.Fatalf("AddEntry: %v", err)
+			}
+		}
+		if added != 1 {
+			t.Fatalf("got %d successful AddEntry calls, want 1", added)
+		}
+	})
+
+	t.Run("Blob", func(t *testing.T) {
+		m, _ := initStore(t)
+		if _, err := m.AcquireBlob(ctx, "h", "a", ""); !errors.Is(err, ErrNoSuchBlob) {
+			t.Fatalf("AcquireBlob of a missing blob: got %v, want %v", err, ErrNoSuchBlob)
+		}
+		if _, err := m.GetBlob(ctx, "h"); !errors.Is(err, ErrNoSuchBlob) {
+			t.Fatalf("GetBlob of a missing blob: got %v, want %v", err, ErrNoSuchBlob)
+		}
+		acquire := func(entryID, key, want string) {
+			t.Helper()
+			got, err := m.AcquireBlob(ctx, "h", entryID, key)
+			if err != nil || got != want {
+				t.Fatalf("AcquireBlob(%q, %q): got %q, %v, want %q", entryID, key, got, err, want)
+			}
+		}
+		release := func(entryID, want string) {
+			t.Helper()
+			got, err := m.ReleaseBlob(ctx, "h", entryID)
+			if err != nil || got != want {
+				t.Fatalf("ReleaseBlob(%q): got %q, %v, want %q", entryID, got, err, want)
+			}
+		}
+		acquire("a", "h/1", "h/1")
+		// The first key wins, and acquiring twice is a no-op.
+		acquire("b", "h/2", "h/1")
+		acquire("b", "", "h/1")
+		blob, err := m.GetBlob(ctx, "h")
+		if err != nil {
+			t.Fatalf("GetBlob: %v", err)
+		}
+		if got, want := fmt.Sprint(blob), "{h h/1 2}"; got != want {
+			t.Fatalf("GetBlob: got %v, want %v", got, want)
+		}
+
+		release("a", "")
+		release("a", "")
+		release("b", "h/1")
+		if _, err := m.GetBlob(ctx, "h"); !errors.Is(err, ErrNoSuchBlob) {
+			t.Fatalf("GetBlob after the last ReleaseBlob: got %v, want %v", err, ErrNoSuchBlob)
+		}
+		release("b", "")
+		acquire("c", "h/3", "h/3")
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		m, _ := initStore(t)
+		pinned := func(keys ...string) string {
+			t.Helper()
+			got, err := m.GetPinnedObjects(ctx, keys)
+			if err != nil {
+				t.Fatalf("GetPinnedObjects: %v", err)
+			}
+			sort.Strings(got)
+			return strings.Join(got, " ")
+		}
+		created := time.Unix(1700000000, 0).UTC()
+		s1 := Snapshot{Name: "s1", Created: created, Manifest: "snapshots/s1/m"}
+		if err := m.AddSnapshot(ctx, s1); err != nil {
+			t.Fatalf("AddSnapshot: %v", err)
+		}
+		if err := m.AddSnapshot(ctx, s1); !errors.Is(err, ErrSnapshotExists) {
+			t.Fatalf("AddSnapshot of an existing name: got %v, want %v", err, ErrSnapshotExists)
+		}
+		// A pending snapshot pins everything.
+		if got := pinned("a", "b"); got != "a b" {
+			t.Fatalf("GetPinnedObjects while pending: got %q", got)
+		}
+		s1.Size = 10
+		if err := m.CompleteSnapshot(ctx, s1, []string{"a", "b"}); err != nil {
+			t.Fatalf("CompleteSnapshot: %v", err)
+		}
+		if err := m.CompleteSnapshot(ctx, Snapshot{Name: "s0"}, nil); !errors.Is(err, ErrNoSuchSnapshot) {
+			t.Fatalf("CompleteSnapshot of an unknown snapshot: got %v, want %v", err, ErrNoSuchSnapshot)
+		}
+		s2 := Snapshot{Name: "s2", Created: created, Manifest: "snapshots/s2/m"}
+		if err := m.AddSnapshot(ctx, s2); err != nil {
+			t.Fatalf("AddSnapshot: %v", err)
+		}
+		if err := m.CompleteSnapshot(ctx, s2, []string{"b", "c"}); err != nil {
+			t.Fatalf("CompleteSnapshot: %v", err)
+		}
+		if got := pinned("a", "b", "c", "d"); got != "a b c" {
+			t.Fatalf("GetPinnedObjects: got %q, want %q", got, "a b c")
+		}
+		snapshots, err := m.GetSnapshots(ctx)
+		if err != nil {
+			t.Fatalf("GetSnapshots: %v", err)
+		}
+		sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+		if got, want := fmt.Sprint(snapshots), fmt.Sprint([]Snapshot{s1, s2}); got != want {
+			t.Fatalf("GetSnapshots: got %v, want %v", got, want)
+		}
+
+		unpinned, err := m.DeleteSnapshot(ctx, "s1", []string{"a", "b"})
+		if err != nil || strings.Join(unpinned, " ") != "a" {
+			t.Fatalf("DeleteSnapshot: got %q, %v, want the objects only s1 pinned", unpinned, err)
+		}
+		if got := pinned("a", "b", "c"); got != "b c" {
+			t.Fatalf("GetPinnedObjects after DeleteSnapshot: got %q", got)
+		}
+		if snapshots, err := m.GetSnapshots(ctx); err != nil || len(snapshots) != 1 {
+			t.Fatalf("GetSnapshots after DeleteSnapshot: got %v, %v", snapshots, err)
+		}
+	})
+
+	t.Run("Usage", func(t *testing.T) {
+		m, _ := initStore(t)
+		usage := func() Usage {
+			t.Helper()
+			u, err := m.GetUsage(ctx)
+			if err != nil {
+				t.Fatalf("GetUsage: %v", err)
+			}
+			return u
+		}
+		if u := usage(); u != (Usage{}) {
+			t.Fatalf("GetUsage of a new store: got %+v", u)
+		}
+		limit := Usage{Bytes: 100, Files: 2}
+		if err := m.AddUsage(ctx, Usage{Bytes: 60, Files: 1}, limit); err != nil {
+			t.Fatalf("AddUsage: %v", err)
+		}
+		for _, delta := range []Usage{{Bytes: 41, Files: 1}, {Bytes: 200}, {Bytes: 10, Files: 2}} {
+			if err := m.AddUsage(ctx, delta, limit); !errors.Is(err, webdav.ErrQuotaExceeded) {
+				t.Fatalf("AddUsage of %+v: got %v, want %v", delta, err, webdav.ErrQuotaExceeded)
+			}
+		}
+		if err := m.AddUsage(ctx, Usage{Bytes: 40, Files: 1}, limit); err != nil {
+			t.Fatalf("AddUsage up to the limit: %v", err)
+		}
+		if u := usage(); u != (Usage{Bytes: 100, Files: 2}) {
+			t.Fatalf("GetUsage: got %+v", u)
+		}
+		// Shrinking and unlimited fields always succeed.
+		if err := m.AddUsage(ctx, Usage{Bytes: -30, Files: 5}, Usage{Bytes: 50}); err != nil {
+			t.Fatalf("AddUsage above the limit: %v", err)
+		}
+		if u := usage(); u != (Usage{Bytes: 70, Files: 7}) {
+			t.Fatalf("GetUsage: got %+v", u)
+		}
+		if err := m.SetUsage(ctx, Usage{Bytes: 5, Files: 1}); err != nil {
+			t.Fatalf("SetUsage: %v", err)
+		}
+		if u := usage(); u != (Usage{Bytes: 5, Files: 1}) {
+			t.Fatalf("GetUsage after SetUsage: got %+v", u)
+		}
+	})
+}
+
+func TestDynamoDBMetadataStoreConformance(t *testing.T) {
+	testMetadataStore(t, func(t *testing.T) MetadataStore {
+		m := newTestMetadataStore(newFakeDynamoDB())
+		m.MaxRetries = 1000
+		return m
+	})
+}
+
+func TestMemMetadataStoreConformance(t *testing.T) {
+	testMetadataStore(t, func(t *testing.T) MetadataStore {
+		return NewMemMetadataStore()
+	})
+}
+
+func TestSQLiteMetadataStoreConformance(t *testing.T) {
+	testMetadataStore(t, func(t *testing.T) MetadataStore {
+		db, err := OpenSQLite(filepath.Join(t.TempDir(), "metadata.db"))
+		if err != nil {
+			t.Fatalf("OpenSQLite: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return SQLiteMetadataStore{DB: db}
+	})
+}
+
+func TestSQLiteMetadataStoreAddsColumns(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer db.Close()
+	// The entry table as created before checksums were recorded.
+	_, err = db.ExecContext(ctx, `CREATE TABLE entry (
+		id TEXT PRIMARY KEY, parent_id TEXT NOT NULL, name TEXT NOT NULL,
+		type TEXT NOT NULL, size INTEGER NOT NULL, modify TEXT NOT NULL,
+		dead_props TEXT NOT NULL, version INTEGER NOT NULL,
+		object TEXT NOT NULL DEFAULT '')`)
+	if err != nil {
+		t.Fatalf("CREATE TABLE: %v", err)
+	}
+	m := SQLiteMetadataStore{DB: db}
+	for i := 0; i < 2; i++ {
+		if err := m.Init(ctx); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+	}
+	anchor, err := m.GetReference(ctx, referenceID)
+	if err != nil {
+		t.Fatalf("GetReference: %v", err)
+	}
+	if _, err := m.GetEntry(ctx, anchor.Entries["/"]); err != nil {
+		t.Fatalf("GetEntry of the root: %v", err)
+	}
+}
+
+// testPhysicalStore runs the conformance tests that every PhysicalStore
+// implementation must pass. newStore returns an empty store.
+func testPhysicalStore(t *testing.T, newStore func(t *testing.T) PhysicalStore) {
+	ctx := context.Background()
+
+	put := func(t *testing.T, s PhysicalStore, key, data string) {
+		t.Helper()
+		if err := s.PutObject(ctx, key, strings.NewReader(data)); err != nil {
+			t.Fatalf("PutObject %q: %v", key, err)
+		}
+	}
+	read := func(t *testing.T, s PhysicalStore, key string, offset, length int64) string {
+		t.Helper()
+		r, err := s.GetObjectRange(ctx, key, offset, length)
+		if err != nil {
+			t.Fatalf("GetObjectRange %q: %v", key, err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll %q: %v", key, err)
+		}
+		return string(data)
+	}
+	list := func(t *testing.T, s PhysicalStore) string {
+		t.Helper()
+		var objects []string
+		err := s.ListObjects(ctx, func(obj Object) error {
+			objects = append(objects, fmt.Sprintf("%s:%d", obj.Key, obj.Size))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ListObjects: %v", err)
+		}
+		return fmt.Sprint(objects)
+	}
+
+	t.Run("PutAndGet", func(t *testing.T) {
+		s := newStore(t)
+		// A key may be a prefix of another key, as the keys of overwritten
+		// files start with the entry ID.
+		put(t, s, "a", "0123456789")
+		put(t, s, "a/1", "abc")
+		testCases := []struct {
+			key            string
+			offset, length int64
+			want           string
+		}{
+			{"a", 0, 10, "0123456789"},
+			{"a", 3, 4, "3456"},
+			{"a", 8, 100, "89"},
+			{"a/1", 0, 3, "abc"},
+		}
+		for _, tc := range testCases {
+			if got := read(t, s, tc.key, tc.offset, tc.length); got != tc.want {
+				t.Errorf("GetObjectRange(%q, %d, %d): got %q, want %q", tc.key, tc.offset, tc.length, got, tc.want)
+			}
+		}
+		put(t, s, "a", "xyz")
+		if got := read(t, s, "a", 0, 3); got != "xyz" {
+			t.Errorf("after PutObject over an object: got %q, want %q", got, "xyz")
+		}
+		if _, err := s.GetObjectRange(ctx, "missing", 0, 1); err == nil {
+			t.Errorf("GetObjectRange of a missing object: got no error")
+		}
+	})
+
+	t.Run("CopyObject", func(t *testing.T) {
+		s := newStore(t)
+		put(t, s, "a", "hello")
+		if err := s.CopyObject(ctx, "a", "b", 5); err != nil {
+			t.Fatalf("CopyObject: %v", err)
+		}
+		put(t, s, "a", "bye")
+		if got := read(t, s, "b", 0, 5); got != "hello" {
+			t.Fatalf("copy after overwriting the source: got %q, want %q", got, "hello")
+		}
+		if err := s.CopyObject(ctx, "missing", "c", 1); err == nil {
+			t.Fatalf("CopyObject of a missing object: got no error")
+		}
+	})
+
+	t.Run("DeleteAndListObjects", func(t *testing.T) {
+		s := newStore(t)
+		if got := list(t, s); got != "[]" {
+			t.Fatalf("ListObjects of an empty store: got %v", got)
+		}
+		put(t, s, "b", "22")
+		put(t, s, "a/1", "1")
+		put(t, s, "a", "")
+		put(t, s, "c", "333")
+		if got, want := list(t, s), "[a:0 a/1:1 b:2 c:3]"; got != want {
+			t.Fatalf("ListObjects: got %v, want %v", got, want)
+		}
+		if err := s.DeleteObjects(ctx, []string{"a/1", "c", "missing"}); err != nil {
+			t.Fatalf("DeleteObjects: %v", err)
+		}
+		if got, want := list(t, s), "[a:0 b:2]"; got != want {
+			t.Fatalf("ListObjects after DeleteObjects: got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestS3PhysicalStoreConformance(t *testing.T) {
+	testPhysicalStore(t, func(t *testing.T) PhysicalStore {
+		return newTestPhysicalStore(newFakeS3())
+	})
+}
+
+func TestMemPhysicalStoreConformance(t *testing.T) {
+	testPhysicalStore(t, func(t *testing.T) PhysicalStore {
+		return NewMemPhysicalStore()
+	})
+}
+
+func TestLocalPhysicalStoreConformance(t *testing.T) {
+	testPhysicalStore(t, func(t *testing.T) PhysicalStore {
+		return LocalPhysicalStore{Dir: filepath.Join(t.TempDir(), "data")}
+	})
+}
+
+func TestLocalPhysicalStoreCopyIsNew(t *testing.T) {
+	ctx := context.Background()
+	s := LocalPhysicalStore{Dir: filepath.Join(t.TempDir(), "data")}
+	if err := s.PutObject(ctx, "a", strings.NewReader("hello")); err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(s.path("a"), old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	start := time.Now().Add(-time.Second)
+	if err := s.CopyObject(ctx, "a", "b", 5); err != nil {
+		t.Fatalf("CopyObject: %v", err)
+	}
+	err := s.ListObjects(ctx, func(obj Object) error {
+		if obj.Key == "b" && obj.LastModified.Before(start) {
+			t.Errorf("copy of an old object: LastModified %v, want after %v", obj.LastModified, start)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListObjects: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package awsfs
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+// TrashPath is the reserved collection that holds the trash of every user,
+// in a collection named after the user. When the Server keeps a trash,
+// RemoveAll moves entries there, and moving them out again with MOVE restores
+// them. Deleting an entry inside the trash deletes it for good. The trash is
+// not listed in the root, and a request with a user only has access to the
+// trash of that user.
+const TrashPath = "/.trash"
+
+// anonymousUser names the trash of requests without a user.
+const anonymousUser = "anonymous"
+
+// trashNamespace is the XML namespace of the properties that describe the
+// entries in the trash.
+const trashNamespace = "urn:webdav-serverless:trash"
+
+// trashTimeFormat formats the deletion time that starts the names of entries
+// in the trash, so that the names are unique and sort by deletion time.
+const trashTimeFormat = "20060102-150405.000000000"
+
+// TrashInfo describes where an entry in the trash came from.
+type TrashInfo struct {
+	// Path is the path of the entry before it was deleted.
+	Path string `dynamodbav:"path"`
+	// Deleted is the time of the deletion.
+	Deleted time.Time `dynamodbav:"deleted"`
+	// Deleter is the user who deleted the entry, or empty if the request had
+	// no user.
+	Deleter string `dynamodbav:"deleter,omitempty"`
+}
+
+type userKey struct{}
+
+// WithUser returns a context for the requests of the named user, whose
+// deletions go to the trash of that user.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// userOf returns the user of the request with context ctx, or empty if it
+// has none.
+func userOf(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// inTrash reports whether the clean path p is the trash or inside it.
+func inTrash(p string) bool {
+	return p == TrashPath || strings.HasPrefix(p, TrashPath+"/")
+}
+
+// checkTrash returns os.ErrPermission if the request with context ctx may not
+// access the clean path p, or may not change it if write is set. A request
+// with a user may only access the trash of that user, and may list but not
+// change TrashPath itself. Requests without a user, as served without
+// authentication, may access every trash.
+func checkTrash(ctx context.Context, p string, write bool) error {
+	user := userOf(ctx)
+	if user == "" || !inTrash(p) {
+		return nil
+	}
+	if p == TrashPath {
+		if write {
+			return os.ErrPermission
+		}
+		return nil
+	}
+	if own := trashDir(user); p != own && !strings.HasPrefix(p, own+"/") {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// listChildren lists the members of the directory with the clean path p and
+// the ID id, without those hidden from the request with context ctx: the
+// trash is not listed in the root, and a request with a user only sees its
+// own trash in TrashPath.
+func (s *Server) listChildren(ctx context.Context, p, id string) EntryIterator {
+	it := s.MetadataStore.ListEntriesByParentID(id)
+	switch {
+	case p == "/":
+		return &filterEntryIterator{EntryIterator: it, keep: func(entry Entry) bool {
+			return entry.Name != path.Base(TrashPath)
+		}}
+	case p == TrashPath && userOf(ctx) != "":
+		own := path.Base(trashDir(userOf(ctx)))
+		return &filterEntryIterator{EntryIterator: it, keep: func(entry Entry) bool {
+			return entry.Name == own
+		}}
+	}
+	return it
+}
+
+// filterEntryIterator skips the entries of EntryIterator that keep rejects.
+type filterEntryIterator struct {
+	EntryIterator
+	keep func(Entry) bool
+}
+
+func (it *filterEntryIterator) Next(ctx context.Context) bool {
+	for it.EntryIterator.Next(ctx) {
+		if it.keep(it.Entry()) {
+			return true
+		}
+	}
+	return false
+}
+
+// trashDir returns the path of the trash of user.
+func trashDir(user string) string {
+	if user == "" {
+		user = anonymousUser
+	}
+	name := url.PathEscape(user)
+	if name == "." || name == ".." {
+		name = strings.ReplaceAll(name, ".", "%2E")
+	}
+	return path.Join(TrashPath, name)
+}
+
+// trash moves entry, which is named by the clean path p, to the trash of the
+// user of the request.
+func (s *Server) trash(ctx context.Context, p string, entry Entry) error {
+	user := userOf(ctx)
+	dir := trashDir(user)
+	dirID, err := s.resolve(ctx, dir)
+	if errors.Is(err, os.ErrNotExist) {
+		for _, d := range []string{TrashPath, dir} {
+			if err := s.mkdir(ctx, d); err != nil && !errors.Is(err, os.ErrExist) {
+				return err
+			}
+		}
+		dirID, err = s.resolve(ctx, dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	info := &TrashInfo{Path: p, Deleted: time.Now(), Deleter: user}
+	name := info.Deleted.UTC().Format(trashTimeFormat) + " " + entry.Name
+	err = s.MetadataStore.UpdateEntryName(ctx, entry, dirID, name, info)
+	if errors.Is(err, ErrEntryExists) {
+		return os.ErrExist
+	}
+	return err
+}
+
+// PurgeTrash deletes the entries that have been in the trash for longer than
+// retention for good, and calls report for each of them. Entries that were
+// moved into the trash rather than deleted count as deleted when they were
+// last modified.
+func (s *Server) PurgeTrash(ctx context.Context, retention time.Duration, report func(TrashInfo)) error {
+	trashID, err := s.resolve(ctx, TrashPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retention)
+	users, err := s.MetadataStore.GetEntriesByParentID(ctx, trashID)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if !user.IsDir() {
+			continue
+		}
+		entries, err := s.MetadataStore.GetEntriesByParentID(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			info := TrashInfo{Path: path.Join(TrashPath, user.Name, entry.Name), Deleted: entry.Modify}
+			if entry.Trash != nil {
+				info = *entry.Trash
+			}
+			if info.Deleted.After(cutoff) {
+				continue
+			}
+			if err := s.MetadataStore.DeleteEntries(ctx, entry); err != nil {
+				return err
+			}
+			if err := s.reap(ctx, entry); err != nil {
+				return err
+			}
+			report(info)
+		}
+	}
+	return nil
+}
+
+// trashProps returns the properties that describe an entry in the trash.
+func trashProps(info *TrashInfo) map[xml.Name]webdav.Property {
+	props := make(map[xml.Name]webdav.Property, 3)
+	add := func(local, value string) {
+		name := xml.Name{Space: trashNamespace, Local: local}
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(value))
+		props[name] = webdav.Property{XMLName: name, InnerXML: []byte(b.String())}
+	}
+	add("original-path", info.Path)
+	add("deleted", info.Deleted.UTC().Format(http.TimeFormat))
+	add("deleter", info.Deleter)
+	return props
+}
@@ -0,0 +1,162 @@
+package awsfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+func TestTrash(t *testing.T) {
+	s := newTestServer(t)
+	s.Trash = true
+	ctx := WithUser(context.Background(), "alice")
+	if err := s.Mkdir(ctx, "/a", 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	for _, name := range []string{"/a/f", "/a/g"} {
+		if _, err := s.Create(ctx, name, 0, 0, strings.NewReader(name)); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	// Each user lists their own trash.
+	trashed := func(user string) []string {
+		t.Helper()
+		ctx := context.Background()
+		if user != "" {
+			ctx = WithUser(ctx, user)
+		}
+		f, err := s.OpenFile(ctx, trashDir(user), os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("OpenFile of the trash: %v", err)
+		}
+		defer f.Close()
+		fis, err := f.Readdir(0)
+		if err != nil {
+			t.Fatalf("Readdir of the trash: %v", err)
+		}
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		return names
+	}
+
+	if err := s.RemoveAll(ctx, "/a/f"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if _, err := s.Stat(ctx, "/a/f"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of a deleted file: got %v, want not exist", err)
+	}
+	names := trashed("alice")
+	if len(names) != 1 || !strings.HasSuffix(names[0], " f") {
+		t.Fatalf("trash: got %q, want the deleted file", names)
+	}
+	if got := len(s.s3.keys()); got != 2 {
+		t.Fatalf("got %d objects, want 2: the content stays in the trash", got)
+	}
+
+	// The trash is browsable, with where its entries came from.
+	rec := newTestHandler(t, s)("PROPFIND", "/.trash/alice/"+strings.ReplaceAll(names[0], " ", "%20"), `<?xml version="1.0" encoding="utf-8" ?>
+		<D:propfind xmlns:D="DAV:" xmlns:T="urn:webdav-serverless:trash">
+			<D:prop><T:original-path/><T:deleter/></D:prop>
+		</D:propfind>`)
+	body := rec.Body.String()
+	if rec.Code != webdav.StatusMulti || !strings.Contains(body, ">/a/f</original-path>") || !strings.Contains(body, ">alice</deleter>") {
+		t.Fatalf("PROPFIND in the trash: got %d %s", rec.Code, body)
+	}
+
+	// Moving the file out of the trash restores it.
+	if err := s.Rename(ctx, path.Join(trashDir("alice"), names[0]), "/a/f"); err != nil {
+		t.Fatalf("Rename out of the trash: %v", err)
+	}
+	id, err := s.resolve(ctx, "/a/f")
+	if err != nil {
+		t.Fatalf("resolve of a restored file: %v", err)
+	}
+	if entry, err := s.MetadataStore.GetEntry(ctx, id); err != nil || entry.Trash != nil {
+		t.Fatalf("restored entry: got %+v, %v, want no trash info", entry, err)
+	}
+
+	// A request without a user deletes to the anonymous trash, and deleting
+	// inside the trash is for good.
+	if err := s.RemoveAll(context.Background(), "/a/g"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	names = trashed("")
+	if len(names) != 1 {
+		t.Fatalf("anonymous trash: got %q", names)
+	}
+	// Another user has no access to that trash.
+	other := path.Join(trashDir(""), names[0])
+	if err := s.RemoveAll(ctx, other); !os.IsPermission(err) {
+		t.Fatalf("RemoveAll in the trash of another user: got %v, want permission denied", err)
+	}
+	if err := s.Rename(ctx, other, "/a/g"); !os.IsPermission(err) {
+		t.Fatalf("Rename out of the trash of another user: got %v, want permission denied", err)
+	}
+	if _, err := s.OpenFile(ctx, other, os.O_RDONLY, 0); !os.IsPermission(err) {
+		t.Fatalf("OpenFile in the trash of another user: got %v, want permission denied", err)
+	}
+	if err := s.ReadDir(ctx, trashDir(""), nil, func(os.FileInfo) error { return nil }); !os.IsPermission(err) {
+		t.Fatalf("ReadDir of the trash of another user: got %v, want permission denied", err)
+	}
+	if err := s.RemoveAll(ctx, TrashPath); !os.IsPermission(err) {
+		t.Fatalf("RemoveAll of the trash of every user: got %v, want permission denied", err)
+	}
+	// The trash is hidden from the root, and lists only the own trash.
+	list := func(ctx context.Context, name string) []string {
+		t.Helper()
+		var names []string
+		err := s.ReadDir(ctx, name, nil, func(fi os.FileInfo) error {
+			names = append(names, fi.Name())
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ReadDir of %s: %v", name, err)
+		}
+		return names
+	}
+	if got := list(ctx, "/"); strings.Join(got, " ") != "a" {
+		t.Fatalf("ReadDir of the root: got %q, want no trash", got)
+	}
+	if got := list(ctx, TrashPath); strings.Join(got, " ") != "alice" {
+		t.Fatalf("ReadDir of the trash: got %q, want only the own trash", got)
+	}
+	if got := list(context.Background(), TrashPath); len(got) != 2 {
+		t.Fatalf("ReadDir of the trash without a user: got %q, want every trash", got)
+	}
+	if err := s.RemoveAll(context.Background(), other); err != nil {
+		t.Fatalf("RemoveAll in the trash: %v", err)
+	}
+	s.Wait()
+	if got := len(s.s3.keys()); got != 1 {
+		t.Fatalf("got %d objects after deleting from the trash, want 1", got)
+	}
+
+	// Purging keeps what is younger than the retention.
+	if err := s.RemoveAll(ctx, "/a"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	var purged []string
+	report := func(info TrashInfo) { purged = append(purged, info.Path) }
+	if err := s.PurgeTrash(ctx, time.Hour, report); err != nil {
+		t.Fatalf("PurgeTrash: %v", err)
+	}
+	if len(purged) != 0 || len(trashed("alice")) != 1 {
+		t.Fatalf("PurgeTrash of recent deletions: purged %q", purged)
+	}
+	if err := s.PurgeTrash(ctx, 0, report); err != nil {
+		t.Fatalf("PurgeTrash: %v", err)
+	}
+	if strings.Join(purged, " ") != "/a" || len(trashed("alice")) != 0 {
+		t.Fatalf("PurgeTrash: purged %q, trash %q", purged, trashed("alice"))
+	}
+	if keys := s.s3.keys(); len(keys) != 0 {
+		t.Fatalf("objects after PurgeTrash: %q", keys)
+	}
+}
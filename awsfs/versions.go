@@ -0,0 +1,209 @@
+package awsfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+// FileVersion is earlier content of a file. Objects are never written twice,
+// so the version keeps the object that held the content.
+type FileVersion struct {
+	Number int       `dynamodbav:"number"`
+	Object string    `dynamodbav:"object"`
+	Size   int64     `dynamodbav:"size"`
+	Modify time.Time `dynamodbav:"modify"`
+	Checksums
+}
+
+// checkedIn returns the number of the version that is the current content of
+// the file e.
+func (e Entry) checkedIn() int {
+	return max(e.CheckedIn, 1)
+}
+
+// objectKeys returns the keys of the objects that the file e refers to: its
+// content and the content of its versions. A restored version shares the
+// object with the version, so a key is listed only once.
+func (e Entry) objectKeys() []string {
+	keys := []string{e.ObjectKey()}
+	for _, v := range e.Versions {
+		if !slices.Contains(keys, v.Object) {
+			keys = append(keys, v.Object)
+		}
+	}
+	return keys
+}
+
+// replaceObject makes the object key the content of the file e, keeping the
+// replaced content as the newest of at most keep versions, and returns the
+// keys of the objects that e no longer refers to.
+func (e *Entry) replaceObject(key string, size int64, sum Checksums, modify time.Time, keep int) []string {
+	before := e.objectKeys()
+	versions := append(slices.Clone(e.Versions), FileVersion{
+		Number:    e.checkedIn(),
+		Object:    e.ObjectKey(),
+		Size:      e.Size,
+		Modify:    e.Modify,
+		Checksums: e.Checksums,
+	})
+	e.Versions = versions[max(len(versions)-keep, 0):]
+	if len(e.Versions) == 0 {
+		e.Versions = nil
+	}
+	e.CheckedIn = e.checkedIn() + 1
+	e.Object = key
+	e.Size = size
+	e.Checksums = sum
+	e.Modify = modify
+
+	after := e.objectKeys()
+	var dropped []string
+	for _, k := range before {
+		if !slices.Contains(after, k) {
+			dropped = append(dropped, k)
+		}
+	}
+	return dropped
+}
+
+// version returns the version n of the file e, which is its current content
+// if n is the number of the checked-in version.
+func (e Entry) version(n int) (FileVersion, bool) {
+	if n == e.checkedIn() {
+		return FileVersion{
+			Number:    n,
+			Object:    e.ObjectKey(),
+			Size:      e.Size,
+			Modify:    e.Modify,
+			Checksums: e.Checksums,
+		}, true
+	}
+	for _, v := range e.Versions {
+		if v.Number == n {
+			return v, true
+		}
+	}
+	return FileVersion{}, false
+}
+
+// entry returns the file as it was at version v.
+func (v FileVersion) entry(file Entry) Entry {
+	file.Object = v.Object
+	file.Size = v.Size
+	file.Modify = v.Modify
+	file.Checksums = v.Checksums
+	file.CheckedIn = v.Number
+	file.Versions = nil
+	return file
+}
+
+var _ webdav.Versioner = (*Server)(nil)
+
+// fileEntry returns the entry of the file named name.
+func (s *Server) fileEntry(ctx context.Context, name string) (Entry, error) {
+	if name = slashClean(name); name == "" {
+		return Entry{}, os.ErrInvalid
+	}
+	var entry Entry
+	if s.inSnapshots(name) {
+		// A file of a snapshot has no versions but its content.
+		var err error
+		if entry, _, err = s.snapshotEntry(ctx, name); err != nil {
+			return Entry{}, err
+		}
+	} else {
+		if err := checkTrash(ctx, name, false); err != nil {
+			return Entry{}, err
+		}
+		id, err := s.resolve(ctx, name)
+		if err != nil {
+			return Entry{}, err
+		}
+		if entry, err = s.MetadataStore.GetEntry(ctx, id); err != nil {
+			return Entry{}, err
+		}
+	}
+	if entry.IsDir() {
+		return Entry{}, os.ErrInvalid
+	}
+	return entry, nil
+}
+
+// Versions returns the kept versions of the file name, oldest first, ending
+// with the checked-in version.
+func (s *Server) Versions(ctx context.Context, name string) ([]webdav.VersionInfo, error) {
+	entry, err := s.fileEntry(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]webdav.VersionInfo, 0, len(entry.Versions)+1)
+	for _, v := range entry.Versions {
+		versions = append(versions, webdav.VersionInfo{FileInfo: newFileInfo(v.entry(entry)), Number: v.Number})
+	}
+	return append(versions, webdav.VersionInfo{FileInfo: newFileInfo(entry), Number: entry.checkedIn()}), nil
+}
+
+// OpenVersion opens the version n of the file name for reading.
+func (s *Server) OpenVersion(ctx context.Context, name string, n int) (webdav.File, error) {
+	entry, err := s.fileEntry(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := entry.version(n)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	entry = v.entry(entry)
+	return &FileReader{
+		object:        newObjectReader(ctx, s.PhysicalStore, entry.ObjectKey(), entry.Size),
+		entry:         entry,
+		metadataStore: s.MetadataStore,
+		ctx:           ctx,
+	}, nil
+}
+
+// RestoreVersion makes the content of the version n the content of the file
+// name again, as a new version. The new version shares the object of the
+// restored one, so nothing is copied.
+func (s *Server) RestoreVersion(ctx context.Context, name string, n int) error {
+	if s.inSnapshots(slashClean(name)) {
+		return os.ErrPermission
+	}
+	if err := checkTrash(ctx, slashClean(name), true); err != nil {
+		return err
+	}
+	entry, err := s.fileEntry(ctx, name)
+	if err != nil {
+		return err
+	}
+	v, ok := entry.version(n)
+	if !ok {
+		return os.ErrNotExist
+	}
+	if n == entry.checkedIn() {
+		return nil
+	}
+	added := Usage{Bytes: v.Size - entry.Size}
+	if err := s.addUsage(ctx, added); err != nil {
+		return err
+	}
+	dropped, err := s.MetadataStore.UpdateEntryObject(ctx, entry.ID, v.Object, v.Size, v.Checksums, time.Now(), s.KeepVersions)
+	if err != nil {
+		s.releaseUsage(added)
+	}
+	if errors.Is(err, ErrNoSuchEntry) {
+		return os.ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+	for _, key := range dropped {
+		s.releaseReplacedObject(entry.ID, key)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package awsfs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.KeepVersions = 2
+	do := newTestHandler(t, s)
+	versions := func() string {
+		t.Helper()
+		rec := do("REPORT", "/f", `<?xml version="1.0" encoding="utf-8" ?>
+			<D:version-tree xmlns:D="DAV:">
+				<D:prop><D:version-name/><D:getcontentlength/></D:prop>
+			</D:version-tree>`)
+		if rec.Code != webdav.StatusMulti {
+			t.Fatalf("REPORT: got %d: %s", rec.Code, rec.Body)
+		}
+		var hrefs []string
+		for _, part := range strings.Split(rec.Body.String(), "<D:href>")[1:] {
+			href, _, _ := strings.Cut(part, "</D:href>")
+			hrefs = append(hrefs, href)
+		}
+		return strings.Join(hrefs, " ")
+	}
+	get := func(path string) (int, string) {
+		t.Helper()
+		rec := do("GET", path, "")
+		return rec.Code, rec.Body.String()
+	}
+
+	for _, content := range []string{"one", "two", "three", "four"} {
+		if rec := do("PUT", "/f", content); rec.Code != http.StatusCreated {
+			t.Fatalf("PUT: got %d", rec.Code)
+		}
+	}
+	if got, want := versions(), "/f?version=2 /f?version=3 /f?version=4"; got != want {
+		t.Fatalf("versions: got %q, want %q", got, want)
+	}
+	// The oldest version is gone with its object.
+	if got := len(s.s3.keys()); got != 3 {
+		t.Fatalf("got %d objects, want 3: %q", got, s.s3.keys())
+	}
+	if code, body := get("/f?version=2"); code != http.StatusOK || body != "two" {
+		t.Fatalf("GET of version 2: got %d %q", code, body)
+	}
+	if code, _ := get("/f?version=1"); code != http.StatusNotFound {
+		t.Fatalf("GET of version 1: got %d, want %d", code, http.StatusNotFound)
+	}
+
+	rec := do("PROPFIND", "/f", `<?xml version="1.0" encoding="utf-8" ?>
+		<D:propfind xmlns:D="DAV:"><D:prop><D:checked-in/></D:prop></D:propfind>`)
+	if !strings.Contains(rec.Body.String(), "<D:checked-in><D:href>/f?version=4</D:href></D:checked-in>") {
+		t.Fatalf("PROPFIND of DAV:checked-in: got %s", rec.Body)
+	}
+
+	update := func(href string) int {
+		t.Helper()
+		return do("UPDATE", "/f", `<?xml version="1.0" encoding="utf-8" ?>
+			<D:update xmlns:D="DAV:"><D:version><D:href>`+href+`</D:href></D:version></D:update>`).Code
+	}
+	if got := update("/f?version=2"); got != webdav.StatusMulti {
+		t.Fatalf("UPDATE to version 2: got %d, want %d", got, webdav.StatusMulti)
+	}
+	if code, body := get("/f"); code != http.StatusOK || body != "two" {
+		t.Fatalf("GET after UPDATE: got %d %q", code, body)
+	}
+	if got, want := versions(), "/f?version=3 /f?version=4 /f?version=5"; got != want {
+		t.Fatalf("versions after UPDATE: got %q, want %q", got, want)
+	}
+	// Version 5 shares the object of version 2.
+	if got := len(s.s3.keys()); got != 3 {
+		t.Fatalf("got %d objects after UPDATE, want 3: %q", got, s.s3.keys())
+	}
+	if got := update("/f?version=1"); got != http.StatusConflict {
+		t.Fatalf("UPDATE to a version that is not kept: got %d, want %d", got, http.StatusConflict)
+	}
+	if got := update("/g?version=3"); got != http.StatusConflict {
+		t.Fatalf("UPDATE to a version of another file: got %d, want %d", got, http.StatusConflict)
+	}
+
+	// Removing the file removes its versions.
+	if err := s.RemoveAll(ctx, "/f"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	s.Wait()
+	if keys := s.s3.keys(); len(keys) != 0 {
+		t.Fatalf("objects after RemoveAll: %q", keys)
+	}
+}
+
+func TestVersionsDeduplicated(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.KeepVersions = 5
+	s.Deduplicate = true
+	for _, content := range []string{"a", "b", "a"} {
+		if _, err := s.Create(ctx, "/f", 0, 0, strings.NewReader(content)); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	if got := len(s.s3.keys()); got != 2 {
+		t.Fatalf("got %d objects, want 2: %q", got, s.s3.keys())
+	}
+	f, err := s.OpenVersion(ctx, "/f", 2)
+	if err != nil {
+		t.Fatalf("OpenVersion: %v", err)
+	}
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(b) != "b" {
+		t.Fatalf("version 2: got %q, %v", b, err)
+	}
+	if err := s.RemoveAll(ctx, "/f"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	s.Wait()
+	if keys := s.s3.keys(); len(keys) != 0 {
+		t.Fatalf("objects after RemoveAll: %q", keys)
+	}
+}
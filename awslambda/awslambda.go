@@ -0,0 +1,159 @@
+// Package awslambda serves an http.Handler as an AWS Lambda function invoked
+// through API Gateway HTTP APIs or Lambda function URLs, which both send
+// events in the payload format version 2.0.
+package awslambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Handler adapts h to the handler signature of the Lambda runtime.
+func Handler(h http.Handler) func(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	return func(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+		r, err := NewRequest(ctx, event)
+		if err != nil {
+			return events.APIGatewayV2HTTPResponse{}, err
+		}
+		w := NewResponseWriter()
+		h.ServeHTTP(w, r)
+		return w.Response(), nil
+	}
+}
+
+// NewRequest returns the HTTP request described by event.
+func NewRequest(ctx context.Context, event events.APIGatewayV2HTTPRequest) (*http.Request, error) {
+	body := []byte(event.Body)
+	if event.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(event.Body); err != nil {
+			return nil, fmt.Errorf("failed to decode body: %w", err)
+		}
+	}
+
+	rawPath := event.RawPath
+	if rawPath == "" {
+		rawPath = event.RequestContext.HTTP.Path
+	}
+	u, err := url.Parse(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse path %q: %w", rawPath, err)
+	}
+	u.RawQuery = event.RawQueryString
+
+	r, err := http.NewRequestWithContext(ctx, event.RequestContext.HTTP.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range event.Headers {
+		// Repeated headers arrive joined with commas.
+		r.Header.Set(name, value)
+	}
+	if len(event.Cookies) > 0 {
+		r.Header.Set("Cookie", strings.Join(event.Cookies, "; "))
+	}
+	r.ContentLength = int64(len(body))
+	r.Host = r.Header.Get("Host")
+	if r.Host == "" {
+		r.Host = event.RequestContext.DomainName
+	}
+	r.URL.Host = r.Host
+	r.RemoteAddr = event.RequestContext.HTTP.SourceIP
+	r.RequestURI = u.RequestURI()
+	return r, nil
+}
+
+// ResponseWriter is an http.ResponseWriter that buffers a response for
+// returning it to API Gateway.
+type ResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+// NewResponseWriter returns an empty ResponseWriter.
+func NewResponseWriter() *ResponseWriter {
+	return &ResponseWriter{header: make(http.Header)}
+}
+
+func (w *ResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *ResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// Response returns the response written so far. The body is base64-encoded
+// unless it is text.
+func (w *ResponseWriter) Response() events.APIGatewayV2HTTPResponse {
+	code := w.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	resp := events.APIGatewayV2HTTPResponse{
+		StatusCode: code,
+		Headers:    make(map[string]string, len(w.header)),
+	}
+	for name, values := range w.header {
+		if name == "Set-Cookie" {
+			resp.Cookies = append(resp.Cookies, values...)
+			continue
+		}
+		resp.Headers[name] = strings.Join(values, ",")
+	}
+	body := w.body.Bytes()
+	contentType := w.header.Get("Content-Type")
+	if _, ok := w.header["Content-Type"]; !ok && len(body) > 0 {
+		// Like net/http, sniff the type of a body that has none.
+		contentType = http.DetectContentType(body)
+		resp.Headers["Content-Type"] = contentType
+	}
+	if isText(contentType, body) {
+		resp.Body = string(body)
+	} else {
+		resp.Body = base64.StdEncoding.EncodeToString(body)
+		resp.IsBase64Encoded = true
+	}
+	return resp
+}
+
+// isText reports whether a body of the given content type can be returned to
+// API Gateway as is.
+func isText(contentType string, body []byte) bool {
+	if len(body) == 0 {
+		return true
+	}
+	if !utf8.Valid(body) {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		mediaType == "application/json",
+		mediaType == "application/xml",
+		strings.HasSuffix(mediaType, "+xml"),
+		strings.HasSuffix(mediaType, "+json"):
+		return true
+	}
+	return false
+}
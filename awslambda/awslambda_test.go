@@ -0,0 +1,169 @@
+package awslambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/webdav-serverless/webdav-serverless/webdav"
+)
+
+func readEvent(t *testing.T, name string) events.APIGatewayV2HTTPRequest {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event events.APIGatewayV2HTTPRequest
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return event
+}
+
+func responseBody(t *testing.T, resp events.APIGatewayV2HTTPResponse) []byte {
+	t.Helper()
+	if !resp.IsBase64Encoded {
+		return []byte(resp.Body)
+	}
+	body, err := base64.StdEncoding.DecodeString(resp.Body)
+	if err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+	return body
+}
+
+func TestHandler(t *testing.T) {
+	h := Handler(&webdav.Handler{
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	})
+
+	// The events are replayed in order against the same file system.
+	testCases := []struct {
+		event      string
+		wantStatus int
+		wantBase64 bool
+		check      func(t *testing.T, resp events.APIGatewayV2HTTPResponse, body []byte)
+	}{{
+		event:      "mkcol.json",
+		wantStatus: http.StatusCreated,
+	}, {
+		event:      "put-binary.json",
+		wantStatus: http.StatusCreated,
+	}, {
+		event:      "put-text.json",
+		wantStatus: http.StatusCreated,
+	}, {
+		event:      "get-binary.json",
+		wantStatus: http.StatusPartialContent,
+		wantBase64: true,
+		check: func(t *testing.T, resp events.APIGatewayV2HTTPResponse, body []byte) {
+			if want := []byte{0xfe, 0xff, 0x80, 0x7f}; !bytes.Equal(body, want) {
+				t.Errorf("body: got %x, want %x", body, want)
+			}
+			if got := resp.Headers["Content-Range"]; got != "bytes 2-5/8" {
+				t.Errorf("Content-Range: got %q, want %q", got, "bytes 2-5/8")
+			}
+		},
+	}, {
+		event:      "propfind.json",
+		wantStatus: http.StatusMultiStatus,
+		check: func(t *testing.T, resp events.APIGatewayV2HTTPResponse, body []byte) {
+			for _, want := range []string{
+				"<D:href>/docs/blob.bin</D:href>",
+				"<D:href>/docs/hello%20world.txt</D:href>",
+				"<D:getcontentlength>13</D:getcontentlength>",
+			} {
+				if !strings.Contains(string(body), want) {
+					t.Errorf("body does not contain %q:\n%s", want, body)
+				}
+			}
+		},
+	}, {
+		event:      "move.json",
+		wantStatus: http.StatusCreated,
+	}, {
+		event:      "get-moved.json",
+		wantStatus: http.StatusOK,
+		wantBase64: true,
+		check: func(t *testing.T, resp events.APIGatewayV2HTTPResponse, body []byte) {
+			if want := []byte{0, 1, 0xfe, 0xff, 0x80, 0x7f, '\n', '\r'}; !bytes.Equal(body, want) {
+				t.Errorf("body: got %x, want %x", body, want)
+			}
+		},
+	}}
+
+	for _, tc := range testCases {
+		resp, err := h(context.Background(), readEvent(t, tc.event))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.event, err)
+		}
+		if resp.StatusCode != tc.wantStatus {
+			t.Fatalf("%s: status: got %d, want %d (body %q)", tc.event, resp.StatusCode, tc.wantStatus, resp.Body)
+		}
+		if resp.IsBase64Encoded != tc.wantBase64 {
+			t.Errorf("%s: IsBase64Encoded: got %t, want %t", tc.event, resp.IsBase64Encoded, tc.wantBase64)
+		}
+		if tc.check != nil {
+			tc.check(t, resp, responseBody(t, resp))
+		}
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	event := readEvent(t, "get-binary.json")
+	event.RawQueryString = "a=1&b=2"
+	r, err := NewRequest(context.Background(), event)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	if r.Method != http.MethodGet {
+		t.Errorf("Method: got %q, want GET", r.Method)
+	}
+	if got, want := r.URL.String(), "//abcdefghij.execute-api.us-east-1.amazonaws.com/docs/blob.bin?a=1&b=2"; got != want {
+		t.Errorf("URL: got %q, want %q", got, want)
+	}
+	if got := r.Header.Get("Range"); got != "bytes=2-5" {
+		t.Errorf("Range: got %q, want %q", got, "bytes=2-5")
+	}
+	if c, err := r.Cookie("session"); err != nil || c.Value != "abc" {
+		t.Errorf("Cookie: got %v, %v, want session=abc", c, err)
+	}
+	if r.RemoteAddr != "203.0.113.7" {
+		t.Errorf("RemoteAddr: got %q, want %q", r.RemoteAddr, "203.0.113.7")
+	}
+}
+
+func TestResponseWriter(t *testing.T) {
+	w := NewResponseWriter()
+	w.Header().Add("Set-Cookie", "a=1")
+	w.Header().Add("Set-Cookie", "b=2")
+	w.Header().Add("Allow", "GET")
+	w.Header().Add("Allow", "PUT")
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("<x/>"))
+
+	resp := w.Response()
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Errorf("StatusCode: got %d, want %d", resp.StatusCode, http.StatusMultiStatus)
+	}
+	if resp.IsBase64Encoded || resp.Body != "<x/>" {
+		t.Errorf("body: got %q (base64 %t), want %q", resp.Body, resp.IsBase64Encoded, "<x/>")
+	}
+	if got := strings.Join(resp.Cookies, " "); got != "a=1 b=2" {
+		t.Errorf("Cookies: got %q, want %q", got, "a=1 b=2")
+	}
+	if got := resp.Headers["Allow"]; got != "GET,PUT" {
+		t.Errorf("Allow: got %q, want %q", got, "GET,PUT")
+	}
+}
@@ -30,3 +30,35 @@ aws dynamodb create-table \
     --key-schema \
         AttributeName=id,KeyType=HASH \
     --billing-mode PAY_PER_REQUEST
+aws dynamodb create-table \
+    --table-name webdav-serverless-blob \
+    --region us-east-1 \
+    --endpoint-url $DYNAMO_DB_URL \
+    --attribute-definitions \
+        AttributeName=id,AttributeType=S \
+    --key-schema \
+        AttributeName=id,KeyType=HASH \
+    --billing-mode PAY_PER_REQUEST
+aws dynamodb create-table \
+    --table-name webdav-serverless-snapshot \
+    --region us-east-1 \
+    --endpoint-url $DYNAMO_DB_URL \
+    --attribute-definitions \
+        AttributeName=id,AttributeType=S \
+    --key-schema \
+        AttributeName=id,KeyType=HASH \
+    --billing-mode PAY_PER_REQUEST
+aws dynamodb create-table \
+    --table-name webdav-serverless-lock \
+    --region us-east-1 \
+    --endpoint-url $DYNAMO_DB_URL \
+    --attribute-definitions \
+        AttributeName=id,AttributeType=S \
+    --key-schema \
+        AttributeName=id,KeyType=HASH \
+    --billing-mode PAY_PER_REQUEST
+aws dynamodb update-time-to-live \
+    --table-name webdav-serverless-lock \
+    --region us-east-1 \
+    --endpoint-url $DYNAMO_DB_URL \
+    --time-to-live-specification Enabled=true,AttributeName=ttl
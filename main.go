@@ -8,15 +8,19 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/webdav-serverless/webdav-serverless/auth"
 	"github.com/webdav-serverless/webdav-serverless/awsfs"
+	"github.com/webdav-serverless/webdav-serverless/awslambda"
 	"github.com/webdav-serverless/webdav-serverless/webdav"
 )
 
@@ -29,6 +33,27 @@ type Params struct {
 	BasicAuthUser       string `mapstructure:"basic-auth-user"`
 	BasicAuthPassword   string `mapstructure:"basic-auth-pass"`
 	DisableBasicAuth    bool   `mapstructure:"disable-basic-auth"`
+	MetadataBackend     string `mapstructure:"metadata-backend"`
+	SQLitePath          string `mapstructure:"sqlite-path"`
+	PhysicalBackend     string `mapstructure:"physical-backend"`
+	DataDir             string `mapstructure:"data-dir"`
+	Dedup               bool   `mapstructure:"dedup"`
+	KeepVersions        int    `mapstructure:"keep-versions"`
+	Trash               bool   `mapstructure:"trash"`
+	Snapshots           bool   `mapstructure:"snapshots"`
+	QuotaBytes          int64  `mapstructure:"quota-bytes"`
+	QuotaFiles          int64  `mapstructure:"quota-files"`
+
+	DeleteDelay time.Duration `mapstructure:"delete-delay"`
+
+	Htpasswd        string        `mapstructure:"htpasswd"`
+	AuthMaxFailures int           `mapstructure:"auth-max-failures"`
+	AuthLockout     time.Duration `mapstructure:"auth-lockout"`
+
+	GCDryRun bool          `mapstructure:"dry-run"`
+	GCMinAge time.Duration `mapstructure:"min-age"`
+
+	TrashRetention time.Duration `mapstructure:"retention"`
 }
 
 func main() {
@@ -62,6 +87,118 @@ func main() {
 	_ = viper.BindPFlag("basic-auth-pass", flags.Lookup("basic-auth-pass"))
 	flags.BoolVar(&params.DisableBasicAuth, "disable-basic-auth", false, "Disable basic auth.")
 	_ = viper.BindPFlag("disable-basic-auth", flags.Lookup("disable-basic-auth"))
+	flags.StringVar(&params.Htpasswd, "htpasswd", "", "File of users with bcrypt or argon2 password hashes, in htpasswd format (instead of --basic-auth-user).")
+	_ = viper.BindPFlag("htpasswd", flags.Lookup("htpasswd"))
+	flags.IntVar(&params.AuthMaxFailures, "auth-max-failures", 5, "Failed logins after which a user is locked out (0 for no lockout).")
+	_ = viper.BindPFlag("auth-max-failures", flags.Lookup("auth-max-failures"))
+	flags.DurationVar(&params.AuthLockout, "auth-lockout", 15*time.Minute, "How long a user is locked out after too many failed logins.")
+	_ = viper.BindPFlag("auth-lockout", flags.Lookup("auth-lockout"))
+	flags.StringVar(&params.MetadataBackend, "metadata-backend", "dynamodb", "Metadata store: dynamodb or sqlite.")
+	_ = viper.BindPFlag("metadata-backend", flags.Lookup("metadata-backend"))
+	flags.StringVar(&params.SQLitePath, "sqlite-path", "webdav-serverless.db", "Path of the SQLite database (with --metadata-backend=sqlite).")
+	_ = viper.BindPFlag("sqlite-path", flags.Lookup("sqlite-path"))
+	flags.StringVar(&params.PhysicalBackend, "physical-backend", "s3", "Physical store: s3 or local.")
+	_ = viper.BindPFlag("physical-backend", flags.Lookup("physical-backend"))
+	flags.StringVar(&params.DataDir, "data-dir", "data", "Directory of the file contents (with --physical-backend=local).")
+	_ = viper.BindPFlag("data-dir", flags.Lookup("data-dir"))
+	flags.BoolVar(&params.Dedup, "dedup", false, "Store files with the same content once.")
+	_ = viper.BindPFlag("dedup", flags.Lookup("dedup"))
+	flags.IntVar(&params.KeepVersions, "keep-versions", 0, "Number of earlier versions of a file to keep.")
+	_ = viper.BindPFlag("keep-versions", flags.Lookup("keep-versions"))
+	flags.DurationVar(&params.DeleteDelay, "delete-delay", 10*time.Minute, "How long overwritten content is kept before it is deleted, so that downloads of it can finish.")
+	_ = viper.BindPFlag("delete-delay", flags.Lookup("delete-delay"))
+	flags.BoolVar(&params.Trash, "trash", false, "Move deleted files to the trash of the user under /.trash.")
+	_ = viper.BindPFlag("trash", flags.Lookup("trash"))
+	flags.BoolVar(&params.Snapshots, "snapshots", false, "Serve snapshots read-only under /.snapshots and keep the objects they pin.")
+	_ = viper.BindPFlag("snapshots", flags.Lookup("snapshots"))
+	flags.Int64Var(&params.QuotaBytes, "quota-bytes", 0, "Maximum total size of the files in bytes, without kept versions (0 for no limit).")
+	_ = viper.BindPFlag("quota-bytes", flags.Lookup("quota-bytes"))
+	flags.Int64Var(&params.QuotaFiles, "quota-files", 0, "Maximum number of files (0 for no limit).")
+	_ = viper.BindPFlag("quota-files", flags.Lookup("quota-files"))
+
+	gc := &cobra.Command{
+		Use:   "gc",
+		Short: "Delete S3 objects that no entry refers to",
+		Long:  `Delete S3 objects that no entry refers to, such as the objects left behind by failed uploads and deletions.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runGC(params)
+		},
+	}
+	gcFlags := gc.Flags()
+	gcFlags.BoolVar(&params.GCDryRun, "dry-run", false, "Only report orphaned objects, do not delete them.")
+	_ = viper.BindPFlag("dry-run", gcFlags.Lookup("dry-run"))
+	gcFlags.DurationVar(&params.GCMinAge, "min-age", time.Hour, "Ignore objects modified more recently than this.")
+	_ = viper.BindPFlag("min-age", gcFlags.Lookup("min-age"))
+	c.AddCommand(gc)
+
+	purgeTrash := &cobra.Command{
+		Use:   "purge-trash",
+		Short: "Delete what has been in the trash for longer than the retention",
+		Long:  `Delete the files and directories that have been in the trash for longer than the retention for good.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runPurgeTrash(params)
+		},
+	}
+	purgeTrashFlags := purgeTrash.Flags()
+	purgeTrashFlags.DurationVar(&params.TrashRetention, "retention", 30*24*time.Hour, "Keep deleted files in the trash for this long.")
+	_ = viper.BindPFlag("retention", purgeTrashFlags.Lookup("retention"))
+	c.AddCommand(purgeTrash)
+
+	snapshot := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Manage point-in-time snapshots of the namespace",
+		Long:  `Manage point-in-time snapshots of the namespace, which are served read-only under /.snapshots/<name>/.`,
+	}
+	snapshot.AddCommand(&cobra.Command{
+		Use:   "create [name]",
+		Short: "Freeze the namespace as a snapshot",
+		Long:  `Freeze the namespace as a snapshot and pin the objects it refers to. The name defaults to the current UTC time.`,
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := time.Now().UTC().Format("20060102-150405")
+			if len(args) > 0 {
+				name = args[0]
+			}
+			return runSnapshotCreate(params, name)
+		},
+	})
+	snapshot.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the snapshots",
+		Long:  `List the snapshots, oldest first.`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSnapshotList(params)
+		},
+	})
+	snapshot.AddCommand(&cobra.Command{
+		Use:   "delete <name>",
+		Short: "Delete a snapshot",
+		Long:  `Delete a snapshot and the objects that only the snapshot kept.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSnapshotDelete(params, args[0])
+		},
+	})
+	c.AddCommand(snapshot)
+
+	c.AddCommand(&cobra.Command{
+		Use:   "recount-usage",
+		Short: "Count the storage used by the files anew",
+		Long:  `Count the storage used by the files anew, which is needed after a quota is set for an existing namespace.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRecountUsage(params)
+		},
+	})
+
+	c.AddCommand(&cobra.Command{
+		Use:   "lambda",
+		Short: "Serve as an AWS Lambda function",
+		Long:  `Serve as an AWS Lambda function invoked through an API Gateway HTTP API or a Lambda function URL.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runLambda(params)
+		},
+	})
 
 	cobra.OnInitialize(func() {
 		viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
@@ -78,45 +215,285 @@ func main() {
 	}
 }
 
-func run(params *Params) error {
-
-	ctx := context.Background()
+// newServer returns the file system and the lock system to serve it with.
+func newServer(ctx context.Context, params *Params) (*awsfs.Server, webdav.LockSystem, error) {
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to load aws config: %v", err)
+		return nil, nil, fmt.Errorf("failed to load aws config: %v", err)
+	}
+
+	metadataStore, lockSystem, err := newMetadataStore(cfg, params)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	metadataStore := awsfs.MetadataStore{
-		EntryTableName:     params.DynamoDBTablePrefix + "entry",
-		ReferenceTableName: params.DynamoDBTablePrefix + "reference",
-		DynamoDBClient: dynamodb.NewFromConfig(cfg, func(options *dynamodb.Options) {
+	physicalStore, err := newPhysicalStore(cfg, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = metadataStore.Init(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to init refarence: %v", err)
+	}
+
+	return &awsfs.Server{
+		MetadataStore: metadataStore,
+		PhysicalStore: physicalStore,
+		Deduplicate:   params.Dedup,
+		KeepVersions:  params.KeepVersions,
+		DeleteDelay:   params.DeleteDelay,
+		Trash:         params.Trash,
+		Snapshots:     params.Snapshots,
+		QuotaBytes:    params.QuotaBytes,
+		QuotaFiles:    params.QuotaFiles,
+	}, lockSystem, nil
+}
+
+// newMetadataStore returns the metadata store selected by
+// --metadata-backend, and a lock system that is shared as widely as the
+// store is: the DynamoDB lock table, or memory for a single-node SQLite
+// deployment.
+func newMetadataStore(cfg aws.Config, params *Params) (awsfs.MetadataStore, webdav.LockSystem, error) {
+	switch params.MetadataBackend {
+	case "dynamodb":
+		dynamoDBClient := dynamodb.NewFromConfig(cfg, func(options *dynamodb.Options) {
 			if params.DynamoDBURL != "" {
 				options.BaseEndpoint = &params.DynamoDBURL
 			}
-		}),
+		})
+		metadataStore := awsfs.DynamoDBMetadataStore{
+			EntryTableName:     params.DynamoDBTablePrefix + "entry",
+			ReferenceTableName: params.DynamoDBTablePrefix + "reference",
+			BlobTableName:      params.DynamoDBTablePrefix + "blob",
+			DynamoDBClient:     dynamoDBClient,
+		}
+		if params.Snapshots {
+			metadataStore.SnapshotTableName = params.DynamoDBTablePrefix + "snapshot"
+		}
+		lockSystem := awsfs.LockSystem{
+			TableName:      params.DynamoDBTablePrefix + "lock",
+			DynamoDBClient: dynamoDBClient,
+		}
+		return metadataStore, lockSystem, nil
+	case "sqlite":
+		db, err := awsfs.OpenSQLite(params.SQLitePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open sqlite database: %v", err)
+		}
+		return awsfs.SQLiteMetadataStore{DB: db}, webdav.NewMemLS(), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown metadata backend %q", params.MetadataBackend)
 	}
+}
 
-	physicalStore := awsfs.PhysicalStore{
-		BucketName: params.S3BucketName,
-		S3Client: s3.NewFromConfig(cfg, func(options *s3.Options) {
-			if params.S3URL != "" {
-				options.UsePathStyle = true
-				options.BaseEndpoint = &params.S3URL
-			}
-		}),
+// newPhysicalStore returns the physical store selected by --physical-backend.
+func newPhysicalStore(cfg aws.Config, params *Params) (awsfs.PhysicalStore, error) {
+	switch params.PhysicalBackend {
+	case "s3":
+		return awsfs.S3PhysicalStore{
+			BucketName: params.S3BucketName,
+			S3Client: s3.NewFromConfig(cfg, func(options *s3.Options) {
+				if params.S3URL != "" {
+					options.UsePathStyle = true
+					options.BaseEndpoint = &params.S3URL
+				}
+			}),
+		}, nil
+	case "local":
+		return awsfs.LocalPhysicalStore{Dir: params.DataDir}, nil
+	default:
+		return nil, fmt.Errorf("unknown physical backend %q", params.PhysicalBackend)
+	}
+}
+
+func runGC(params *Params) error {
+	ctx := context.Background()
+	fs, _, err := newServer(ctx, params)
+	if err != nil {
+		return err
+	}
+	if err := fs.ReapDeleted(ctx); err != nil {
+		return fmt.Errorf("failed to reap deleted entries: %v", err)
+	}
+	var count, size int64
+	err = fs.CollectGarbage(ctx, params.GCMinAge, params.GCDryRun, func(obj awsfs.Object) {
+		count++
+		size += obj.Size
+		log.Printf("orphan %-40s%12d  %s", obj.Key, obj.Size, obj.LastModified.Format(time.RFC3339))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to collect garbage: %v", err)
+	}
+	if params.GCDryRun {
+		log.Printf("found %d orphaned objects (%d bytes)", count, size)
+	} else {
+		log.Printf("deleted %d orphaned objects (%d bytes)", count, size)
+	}
+	return nil
+}
+
+func runPurgeTrash(params *Params) error {
+	ctx := context.Background()
+	fs, _, err := newServer(ctx, params)
+	if err != nil {
+		return err
+	}
+	var count int
+	err = fs.PurgeTrash(ctx, params.TrashRetention, func(info awsfs.TrashInfo) {
+		count++
+		log.Printf("purged %-40s%-20s%s", info.Path, info.Deleter, info.Deleted.Format(time.RFC3339))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to purge trash: %v", err)
+	}
+	log.Printf("purged %d entries from the trash", count)
+	return nil
+}
+
+// newSnapshotServer is newServer for the snapshot commands, which need the
+// snapshot table whether or not --snapshots is set.
+func newSnapshotServer(ctx context.Context, params *Params) (*awsfs.Server, error) {
+	params.Snapshots = true
+	fs, _, err := newServer(ctx, params)
+	return fs, err
+}
+
+func runSnapshotCreate(params *Params, name string) error {
+	ctx := context.Background()
+	fs, err := newSnapshotServer(ctx, params)
+	if err != nil {
+		return err
+	}
+	snap, err := fs.CreateSnapshot(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %v", err)
+	}
+	log.Printf("created snapshot %s", snap.Name)
+	return nil
+}
+
+func runSnapshotList(params *Params) error {
+	ctx := context.Background()
+	fs, err := newSnapshotServer(ctx, params)
+	if err != nil {
+		return err
+	}
+	snapshots, err := fs.ListSnapshots(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	for _, snap := range snapshots {
+		line := fmt.Sprintf("%-40s%s", snap.Name, snap.Created.Format(time.RFC3339))
+		if snap.Pending {
+			// Its creation is running or failed; delete it in the latter case.
+			line += "  pending"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func runSnapshotDelete(params *Params, name string) error {
+	ctx := context.Background()
+	fs, err := newSnapshotServer(ctx, params)
+	if err != nil {
+		return err
 	}
+	if err := fs.DeleteSnapshot(ctx, name); err != nil {
+		return fmt.Errorf("failed to delete snapshot: %v", err)
+	}
+	log.Printf("deleted snapshot %s", name)
+	return nil
+}
 
-	if err = metadataStore.Init(context.Background()); err != nil {
-		return fmt.Errorf("failed to init refarence: %v", err)
+func runRecountUsage(params *Params) error {
+	ctx := context.Background()
+	fs, _, err := newServer(ctx, params)
+	if err != nil {
+		return err
+	}
+	usage, err := fs.RecountUsage(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to recount usage: %v", err)
 	}
+	log.Printf("counted %d files (%d bytes)", usage.Files, usage.Bytes)
+	return nil
+}
 
+func run(params *Params) error {
+
+	ctx := context.Background()
+	fs, ls, err := newServer(ctx, params)
+	if err != nil {
+		return err
+	}
+
+	authenticator, err := newAuthenticator(params)
+	if err != nil {
+		return err
+	}
+
+	http.Handle("/", newHandler(fs, ls, authenticator))
+
+	log.Printf("WEBDAV ListenAndServe: [%s]\n", fmt.Sprintf(":%d", params.Port))
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", params.Port), nil); err != nil {
+		return fmt.Errorf("error with WebDAV server: %v", err)
+	}
+
+	return nil
+}
+
+func runLambda(params *Params) error {
+	ctx := context.Background()
+	fs, ls, err := newServer(ctx, params)
+	if err != nil {
+		return err
+	}
+	// The execution environment is frozen once a response is returned, so
+	// nothing may be left to run in the background.
+	fs.SyncReap = true
+	authenticator, err := newAuthenticator(params)
+	if err != nil {
+		return err
+	}
+	lambda.Start(awslambda.Handler(newHandler(fs, ls, authenticator)))
+	return nil
+}
+
+// newAuthenticator returns the authenticator of the users in --htpasswd, or
+// of the single --basic-auth-user, with lockout after repeated failures. It
+// returns nil if basic auth is disabled.
+func newAuthenticator(params *Params) (auth.Authenticator, error) {
+	if params.DisableBasicAuth {
+		return nil, nil
+	}
+	var authenticator auth.Authenticator = auth.Static{User: params.BasicAuthUser, Password: params.BasicAuthPassword}
+	if params.Htpasswd != "" {
+		if params.BasicAuthUser != "" {
+			return nil, errors.New("--htpasswd and --basic-auth-user are mutually exclusive")
+		}
+		users, err := auth.LoadHtpasswd(params.Htpasswd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load users: %v", err)
+		}
+		authenticator = users
+	}
+	if params.AuthMaxFailures > 0 {
+		authenticator = &auth.Lockout{
+			Authenticator: authenticator,
+			MaxFailures:   params.AuthMaxFailures,
+			Duration:      params.AuthLockout,
+		}
+	}
+	return authenticator, nil
+}
+
+// newHandler returns the WebDAV handler of fs. Unless authenticator is nil,
+// requests must authenticate with basic auth.
+func newHandler(fs *awsfs.Server, ls webdav.LockSystem, authenticator auth.Authenticator) http.Handler {
 	srv := &webdav.Handler{
-		FileSystem: &awsfs.Server{
-			MetadataStore: metadataStore,
-			PhysicalStore: physicalStore,
-			TempDir:       filepath.Clean(os.TempDir()),
-		},
-		LockSystem: webdav.NewMemLS(),
+		FileSystem: fs,
+		LockSystem: ls,
 		Logger: func(r *http.Request, code int, err error) {
 			litmus := r.Header.Get("X-Litmus")
 			if len(litmus) > 19 {
@@ -136,9 +513,8 @@ func run(params *Params) error {
 		},
 	}
 
-	// The next line would normally be:
-	//	http.Handle("/", h)
-	// but we wrap that HTTP handler h to cater for a special case.
+	// We would normally return srv as is, but we wrap it to cater for a
+	// special case.
 	//
 	// The propfind_invalid2 litmus test case expects an empty namespace prefix
 	// declaration to be an error. The FAQ in the webdav litmus test says:
@@ -161,27 +537,27 @@ func run(params *Params) error {
 	//
 	// Thus, we assume that the propfind_invalid2 test is obsolete, and
 	// hard-code the 400 Bad Request response that the test expects.
-	http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !params.DisableBasicAuth {
-			if user, pass, ok := r.BasicAuth(); !ok || user != params.BasicAuthUser || pass != params.BasicAuthPassword {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authenticator != nil {
+			var principal auth.Principal
+			err := errors.New("unauthorized")
+			if user, pass, ok := r.BasicAuth(); ok {
+				principal, err = authenticator.Authenticate(r.Context(), user, pass)
+			}
+			if err != nil {
 				w.Header().Add("WWW-Authenticate", `Basic realm="Please enter your username and password."`)
 				http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
-				log.Printf("%-20s%-10s%-30s%-10d%v", "", r.Method, r.URL.Path, http.StatusUnauthorized,
-					errors.New("unauthorized"))
+				log.Printf("%-20s%-10s%-30s%-10d%v", "", r.Method, r.URL.Path, http.StatusUnauthorized, err)
 				return
 			}
+			// Deletions go to the trash of the user.
+			ctx := auth.NewContext(r.Context(), principal)
+			r = r.WithContext(awsfs.WithUser(ctx, principal.Name))
 		}
 		if r.Header.Get("X-Litmus") == "props: 3 (propfind_invalid2)" {
 			http.Error(w, "400 Bad Request", http.StatusBadRequest)
 			return
 		}
 		srv.ServeHTTP(w, r)
-	}))
-
-	log.Printf("WEBDAV ListenAndServe: [%s]\n", fmt.Sprintf(":%d", params.Port))
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", params.Port), nil); err != nil {
-		return fmt.Errorf("error with WebDAV server: %v", err)
-	}
-
-	return nil
+	})
 }
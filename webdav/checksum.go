@@ -0,0 +1,137 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Digester is an optional interface for the os.FileInfo objects returned by
+// the FileSystem.
+//
+// If this interface is defined then the digests are sent with the content of
+// the file, in the Digest header of RFC 3230 and the Content-MD5 header of
+// RFC 1864.
+type Digester interface {
+	// Digests returns the SHA-256 and MD5 hashes of the content of the
+	// file. Either may be nil if it is not known.
+	//
+	// If this returns error ErrNotImplemented then the error will be
+	// ignored and no digest will be sent.
+	Digests(ctx context.Context) (sha256, md5 []byte, err error)
+}
+
+// setDigestHeaders sets the digest headers of a GET or HEAD response for the
+// file fi. Content-MD5 covers the body of the response, so it is left out
+// for a range request.
+func setDigestHeaders(ctx context.Context, w http.ResponseWriter, r *http.Request, fi os.FileInfo) error {
+	do, ok := fi.(Digester)
+	if !ok {
+		return nil
+	}
+	sha256Sum, md5Sum, err := do.Digests(ctx)
+	if err == ErrNotImplemented {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var digests []string
+	if sha256Sum != nil {
+		digests = append(digests, "SHA-256="+base64.StdEncoding.EncodeToString(sha256Sum))
+	}
+	if md5Sum != nil {
+		digests = append(digests, "MD5="+base64.StdEncoding.EncodeToString(md5Sum))
+		if r.Header.Get("Range") == "" {
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(md5Sum))
+		}
+	}
+	if len(digests) > 0 {
+		w.Header().Set("Digest", strings.Join(digests, ", "))
+	}
+	return nil
+}
+
+// checksumReader verifies the body of a PUT request against the checksums
+// that the client sent in its Content-MD5 and Digest headers. It fails the
+// final read instead of returning io.EOF if the body does not match. The
+// FileSystem must not replace the content of the file before its reader
+// returned io.EOF, so that the file keeps its old content then.
+type checksumReader struct {
+	r        io.Reader
+	sums     []expectedSum
+	mismatch bool
+}
+
+type expectedSum struct {
+	hash hash.Hash
+	want []byte
+}
+
+// newChecksumReader returns a checksumReader for the body of r, or nil if the
+// request carries no checksum that it knows. Digest algorithms other than
+// SHA-256 and MD5 are ignored.
+func newChecksumReader(r *http.Request) (*checksumReader, error) {
+	cr := &checksumReader{r: r.Body}
+	if v := r.Header.Get("Content-MD5"); v != "" {
+		if err := cr.expect("MD5", v); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range r.Header.Values("Digest") {
+		for _, digest := range strings.Split(v, ",") {
+			alg, value, ok := strings.Cut(strings.TrimSpace(digest), "=")
+			if !ok {
+				return nil, errInvalidChecksum
+			}
+			if err := cr.expect(alg, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(cr.sums) == 0 {
+		return nil, nil
+	}
+	return cr, nil
+}
+
+func (cr *checksumReader) expect(alg, value string) error {
+	var h hash.Hash
+	switch strings.ToUpper(alg) {
+	case "SHA-256":
+		h = sha256.New()
+	case "MD5":
+		h = md5.New()
+	default:
+		return nil
+	}
+	want, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(want) != h.Size() {
+		return errInvalidChecksum
+	}
+	cr.sums = append(cr.sums, expectedSum{hash: h, want: want})
+	return nil
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	for _, sum := range cr.sums {
+		sum.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		for _, sum := range cr.sums {
+			if !bytes.Equal(sum.hash.Sum(nil), sum.want) {
+				cr.mismatch = true
+				return n, errChecksumMismatch
+			}
+		}
+	}
+	return n, err
+}
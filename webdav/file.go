@@ -7,6 +7,7 @@ package webdav
 import (
 	"context"
 	"encoding/xml"
+	"errors"
 	"io"
 	"net/http"
 	"os"
@@ -46,6 +47,32 @@ type FileSystem interface {
 	Stat(ctx context.Context, name string) (os.FileInfo, error)
 }
 
+// A Copier is a FileSystem that can copy files and directories on its own,
+// for example without moving their content through the server. copyFiles
+// uses it when the FileSystem implements it.
+//
+// Copy copies src, including its dead properties, to dst, which does not
+// exist. If src is a directory and recursive is true, its descendants are
+// copied too; otherwise only an empty directory is created. A descendant
+// that fails to copy does not keep the others from being copied; Copy then
+// returns MemberErrors.
+type Copier interface {
+	Copy(ctx context.Context, src, dst string, recursive bool) error
+}
+
+// A DirLister is a FileSystem that can list the members of a directory with
+// their file info in one pass. walkFS uses it when the FileSystem implements
+// it, instead of opening the directory and calling Stat for every member.
+//
+// ReadDir calls fn with the file info of each member of the directory name,
+// as Stat would return it. fi is the file info of the directory, as returned
+// by Stat or an earlier ReadDir, which the FileSystem may use to find the
+// directory without looking up name again. ReadDir stops at the first error
+// that fn returns and returns it.
+type DirLister interface {
+	ReadDir(ctx context.Context, name string, fi os.FileInfo, fn func(os.FileInfo) error) error
+}
+
 // A File is returned by a FileSystem's OpenFile method and can be served by a
 // Handler.
 //
@@ -97,6 +124,57 @@ func (d Dir) OpenFile(ctx context.Context, name string, flag int, perm os.FileMo
 	return f, nil
 }
 
+// Create writes the content to a temporary file in the same directory and
+// renames it over name only once reader has been read to its end, so that
+// name keeps its old content if reading fails, such as when the body of a
+// PUT does not match its checksum.
+func (d Dir) Create(ctx context.Context, name string, flag int, perm os.FileMode, reader io.Reader) (os.FileInfo, error) {
+	if name = d.resolve(name); name == "" {
+		return nil, os.ErrNotExist
+	}
+	_, statErr := os.Lstat(name)
+	// Open the file without truncating it, so that the flags and permissions
+	// are checked before the content is read.
+	f, err := os.OpenFile(name, flag&^os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	fi, err = replaceFile(name, fi.Mode().Perm(), reader)
+	if err != nil && os.IsNotExist(statErr) {
+		os.Remove(name)
+	}
+	return fi, err
+}
+
+// replaceFile writes the content of reader to a temporary file next to name
+// and renames it to name.
+func replaceFile(name string, perm os.FileMode, reader io.Reader) (os.FileInfo, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(tmp, reader)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return os.Stat(name)
+}
+
 func (d Dir) RemoveAll(ctx context.Context, name string) error {
 	if name = d.resolve(name); name == "" {
 		return os.ErrNotExist
@@ -153,14 +231,30 @@ type memFS struct {
 	root memFSNode
 }
 
-func (fs *memFS) Open(ctx context.Context, name string, flag int, perm os.FileMode) (io.Reader, error) {
-	//TODO implement me
-	panic("implement me")
-}
-
+// Create reads the whole content before it opens, and possibly truncates,
+// the file, so that name keeps its old content if reading fails, such as when
+// the body of a PUT does not match its checksum.
 func (fs *memFS) Create(ctx context.Context, name string, flag int, perm os.FileMode, reader io.Reader) (os.FileInfo, error) {
-	//TODO implement me
-	panic("implement me")
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fi, nil
 }
 
 // TODO: clean up and rationalize the walk/find code.
@@ -616,10 +710,73 @@ func (f *memFile) Write(p []byte) (int, error) {
 	return lenp, nil
 }
 
-// moveFiles moves files and/or directories from src to dst.
+// removeFiles removes name and its members, except for the locked members
+// and the collections that contain them.
+//
+// See section 9.6.1 for when various HTTP status codes apply.
+func removeFiles(ctx context.Context, fs FileSystem, name string, locked []string) (status int, err error) {
+	name = path.Clean(name)
+	errs := removeTree(ctx, fs, name, lockedTree(name, locked), nil)
+	if len(errs) == 0 {
+		return http.StatusNoContent, nil
+	}
+	if len(errs) == 1 && errs[0].name == name {
+		return http.StatusMethodNotAllowed, errs[0].err
+	}
+	return StatusMulti, errs
+}
+
+// removeTree removes name unless it is in tree, which is built by lockedTree,
+// and otherwise removes the members of name. If fs fails to remove a
+// collection as a whole, its members are removed one by one, so that a
+// failing member does not keep the others.
+func removeTree(ctx context.Context, fs FileSystem, name string, tree map[string]bool, errs memberErrors) memberErrors {
+	locked, inTree := tree[name]
+	if locked {
+		return append(errs, memberError{name, StatusLocked, ErrLocked})
+	}
+	if !inTree {
+		err := fs.RemoveAll(ctx, name)
+		if err == nil || os.IsNotExist(err) {
+			return errs
+		}
+		if fi, statErr := fs.Stat(ctx, name); statErr != nil || !fi.IsDir() {
+			return append(errs, memberError{name, http.StatusForbidden, err})
+		}
+	}
+
+	children, err := readDir(ctx, fs, name)
+	if err != nil {
+		return append(errs, memberError{name, http.StatusForbidden, err})
+	}
+	n := len(errs)
+	for _, c := range children {
+		errs = removeTree(ctx, fs, path.Join(name, c.Name()), tree, errs)
+	}
+	if inTree || len(errs) > n {
+		return errs
+	}
+	if err := fs.RemoveAll(ctx, name); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, memberError{name, http.StatusForbidden, err})
+	}
+	return errs
+}
+
+func readDir(ctx context.Context, fs FileSystem, name string) ([]os.FileInfo, error) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
+
+// moveFiles moves files and/or directories from src to dst. The locked
+// members of src, and the collections that contain them, stay in place; see
+// moveTree.
 //
 // See section 9.9.4 for when various HTTP status codes apply.
-func moveFiles(ctx context.Context, fs FileSystem, src, dst string, overwrite bool) (status int, err error) {
+func moveFiles(ctx context.Context, fs FileSystem, src, dst string, overwrite bool, locked []string) (status int, err error) {
 	created := false
 	if _, err := fs.Stat(ctx, dst); err != nil {
 		if !os.IsNotExist(err) {
@@ -637,7 +794,12 @@ func moveFiles(ctx context.Context, fs FileSystem, src, dst string, overwrite bo
 	} else {
 		return http.StatusPreconditionFailed, os.ErrExist
 	}
-	if err := fs.Rename(ctx, src, dst); err != nil {
+	if len(locked) > 0 {
+		src = path.Clean(src)
+		if errs := moveTree(ctx, fs, src, dst, lockedTree(src, locked), nil); len(errs) > 0 {
+			return StatusMulti, errs
+		}
+	} else if err := fs.Rename(ctx, src, dst); err != nil {
 		return http.StatusForbidden, err
 	}
 	if created {
@@ -646,6 +808,34 @@ func moveFiles(ctx context.Context, fs FileSystem, src, dst string, overwrite bo
 	return http.StatusNoContent, nil
 }
 
+// moveTree moves src to dst unless src is in tree, which is built by
+// lockedTree. Otherwise src stays in place, and its members that are not
+// locked are moved into a copy of it at dst.
+func moveTree(ctx context.Context, fs FileSystem, src, dst string, tree map[string]bool, errs memberErrors) memberErrors {
+	locked, inTree := tree[src]
+	if locked {
+		return append(errs, memberError{src, StatusLocked, ErrLocked})
+	}
+	if !inTree {
+		if err := fs.Rename(ctx, src, dst); err != nil {
+			return append(errs, memberError{dst, http.StatusForbidden, err})
+		}
+		return errs
+	}
+
+	if status, err := copyFiles(ctx, fs, src, dst, false, 0, 0); err != nil {
+		return append(errs, memberError{dst, status, err})
+	}
+	children, err := readDir(ctx, fs, src)
+	if err != nil {
+		return append(errs, memberError{src, http.StatusForbidden, err})
+	}
+	for _, c := range children {
+		errs = moveTree(ctx, fs, path.Join(src, c.Name()), path.Join(dst, c.Name()), tree, errs)
+	}
+	return errs
+}
+
 func copyProps(dst, src File) error {
 	d, ok := dst.(DeadPropsHolder)
 	if !ok {
@@ -712,7 +902,19 @@ func copyFiles(ctx context.Context, fs FileSystem, src, dst string, overwrite bo
 		}
 	}
 
-	if srcStat.IsDir() {
+	if c, ok := fs.(Copier); ok {
+		if err := c.Copy(ctx, src, dst, depth == infiniteDepth); err != nil {
+			var cErrs MemberErrors
+			if !errors.As(err, &cErrs) {
+				return copyStatus(err), err
+			}
+			errs := make(memberErrors, len(cErrs))
+			for i, e := range cErrs {
+				errs[i] = memberError{e.Name, copyStatus(e.Err), e.Err}
+			}
+			return StatusMulti, errs
+		}
+	} else if srcStat.IsDir() {
 		if err := fs.Mkdir(ctx, dst, srcPerm); err != nil {
 			return http.StatusForbidden, err
 		}
@@ -721,26 +923,40 @@ func copyFiles(ctx context.Context, fs FileSystem, src, dst string, overwrite bo
 			if err != nil {
 				return http.StatusForbidden, err
 			}
+			// A failing member does not keep the others from being copied.
+			var errs memberErrors
 			for _, c := range children {
 				name := c.Name()
 				s := path.Join(src, name)
 				d := path.Join(dst, name)
 				cStatus, cErr := copyFiles(ctx, fs, s, d, overwrite, depth, recursion)
-				if cErr != nil {
-					// TODO: MultiStatus.
-					return cStatus, cErr
+				if cErrs, ok := cErr.(memberErrors); ok {
+					errs = append(errs, cErrs...)
+				} else if cErr != nil {
+					errs = append(errs, memberError{d, cStatus, cErr})
 				}
 			}
+			if len(errs) > 0 {
+				return StatusMulti, errs
+			}
 		}
 
 	} else {
 		_, err := fs.Create(ctx, dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, srcPerm, srcFile)
 		if err != nil {
-			if os.IsNotExist(err) {
-				return http.StatusConflict, err
-			}
+			return copyStatus(err), err
+		}
+		dstFile, err := fs.OpenFile(ctx, dst, os.O_RDWR, 0)
+		if err != nil {
 			return http.StatusForbidden, err
-
+		}
+		propsErr := copyProps(dstFile, srcFile)
+		closeErr := dstFile.Close()
+		if propsErr != nil {
+			return http.StatusInternalServerError, propsErr
+		}
+		if closeErr != nil {
+			return http.StatusInternalServerError, closeErr
 		}
 	}
 
@@ -750,6 +966,17 @@ func copyFiles(ctx context.Context, fs FileSystem, src, dst string, overwrite bo
 	return http.StatusNoContent, nil
 }
 
+// copyStatus returns the status of a copy that failed with err.
+func copyStatus(err error) int {
+	switch {
+	case os.IsNotExist(err):
+		return http.StatusConflict
+	case errors.Is(err, ErrQuotaExceeded):
+		return StatusInsufficientStorage
+	}
+	return http.StatusForbidden
+}
+
 // walkFS traverses filesystem fs starting at name up to depth levels.
 //
 // Allowed values for depth are 0, 1 or infiniteDepth. For each visited node,
@@ -771,6 +998,24 @@ func walkFS(ctx context.Context, fs FileSystem, depth int, name string, info os.
 		depth = 0
 	}
 
+	if dl, ok := fs.(DirLister); ok {
+		var walkErr error
+		err := dl.ReadDir(ctx, name, info, func(fileInfo os.FileInfo) error {
+			walkErr = walkFS(ctx, fs, depth, path.Join(name, fileInfo.Name()), fileInfo, walkFn)
+			if walkErr == filepath.SkipDir && fileInfo.IsDir() {
+				walkErr = nil
+			}
+			return walkErr
+		})
+		if walkErr != nil {
+			return walkErr
+		}
+		if err != nil {
+			return walkFn(name, info, err)
+		}
+		return nil
+	}
+
 	// Read directory names.
 	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
 	if err != nil {
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
@@ -473,7 +474,7 @@ func testFS(t *testing.T, fs FileSystem) {
 			case "mk-dir":
 				opErr = fs.Mkdir(ctx, parts[0], 0777)
 			case "move__":
-				_, opErr = moveFiles(ctx, fs, parts[1], parts[2], parts[0] == "o=T")
+				_, opErr = moveFiles(ctx, fs, parts[1], parts[2], parts[0] == "o=T", nil)
 			case "rm-all":
 				opErr = fs.RemoveAll(ctx, parts[0])
 			case "stat":
@@ -916,7 +917,7 @@ func TestCopyMoveProps(t *testing.T) {
 	if _, err := copyFiles(ctx, fs, "/src", "/tmp", true, infiniteDepth, 0); err != nil {
 		t.Fatalf("copyFiles /src /tmp: %v", err)
 	}
-	if _, err := moveFiles(ctx, fs, "/tmp", "/dst", true); err != nil {
+	if _, err := moveFiles(ctx, fs, "/tmp", "/dst", true, nil); err != nil {
 		t.Fatalf("moveFiles /tmp /dst: %v", err)
 	}
 	if err := patch("/src", Proppatch{Props: []Property{p0}, Remove: true}); err != nil {
@@ -957,6 +958,40 @@ func TestCopyMoveProps(t *testing.T) {
 	}
 }
 
+// copierFS is a FileSystem that records the calls to its Copy method.
+type copierFS struct {
+	FileSystem
+	copies []string
+}
+
+func (fs *copierFS) Copy(ctx context.Context, src, dst string, recursive bool) error {
+	fs.copies = append(fs.copies, fmt.Sprintf("%s %s %t", src, dst, recursive))
+	return fs.FileSystem.Mkdir(ctx, dst, 0777)
+}
+
+func TestCopyFilesCopier(t *testing.T) {
+	ctx := context.Background()
+	fs := &copierFS{FileSystem: NewMemFS()}
+	if err := fs.Mkdir(ctx, "/a", 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	status, err := copyFiles(ctx, fs, "/a", "/b", false, infiniteDepth, 0)
+	if err != nil || status != http.StatusCreated {
+		t.Fatalf("copyFiles /a /b: got %d, %v, want %d", status, err, http.StatusCreated)
+	}
+	status, err = copyFiles(ctx, fs, "/a", "/b", true, 0, 0)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("copyFiles /a /b: got %d, %v, want %d", status, err, http.StatusNoContent)
+	}
+	if _, err = copyFiles(ctx, fs, "/a", "/b", false, 0, 0); !os.IsExist(err) {
+		t.Fatalf("copyFiles without overwrite: got %v, want os.ErrExist", err)
+	}
+	want := []string{"/a /b true", "/a /b false"}
+	if !reflect.DeepEqual(fs.copies, want) {
+		t.Fatalf("Copy calls: got %v, want %v", fs.copies, want)
+	}
+}
+
 func TestWalkFS(t *testing.T) {
 	testCases := []struct {
 		desc    string
@@ -1117,33 +1152,74 @@ func TestWalkFS(t *testing.T) {
 		if err != nil {
 			t.Fatalf("%s: cannot create test filesystem: %v", tc.desc, err)
 		}
-		var got []string
-		traceFn := func(path string, info os.FileInfo, err error) error {
-			if tc.walkFn != nil {
-				err = tc.walkFn(path, info, err)
-				if err != nil {
-					return err
+		lister := &dirListerFS{FileSystem: fs}
+		for _, fs := range []FileSystem{fs, lister} {
+			var got []string
+			traceFn := func(path string, info os.FileInfo, err error) error {
+				if tc.walkFn != nil {
+					err = tc.walkFn(path, info, err)
+					if err != nil {
+						return err
+					}
 				}
+				got = append(got, path)
+				return nil
+			}
+			fi, err := fs.Stat(ctx, tc.startAt)
+			if err != nil {
+				t.Fatalf("%s: cannot stat: %v", tc.desc, err)
+			}
+			lister.opened = 0
+			err = walkFS(ctx, fs, tc.depth, tc.startAt, fi, traceFn)
+			if err != nil {
+				t.Errorf("%s:\ngot error %v, want nil", tc.desc, err)
+				continue
+			}
+			sort.Strings(got)
+			sort.Strings(tc.want)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("%s (%T):\ngot  %q\nwant %q", tc.desc, fs, got, tc.want)
+				continue
+			}
+			if lister.opened != 0 {
+				t.Errorf("%s: walkFS opened or stat'ed %d files of a DirLister", tc.desc, lister.opened)
 			}
-			got = append(got, path)
-			return nil
-		}
-		fi, err := fs.Stat(ctx, tc.startAt)
-		if err != nil {
-			t.Fatalf("%s: cannot stat: %v", tc.desc, err)
-		}
-		err = walkFS(ctx, fs, tc.depth, tc.startAt, fi, traceFn)
-		if err != nil {
-			t.Errorf("%s:\ngot error %v, want nil", tc.desc, err)
-			continue
 		}
-		sort.Strings(got)
-		sort.Strings(tc.want)
-		if !reflect.DeepEqual(got, tc.want) {
-			t.Errorf("%s:\ngot  %q\nwant %q", tc.desc, got, tc.want)
-			continue
+	}
+}
+
+// dirListerFS is a DirLister that counts the calls of OpenFile and Stat.
+type dirListerFS struct {
+	FileSystem
+	opened int
+}
+
+func (fs *dirListerFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	fs.opened++
+	return fs.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+func (fs *dirListerFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fs.opened++
+	return fs.FileSystem.Stat(ctx, name)
+}
+
+func (fs *dirListerFS) ReadDir(ctx context.Context, name string, fi os.FileInfo, fn func(os.FileInfo) error) error {
+	f, err := fs.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fileInfos, err := f.Readdir(0)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fileInfos {
+		if err := fn(fi); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 func buildTestFS(buildfs []string) (FileSystem, error) {
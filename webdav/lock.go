@@ -38,8 +38,9 @@ type Condition struct {
 type LockSystem interface {
 	// Confirm confirms that the caller can claim all of the locks specified by
 	// the given conditions, and that holding the union of all of those locks
-	// gives exclusive access to all of the named resources. Up to two resources
-	// can be named. Empty names are ignored.
+	// gives exclusive access to all of the named resources, shared only with
+	// the holders of other shared locks on them. Up to two resources can be
+	// named. Empty names are ignored.
 	//
 	// Exactly one of release and err will be non-nil. If release is non-nil,
 	// all of the requested locks are held until release is called. Calling
@@ -53,8 +54,9 @@ type LockSystem interface {
 	// error, the Handler will write a "500 Internal Server Error" HTTP status.
 	Confirm(now time.Time, name0, name1 string, conditions ...Condition) (release func(), err error)
 
-	// Create creates a lock with the given depth, duration, owner and root
-	// (name). The depth will either be negative (meaning infinite) or zero.
+	// Create creates a lock with the given depth, duration, owner, scope and
+	// root (name). The depth will either be negative (meaning infinite) or
+	// zero. A shared lock conflicts only with exclusive locks.
 	//
 	// If Create returns ErrLocked then the Handler will write a "423 Locked"
 	// HTTP status. If it returns any other non-nil error, the Handler will
@@ -93,6 +95,25 @@ type LockSystem interface {
 	Unlock(now time.Time, token string) error
 }
 
+// LockLister is an optional interface for a LockSystem.
+//
+// If this interface is defined then the DAV:lockdiscovery property lists the
+// active locks on a resource, which clients show to tell who holds them.
+type LockLister interface {
+	// Locks returns the active locks on the named resource: its own lock
+	// and the infinite depth locks on its ancestors. The Duration of each
+	// lock is the time left before it expires, or negative if it never
+	// does.
+	Locks(now time.Time, name string) ([]ActiveLock, error)
+}
+
+// ActiveLock is a lock listed by a LockLister.
+type ActiveLock struct {
+	// Token identifies the lock.
+	Token string
+	LockDetails
+}
+
 // LockDetails are a lock's metadata.
 type LockDetails struct {
 	// Root is the root resource name being locked. For a zero-depth lock, the
@@ -109,13 +130,16 @@ type LockDetails struct {
 	// ZeroDepth is whether the lock has zero depth. If it does not have zero
 	// depth, it has infinite depth.
 	ZeroDepth bool
+	// Shared is whether the lock is a shared lock, which other shared locks
+	// may cover too. If it is not shared, it is exclusive.
+	Shared bool
 }
 
 // NewMemLS returns a new in-memory LockSystem.
 func NewMemLS() LockSystem {
 	return &memLS{
 		byName:  make(map[string]*memLSNode),
-		byToken: make(map[string]*memLSNode),
+		byToken: make(map[string]*memLSLock),
 		gen:     uint64(time.Now().Unix()),
 	}
 }
@@ -123,9 +147,9 @@ func NewMemLS() LockSystem {
 type memLS struct {
 	mu      sync.Mutex
 	byName  map[string]*memLSNode
-	byToken map[string]*memLSNode
+	byToken map[string]*memLSLock
 	gen     uint64
-	// byExpiry only contains those nodes whose LockDetails have a finite
+	// byExpiry only contains those locks whose LockDetails have a finite
 	// Duration and are yet to expire.
 	byExpiry byExpiry
 }
@@ -149,83 +173,84 @@ func (m *memLS) Confirm(now time.Time, name0, name1 string, conditions ...Condit
 	defer m.mu.Unlock()
 	m.collectExpiredNodes(now)
 
-	var n0, n1 *memLSNode
+	var l0, l1 *memLSLock
 	if name0 != "" {
-		if n0 = m.lookup(slashClean(name0), conditions...); n0 == nil {
+		if l0 = m.lookup(slashClean(name0), conditions...); l0 == nil {
 			return nil, ErrConfirmationFailed
 		}
 	}
 	if name1 != "" {
-		if n1 = m.lookup(slashClean(name1), conditions...); n1 == nil {
+		if l1 = m.lookup(slashClean(name1), conditions...); l1 == nil {
 			return nil, ErrConfirmationFailed
 		}
 	}
 
-	// Don't hold the same node twice.
-	if n1 == n0 {
-		n1 = nil
+	// Don't hold the same lock twice.
+	if l1 == l0 {
+		l1 = nil
 	}
 
-	if n0 != nil {
-		m.hold(n0)
+	if l0 != nil {
+		m.hold(l0)
 	}
-	if n1 != nil {
-		m.hold(n1)
+	if l1 != nil {
+		m.hold(l1)
 	}
 	return func() {
 		m.mu.Lock()
 		defer m.mu.Unlock()
-		if n1 != nil {
-			m.unhold(n1)
+		if l1 != nil {
+			m.unhold(l1)
 		}
-		if n0 != nil {
-			m.unhold(n0)
+		if l0 != nil {
+			m.unhold(l0)
 		}
 	}, nil
 }
 
-// lookup returns the node n that locks the named resource, provided that n
+// lookup returns the lock l that locks the named resource, provided that l
 // matches at least one of the given conditions and that lock isn't held by
 // another party. Otherwise, it returns nil.
 //
-// n may be a parent of the named resource, if n is an infinite depth lock.
-func (m *memLS) lookup(name string, conditions ...Condition) (n *memLSNode) {
-	// TODO: support Condition.Not and Condition.ETag.
+// l may be rooted at a parent of the named resource, if l is an infinite
+// depth lock.
+func (m *memLS) lookup(name string, conditions ...Condition) (l *memLSLock) {
+	// TODO: support Condition.Not. The Handler checks Condition.ETag.
 	for _, c := range conditions {
-		n = m.byToken[c.Token]
-		if n == nil || n.held {
+		l = m.byToken[c.Token]
+		if l == nil || l.held {
 			continue
 		}
-		if name == n.details.Root {
-			return n
+		if name == l.details.Root {
+			return l
 		}
-		if n.details.ZeroDepth {
+		if l.details.ZeroDepth {
 			continue
 		}
-		if n.details.Root == "/" || strings.HasPrefix(name, n.details.Root+"/") {
-			return n
+		if l.details.Root == "/" || strings.HasPrefix(name, l.details.Root+"/") {
+			return l
 		}
 	}
 	return nil
 }
 
-func (m *memLS) hold(n *memLSNode) {
-	if n.held {
+func (m *memLS) hold(l *memLSLock) {
+	if l.held {
 		panic("webdav: memLS inconsistent held state")
 	}
-	n.held = true
-	if n.details.Duration >= 0 && n.byExpiryIndex >= 0 {
-		heap.Remove(&m.byExpiry, n.byExpiryIndex)
+	l.held = true
+	if l.details.Duration >= 0 && l.byExpiryIndex >= 0 {
+		heap.Remove(&m.byExpiry, l.byExpiryIndex)
 	}
 }
 
-func (m *memLS) unhold(n *memLSNode) {
-	if !n.held {
+func (m *memLS) unhold(l *memLSLock) {
+	if !l.held {
 		panic("webdav: memLS inconsistent held state")
 	}
-	n.held = false
-	if n.details.Duration >= 0 {
-		heap.Push(&m.byExpiry, n)
+	l.held = false
+	if l.details.Duration >= 0 {
+		heap.Push(&m.byExpiry, l)
 	}
 }
 
@@ -235,18 +260,22 @@ func (m *memLS) Create(now time.Time, details LockDetails) (string, error) {
 	m.collectExpiredNodes(now)
 	details.Root = slashClean(details.Root)
 
-	if !m.canCreate(details.Root, details.ZeroDepth) {
+	if !m.canCreate(details.Root, details.ZeroDepth, details.Shared) {
 		return "", ErrLocked
 	}
-	n := m.create(details.Root)
-	n.token = m.nextToken()
-	m.byToken[n.token] = n
-	n.details = details
-	if n.details.Duration >= 0 {
-		n.expiry = now.Add(n.details.Duration)
-		heap.Push(&m.byExpiry, n)
+	n := m.create(details.Root, details.Shared)
+	l := &memLSLock{
+		details:       details,
+		token:         m.nextToken(),
+		byExpiryIndex: -1,
+	}
+	n.locks = append(n.locks, l)
+	m.byToken[l.token] = l
+	if l.details.Duration >= 0 {
+		l.expiry = now.Add(l.details.Duration)
+		heap.Push(&m.byExpiry, l)
 	}
-	return n.token, nil
+	return l.token, nil
 }
 
 func (m *memLS) Refresh(now time.Time, token string, duration time.Duration) (LockDetails, error) {
@@ -254,22 +283,22 @@ func (m *memLS) Refresh(now time.Time, token string, duration time.Duration) (Lo
 	defer m.mu.Unlock()
 	m.collectExpiredNodes(now)
 
-	n := m.byToken[token]
-	if n == nil {
+	l := m.byToken[token]
+	if l == nil {
 		return LockDetails{}, ErrNoSuchLock
 	}
-	if n.held {
+	if l.held {
 		return LockDetails{}, ErrLocked
 	}
-	if n.byExpiryIndex >= 0 {
-		heap.Remove(&m.byExpiry, n.byExpiryIndex)
+	if l.byExpiryIndex >= 0 {
+		heap.Remove(&m.byExpiry, l.byExpiryIndex)
 	}
-	n.details.Duration = duration
-	if n.details.Duration >= 0 {
-		n.expiry = now.Add(n.details.Duration)
-		heap.Push(&m.byExpiry, n)
+	l.details.Duration = duration
+	if l.details.Duration >= 0 {
+		l.expiry = now.Add(l.details.Duration)
+		heap.Push(&m.byExpiry, l)
 	}
-	return n.details, nil
+	return l.details, nil
 }
 
 func (m *memLS) Unlock(now time.Time, token string) error {
@@ -277,54 +306,92 @@ func (m *memLS) Unlock(now time.Time, token string) error {
 	defer m.mu.Unlock()
 	m.collectExpiredNodes(now)
 
-	n := m.byToken[token]
-	if n == nil {
+	l := m.byToken[token]
+	if l == nil {
 		return ErrNoSuchLock
 	}
-	if n.held {
+	if l.held {
 		return ErrLocked
 	}
-	m.remove(n)
+	m.remove(l)
 	return nil
 }
 
-func (m *memLS) canCreate(name string, zeroDepth bool) bool {
+func (m *memLS) Locks(now time.Time, name string) ([]ActiveLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectExpiredNodes(now)
+
+	var locks []ActiveLock
+	walkToRoot(slashClean(name), func(name0 string, first bool) bool {
+		n := m.byName[name0]
+		if n == nil {
+			return true
+		}
+		for _, l := range n.locks {
+			if !first && l.details.ZeroDepth {
+				continue
+			}
+			al := ActiveLock{Token: l.token, LockDetails: l.details}
+			if al.Duration >= 0 {
+				al.Duration = l.expiry.Sub(now)
+			}
+			locks = append(locks, al)
+		}
+		return true
+	})
+	return locks, nil
+}
+
+// canCreate reports whether a lock with the given depth and scope can be
+// created on name. Shared locks only conflict with exclusive locks, and
+// exclusive locks conflict with any lock.
+func (m *memLS) canCreate(name string, zeroDepth, shared bool) bool {
 	return walkToRoot(name, func(name0 string, first bool) bool {
 		n := m.byName[name0]
 		if n == nil {
 			return true
 		}
 		if first {
-			if n.token != "" {
+			// The locks on a node are all shared, or a single exclusive lock.
+			if len(n.locks) > 0 && !(shared && n.locks[0].details.Shared) {
 				// The target node is already locked.
 				return false
 			}
 			if !zeroDepth {
-				// The requested lock depth is infinite, and the fact that n exists
-				// (n != nil) means that a descendent of the target node is locked.
+				// The requested lock depth is infinite, and the fact that n
+				// exists (n != nil) means that a descendent of the target node
+				// may be locked.
+				if !shared && n.refCount > len(n.locks) {
+					return false
+				}
+				if shared && n.exclusiveCount > 0 {
+					return false
+				}
+			}
+			return true
+		}
+		for _, l := range n.locks {
+			if !l.details.ZeroDepth && !(shared && l.details.Shared) {
+				// An ancestor of the target node is locked with infinite depth.
 				return false
 			}
-		} else if n.token != "" && !n.details.ZeroDepth {
-			// An ancestor of the target node is locked with infinite depth.
-			return false
 		}
 		return true
 	})
 }
 
-func (m *memLS) create(name string) (ret *memLSNode) {
+func (m *memLS) create(name string, shared bool) (ret *memLSNode) {
 	walkToRoot(name, func(name0 string, first bool) bool {
 		n := m.byName[name0]
 		if n == nil {
-			n = &memLSNode{
-				details: LockDetails{
-					Root: name0,
-				},
-				byExpiryIndex: -1,
-			}
+			n = &memLSNode{name: name0}
 			m.byName[name0] = n
 		}
 		n.refCount++
+		if !shared {
+			n.exclusiveCount++
+		}
 		if first {
 			ret = n
 		}
@@ -333,19 +400,28 @@ func (m *memLS) create(name string) (ret *memLSNode) {
 	return ret
 }
 
-func (m *memLS) remove(n *memLSNode) {
-	delete(m.byToken, n.token)
-	n.token = ""
-	walkToRoot(n.details.Root, func(name0 string, first bool) bool {
+func (m *memLS) remove(l *memLSLock) {
+	delete(m.byToken, l.token)
+	n := m.byName[l.details.Root]
+	for i, l0 := range n.locks {
+		if l0 == l {
+			n.locks = append(n.locks[:i], n.locks[i+1:]...)
+			break
+		}
+	}
+	walkToRoot(l.details.Root, func(name0 string, first bool) bool {
 		x := m.byName[name0]
 		x.refCount--
+		if !l.details.Shared {
+			x.exclusiveCount--
+		}
 		if x.refCount == 0 {
 			delete(m.byName, name0)
 		}
 		return true
 	})
-	if n.byExpiryIndex >= 0 {
-		heap.Remove(&m.byExpiry, n.byExpiryIndex)
+	if l.byExpiryIndex >= 0 {
+		heap.Remove(&m.byExpiry, l.byExpiryIndex)
 	}
 }
 
@@ -365,25 +441,34 @@ func walkToRoot(name string, f func(name0 string, first bool) bool) bool {
 	return true
 }
 
+// memLSNode is a resource name that is locked or has locked descendents.
 type memLSNode struct {
-	// details are the lock metadata. Even if this node's name is not explicitly locked,
-	// details.Root will still equal the node's name.
+	// name is the resource name.
+	name string
+	// locks are the locks whose root is this node's name: either a single
+	// exclusive lock, or any number of shared locks.
+	locks []*memLSLock
+	// refCount is the number of locks on this node or its descendents.
+	refCount int
+	// exclusiveCount is the number of those locks that are exclusive.
+	exclusiveCount int
+}
+
+type memLSLock struct {
+	// details are the lock metadata.
 	details LockDetails
-	// token is the unique identifier for this node's lock. An empty token means that
-	// this node is not explicitly locked.
+	// token is the unique identifier for this lock.
 	token string
-	// refCount is the number of self-or-descendent nodes that are explicitly locked.
-	refCount int
-	// expiry is when this node's lock expires.
+	// expiry is when this lock expires.
 	expiry time.Time
-	// byExpiryIndex is the index of this node in memLS.byExpiry. It is -1
-	// if this node does not expire, or has expired.
+	// byExpiryIndex is the index of this lock in memLS.byExpiry. It is -1
+	// if this lock does not expire, or has expired.
 	byExpiryIndex int
-	// held is whether this node's lock is actively held by a Confirm call.
+	// held is whether this lock is actively held by a Confirm call.
 	held bool
 }
 
-type byExpiry []*memLSNode
+type byExpiry []*memLSLock
 
 func (b *byExpiry) Len() int {
 	return len(*b)
@@ -400,18 +485,18 @@ func (b *byExpiry) Swap(i, j int) {
 }
 
 func (b *byExpiry) Push(x interface{}) {
-	n := x.(*memLSNode)
-	n.byExpiryIndex = len(*b)
-	*b = append(*b, n)
+	l := x.(*memLSLock)
+	l.byExpiryIndex = len(*b)
+	*b = append(*b, l)
 }
 
 func (b *byExpiry) Pop() interface{} {
 	i := len(*b) - 1
-	n := (*b)[i]
+	l := (*b)[i]
 	(*b)[i] = nil
-	n.byExpiryIndex = -1
+	l.byExpiryIndex = -1
 	*b = (*b)[:i]
-	return n
+	return l
 }
 
 const infiniteTimeout = -1
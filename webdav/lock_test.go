@@ -136,7 +136,7 @@ func TestMemLSCanCreate(t *testing.T) {
 	var check func(int, string)
 	check = func(recursion int, name string) {
 		for _, zeroDepth := range []bool{false, true} {
-			got := m.canCreate(name, zeroDepth)
+			got := m.canCreate(name, zeroDepth, false)
 			want := wantCanCreate(name, zeroDepth)
 			if got != want {
 				t.Errorf("canCreate name=%q zeroDepth=%t: got %t, want %t", name, zeroDepth, got, want)
@@ -171,7 +171,7 @@ func TestMemLSLookup(t *testing.T) {
 		if err != nil {
 			t.Fatalf("creating lock for %q: %v", name, err)
 		}
-		t.Logf("%-15q -> node=%p token=%q", name, m.byName[name], token)
+		t.Logf("%-15q -> lock=%p token=%q", name, m.byToken[token], token)
 	}
 
 	baseNames := append([]string{"/a", "/b/c"}, lockTestNames...)
@@ -180,9 +180,12 @@ func TestMemLSLookup(t *testing.T) {
 			name := baseName + suffix
 
 			goodToken := ""
-			base := m.byName[baseName]
-			if base != nil && (suffix == "" || !lockTestZeroDepth(baseName)) {
-				goodToken = base.token
+			var base *memLSLock
+			if n := m.byName[baseName]; n != nil && len(n.locks) > 0 {
+				base = n.locks[0]
+				if suffix == "" || !lockTestZeroDepth(baseName) {
+					goodToken = base.token
+				}
 			}
 
 			for _, token := range []string{badToken, goodToken} {
@@ -449,6 +452,145 @@ func TestMemLSExpiry(t *testing.T) {
 	}
 }
 
+func TestMemLSShared(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := NewMemLS().(*memLS)
+	create := func(root string, zeroDepth, shared bool) (string, error) {
+		t.Helper()
+		token, err := m.Create(now, LockDetails{
+			Root:      root,
+			Duration:  infiniteTimeout,
+			ZeroDepth: zeroDepth,
+			Shared:    shared,
+		})
+		if err := m.consistent(); err != nil {
+			t.Fatalf("Create %s: inconsistent state: %v", root, err)
+		}
+		return token, err
+	}
+
+	alice, err := create("/a", false, true)
+	if err != nil {
+		t.Fatalf("Create shared /a: %v", err)
+	}
+	bob, err := create("/a", true, true)
+	if err != nil {
+		t.Fatalf("Create second shared /a: %v", err)
+	}
+	testCases := []struct {
+		root      string
+		zeroDepth bool
+		shared    bool
+		want      error
+	}{
+		{"/a", true, false, ErrLocked},
+		{"/", false, false, ErrLocked},
+		{"/a/b", true, false, ErrLocked},
+		{"/a/b", true, true, nil},
+		{"/c", false, false, nil},
+		{"/c/d", true, true, ErrLocked},
+		{"/", false, true, ErrLocked},
+		{"/a/b/e", false, true, nil},
+	}
+	for _, tc := range testCases {
+		if _, err := create(tc.root, tc.zeroDepth, tc.shared); err != tc.want {
+			t.Errorf("Create %s zeroDepth=%t shared=%t: got %v, want %v", tc.root, tc.zeroDepth, tc.shared, err, tc.want)
+		}
+	}
+
+	// Every holder of a shared lock can confirm it.
+	for _, token := range []string{alice, bob} {
+		release, err := m.Confirm(now, "/a", "", Condition{Token: token})
+		if err != nil {
+			t.Fatalf("Confirm %s: %v", token, err)
+		}
+		release()
+	}
+	if _, err := m.Confirm(now, "/a/b", "", Condition{Token: bob}); err != ErrConfirmationFailed {
+		t.Fatalf("Confirm of a zero-depth shared lock below its root: got %v, want %v", err, ErrConfirmationFailed)
+	}
+
+	if locks, _ := m.Locks(now, "/a"); len(locks) != 2 {
+		t.Fatalf("Locks /a: got %d locks, want 2", len(locks))
+	}
+	if err := m.Unlock(now, alice); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := m.consistent(); err != nil {
+		t.Fatalf("Unlock: inconsistent state: %v", err)
+	}
+	if _, err := create("/a", true, false); err != ErrLocked {
+		t.Fatalf("Create exclusive /a with a shared lock left: got %v, want %v", err, ErrLocked)
+	}
+}
+
+func TestMemLSLocks(t *testing.T) {
+	now := time.Unix(0, 0)
+	m := NewMemLS().(*memLS)
+	create := func(root string, zeroDepth bool, duration time.Duration) string {
+		t.Helper()
+		token, err := m.Create(now, LockDetails{
+			Root:      root,
+			Duration:  duration,
+			OwnerXML:  "<D:href>" + root + "</D:href>",
+			ZeroDepth: zeroDepth,
+		})
+		if err != nil {
+			t.Fatalf("Create %s: %v", root, err)
+		}
+		return token
+	}
+	tokens := map[string]string{
+		"/a":   create("/a", false, 10*time.Second),
+		"/b":   create("/b", true, infiniteTimeout),
+		"/c":   create("/c", true, infiniteTimeout),
+		"/c/d": create("/c/d", true, 20*time.Second),
+	}
+	now = now.Add(4 * time.Second)
+
+	testCases := []struct {
+		name string
+		want []string
+	}{
+		{"/", nil},
+		{"/a", []string{"/a"}},
+		{"/a/b/c", []string{"/a"}},
+		{"/b", []string{"/b"}},
+		{"/b/c", nil},
+		{"/c", []string{"/c"}},
+		{"/c/d", []string{"/c/d"}},
+	}
+	for _, tc := range testCases {
+		locks, err := m.Locks(now, tc.name)
+		if err != nil {
+			t.Fatalf("Locks %s: %v", tc.name, err)
+		}
+		var got []string
+		for _, l := range locks {
+			got = append(got, l.Root)
+			if l.Token != tokens[l.Root] {
+				t.Errorf("Locks %s: lock on %s: got token %q, want %q", tc.name, l.Root, l.Token, tokens[l.Root])
+			}
+			if want := "<D:href>" + l.Root + "</D:href>"; l.OwnerXML != want {
+				t.Errorf("Locks %s: lock on %s: got owner %q, want %q", tc.name, l.Root, l.OwnerXML, want)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Locks %s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	for name, want := range map[string]time.Duration{"/a": 6 * time.Second, "/b": infiniteTimeout, "/c/d": 16 * time.Second} {
+		if locks, _ := m.Locks(now, name); len(locks) != 1 || locks[0].Duration != want {
+			t.Errorf("Locks %s: got %v, want one lock with %v left", name, locks, want)
+		}
+	}
+	now = now.Add(6 * time.Second)
+	if locks, _ := m.Locks(now, "/a/b/c"); len(locks) != 0 {
+		t.Errorf("Locks after /a expired: got %v, want none", locks)
+	}
+}
+
 func TestMemLS(t *testing.T) {
 	now := time.Unix(0, 0)
 	m := NewMemLS().(*memLS)
@@ -540,7 +682,7 @@ func (m *memLS) consistent() error {
 	defer m.mu.Unlock()
 
 	// If m.byName is non-empty, then it must contain an entry for the root "/",
-	// and its refCount should equal the number of locked nodes.
+	// and its refCount should equal the number of locks.
 	if len(m.byName) > 0 {
 		n := m.byName["/"]
 		if n == nil {
@@ -553,8 +695,8 @@ func (m *memLS) consistent() error {
 
 	for name, n := range m.byName {
 		// The map keys should be consistent with the node's copy of the key.
-		if n.details.Root != name {
-			return fmt.Errorf("node name %q != byName map key %q", n.details.Root, name)
+		if n.name != name {
+			return fmt.Errorf("node name %q != byName map key %q", n.name, name)
 		}
 
 		// A name must be clean, and start with a "/".
@@ -570,68 +712,81 @@ func (m *memLS) consistent() error {
 			return fmt.Errorf("non-positive refCount for node at name %q", name)
 		}
 
-		// A node's refCount should be the number of self-or-descendents that
-		// are locked (i.e. have a non-empty token).
+		// A node's refCount should be the number of locks on self-or-descendents,
+		// and its exclusiveCount the number of those that are exclusive.
 		var list []string
-		for name0, n0 := range m.byName {
+		exclusive := 0
+		for _, l := range m.byToken {
 			// All of lockTestNames' name fragments are one byte long: '_', 'i' or 'z',
 			// so strings.HasPrefix is equivalent to self-or-descendent name match.
 			// We don't have to worry about "/foo/bar" being a false positive match
 			// for "/foo/b".
-			if strings.HasPrefix(name0, name) && n0.token != "" {
-				list = append(list, name0)
+			if strings.HasPrefix(l.details.Root, name) {
+				list = append(list, l.details.Root)
+				if !l.details.Shared {
+					exclusive++
+				}
 			}
 		}
 		if n.refCount != len(list) {
 			sort.Strings(list)
-			return fmt.Errorf("node at name %q has refCount %d but locked self-or-descendents are %q (len=%d)",
+			return fmt.Errorf("node at name %q has refCount %d but locks on self-or-descendents are %q (len=%d)",
 				name, n.refCount, list, len(list))
 		}
-
-		// A node n is in m.byToken if it has a non-empty token.
-		if n.token != "" {
-			if _, ok := m.byToken[n.token]; !ok {
-				return fmt.Errorf("node at name %q has token %q but not in m.byToken", name, n.token)
-			}
+		if n.exclusiveCount != exclusive {
+			return fmt.Errorf("node at name %q has exclusiveCount %d, want %d", name, n.exclusiveCount, exclusive)
 		}
 
-		// A node n is in m.byExpiry if it has a non-negative byExpiryIndex.
-		if n.byExpiryIndex >= 0 {
-			if n.byExpiryIndex >= len(m.byExpiry) {
-				return fmt.Errorf("node at name %q has byExpiryIndex %d but m.byExpiry has length %d", name, n.byExpiryIndex, len(m.byExpiry))
+		// A node is locked either by a single exclusive lock, or by shared locks.
+		for _, l := range n.locks {
+			if !l.details.Shared && len(n.locks) > 1 {
+				return fmt.Errorf("node at name %q has an exclusive lock and %d others", name, len(n.locks)-1)
 			}
-			if n != m.byExpiry[n.byExpiryIndex] {
-				return fmt.Errorf("node at name %q has byExpiryIndex %d but that indexes a different node", name, n.byExpiryIndex)
+			if l.details.Root != name {
+				return fmt.Errorf("lock on %q is on the node at name %q", l.details.Root, name)
+			}
+			if m.byToken[l.token] != l {
+				return fmt.Errorf("node at name %q has a lock with token %q but not in m.byToken", name, l.token)
 			}
 		}
 	}
 
-	for token, n := range m.byToken {
-		// The map keys should be consistent with the node's copy of the key.
-		if n.token != token {
-			return fmt.Errorf("node token %q != byToken map key %q", n.token, token)
+	for token, l := range m.byToken {
+		// The map keys should be consistent with the lock's copy of the key.
+		if l.token != token {
+			return fmt.Errorf("lock token %q != byToken map key %q", l.token, token)
 		}
 
-		// Every node in m.byToken is in m.byName.
-		if _, ok := m.byName[n.details.Root]; !ok {
-			return fmt.Errorf("node at name %q in m.byToken but not in m.byName", n.details.Root)
+		// Every lock in m.byToken is on a node in m.byName.
+		if _, ok := m.byName[l.details.Root]; !ok {
+			return fmt.Errorf("lock on %q in m.byToken but not in m.byName", l.details.Root)
+		}
+
+		// A lock is in m.byExpiry if it has a non-negative byExpiryIndex.
+		if l.byExpiryIndex >= 0 {
+			if l.byExpiryIndex >= len(m.byExpiry) {
+				return fmt.Errorf("lock on %q has byExpiryIndex %d but m.byExpiry has length %d", l.details.Root, l.byExpiryIndex, len(m.byExpiry))
+			}
+			if l != m.byExpiry[l.byExpiryIndex] {
+				return fmt.Errorf("lock on %q has byExpiryIndex %d but that indexes a different lock", l.details.Root, l.byExpiryIndex)
+			}
 		}
 	}
 
-	for i, n := range m.byExpiry {
-		// The slice indices should be consistent with the node's copy of the index.
-		if n.byExpiryIndex != i {
-			return fmt.Errorf("node byExpiryIndex %d != byExpiry slice index %d", n.byExpiryIndex, i)
+	for i, l := range m.byExpiry {
+		// The slice indices should be consistent with the lock's copy of the index.
+		if l.byExpiryIndex != i {
+			return fmt.Errorf("lock byExpiryIndex %d != byExpiry slice index %d", l.byExpiryIndex, i)
 		}
 
-		// Every node in m.byExpiry is in m.byName.
-		if _, ok := m.byName[n.details.Root]; !ok {
-			return fmt.Errorf("node at name %q in m.byExpiry but not in m.byName", n.details.Root)
+		// Every lock in m.byExpiry is in m.byToken.
+		if m.byToken[l.token] != l {
+			return fmt.Errorf("lock on %q in m.byExpiry but not in m.byToken", l.details.Root)
 		}
 
-		// No node in m.byExpiry should be held.
-		if n.held {
-			return fmt.Errorf("node at name %q in m.byExpiry is held", n.details.Root)
+		// No lock in m.byExpiry should be held.
+		if l.held {
+			return fmt.Errorf("lock on %q in m.byExpiry is held", l.details.Root)
 		}
 	}
 	return nil
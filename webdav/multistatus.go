@@ -0,0 +1,96 @@
+package webdav
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// memberError is the failure of a member of a collection that a DELETE, COPY
+// or MOVE request operates on.
+type memberError struct {
+	name   string
+	status int
+	err    error
+}
+
+// memberErrors is returned by removeFiles, copyFiles and moveFiles when they
+// carried out the rest of the request despite the failing members. Section
+// 9.6.1 says that such a partial success is reported with a 207 (Multi-Status)
+// response that lists the members that failed, but not their ancestors, which
+// the client can infer to still exist.
+type memberErrors []memberError
+
+func (e memberErrors) Error() string {
+	if len(e) == 1 {
+		return fmt.Sprintf("webdav: %s: %v", e[0].name, e[0].err)
+	}
+	return fmt.Sprintf("webdav: %s: %v (and %d more failed members)", e[0].name, e[0].err, len(e)-1)
+}
+
+// MemberError is the failure of Copier.Copy to copy the member Name of a
+// collection.
+type MemberError struct {
+	Name string
+	Err  error
+}
+
+// MemberErrors is returned by Copier.Copy when it copied the rest of a
+// collection despite the failing members. The Handler reports them in a 207
+// (Multi-Status) response, like the members that it fails to copy itself.
+type MemberErrors []MemberError
+
+func (e MemberErrors) Error() string {
+	if len(e) == 1 {
+		return fmt.Sprintf("webdav: %s: %v", e[0].Name, e[0].Err)
+	}
+	return fmt.Sprintf("webdav: %s: %v (and %d more failed members)", e[0].Name, e[0].Err, len(e)-1)
+}
+
+// lockedErrors returns the errors for the members in locked.
+func lockedErrors(locked []string) memberErrors {
+	errs := make(memberErrors, len(locked))
+	for i, name := range locked {
+		errs[i] = memberError{name, StatusLocked, ErrLocked}
+	}
+	return errs
+}
+
+// writeMemberErrors writes the 207 (Multi-Status) response for errs.
+func (h *Handler) writeMemberErrors(w http.ResponseWriter, errs memberErrors) (status int, err error) {
+	mw := multistatusWriter{w: w}
+	for _, e := range errs {
+		href := (&url.URL{Path: path.Join(h.Prefix, e.name)}).EscapedPath()
+		err := mw.write(&response{
+			Href:   []string{href},
+			Status: fmt.Sprintf("HTTP/1.1 %d %s", e.status, StatusText(e.status)),
+		})
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return 0, mw.close()
+}
+
+// lockedTree maps the locked members of the collection root and the
+// collections between them and root, including root itself, to whether they
+// are locked themselves. Only the members that are not in the map may be
+// removed.
+func lockedTree(root string, locked []string) map[string]bool {
+	root = path.Clean(root)
+	tree := make(map[string]bool)
+	for _, name := range locked {
+		tree[name] = true
+		for p := path.Dir(name); ; p = path.Dir(p) {
+			if _, ok := tree[p]; ok {
+				break
+			}
+			tree[p] = false
+			if p == root || p == "/" {
+				break
+			}
+		}
+	}
+	return tree
+}
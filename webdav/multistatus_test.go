@@ -0,0 +1,147 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// multistatusCodes returns the status line of every href in the 207 response
+// of rec.
+func multistatusCodes(t *testing.T, rec *httptest.ResponseRecorder) map[string]string {
+	t.Helper()
+	if rec.Code != StatusMulti {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, StatusMulti, rec.Body)
+	}
+	var ms struct {
+		Responses []struct {
+			Href   []string `xml:"href"`
+			Status string   `xml:"status"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &ms); err != nil {
+		t.Fatalf("Multi-Status body: %v", err)
+	}
+	codes := make(map[string]string)
+	for _, r := range ms.Responses {
+		for _, href := range r.Href {
+			codes[href] = r.Status
+		}
+	}
+	return codes
+}
+
+func TestMultiStatus(t *testing.T) {
+	ctx := context.Background()
+	fs := NewMemFS()
+	serve := newTestHandler(t, fs)
+	do := func(method, path string, headers ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		body := ""
+		if method == "LOCK" {
+			body = `<?xml version="1.0" encoding="utf-8" ?>
+				<D:lockinfo xmlns:D='DAV:'>
+					<D:lockscope><D:exclusive/></D:lockscope>
+					<D:locktype><D:write/></D:locktype>
+				</D:lockinfo>`
+		}
+		return serve(method, path, body, headers...)
+	}
+	tree := func(names ...string) {
+		t.Helper()
+		for _, name := range names {
+			if strings.HasSuffix(name, "/") {
+				if err := fs.Mkdir(ctx, name, 0777); err != nil {
+					t.Fatalf("Mkdir %q: %v", name, err)
+				}
+				continue
+			}
+			if _, err := fs.Create(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, strings.NewReader(name)); err != nil {
+				t.Fatalf("Create %q: %v", name, err)
+			}
+		}
+	}
+	lock := func(name string, headers ...string) string {
+		t.Helper()
+		token := do("LOCK", name, headers...).Header().Get("Lock-Token")
+		if token == "" {
+			t.Fatalf("LOCK %s: no lock token", name)
+		}
+		return token
+	}
+	exist := func(names ...string) []string {
+		var found []string
+		for _, name := range names {
+			if _, err := fs.Stat(ctx, name); err == nil {
+				found = append(found, name)
+			}
+		}
+		sort.Strings(found)
+		return found
+	}
+	want423 := func(desc string, codes map[string]string, hrefs ...string) {
+		t.Helper()
+		if len(codes) != len(hrefs) {
+			t.Errorf("%s: got %v, want 423 for %q", desc, codes, hrefs)
+		}
+		for _, href := range hrefs {
+			if got := codes[href]; got != "HTTP/1.1 423 Locked" {
+				t.Errorf("%s: %s: got %q, want 423", desc, href, got)
+			}
+		}
+	}
+
+	// DELETE removes everything but a locked member and its ancestors.
+	tree("/a/", "/a/b/", "/a/b/c", "/a/b/d", "/a/e", "/a/f/", "/a/f/g")
+	token := lock("/a/b/c", "Depth", "0")
+	codes := multistatusCodes(t, do("DELETE", "/a"))
+	want423("DELETE", codes, "/a/b/c")
+	all := []string{"/a", "/a/b", "/a/b/c", "/a/b/d", "/a/e", "/a/f", "/a/f/g"}
+	if got, want := exist(all...), []string{"/a", "/a/b", "/a/b/c"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("after DELETE: got %q, want %q", got, want)
+	}
+	// The client holding the lock may delete everything.
+	if got := do("DELETE", "/a", "If", "<http://example.com/a/b/c> ("+token+")").Code; got != http.StatusNoContent {
+		t.Fatalf("DELETE with the lock token: got %d, want %d", got, http.StatusNoContent)
+	}
+	if got := exist(all...); len(got) != 0 {
+		t.Fatalf("after DELETE with the lock token: %q remain", got)
+	}
+
+	// A locked collection keeps its members.
+	tree("/a/", "/a/b/", "/a/b/c", "/a/e")
+	lock("/a/b", "Depth", "0")
+	codes = multistatusCodes(t, do("DELETE", "/a"))
+	want423("DELETE of a locked collection", codes, "/a/b")
+	if got, want := exist("/a", "/a/b", "/a/b/c", "/a/e"), []string{"/a", "/a/b", "/a/b/c"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("after DELETE of a locked collection: got %q, want %q", got, want)
+	}
+
+	// COPY does not overwrite a destination with locked members, and MOVE
+	// leaves them behind.
+	tree("/m/", "/m/x", "/m/y/", "/m/y/z")
+	lock("/m/y/z", "Depth", "0")
+	codes = multistatusCodes(t, do("COPY", "/a", "Destination", "/m"))
+	want423("COPY", codes, "/m/y/z")
+	if got := exist("/m/x", "/m/y/z"); len(got) != 2 {
+		t.Fatalf("after COPY: got %q, want the destination untouched", got)
+	}
+	codes = multistatusCodes(t, do("MOVE", "/m", "Destination", "/n"))
+	want423("MOVE", codes, "/m/y/z")
+	if got, want := exist("/m", "/m/x", "/m/y", "/m/y/z", "/n", "/n/x", "/n/y", "/n/y/z"), []string{"/m", "/m/y", "/m/y/z", "/n", "/n/x", "/n/y"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("after MOVE: got %q, want %q", got, want)
+	}
+
+	// Nothing below is locked.
+	if got := do("COPY", "/n", "Destination", "/o").Code; got != http.StatusCreated {
+		t.Fatalf("COPY: got %d, want %d", got, http.StatusCreated)
+	}
+	if got := do("DELETE", "/o").Code; got != http.StatusNoContent {
+		t.Fatalf("DELETE: got %d, want %d", got, http.StatusNoContent)
+	}
+}
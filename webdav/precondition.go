@@ -0,0 +1,117 @@
+package webdav
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// checkPreconditions evaluates the conditional headers of RFC 7232 for a
+// request that modifies the resource name, in the order given by Section 6.
+// It is called with the locks of the request held, so that the resource
+// cannot change between the check and the modification.
+//
+// If-Modified-Since only applies to GET and HEAD, where http.ServeContent
+// evaluates it; If-Unmodified-Since is its counterpart for writes.
+func (h *Handler) checkPreconditions(r *http.Request, name string) (status int, err error) {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	ifUnmodifiedSince := r.Header.Get("If-Unmodified-Since")
+	if ifMatch == "" && ifNoneMatch == "" && ifUnmodifiedSince == "" {
+		return 0, nil
+	}
+	ctx := r.Context()
+	fi, etag, err := h.statETag(ctx, name)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if fi == nil && r.Method != "PUT" {
+		// Section 5 says that preconditions are ignored if the response
+		// would not be a 2xx without them, which is a 404 here.
+		return 0, nil
+	}
+
+	if ifMatch != "" {
+		if !matchETag(ifMatch, etag, true) {
+			return http.StatusPreconditionFailed, errPreconditionFailed
+		}
+	} else if ifUnmodifiedSince != "" && fi != nil {
+		// An invalid date is ignored.
+		if t, err := http.ParseTime(ifUnmodifiedSince); err == nil && fi.ModTime().Truncate(time.Second).After(t) {
+			return http.StatusPreconditionFailed, errPreconditionFailed
+		}
+	}
+	if ifNoneMatch != "" && matchETag(ifNoneMatch, etag, false) {
+		return http.StatusPreconditionFailed, errPreconditionFailed
+	}
+	return 0, nil
+}
+
+// statETag returns the file info and the ETag of the resource name, or nil
+// and an empty ETag if it does not exist.
+func (h *Handler) statETag(ctx context.Context, name string) (os.FileInfo, string, error) {
+	fi, err := h.FileSystem.Stat(ctx, name)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	etag, err := findETag(ctx, h.FileSystem, h.LockSystem, name, fi)
+	if err != nil {
+		return nil, "", err
+	}
+	return fi, etag, nil
+}
+
+// matchETag reports whether the value of an If-Match or If-None-Match header
+// matches etag, which is empty for a missing resource. "*" matches any
+// existing resource. Strong comparison never matches a weak entity-tag.
+func matchETag(hdr, etag string, strong bool) bool {
+	if strings.TrimSpace(hdr) == "*" {
+		return etag != ""
+	}
+	if etag == "" {
+		return false
+	}
+	for _, t := range strings.Split(hdr, ",") {
+		if etagsEqual(strings.TrimSpace(t), etag, strong) {
+			return true
+		}
+	}
+	return false
+}
+
+func etagsEqual(a, b string, strong bool) bool {
+	if strong {
+		return a == b && !strings.HasPrefix(a, "W/")
+	}
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// matchIfETags reports whether the ETag conditions of a list of the If
+// header hold for the resource name. Section 10.4.4 of RFC 4918 calls for
+// strong comparison.
+func (h *Handler) matchIfETags(ctx context.Context, name string, conditions []Condition) (bool, error) {
+	var etag string
+	stated := false
+	for _, c := range conditions {
+		if c.ETag == "" {
+			continue
+		}
+		if !stated {
+			var err error
+			if _, etag, err = h.statETag(ctx, name); err != nil {
+				return false, err
+			}
+			stated = true
+		}
+		match := etag != "" && etagsEqual(c.ETag, etag, true)
+		if match == c.Not {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,124 @@
+package webdav
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreconditions(t *testing.T) {
+	do := newTestHandler(t, NewMemFS())
+	put := func(path, body string, headers ...string) (status int, etag string) {
+		t.Helper()
+		rec := do("PUT", path, body, headers...)
+		return rec.Code, rec.Header().Get("ETag")
+	}
+
+	// If-None-Match: * only creates.
+	if status, _ := put("/a", "1", "If-None-Match", "*"); status != http.StatusCreated {
+		t.Fatalf("create-only PUT of a new file: got %d, want %d", status, http.StatusCreated)
+	}
+	if status, _ := put("/a", "2", "If-None-Match", "*"); status != http.StatusPreconditionFailed {
+		t.Fatalf("create-only PUT of an existing file: got %d, want %d", status, http.StatusPreconditionFailed)
+	}
+	if status, _ := put("/b", "1", "If-Match", "*"); status != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with If-Match of a missing file: got %d, want %d", status, http.StatusPreconditionFailed)
+	}
+
+	// Lost updates are detected.
+	_, etag := put("/a", "first")
+	status, newETag := put("/a", "second, longer", "If-Match", etag)
+	if status != http.StatusCreated {
+		t.Fatalf("PUT with a current ETag: got %d, want %d", status, http.StatusCreated)
+	}
+	if status, _ := put("/a", "third", "If-Match", etag); status != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with a stale ETag: got %d, want %d", status, http.StatusPreconditionFailed)
+	}
+	if status, _ := put("/a", "third", "If-Match", `"x", `+newETag); status != http.StatusCreated {
+		t.Fatalf("PUT with a list of ETags: got %d, want %d", status, http.StatusCreated)
+	}
+	if status, _ := put("/a", "fourth", "If-Match", "W/"+newETag); status != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with a weak ETag: got %d, want %d", status, http.StatusPreconditionFailed)
+	}
+
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if status, _ := put("/a", "fifth", "If-Unmodified-Since", past); status != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with If-Unmodified-Since in the past: got %d, want %d", status, http.StatusPreconditionFailed)
+	}
+	if status, _ := put("/a", "fifth", "If-Unmodified-Since", future); status != http.StatusCreated {
+		t.Fatalf("PUT with If-Unmodified-Since in the future: got %d, want %d", status, http.StatusCreated)
+	}
+
+	_, etag = put("/c", "c")
+	testCases := []struct {
+		desc    string
+		method  string
+		path    string
+		headers []string
+		want    int
+	}{
+		{"DELETE with a stale ETag", "DELETE", "/c", []string{"If-Match", `"stale"`}, http.StatusPreconditionFailed},
+		{"DELETE of a missing file", "DELETE", "/x", []string{"If-Match", etag}, http.StatusNotFound},
+		{"MOVE with a matching If-None-Match", "MOVE", "/c", []string{"If-None-Match", etag, "Destination", "/d"}, http.StatusPreconditionFailed},
+		{"COPY with a stale ETag", "COPY", "/c", []string{"If-Match", `"stale"`, "Destination", "/d"}, http.StatusPreconditionFailed},
+		{"COPY with the current ETag", "COPY", "/c", []string{"If-Match", etag, "Destination", "/d"}, http.StatusCreated},
+		{"MOVE with the current ETag", "MOVE", "/d", []string{"If-Match", "*", "Destination", "/e"}, http.StatusCreated},
+		{"DELETE with the current ETag", "DELETE", "/c", []string{"If-Match", etag}, http.StatusNoContent},
+	}
+	for _, tc := range testCases {
+		if got := do(tc.method, tc.path, "", tc.headers...).Code; got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestIfHeaderETags(t *testing.T) {
+	do := newTestHandler(t, NewMemFS())
+	etag := do("PUT", "/a", "a").Header().Get("ETag")
+
+	// ETAG stands for the current ETag of /a.
+	testCases := []struct {
+		desc string
+		If   string
+		want int
+	}{
+		{"matching ETag", "([ETAG])", http.StatusCreated},
+		{"stale ETag", `(["stale"])`, http.StatusPreconditionFailed},
+		{"negated stale ETag", `(Not ["stale"])`, http.StatusCreated},
+		{"negated current ETag", `(Not [ETAG])`, http.StatusPreconditionFailed},
+		{"second list matches", `(["stale"]) ([ETAG])`, http.StatusCreated},
+		{"tagged list", `<http://example.com/a> ([ETAG])`, http.StatusCreated},
+		{"list tagged with another file", `<http://example.com/b> ([ETAG])`, http.StatusPreconditionFailed},
+	}
+	for _, tc := range testCases {
+		rec := do("PUT", "/a", "a", "If", strings.ReplaceAll(tc.If, "ETAG", etag))
+		if rec.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.desc, rec.Code, tc.want)
+		}
+		if rec.Code == http.StatusCreated {
+			etag = rec.Header().Get("ETag")
+		}
+	}
+
+	// An ETag does not claim a lock held by another client.
+	lockBody := `<?xml version="1.0" encoding="utf-8" ?>
+		<D:lockinfo xmlns:D='DAV:'>
+			<D:lockscope><D:exclusive/></D:lockscope>
+			<D:locktype><D:write/></D:locktype>
+		</D:lockinfo>`
+	token := do("LOCK", "/a", lockBody).Header().Get("Lock-Token")
+	if token == "" {
+		t.Fatal("LOCK: no lock token")
+	}
+	if got := do("PUT", "/a", "b", "If", "(["+etag+"])").Code; got != StatusLocked {
+		t.Fatalf("PUT to a locked file with an ETag: got %d, want %d", got, StatusLocked)
+	}
+	if got := do("PUT", "/a", "b", "If", "("+token+" ["+etag+"])").Code; got != http.StatusCreated {
+		t.Fatalf("PUT to a locked file with its token and ETag: got %d, want %d", got, http.StatusCreated)
+	}
+	if got := do("PUT", "/a", "c", "If", "("+token+` ["stale"])`).Code; got != http.StatusPreconditionFailed {
+		t.Fatalf("PUT to a locked file with its token and a stale ETag: got %d, want %d", got, http.StatusPreconditionFailed)
+	}
+}
@@ -16,6 +16,8 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Proppatch describes a property update instruction as defined in RFC 4918.
@@ -99,6 +101,17 @@ type DeadPropsHolder interface {
 	Patch([]Proppatch) ([]Propstat, error)
 }
 
+// DeadPropsReader is an optional interface for the os.FileInfo objects
+// returned by the FileSystem, for file systems that read the dead properties
+// of a file together with its other metadata.
+//
+// If this interface is defined then PROPFIND reads the dead properties from
+// the object instead of opening the file.
+type DeadPropsReader interface {
+	// DeadProps returns a copy of the dead properties of the file.
+	DeadProps() (map[xml.Name]Property, error)
+}
+
 // liveProps contains all supported, protected DAV: properties.
 var liveProps = map[xml.Name]struct {
 	// findFn implements the propfind function of this property. If nil,
@@ -106,6 +119,14 @@ var liveProps = map[xml.Name]struct {
 	findFn func(context.Context, FileSystem, LockSystem, string, os.FileInfo) (string, error)
 	// dir is true if the property applies to directories.
 	dir bool
+	// deltaV is true if the property is defined by RFC 3253 and only applies
+	// to the files of a Versioner. allprop does not return it unless it is
+	// named in include.
+	deltaV bool
+	// quota is true if the property is defined by RFC 4331 and only applies
+	// to the resources of a Quotaer. allprop does not return it unless it is
+	// named in include.
+	quota bool
 }{
 	{Space: "DAV:", Local: "resourcetype"}: {
 		findFn: findResourceType,
@@ -151,40 +172,78 @@ var liveProps = map[xml.Name]struct {
 		dir: false,
 	},
 
-	// TODO: The lockdiscovery property requires LockSystem to list the
-	// active locks on a resource.
-	{Space: "DAV:", Local: "lockdiscovery"}: {},
+	{Space: "DAV:", Local: "lockdiscovery"}: {
+		findFn: findLockDiscovery,
+		dir:    true,
+	},
 	{Space: "DAV:", Local: "supportedlock"}: {
 		findFn: findSupportedLock,
 		dir:    true,
 	},
+
+	{Space: "DAV:", Local: "checked-in"}: {
+		findFn: findCheckedIn,
+		dir:    false,
+		deltaV: true,
+	},
+
+	{Space: "DAV:", Local: "quota-available-bytes"}: {
+		findFn: findQuotaAvailableBytes,
+		dir:    true,
+		quota:  true,
+	},
+	{Space: "DAV:", Local: "quota-used-bytes"}: {
+		findFn: findQuotaUsedBytes,
+		dir:    true,
+		quota:  true,
+	},
 }
 
 // TODO(nigeltao) merge props and allprop?
 
-// props returns the status of the properties named pnames for resource name.
-//
-// Each Propstat has a unique status and each property name will only be part
-// of one Propstat element.
-func props(ctx context.Context, fs FileSystem, ls LockSystem, name string, pnames []xml.Name) ([]Propstat, error) {
+// readProps returns the file info and the dead properties of resource name.
+// fi is the file info of name if the caller has it, or nil. The file is only
+// opened if fi does not implement DeadPropsReader.
+func readProps(ctx context.Context, fs FileSystem, name string, fi os.FileInfo) (os.FileInfo, map[xml.Name]Property, error) {
+	if dpr, ok := fi.(DeadPropsReader); ok {
+		deadProps, err := dpr.DeadProps()
+		if err != nil {
+			return nil, nil, err
+		}
+		return fi, deadProps, nil
+	}
 	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer f.Close()
-	fi, err := f.Stat()
+	fi, err = f.Stat()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	isDir := fi.IsDir()
-
 	var deadProps map[xml.Name]Property
 	if dph, ok := f.(DeadPropsHolder); ok {
 		deadProps, err = dph.DeadProps()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
+	return fi, deadProps, nil
+}
+
+// props returns the status of the properties named pnames for resource name,
+// whose file info is fi, or nil if the caller doesn't have it.
+//
+// Each Propstat has a unique status and each property name will only be part
+// of one Propstat element.
+func props(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo, pnames []xml.Name) ([]Propstat, error) {
+	fi, deadProps, err := readProps(ctx, fs, name, fi)
+	if err != nil {
+		return nil, err
+	}
+	isDir := fi.IsDir()
+	_, versioned := fs.(Versioner)
+	_, quotaed := fs.(Quotaer)
 
 	pstatOK := Propstat{Status: http.StatusOK}
 	pstatNotFound := Propstat{Status: http.StatusNotFound}
@@ -195,8 +254,14 @@ func props(ctx context.Context, fs FileSystem, ls LockSystem, name string, pname
 			continue
 		}
 		// Otherwise, it must either be a live property or we don't know it.
-		if prop := liveProps[pn]; prop.findFn != nil && (prop.dir || !isDir) {
+		if prop := liveProps[pn]; prop.findFn != nil && (prop.dir || !isDir) && (versioned || !prop.deltaV) && (quotaed || !prop.quota) {
 			innerXML, err := prop.findFn(ctx, fs, ls, name, fi)
+			if err == errNoQuota {
+				pstatNotFound.Props = append(pstatNotFound.Props, Property{
+					XMLName: pn,
+				})
+				continue
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -213,30 +278,20 @@ func props(ctx context.Context, fs FileSystem, ls LockSystem, name string, pname
 	return makePropstats(pstatOK, pstatNotFound), nil
 }
 
-// propnames returns the property names defined for resource name.
-func propnames(ctx context.Context, fs FileSystem, ls LockSystem, name string) ([]xml.Name, error) {
-	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	fi, err := f.Stat()
+// propnames returns the property names defined for resource name, whose file
+// info is fi, or nil if the caller doesn't have it.
+func propnames(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) ([]xml.Name, error) {
+	fi, deadProps, err := readProps(ctx, fs, name, fi)
 	if err != nil {
 		return nil, err
 	}
 	isDir := fi.IsDir()
-
-	var deadProps map[xml.Name]Property
-	if dph, ok := f.(DeadPropsHolder); ok {
-		deadProps, err = dph.DeadProps()
-		if err != nil {
-			return nil, err
-		}
-	}
+	_, versioned := fs.(Versioner)
+	_, quotaed := fs.(Quotaer)
 
 	pnames := make([]xml.Name, 0, len(liveProps)+len(deadProps))
 	for pn, prop := range liveProps {
-		if prop.findFn != nil && (prop.dir || !isDir) {
+		if prop.findFn != nil && (prop.dir || !isDir) && (versioned || !prop.deltaV) && (quotaed || !prop.quota) {
 			pnames = append(pnames, pn)
 		}
 	}
@@ -254,22 +309,31 @@ func propnames(ctx context.Context, fs FileSystem, ls LockSystem, name string) (
 // returned if they are named in 'include'.
 //
 // See http://www.webdav.org/specs/rfc4918.html#METHOD_PROPFIND
-func allprop(ctx context.Context, fs FileSystem, ls LockSystem, name string, include []xml.Name) ([]Propstat, error) {
-	pnames, err := propnames(ctx, fs, ls, name)
+func allprop(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo, include []xml.Name) ([]Propstat, error) {
+	pnames, err := propnames(ctx, fs, ls, name, fi)
 	if err != nil {
 		return nil, err
 	}
 	// Add names from include if they are not already covered in pnames.
+	// The RFC 3253 and RFC 4331 properties are only returned if they are
+	// included.
 	nameset := make(map[xml.Name]bool)
+	n := 0
 	for _, pn := range pnames {
+		if prop := liveProps[pn]; prop.deltaV || prop.quota {
+			continue
+		}
 		nameset[pn] = true
+		pnames[n] = pn
+		n++
 	}
+	pnames = pnames[:n]
 	for _, pn := range include {
 		if !nameset[pn] {
 			pnames = append(pnames, pn)
 		}
 	}
-	return props(ctx, fs, ls, name, pnames)
+	return props(ctx, fs, ls, name, fi, pnames)
 }
 
 // patch patches the properties of resource name. The return values are
@@ -460,10 +524,32 @@ func findETag(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi
 	return fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size()), nil
 }
 
+// findLockDiscovery lists the active locks on name if ls is a LockLister.
+// Otherwise the property is empty, as if there were no locks.
+func findLockDiscovery(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	ll, ok := ls.(LockLister)
+	if !ok {
+		return "", nil
+	}
+	locks, err := ll.Locks(time.Now(), name)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, l := range locks {
+		b.WriteString(activeLock(l.Token, l.LockDetails))
+	}
+	return b.String(), nil
+}
+
 func findSupportedLock(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
 	return `` +
 		`<D:lockentry xmlns:D="DAV:">` +
 		`<D:lockscope><D:exclusive/></D:lockscope>` +
 		`<D:locktype><D:write/></D:locktype>` +
+		`</D:lockentry>` +
+		`<D:lockentry xmlns:D="DAV:">` +
+		`<D:lockscope><D:shared/></D:lockscope>` +
+		`<D:locktype><D:write/></D:locktype>` +
 		`</D:lockentry>`, nil
 }
@@ -14,6 +14,7 @@ import (
 	"regexp"
 	"sort"
 	"testing"
+	"time"
 )
 
 func TestMemPS(t *testing.T) {
@@ -52,6 +53,10 @@ func TestMemPS(t *testing.T) {
 			`<D:lockentry xmlns:D="DAV:">` +
 			`<D:lockscope><D:exclusive/></D:lockscope>` +
 			`<D:locktype><D:write/></D:locktype>` +
+			`</D:lockentry>` +
+			`<D:lockentry xmlns:D="DAV:">` +
+			`<D:lockscope><D:shared/></D:lockscope>` +
+			`<D:locktype><D:write/></D:locktype>` +
 			`</D:lockentry>`
 		statForbiddenError = `<D:cannot-modify-protected-property xmlns:D="DAV:"/>`
 	)
@@ -79,6 +84,7 @@ func TestMemPS(t *testing.T) {
 			wantPnames: []xml.Name{
 				{Space: "DAV:", Local: "resourcetype"},
 				{Space: "DAV:", Local: "displayname"},
+				{Space: "DAV:", Local: "lockdiscovery"},
 				{Space: "DAV:", Local: "supportedlock"},
 				{Space: "DAV:", Local: "getlastmodified"},
 			},
@@ -92,6 +98,7 @@ func TestMemPS(t *testing.T) {
 				{Space: "DAV:", Local: "getlastmodified"},
 				{Space: "DAV:", Local: "getcontenttype"},
 				{Space: "DAV:", Local: "getetag"},
+				{Space: "DAV:", Local: "lockdiscovery"},
 				{Space: "DAV:", Local: "supportedlock"},
 			},
 		}},
@@ -112,6 +119,9 @@ func TestMemPS(t *testing.T) {
 				}, {
 					XMLName:  xml.Name{Space: "DAV:", Local: "getlastmodified"},
 					InnerXML: nil, // Calculated during test.
+				}, {
+					XMLName:  xml.Name{Space: "DAV:", Local: "lockdiscovery"},
+					InnerXML: []byte(""),
 				}, {
 					XMLName:  xml.Name{Space: "DAV:", Local: "supportedlock"},
 					InnerXML: []byte(lockEntry),
@@ -140,6 +150,9 @@ func TestMemPS(t *testing.T) {
 				}, {
 					XMLName:  xml.Name{Space: "DAV:", Local: "getetag"},
 					InnerXML: nil, // Calculated during test.
+				}, {
+					XMLName:  xml.Name{Space: "DAV:", Local: "lockdiscovery"},
+					InnerXML: []byte(""),
 				}, {
 					XMLName:  xml.Name{Space: "DAV:", Local: "supportedlock"},
 					InnerXML: []byte(lockEntry),
@@ -172,6 +185,9 @@ func TestMemPS(t *testing.T) {
 				}, {
 					XMLName:  xml.Name{Space: "DAV:", Local: "getetag"},
 					InnerXML: nil, // Calculated during test.
+				}, {
+					XMLName:  xml.Name{Space: "DAV:", Local: "lockdiscovery"},
+					InnerXML: []byte(""),
 				}, {
 					XMLName:  xml.Name{Space: "DAV:", Local: "supportedlock"},
 					InnerXML: []byte(lockEntry),
@@ -464,6 +480,7 @@ func TestMemPS(t *testing.T) {
 				{Space: "DAV:", Local: "getlastmodified"},
 				{Space: "DAV:", Local: "getcontenttype"},
 				{Space: "DAV:", Local: "getetag"},
+				{Space: "DAV:", Local: "lockdiscovery"},
 				{Space: "DAV:", Local: "supportedlock"},
 				{Space: "foo", Local: "bar"},
 			},
@@ -522,7 +539,7 @@ func TestMemPS(t *testing.T) {
 			var propstats []Propstat
 			switch op.op {
 			case "propname":
-				pnames, err := propnames(ctx, fs, ls, op.name)
+				pnames, err := propnames(ctx, fs, ls, op.name, nil)
 				if err != nil {
 					t.Errorf("%s: got error %v, want nil", desc, err)
 					continue
@@ -534,9 +551,9 @@ func TestMemPS(t *testing.T) {
 				}
 				continue
 			case "allprop":
-				propstats, err = allprop(ctx, fs, ls, op.name, op.pnames)
+				propstats, err = allprop(ctx, fs, ls, op.name, nil, op.pnames)
 			case "propfind":
-				propstats, err = props(ctx, fs, ls, op.name, op.pnames)
+				propstats, err = props(ctx, fs, ls, op.name, nil, op.pnames)
 			case "proppatch":
 				propstats, err = patch(ctx, fs, ls, op.name, op.patches)
 			default:
@@ -714,3 +731,56 @@ func TestFindETagOverride(t *testing.T) {
 		t.Fatalf("ETag wrong want %q got %q", originalETag, ETag)
 	}
 }
+
+func TestFindLockDiscovery(t *testing.T) {
+	ctx := context.Background()
+	fs, ls := NewMemFS(), NewMemLS()
+	if err := fs.Mkdir(ctx, "/dir", 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	fi, err := fs.Stat(ctx, "/dir")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if got, err := findLockDiscovery(ctx, fs, ls, "/dir", fi); err != nil || got != "" {
+		t.Fatalf("findLockDiscovery of an unlocked resource: got %q, %v, want no locks", got, err)
+	}
+
+	token, err := ls.Create(time.Now(), LockDetails{
+		Root:      "/dir",
+		Duration:  time.Hour,
+		OwnerXML:  "<D:href>alice</D:href>",
+		ZeroDepth: true,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	got, err := findLockDiscovery(ctx, fs, ls, "/dir", fi)
+	if err != nil {
+		t.Fatalf("findLockDiscovery: %v", err)
+	}
+	var al struct {
+		XMLName   xml.Name  `xml:"DAV: activelock"`
+		Exclusive *struct{} `xml:"lockscope>exclusive"`
+		Write     *struct{} `xml:"locktype>write"`
+		Depth     string    `xml:"depth"`
+		Owner     string    `xml:"owner>href"`
+		Timeout   string    `xml:"timeout"`
+		Token     string    `xml:"locktoken>href"`
+		Root      string    `xml:"lockroot>href"`
+	}
+	if err := xml.Unmarshal([]byte(got), &al); err != nil {
+		t.Fatalf("activelock %q: %v", got, err)
+	}
+	if al.Exclusive == nil || al.Write == nil || al.Depth != "0" || al.Owner != "alice" || al.Token != token || al.Root != "/dir" {
+		t.Errorf("activelock: got %+v", al)
+	}
+	if !regexp.MustCompile(`^Second-(3600|359\d)$`).MatchString(al.Timeout) {
+		t.Errorf("timeout: got %q, want about an hour", al.Timeout)
+	}
+
+	// Without a LockLister, there is nothing to discover.
+	if got, err := findLockDiscovery(ctx, fs, struct{ LockSystem }{ls}, "/dir", fi); err != nil || got != "" {
+		t.Errorf("findLockDiscovery without a LockLister: got %q, %v, want no locks", got, err)
+	}
+}
@@ -0,0 +1,82 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+)
+
+// ErrQuotaExceeded is returned by the FileSystem if an operation would use
+// more storage than the quota allows. The Handler answers it with "507
+// Insufficient Storage".
+var ErrQuotaExceeded = errors.New("webdav: quota exceeded")
+
+// Quotaer is an optional interface for the FileSystem, for file systems that
+// limit the storage available to resources, as described in RFC 4331 (Quota
+// and Size Properties for DAV Collections).
+//
+// If this interface is defined then the Handler supports the
+// DAV:quota-available-bytes and DAV:quota-used-bytes properties.
+type Quotaer interface {
+	// Quota returns the number of bytes that the resource name may still
+	// use, or -1 if there is no limit, and the number of bytes counted
+	// against its quota. If it returns ErrNotImplemented then the resource
+	// has no quota properties.
+	Quota(ctx context.Context, name string) (available, used int64, err error)
+}
+
+// checkQuota returns ErrQuotaExceeded if fs has a quota and writing size
+// bytes to the file name would go over it, taking the file's current size into
+// account, so that a PUT is refused before its body is read. A size below
+// zero is unknown and always passes, as the FileSystem checks the quota again
+// while writing.
+func checkQuota(ctx context.Context, fs FileSystem, name string, size int64) error {
+	q, ok := fs.(Quotaer)
+	if !ok || size <= 0 {
+		return nil
+	}
+	available, _, err := q.Quota(ctx, name)
+	if errors.Is(err, ErrNotImplemented) || err == nil && available < 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi, err := fs.Stat(ctx, name); err == nil && !fi.IsDir() {
+		size -= fi.Size()
+	}
+	if size > available {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// errNoQuota is returned by the find functions of the quota properties if
+// the resource does not have the property, which is then reported as "404
+// Not Found".
+var errNoQuota = errors.New("webdav: no quota")
+
+func findQuotaAvailableBytes(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	available, _, err := fs.(Quotaer).Quota(ctx, name)
+	if errors.Is(err, ErrNotImplemented) || err == nil && available < 0 {
+		// Section 3 of RFC 4331 allows leaving out the property of a
+		// resource without a limit.
+		return "", errNoQuota
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(available, 10), nil
+}
+
+func findQuotaUsedBytes(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	_, used, err := fs.(Quotaer).Quota(ctx, name)
+	if errors.Is(err, ErrNotImplemented) {
+		return "", errNoQuota
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(used, 10), nil
+}
@@ -0,0 +1,277 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+)
+
+// Versioner is an optional interface for the FileSystem, for file systems
+// that keep the earlier contents of files as versions, as described in RFC
+// 3253 (Versioning Extensions to WebDAV). Every write of the content of a
+// file creates a version, numbered from 1.
+//
+// If this interface is defined then the Handler supports the DAV:checked-in
+// property, the DAV:version-tree REPORT, GET of a version with the "version"
+// query parameter and UPDATE to restore a version.
+type Versioner interface {
+	// Versions returns the kept versions of the file name, oldest first.
+	// The last one is the checked-in version, which is the current content.
+	Versions(ctx context.Context, name string) ([]VersionInfo, error)
+	// OpenVersion opens the version n of the file name for reading. It
+	// returns an error satisfying os.IsNotExist if the version is not kept.
+	OpenVersion(ctx context.Context, name string, n int) (File, error)
+	// RestoreVersion makes the content of the version n of the file name its
+	// content again, as a new version.
+	RestoreVersion(ctx context.Context, name string, n int) error
+}
+
+// VersionInfo describes a version of a file.
+type VersionInfo struct {
+	os.FileInfo
+	// Number is the number of the version.
+	Number int
+}
+
+// VersionedFileInfo is an optional interface for the os.FileInfo objects
+// returned by a Versioner.
+//
+// If this interface is defined then PROPFIND reports the DAV:checked-in
+// property without calling Versions for every file.
+type VersionedFileInfo interface {
+	// CheckedIn returns the number of the checked-in version, or 0 if it is
+	// not known.
+	CheckedIn() int
+}
+
+// versionParam is the query parameter that selects a version of a file.
+const versionParam = "version"
+
+// versionHref returns the URL of the version n of the resource name, for
+// the Handler with the given URL path prefix.
+func versionHref(prefix, name string, n int) string {
+	u := url.URL{
+		Path:     path.Join(prefix, name),
+		RawQuery: versionParam + "=" + strconv.Itoa(n),
+	}
+	return u.String()
+}
+
+// parseVersion returns the version selected by the query q, or 0 if q does
+// not select one.
+func parseVersion(q url.Values) (int, error) {
+	s := q.Get(versionParam)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, errInvalidVersion
+	}
+	return n, nil
+}
+
+type prefixKey struct{}
+
+// withPrefix returns a context that carries the URL path prefix of the
+// Handler, which properties holding hrefs need.
+func withPrefix(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, prefixKey{}, prefix)
+}
+
+func prefixFrom(ctx context.Context) string {
+	prefix, _ := ctx.Value(prefixKey{}).(string)
+	return prefix
+}
+
+func findCheckedIn(ctx context.Context, fs FileSystem, ls LockSystem, name string, fi os.FileInfo) (string, error) {
+	var n int
+	if vfi, ok := fi.(VersionedFileInfo); ok {
+		n = vfi.CheckedIn()
+	}
+	if n == 0 {
+		versions, err := fs.(Versioner).Versions(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		if len(versions) == 0 {
+			return "", nil
+		}
+		n = versions[len(versions)-1].Number
+	}
+	return "<D:href>" + escape(versionHref(prefixFrom(ctx), name, n)) + "</D:href>", nil
+}
+
+// versionProps are the properties that the DAV:version-tree REPORT reports
+// for a version, besides DAV:version-name.
+var versionProps = []xml.Name{
+	{Space: "DAV:", Local: "getcontentlength"},
+	{Space: "DAV:", Local: "getlastmodified"},
+	{Space: "DAV:", Local: "getetag"},
+}
+
+// versionPropstats returns the status of the properties named pnames for the
+// version v of the file name.
+func versionPropstats(ctx context.Context, fs FileSystem, ls LockSystem, name string, v VersionInfo, pnames []xml.Name) ([]Propstat, error) {
+	pstatOK := Propstat{Status: http.StatusOK}
+	pstatNotFound := Propstat{Status: http.StatusNotFound}
+	for _, pn := range pnames {
+		if pn == (xml.Name{Space: "DAV:", Local: "version-name"}) {
+			pstatOK.Props = append(pstatOK.Props, Property{
+				XMLName:  pn,
+				InnerXML: []byte(strconv.Itoa(v.Number)),
+			})
+			continue
+		}
+		if !slices.Contains(versionProps, pn) {
+			pstatNotFound.Props = append(pstatNotFound.Props, Property{
+				XMLName: pn,
+			})
+			continue
+		}
+		innerXML, err := liveProps[pn].findFn(ctx, fs, ls, name, v.FileInfo)
+		if err != nil {
+			return nil, err
+		}
+		pstatOK.Props = append(pstatOK.Props, Property{
+			XMLName:  pn,
+			InnerXML: []byte(innerXML),
+		})
+	}
+	return makePropstats(pstatOK, pstatNotFound), nil
+}
+
+// handleReport answers the DAV:version-tree REPORT, which lists the versions
+// of a file. Section 3.7 of RFC 3253.
+func (h *Handler) handleReport(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return status, err
+	}
+	vr, ok := h.FileSystem.(Versioner)
+	if !ok {
+		return http.StatusBadRequest, errUnsupportedMethod
+	}
+	ctx := withPrefix(r.Context(), h.Prefix)
+	fi, err := h.FileSystem.Stat(ctx, reqPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		}
+		return http.StatusMethodNotAllowed, err
+	}
+	rep, status, err := readReport(r.Body)
+	if err != nil {
+		return status, err
+	}
+	if xml.Name(rep.XMLName) != (xml.Name{Space: "DAV:", Local: "version-tree"}) || fi.IsDir() {
+		return http.StatusForbidden, errUnsupportedReport
+	}
+	pnames := []xml.Name(rep.Prop)
+	if len(pnames) == 0 {
+		pnames = []xml.Name{{Space: "DAV:", Local: "version-name"}}
+	}
+	versions, err := vr.Versions(ctx, reqPath)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	mw := multistatusWriter{w: w}
+	for _, v := range versions {
+		pstats, err := versionPropstats(ctx, h.FileSystem, h.LockSystem, reqPath, v, pnames)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		resp := makePropstatResponse(path.Join(h.Prefix, reqPath), pstats)
+		resp.Href = []string{versionHref(h.Prefix, reqPath, v.Number)}
+		if err := mw.write(resp); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if err := mw.close(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+}
+
+// handleUpdate restores the version of a file named by the DAV:version
+// element of the request body. Section 7.1 of RFC 3253.
+func (h *Handler) handleUpdate(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	reqPath, status, err := h.stripPrefix(r.URL.Path)
+	if err != nil {
+		return status, err
+	}
+	vr, ok := h.FileSystem.(Versioner)
+	if !ok {
+		return http.StatusBadRequest, errUnsupportedMethod
+	}
+	release, status, err := h.confirmLocks(r, reqPath, "")
+	if err != nil {
+		return status, err
+	}
+	defer release()
+
+	ctx := r.Context()
+	fi, err := h.FileSystem.Stat(ctx, reqPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusNotFound, err
+		}
+		return http.StatusMethodNotAllowed, err
+	}
+	if fi.IsDir() {
+		return http.StatusMethodNotAllowed, errInvalidUpdate
+	}
+	if status, err := h.checkPreconditions(r, reqPath); err != nil {
+		return status, err
+	}
+	ui, status, err := readUpdateInfo(r.Body)
+	if err != nil {
+		return status, err
+	}
+	u, err := url.Parse(ui.Version.Href)
+	if err != nil {
+		return http.StatusBadRequest, errInvalidUpdate
+	}
+	name, status, err := h.stripPrefix(u.Path)
+	if err != nil {
+		return http.StatusConflict, err
+	}
+	n, err := parseVersion(u.Query())
+	if err != nil || n == 0 || path.Clean(name) != path.Clean(reqPath) {
+		// Only a version of the file itself can be restored.
+		return http.StatusConflict, errInvalidUpdate
+	}
+	if err := vr.RestoreVersion(ctx, reqPath, n); err != nil {
+		if os.IsNotExist(err) {
+			return http.StatusConflict, err
+		}
+		if os.IsPermission(err) {
+			return http.StatusForbidden, err
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			return StatusInsufficientStorage, err
+		}
+		return http.StatusInternalServerError, err
+	}
+
+	mw := multistatusWriter{w: w}
+	err = mw.write(&response{
+		Href:   []string{(&url.URL{Path: path.Join(h.Prefix, reqPath)}).EscapedPath()},
+		Status: fmt.Sprintf("HTTP/1.1 %d %s", http.StatusOK, StatusText(http.StatusOK)),
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := mw.close(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+}
@@ -8,6 +8,7 @@ package webdav // import "golang.org/x/net/webdav"
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
@@ -67,6 +68,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			status, err = h.handlePropfind(w, r)
 		case "PROPPATCH":
 			status, err = h.handleProppatch(w, r)
+		case "REPORT":
+			status, err = h.handleReport(w, r)
+		case "UPDATE":
+			status, err = h.handleUpdate(w, r)
 		}
 	}
 
@@ -81,11 +86,11 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *Handler) lock(now time.Time, root string) (token string, status int, err error) {
+func (h *Handler) lock(now time.Time, root string, zeroDepth bool) (token string, status int, err error) {
 	token, err = h.LockSystem.Create(now, LockDetails{
 		Root:      root,
 		Duration:  infiniteTimeout,
-		ZeroDepth: true,
+		ZeroDepth: zeroDepth,
 	})
 	if err != nil {
 		if err == ErrLocked {
@@ -100,35 +105,7 @@ func (h *Handler) confirmLocks(r *http.Request, src, dst string) (release func()
 	hdr := r.Header.Get("If")
 	if hdr == "" {
 		// An empty If header means that the client hasn't previously created locks.
-		// Even if this client doesn't care about locks, we still need to check that
-		// the resources aren't locked by another client, so we create temporary
-		// locks that would conflict with another client's locks. These temporary
-		// locks are unlocked at the end of the HTTP request.
-		now, srcToken, dstToken := time.Now(), "", ""
-		if src != "" {
-			srcToken, status, err = h.lock(now, src)
-			if err != nil {
-				return nil, status, err
-			}
-		}
-		if dst != "" {
-			dstToken, status, err = h.lock(now, dst)
-			if err != nil {
-				if srcToken != "" {
-					h.LockSystem.Unlock(now, srcToken)
-				}
-				return nil, status, err
-			}
-		}
-
-		return func() {
-			if dstToken != "" {
-				h.LockSystem.Unlock(now, dstToken)
-			}
-			if srcToken != "" {
-				h.LockSystem.Unlock(now, srcToken)
-			}
-		}, 0, nil
+		return h.lockTemporarily(src, dst, true)
 	}
 
 	ih, ok := parseIfHeader(hdr)
@@ -153,7 +130,26 @@ func (h *Handler) confirmLocks(r *http.Request, src, dst string) (release func()
 				return nil, status, err
 			}
 		}
-		release, err = h.LockSystem.Confirm(time.Now(), lsrc, dst, l.conditions...)
+		// The ETag conditions are checked here, the lock tokens by the
+		// LockSystem.
+		ok, err := h.matchIfETags(r.Context(), lsrc, l.conditions)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if !ok {
+			continue
+		}
+		var tokens []Condition
+		for _, c := range l.conditions {
+			if c.Token != "" {
+				tokens = append(tokens, c)
+			}
+		}
+		if len(tokens) == 0 {
+			// A list of ETags claims no lock.
+			return h.lockTemporarily(src, dst, true)
+		}
+		release, err = h.LockSystem.Confirm(time.Now(), lsrc, dst, tokens...)
 		if err == ErrConfirmationFailed {
 			continue
 		}
@@ -169,6 +165,147 @@ func (h *Handler) confirmLocks(r *http.Request, src, dst string) (release func()
 	return nil, http.StatusPreconditionFailed, ErrLocked
 }
 
+// lockTemporarily is confirmLocks for a client that claims no locks. Even if
+// this client doesn't care about locks, we still need to check that the
+// resources aren't locked by another client, so we create temporary locks
+// that would conflict with another client's locks. These temporary locks are
+// unlocked at the end of the HTTP request.
+func (h *Handler) lockTemporarily(src, dst string, zeroDepth bool) (release func(), status int, err error) {
+	now, srcToken, dstToken := time.Now(), "", ""
+	if src != "" {
+		srcToken, status, err = h.lock(now, src, zeroDepth)
+		if err != nil {
+			return nil, status, err
+		}
+	}
+	if dst != "" {
+		dstToken, status, err = h.lock(now, dst, zeroDepth)
+		if err != nil {
+			if srcToken != "" {
+				h.LockSystem.Unlock(now, srcToken)
+			}
+			return nil, status, err
+		}
+	}
+
+	return func() {
+		if dstToken != "" {
+			h.LockSystem.Unlock(now, dstToken)
+		}
+		if srcToken != "" {
+			h.LockSystem.Unlock(now, srcToken)
+		}
+	}, 0, nil
+}
+
+// confirmTreeLocks is confirmLocks for a request that removes src or dst,
+// which may be empty, together with all their members: a DELETE, or a COPY
+// or MOVE that overwrites its destination. A member that is locked by another
+// client must not be removed, but section 9.6.1 says that the rest of the
+// request should still be carried out, so the locked members below src and
+// dst are returned instead of failing the whole request.
+func (h *Handler) confirmTreeLocks(r *http.Request, src, dst string) (srcLocked, dstLocked []string, release func(), status int, err error) {
+	hdr := r.Header.Get("If")
+	if hdr == "" {
+		// Temporary locks of infinite depth claim the whole trees at once
+		// unless something below them is locked.
+		release, status, err := h.lockTemporarily(src, dst, false)
+		if err != ErrLocked {
+			return nil, nil, release, status, err
+		}
+	}
+
+	// Lock the members one by one, before confirmLocks holds the locks of
+	// the client, so that those locks still confirm the members they cover.
+	var tokens []Condition
+	if ih, ok := parseIfHeader(hdr); ok {
+		for _, l := range ih.lists {
+			for _, c := range l.conditions {
+				if c.Token != "" && !c.Not {
+					tokens = append(tokens, c)
+				}
+			}
+		}
+	}
+	ctx, now := r.Context(), time.Now()
+	var memberTokens []string
+	releaseMembers := func() {
+		for _, token := range memberTokens {
+			h.LockSystem.Unlock(now, token)
+		}
+	}
+	lockMembers := func(root string) (locked []string, err error) {
+		fi, err := h.FileSystem.Stat(ctx, root)
+		if err != nil {
+			// A missing resource has no members. The caller reports
+			// other errors.
+			return nil, nil
+		}
+		err = walkFS(ctx, h.FileSystem, infiniteDepth, root, fi, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if name == root {
+				return nil
+			}
+			if len(tokens) > 0 {
+				release, err := h.LockSystem.Confirm(now, name, "", tokens...)
+				if err == nil {
+					release()
+					return nil
+				}
+				if err != ErrConfirmationFailed {
+					return err
+				}
+			}
+			token, err := h.LockSystem.Create(now, LockDetails{
+				Root:      name,
+				Duration:  infiniteTimeout,
+				ZeroDepth: true,
+			})
+			if err == ErrLocked {
+				locked = append(locked, name)
+				if info.IsDir() {
+					// A lock on a collection also protects its members.
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			memberTokens = append(memberTokens, token)
+			return nil
+		})
+		return locked, err
+	}
+	if src != "" {
+		if srcLocked, err = lockMembers(src); err != nil {
+			releaseMembers()
+			return nil, nil, nil, http.StatusInternalServerError, err
+		}
+	}
+	if dst != "" {
+		if dstLocked, err = lockMembers(dst); err != nil {
+			releaseMembers()
+			return nil, nil, nil, http.StatusInternalServerError, err
+		}
+	}
+
+	releaseRoots, status, err := h.confirmLocks(r, src, dst)
+	if err != nil {
+		releaseMembers()
+		return nil, nil, nil, status, err
+	}
+	return srcLocked, dstLocked, func() {
+		releaseRoots()
+		releaseMembers()
+	}, 0, nil
+}
+
 func (h *Handler) handleOptions(w http.ResponseWriter, r *http.Request) (status int, err error) {
 	reqPath, status, err := h.stripPrefix(r.URL.Path)
 	if err != nil {
@@ -181,6 +318,9 @@ func (h *Handler) handleOptions(w http.ResponseWriter, r *http.Request) (status
 			allow = "OPTIONS, LOCK, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND"
 		} else {
 			allow = "OPTIONS, LOCK, GET, HEAD, POST, DELETE, PROPPATCH, COPY, MOVE, UNLOCK, PROPFIND, PUT"
+			if _, ok := h.FileSystem.(Versioner); ok {
+				allow += ", REPORT, UPDATE"
+			}
 		}
 	}
 	w.Header().Set("Allow", allow)
@@ -198,9 +338,19 @@ func (h *Handler) handleGetHeadPost(w http.ResponseWriter, r *http.Request) (sta
 	}
 	// TODO: check locks for read-only access??
 	ctx := r.Context()
-	f, err := h.FileSystem.OpenFile(ctx, reqPath, os.O_RDONLY, 0)
-	if err != nil {
-		return http.StatusNotFound, err
+	var f File
+	if n, err := parseVersion(r.URL.Query()); err != nil {
+		return http.StatusBadRequest, err
+	} else if vr, ok := h.FileSystem.(Versioner); ok && n != 0 {
+		f, err = vr.OpenVersion(ctx, reqPath, n)
+		if err != nil {
+			return http.StatusNotFound, err
+		}
+	} else {
+		f, err = h.FileSystem.OpenFile(ctx, reqPath, os.O_RDONLY, 0)
+		if err != nil {
+			return http.StatusNotFound, err
+		}
 	}
 	defer f.Close()
 	fi, err := f.Stat()
@@ -215,7 +365,21 @@ func (h *Handler) handleGetHeadPost(w http.ResponseWriter, r *http.Request) (sta
 		return http.StatusInternalServerError, err
 	}
 	w.Header().Set("ETag", etag)
-	// Let ServeContent determine the Content-Type header.
+	if err := setDigestHeaders(ctx, w, r, fi); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// A ContentTyper reports the same Content-Type as DAV:getcontenttype.
+	// Otherwise, let ServeContent determine the Content-Type header.
+	if do, ok := fi.(ContentTyper); ok {
+		ctype, err := do.ContentType(ctx)
+		switch err {
+		case nil:
+			w.Header().Set("Content-Type", ctype)
+		case ErrNotImplemented:
+		default:
+			return http.StatusInternalServerError, err
+		}
+	}
 	http.ServeContent(w, r, reqPath, fi.ModTime(), f)
 	return 0, nil
 }
@@ -225,7 +389,7 @@ func (h *Handler) handleDelete(w http.ResponseWriter, r *http.Request) (status i
 	if err != nil {
 		return status, err
 	}
-	release, status, err := h.confirmLocks(r, reqPath, "")
+	locked, _, release, status, err := h.confirmTreeLocks(r, reqPath, "")
 	if err != nil {
 		return status, err
 	}
@@ -233,8 +397,6 @@ func (h *Handler) handleDelete(w http.ResponseWriter, r *http.Request) (status i
 
 	ctx := r.Context()
 
-	// TODO: return MultiStatus where appropriate.
-
 	// "godoc os RemoveAll" says that "If the path does not exist, RemoveAll
 	// returns nil (no error)." WebDAV semantics are that it should return a
 	// "404 Not Found". We therefore have to Stat before we RemoveAll.
@@ -244,10 +406,14 @@ func (h *Handler) handleDelete(w http.ResponseWriter, r *http.Request) (status i
 		}
 		return http.StatusMethodNotAllowed, err
 	}
-	if err := h.FileSystem.RemoveAll(ctx, reqPath); err != nil {
-		return http.StatusMethodNotAllowed, err
+	if status, err := h.checkPreconditions(r, reqPath); err != nil {
+		return status, err
+	}
+	status, err = removeFiles(ctx, h.FileSystem, reqPath, locked)
+	if errs, ok := err.(memberErrors); ok {
+		return h.writeMemberErrors(w, errs)
 	}
-	return http.StatusNoContent, nil
+	return status, err
 }
 
 func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request) (status int, err error) {
@@ -260,11 +426,35 @@ func (h *Handler) handlePut(w http.ResponseWriter, r *http.Request) (status int,
 		return status, err
 	}
 	defer release()
-	// TODO(rost): Support the If-Match, If-None-Match headers? See bradfitz'
-	// comments in http.checkEtag.
+	if status, err := h.checkPreconditions(r, reqPath); err != nil {
+		return status, err
+	}
 	ctx := r.Context()
-	fi, err := h.FileSystem.Create(ctx, reqPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, r.Body)
+	if err := checkQuota(ctx, h.FileSystem, reqPath, r.ContentLength); err != nil {
+		if errors.Is(err, ErrQuotaExceeded) {
+			return StatusInsufficientStorage, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	cr, err := newChecksumReader(r)
 	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	var body io.Reader = r.Body
+	if cr != nil {
+		body = cr
+	}
+	fi, err := h.FileSystem.Create(ctx, reqPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666, body)
+	if cr != nil && cr.mismatch {
+		return http.StatusBadRequest, errChecksumMismatch
+	}
+	if err != nil {
+		if os.IsPermission(err) {
+			return http.StatusForbidden, err
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			return StatusInsufficientStorage, err
+		}
 		return http.StatusConflict, err
 	}
 	etag, err := findETag(ctx, h.FileSystem, h.LockSystem, reqPath, fi)
@@ -338,11 +528,19 @@ func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) (status
 		// even though a COPY doesn't modify the source, if a concurrent
 		// operation modifies the source. However, the litmus test explicitly
 		// checks that COPYing a locked-by-another source is OK.
-		release, status, err := h.confirmLocks(r, "", dst)
+		_, dstLocked, release, status, err := h.confirmTreeLocks(r, "", dst)
 		if err != nil {
 			return status, err
 		}
 		defer release()
+		if status, err := h.checkPreconditions(r, src); err != nil {
+			return status, err
+		}
+		overwrite := r.Header.Get("Overwrite") != "F"
+		if overwrite && len(dstLocked) > 0 {
+			// The destination cannot be deleted before the copy.
+			return h.writeMemberErrors(w, lockedErrors(dstLocked))
+		}
 
 		// Section 9.8.3 says that "The COPY method on a collection without a Depth
 		// header must act as if a Depth header with value "infinity" was included".
@@ -355,14 +553,25 @@ func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) (status
 				return http.StatusBadRequest, errInvalidDepth
 			}
 		}
-		return copyFiles(ctx, h.FileSystem, src, dst, r.Header.Get("Overwrite") != "F", depth, 0)
+		status, err = copyFiles(ctx, h.FileSystem, src, dst, overwrite, depth, 0)
+		if errs, ok := err.(memberErrors); ok {
+			return h.writeMemberErrors(w, errs)
+		}
+		return status, err
 	}
 
-	release, status, err := h.confirmLocks(r, src, dst)
+	srcLocked, dstLocked, release, status, err := h.confirmTreeLocks(r, src, dst)
 	if err != nil {
 		return status, err
 	}
 	defer release()
+	if status, err := h.checkPreconditions(r, src); err != nil {
+		return status, err
+	}
+	overwrite := r.Header.Get("Overwrite") == "T"
+	if overwrite && len(dstLocked) > 0 {
+		return h.writeMemberErrors(w, lockedErrors(dstLocked))
+	}
 
 	// Section 9.9.2 says that "The MOVE method on a collection must act as if
 	// a "Depth: infinity" header was used on it. A client must not submit a
@@ -372,7 +581,11 @@ func (h *Handler) handleCopyMove(w http.ResponseWriter, r *http.Request) (status
 			return http.StatusBadRequest, errInvalidDepth
 		}
 	}
-	return moveFiles(ctx, h.FileSystem, src, dst, r.Header.Get("Overwrite") == "T")
+	status, err = moveFiles(ctx, h.FileSystem, src, dst, overwrite, srcLocked)
+	if errs, ok := err.(memberErrors); ok {
+		return h.writeMemberErrors(w, errs)
+	}
+	return status, err
 }
 
 func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) (retStatus int, retErr error) {
@@ -428,6 +641,7 @@ func (h *Handler) handleLock(w http.ResponseWriter, r *http.Request) (retStatus
 			Duration:  duration,
 			OwnerXML:  li.Owner.InnerXML,
 			ZeroDepth: depth == 0,
+			Shared:    li.Shared != nil,
 		}
 		token, err = h.LockSystem.Create(now, ld)
 		if err != nil {
@@ -496,7 +710,7 @@ func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (status
 	if err != nil {
 		return status, err
 	}
-	ctx := r.Context()
+	ctx := withPrefix(r.Context(), h.Prefix)
 	fi, err := h.FileSystem.Stat(ctx, reqPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -525,7 +739,7 @@ func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (status
 
 		var pstats []Propstat
 		if pf.Propname != nil {
-			pnames, err := propnames(ctx, h.FileSystem, h.LockSystem, reqPath)
+			pnames, err := propnames(ctx, h.FileSystem, h.LockSystem, reqPath, info)
 			if err != nil {
 				return handlePropfindError(err, info)
 			}
@@ -535,9 +749,9 @@ func (h *Handler) handlePropfind(w http.ResponseWriter, r *http.Request) (status
 			}
 			pstats = append(pstats, pstat)
 		} else if pf.Allprop != nil {
-			pstats, err = allprop(ctx, h.FileSystem, h.LockSystem, reqPath, pf.Prop)
+			pstats, err = allprop(ctx, h.FileSystem, h.LockSystem, reqPath, info, pf.Prop)
 		} else {
-			pstats, err = props(ctx, h.FileSystem, h.LockSystem, reqPath, pf.Prop)
+			pstats, err = props(ctx, h.FileSystem, h.LockSystem, reqPath, info, pf.Prop)
 		}
 		if err != nil {
 			return handlePropfindError(err, info)
@@ -581,12 +795,18 @@ func (h *Handler) handleProppatch(w http.ResponseWriter, r *http.Request) (statu
 		}
 		return http.StatusMethodNotAllowed, err
 	}
+	if status, err := h.checkPreconditions(r, reqPath); err != nil {
+		return status, err
+	}
 	patches, status, err := readProppatch(r.Body)
 	if err != nil {
 		return status, err
 	}
 	pstats, err := patch(ctx, h.FileSystem, h.LockSystem, reqPath, patches)
 	if err != nil {
+		if os.IsPermission(err) {
+			return http.StatusForbidden, err
+		}
 		return http.StatusInternalServerError, err
 	}
 	mw := multistatusWriter{w: w}
@@ -701,8 +921,10 @@ func StatusText(code int) string {
 }
 
 var (
+	errChecksumMismatch        = errors.New("webdav: checksum mismatch")
 	errDestinationEqualsSource = errors.New("webdav: destination equals source")
 	errDirectoryNotEmpty       = errors.New("webdav: directory not empty")
+	errInvalidChecksum         = errors.New("webdav: invalid checksum")
 	errInvalidDepth            = errors.New("webdav: invalid depth")
 	errInvalidDestination      = errors.New("webdav: invalid destination")
 	errInvalidIfHeader         = errors.New("webdav: invalid If header")
@@ -710,13 +932,18 @@ var (
 	errInvalidLockToken        = errors.New("webdav: invalid lock token")
 	errInvalidPropfind         = errors.New("webdav: invalid propfind")
 	errInvalidProppatch        = errors.New("webdav: invalid proppatch")
+	errInvalidReport           = errors.New("webdav: invalid report")
 	errInvalidResponse         = errors.New("webdav: invalid response")
 	errInvalidTimeout          = errors.New("webdav: invalid timeout")
+	errInvalidUpdate           = errors.New("webdav: invalid update")
+	errInvalidVersion          = errors.New("webdav: invalid version")
 	errNoFileSystem            = errors.New("webdav: no file system")
 	errNoLockSystem            = errors.New("webdav: no lock system")
 	errNotADirectory           = errors.New("webdav: not a directory")
+	errPreconditionFailed      = errors.New("webdav: precondition failed")
 	errPrefixMismatch          = errors.New("webdav: prefix mismatch")
 	errRecursionTooDeep        = errors.New("webdav: recursion too deep")
 	errUnsupportedLockInfo     = errors.New("webdav: unsupported lock info")
 	errUnsupportedMethod       = errors.New("webdav: unsupported method")
+	errUnsupportedReport       = errors.New("webdav: unsupported report")
 )
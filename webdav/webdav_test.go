@@ -347,3 +347,93 @@ func TestFilenameEscape(t *testing.T) {
 		}
 	}
 }
+
+// newTestHandler returns a function that serves a request with the given
+// method, path, body and header name/value pairs from a Handler over fs.
+func newTestHandler(t *testing.T, fs FileSystem) func(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	h := &Handler{FileSystem: fs, LockSystem: NewMemLS()}
+	return func(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for ; len(headers) >= 2; headers = headers[2:] {
+			req.Header.Set(headers[0], headers[1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+}
+
+func TestSharedLocks(t *testing.T) {
+	do := newTestHandler(t, NewMemFS())
+	lockBody := func(scope string) string {
+		return `<?xml version="1.0" encoding="utf-8" ?>
+			<D:lockinfo xmlns:D='DAV:'>
+				<D:lockscope><D:` + scope + `/></D:lockscope>
+				<D:locktype><D:write/></D:locktype>
+			</D:lockinfo>`
+	}
+
+	do("PUT", "/a", "a")
+	var tokens []string
+	for i := 0; i < 2; i++ {
+		rec := do("LOCK", "/a", lockBody("shared"))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("shared LOCK #%d: got %d, want %d", i, rec.Code, http.StatusOK)
+		}
+		if !strings.Contains(rec.Body.String(), "<D:shared/>") {
+			t.Fatalf("shared LOCK #%d: lock scope missing from %s", i, rec.Body)
+		}
+		tokens = append(tokens, rec.Header().Get("Lock-Token"))
+	}
+	if got := do("LOCK", "/a", lockBody("exclusive")).Code; got != StatusLocked {
+		t.Fatalf("exclusive LOCK of a shared-locked file: got %d, want %d", got, StatusLocked)
+	}
+
+	if got := do("PUT", "/a", "b").Code; got != StatusLocked {
+		t.Fatalf("PUT without a lock token: got %d, want %d", got, StatusLocked)
+	}
+	for _, token := range tokens {
+		if got := do("PUT", "/a", "b", "If", "("+token+")").Code; got != http.StatusCreated {
+			t.Fatalf("PUT with lock token %s: got %d, want %d", token, got, http.StatusCreated)
+		}
+	}
+
+	rec := do("PROPFIND", "/a", `<?xml version="1.0" encoding="utf-8" ?>
+		<D:propfind xmlns:D="DAV:"><D:prop><D:lockdiscovery/></D:prop></D:propfind>`, "Depth", "0")
+	if n := strings.Count(rec.Body.String(), "<D:shared/>"); n != 2 {
+		t.Fatalf("lockdiscovery: got %d shared locks, want 2: %s", n, rec.Body)
+	}
+
+	for _, token := range tokens {
+		if got := do("UNLOCK", "/a", "", "Lock-Token", token).Code; got != http.StatusNoContent {
+			t.Fatalf("UNLOCK: got %d, want %d", got, http.StatusNoContent)
+		}
+	}
+	if got := do("LOCK", "/a", lockBody("exclusive")).Code; got != http.StatusOK {
+		t.Fatalf("exclusive LOCK after UNLOCK: got %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestPutChecksumMismatch(t *testing.T) {
+	for _, fs := range []FileSystem{NewMemFS(), Dir(t.TempDir())} {
+		do := newTestHandler(t, fs)
+
+		if got := do("PUT", "/a", "old").Code; got != http.StatusCreated {
+			t.Fatalf("%T: PUT: got %d, want %d", fs, got, http.StatusCreated)
+		}
+		// The MD5 of "old" does not match the body.
+		if got := do("PUT", "/a", "new", "Content-MD5", "FJYD5sA1FjYqjaI/Yk25RQ==").Code; got != http.StatusBadRequest {
+			t.Fatalf("%T: PUT with a wrong checksum: got %d, want %d", fs, got, http.StatusBadRequest)
+		}
+		if rec := do("GET", "/a", ""); rec.Body.String() != "old" {
+			t.Fatalf("%T: GET after a PUT with a wrong checksum: got %q, want %q", fs, rec.Body, "old")
+		}
+		if got := do("PUT", "/b", "new", "Content-MD5", "FJYD5sA1FjYqjaI/Yk25RQ==").Code; got != http.StatusBadRequest {
+			t.Fatalf("%T: PUT of a new file with a wrong checksum: got %d, want %d", fs, got, http.StatusBadRequest)
+		}
+		if _, err := fs.Stat(context.Background(), "/b"); !os.IsNotExist(err) {
+			t.Fatalf("%T: Stat of a new file with a wrong checksum: got %v, want it not to exist", fs, err)
+		}
+	}
+}
@@ -62,9 +62,8 @@ func readLockInfo(r io.Reader) (li lockInfo, status int, err error) {
 		}
 		return lockInfo{}, http.StatusBadRequest, err
 	}
-	// We only support exclusive (non-shared) write locks. In practice, these are
-	// the only types of locks that seem to matter.
-	if li.Exclusive == nil || li.Shared != nil || li.Write == nil {
+	// We only support write locks, either exclusive or shared.
+	if (li.Exclusive == nil) == (li.Shared == nil) || li.Write == nil {
 		return lockInfo{}, http.StatusNotImplemented, errUnsupportedLockInfo
 	}
 	return li, 0, nil
@@ -82,22 +81,36 @@ func (c *countingReader) Read(p []byte) (int, error) {
 }
 
 func writeLockInfo(w io.Writer, token string, ld LockDetails) (int, error) {
+	return fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n"+
+		"<D:prop xmlns:D=\"DAV:\"><D:lockdiscovery>%s</D:lockdiscovery></D:prop>",
+		activeLock(token, ld),
+	)
+}
+
+// activeLock returns the activelock element of the lock with the given token.
+func activeLock(token string, ld LockDetails) string {
 	depth := "infinity"
 	if ld.ZeroDepth {
 		depth = "0"
 	}
-	timeout := ld.Duration / time.Second
-	return fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n"+
-		"<D:prop xmlns:D=\"DAV:\"><D:lockdiscovery><D:activelock>\n"+
+	scope := "exclusive"
+	if ld.Shared {
+		scope = "shared"
+	}
+	timeout := "Infinite"
+	if ld.Duration >= 0 {
+		timeout = fmt.Sprintf("Second-%d", ld.Duration/time.Second)
+	}
+	return fmt.Sprintf("<D:activelock xmlns:D=\"DAV:\">\n"+
 		"	<D:locktype><D:write/></D:locktype>\n"+
-		"	<D:lockscope><D:exclusive/></D:lockscope>\n"+
+		"	<D:lockscope><D:%s/></D:lockscope>\n"+
 		"	<D:depth>%s</D:depth>\n"+
 		"	<D:owner>%s</D:owner>\n"+
-		"	<D:timeout>Second-%d</D:timeout>\n"+
+		"	<D:timeout>%s</D:timeout>\n"+
 		"	<D:locktoken><D:href>%s</D:href></D:locktoken>\n"+
 		"	<D:lockroot><D:href>%s</D:href></D:lockroot>\n"+
-		"</D:activelock></D:lockdiscovery></D:prop>",
-		depth, ld.OwnerXML, timeout, escape(token), escape(ld.Root),
+		"</D:activelock>",
+		scope, depth, ld.OwnerXML, timeout, escape(token), escape(ld.Root),
 	)
 }
 
@@ -204,6 +217,45 @@ func readPropfind(r io.Reader) (pf propfind, status int, err error) {
 	return pf, 0, nil
 }
 
+// report is the body of a REPORT request. Only the DAV:version-tree report is
+// supported, whose element holds the properties to report for each version.
+// http://www.webdav.org/specs/rfc3253.html#REPORT_version-tree
+type report struct {
+	XMLName ixml.Name
+	Prop    propfindProps `xml:"DAV: prop"`
+}
+
+func readReport(r io.Reader) (rep report, status int, err error) {
+	if err = ixml.NewDecoder(r).Decode(&rep); err != nil {
+		if err == io.EOF {
+			err = errInvalidReport
+		}
+		return report{}, http.StatusBadRequest, err
+	}
+	return rep, 0, nil
+}
+
+// http://www.webdav.org/specs/rfc3253.html#METHOD_UPDATE
+type updateInfo struct {
+	XMLName ixml.Name `xml:"DAV: update"`
+	Version struct {
+		Href string `xml:"DAV: href"`
+	} `xml:"DAV: version"`
+}
+
+func readUpdateInfo(r io.Reader) (ui updateInfo, status int, err error) {
+	if err = ixml.NewDecoder(r).Decode(&ui); err != nil {
+		if err == io.EOF {
+			err = errInvalidUpdate
+		}
+		return updateInfo{}, http.StatusBadRequest, err
+	}
+	if ui.Version.Href == "" {
+		return updateInfo{}, http.StatusBadRequest, errInvalidUpdate
+	}
+	return ui, 0, nil
+}
+
 // Property represents a single DAV resource property as defined in RFC 4918.
 // See http://www.webdav.org/specs/rfc4918.html#data.model.for.resource.properties
 type Property struct {
@@ -73,11 +73,37 @@ func TestReadLockInfo(t *testing.T) {
 			"  <D:owner>\n",
 		lockInfo{},
 		http.StatusBadRequest,
+	}, {
+		"bad: both exclusive and shared",
+		"" +
+			"<D:lockinfo xmlns:D='DAV:'>\n" +
+			"  <D:lockscope><D:exclusive/><D:shared/></D:lockscope>\n" +
+			"  <D:locktype><D:write/></D:locktype>\n" +
+			"</D:lockinfo>",
+		lockInfo{},
+		http.StatusNotImplemented,
 	}, {
 		"good: empty",
 		"",
 		lockInfo{},
 		0,
+	}, {
+		"good: shared",
+		"" +
+			"<D:lockinfo xmlns:D='DAV:'>\n" +
+			"  <D:lockscope><D:shared/></D:lockscope>\n" +
+			"  <D:locktype><D:write/></D:locktype>\n" +
+			"  <D:owner>gopher</D:owner>\n" +
+			"</D:lockinfo>",
+		lockInfo{
+			XMLName: ixml.Name{Space: "DAV:", Local: "lockinfo"},
+			Shared:  new(struct{}),
+			Write:   new(struct{}),
+			Owner: owner{
+				InnerXML: "gopher",
+			},
+		},
+		0,
 	}, {
 		"good: plain-text owner",
 		"" +